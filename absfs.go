@@ -116,16 +116,15 @@ func (a *absFSAdapter) Sub(dir string) (fs.FS, error) {
 // Truncate changes the size of the named file
 func (a *absFSAdapter) Truncate(name string, size int64) error {
 	ufs := a.ufs
-	name = cleanPath(name)
+	name = ufs.resolveCase(cleanPath(name))
 
-	// Get writable layer
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
+	// Get the layer that handles the path
+	if _, err := ufs.getWritableLayer(name); err != nil {
 		return err
 	}
 
 	// Check if file exists and copy up if needed
-	info, layerIdx, err := ufs.findFile(name)
+	info, found, err := ufs.findLayer(name)
 	if err != nil {
 		return err
 	}
@@ -135,9 +134,13 @@ func (a *absFSAdapter) Truncate(name string, size int64) error {
 		return &os.PathError{Op: "truncate", Path: name, Err: os.ErrInvalid}
 	}
 
-	// Copy up if file is in a lower layer
-	if layerIdx > 0 {
-		if err := ufs.copyUp(name, info); err != nil {
+	// Copy the file to the branch that takes the write
+	layer, needCopy, err := ufs.writeTarget(name, found)
+	if err != nil {
+		return err
+	}
+	if needCopy {
+		if err := ufs.copyUp(layer, name, info); err != nil {
 			return err
 		}
 	}
@@ -162,6 +165,7 @@ func (a *absFSAdapter) Truncate(name string, size int64) error {
 
 	if err == nil {
 		ufs.InvalidateCache(name)
+		ufs.notify(Write, name)
 	}
 
 	return err
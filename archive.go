@@ -0,0 +1,528 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// maxSymlinkHops bounds symlink resolution inside archives
+const maxSymlinkHops = 40
+
+// WithZipLayer adds a zip archive as a read-only layer. The archive's
+// central directory is indexed on first use; stored entries are served
+// directly from r and compressed entries are decompressed on demand.
+func WithZipLayer(r io.ReaderAt, size int64, opts ...LayerOption) Option {
+	return WithReadOnlyLayer(newFSLayer(newArchiveFS(func(a *archiveFS) error {
+		return a.indexZip(r, size)
+	})), opts...)
+}
+
+// WithTarLayer adds an uncompressed tar archive as a read-only layer. The
+// archive is scanned once on first use to index its headers; file contents
+// are read from r in place. Compressed tarballs must be decompressed first,
+// since random access needs an io.ReaderAt over the raw tar stream.
+func WithTarLayer(r io.ReaderAt, size int64, opts ...LayerOption) Option {
+	return WithReadOnlyLayer(newFSLayer(newArchiveFS(func(a *archiveFS) error {
+		return a.indexTar(r, size)
+	})), opts...)
+}
+
+// NewZipLayer indexes a zip archive and returns it as a read-only
+// filesystem, reporting malformed archives up front
+func NewZipLayer(r io.ReaderAt, size int64) (absfs.FileSystem, error) {
+	a := newArchiveFS(func(a *archiveFS) error {
+		return a.indexZip(r, size)
+	})
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return newFSLayer(a), nil
+}
+
+// NewTarLayer indexes an uncompressed tar archive and returns it as a
+// read-only filesystem, reporting malformed archives up front
+func NewTarLayer(r io.ReaderAt, size int64) (absfs.FileSystem, error) {
+	a := newArchiveFS(func(a *archiveFS) error {
+		return a.indexTar(r, size)
+	})
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return newFSLayer(a), nil
+}
+
+// archiveEntry is one indexed archive member. It doubles as the member's
+// fs.FileInfo.
+type archiveEntry struct {
+	name     string
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	sys      any
+	link     string            // symlink target, or hard link source while indexing
+	data     *io.SectionReader // random access contents, if stored uncompressed
+	offset   int64             // start of data in the archive, or -1 if held in memory
+	zf       *zip.File         // compressed zip member
+	children []*archiveEntry   // sorted directory contents
+	childMap map[string]*archiveEntry
+}
+
+func (e *archiveEntry) Name() string       { return e.name }
+func (e *archiveEntry) Size() int64        { return e.size }
+func (e *archiveEntry) Mode() fs.FileMode  { return e.mode }
+func (e *archiveEntry) ModTime() time.Time { return e.modTime }
+func (e *archiveEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() any           { return e.sys }
+
+// archiveFS is an io/fs view of an indexed zip or tar archive. Symlinks and
+// hard links inside the archive are resolved; whiteout markers are ordinary
+// members, so layer tarballs keep their meaning.
+type archiveFS struct {
+	build func(*archiveFS) error
+	once  sync.Once
+	err   error
+	index map[string]*archiveEntry // keyed by fs.ValidPath name
+	links []*archiveEntry          // hard links awaiting resolution
+}
+
+// Ensure archiveFS implements the io/fs interfaces used by fsLayer
+var (
+	_ fs.StatFS    = (*archiveFS)(nil)
+	_ fs.ReadDirFS = (*archiveFS)(nil)
+	_ SortedLister = (*archiveFS)(nil)
+)
+
+// newArchiveFS returns an archive view indexed lazily by build
+func newArchiveFS(build func(*archiveFS) error) *archiveFS {
+	return &archiveFS{build: build}
+}
+
+// load builds the index once and returns any indexing error
+func (a *archiveFS) load() error {
+	a.once.Do(func() {
+		a.index = map[string]*archiveEntry{
+			".": {name: ".", mode: fs.ModeDir | 0755, childMap: map[string]*archiveEntry{}},
+		}
+		if err := a.build(a); err != nil {
+			a.err, a.index = err, nil
+			return
+		}
+		a.resolveHardLinks()
+		for _, e := range a.index {
+			if e.childMap == nil {
+				continue
+			}
+			for _, child := range e.childMap {
+				e.children = append(e.children, child)
+			}
+			sort.Slice(e.children, func(i, j int) bool { return e.children[i].name < e.children[j].name })
+			e.childMap = nil
+		}
+	})
+	return a.err
+}
+
+// archiveName converts a member name to an fs.ValidPath name, or "" if the
+// member should be ignored
+func archiveName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return ""
+	}
+	return name
+}
+
+// add records e under name, creating missing parent directories. A later
+// member with the same name replaces an earlier one, as in tar extraction.
+func (a *archiveFS) add(name string, e *archiveEntry) {
+	e.name = path.Base(name)
+	if e.mode.IsDir() {
+		if existing, ok := a.index[name]; ok && existing.childMap != nil {
+			e.childMap = existing.childMap
+		} else {
+			e.childMap = map[string]*archiveEntry{}
+		}
+	}
+	a.index[name] = e
+	a.parent(path.Dir(name)).childMap[e.name] = e
+}
+
+// parent returns the directory entry for dir, creating it if needed
+func (a *archiveFS) parent(dir string) *archiveEntry {
+	if e, ok := a.index[dir]; ok && e.childMap != nil {
+		return e
+	}
+	e := &archiveEntry{mode: fs.ModeDir | 0755}
+	a.add(dir, e)
+	return e
+}
+
+// resolveHardLinks points hard links at the contents of their targets
+func (a *archiveFS) resolveHardLinks() {
+	for _, e := range a.links {
+		target, ok := a.index[archiveName(e.link)]
+		if !ok || target.mode.IsDir() {
+			continue
+		}
+		e.mode, e.size, e.data, e.offset, e.zf, e.link = target.mode, target.size, target.data, target.offset, target.zf, target.link
+	}
+	a.links = nil
+}
+
+// indexZip indexes the central directory of a zip archive
+func (a *archiveFS) indexZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		name := archiveName(f.Name)
+		if name == "" {
+			continue
+		}
+		info := f.FileInfo()
+		e := &archiveEntry{
+			mode:    info.Mode(),
+			size:    info.Size(),
+			modTime: f.Modified,
+			sys:     &f.FileHeader,
+		}
+		switch {
+		case e.mode.IsDir():
+		case e.mode&fs.ModeSymlink != 0:
+			target, err := readZipMember(f)
+			if err != nil {
+				return err
+			}
+			e.link = string(target)
+		case f.Method == zip.Store:
+			offset, err := f.DataOffset()
+			if err != nil {
+				return err
+			}
+			e.data, e.offset = io.NewSectionReader(r, offset, e.size), offset
+		default:
+			e.zf = f
+		}
+		a.add(name, e)
+	}
+	return nil
+}
+
+// readZipMember reads a small zip member in full
+func readZipMember(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// indexTar scans the headers of a tar archive, recording where each
+// member's contents start
+func (a *archiveFS) indexTar(r io.ReaderAt, size int64) error {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := archiveName(hdr.Name)
+		if name == "" {
+			continue
+		}
+		e := &archiveEntry{
+			mode:    hdr.FileInfo().Mode(),
+			size:    hdr.Size,
+			modTime: hdr.ModTime,
+			sys:     hdr,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.size = 0
+		case tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			e.link = hdr.Linkname
+			a.links = append(a.links, e)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			e.size = 0
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			if isSparseTar(hdr) {
+				// Sparse members are not contiguous in the archive, so
+				// expand them through the tar reader
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				e.data = io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+				e.offset = -1
+				break
+			}
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			e.data, e.offset = io.NewSectionReader(r, offset, hdr.Size), offset
+		}
+		a.add(name, e)
+	}
+}
+
+// isSparseTar reports whether a tar member is stored in a sparse format
+func isSparseTar(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves name, following symlinks in every component
+func (a *archiveFS) lookup(op, name string) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := a.load(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	cur, hops := ".", 0
+	for i := 0; i < len(parts); i++ {
+		next := path.Join(cur, parts[i])
+		e, ok := a.index[next]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if e.mode&fs.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		// Restart from the root with the target spliced in; targets that
+		// climb above the root are clamped to it
+		target := e.link
+		if !path.IsAbs(target) {
+			target = path.Join("/", cur, target)
+		}
+		var resolved []string
+		if t := archiveName(target); t != "" {
+			resolved = strings.Split(t, "/")
+		}
+		parts = append(resolved, parts[i+1:]...)
+		cur, i = ".", -1
+	}
+	return a.index[cur], nil
+}
+
+// Open implements fs.FS
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	e, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return &archiveDir{entry: e}, nil
+	}
+	return &archiveFile{entry: e}, nil
+}
+
+// Stat implements fs.StatFS
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := a.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+func (a *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return dirEntries(e.children), nil
+}
+
+// SortedReaddir reports that directory handles list in name order
+func (a *archiveFS) SortedReaddir() bool {
+	return true
+}
+
+// dirEntries converts archive entries to fs.DirEntry values
+func dirEntries(children []*archiveEntry) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(children))
+	for i, child := range children {
+		entries[i] = fs.FileInfoToDirEntry(child)
+	}
+	return entries
+}
+
+// archiveFile is an open archive member. Stored members are read in place;
+// compressed members keep a decompression stream that is restarted when a
+// read moves backwards.
+type archiveFile struct {
+	entry  *archiveEntry
+	offset int64
+
+	mu     sync.Mutex
+	stream io.ReadCloser // decompressor for compressed zip members
+	pos    int64         // offset of stream within the member
+}
+
+// Stat implements fs.File
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.entry, nil
+}
+
+// Read implements fs.File
+func (f *archiveFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (f *archiveFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.entry.name, Err: fs.ErrInvalid}
+	}
+	if f.entry.data != nil {
+		return f.entry.data.ReadAt(b, off)
+	}
+	if f.entry.zf == nil || off >= f.entry.size {
+		return 0, io.EOF
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stream == nil || off < f.pos {
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		stream, err := f.entry.zf.Open()
+		if err != nil {
+			f.stream = nil
+			return 0, err
+		}
+		f.stream, f.pos = stream, 0
+	}
+	if skip := off - f.pos; skip > 0 {
+		n, err := io.CopyN(io.Discard, f.stream, skip)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(f.stream, b)
+	f.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close implements fs.File
+func (f *archiveFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	return nil
+}
+
+// archiveDir is an open archive directory
+type archiveDir struct {
+	entry *archiveEntry
+	pos   int
+}
+
+// Stat implements fs.File
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return d.entry, nil
+}
+
+// Read implements fs.File
+func (d *archiveDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entry.children[d.pos:]
+	if n <= 0 {
+		d.pos += len(remaining)
+		return dirEntries(remaining), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.pos += n
+	return dirEntries(remaining[:n]), nil
+}
+
+// Close implements fs.File
+func (d *archiveDir) Close() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildZip writes an archive with one stored and one deflated member
+func buildZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	members := []struct {
+		name   string
+		method uint16
+		data   string
+	}{
+		{"assets/logo.txt", zip.Store, "stored logo"},
+		{"assets/big.txt", zip.Deflate, strings.Repeat("0123456789", 1000)},
+		{"assets/.wh.legacy.txt", zip.Store, ""},
+	}
+	for _, m := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: m.method, Modified: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, m.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTar writes an archive with implicit parents, links and a whiteout
+func buildTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "usr/lib/libfoo.so.1", Typeflag: tar.TypeReg, Mode: 0644}, "libfoo"},
+		{tar.Header{Name: "usr/lib/libfoo.so", Typeflag: tar.TypeSymlink, Linkname: "libfoo.so.1"}, ""},
+		{tar.Header{Name: "usr/lib64", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib"}, ""},
+		{tar.Header{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, "tool"},
+		{tar.Header{Name: "usr/bin/tool-alias", Typeflag: tar.TypeLink, Linkname: "usr/bin/tool"}, ""},
+		{tar.Header{Name: "etc/.wh.motd", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+	}
+	for _, h := range headers {
+		h.hdr.Size = int64(len(h.data))
+		if err := tw.WriteHeader(&h.hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, h.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTar writes a single-file tar archive to w
+func writeTar(t *testing.T, w io.Writer, name, data string) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(tw, data)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestZipLayer tests stored and compressed members served from a zip
+func TestZipLayer(t *testing.T) {
+	data := buildZip(t)
+	base := mustNewMemFS()
+	writeFile(base, "/assets/legacy.txt", []byte("legacy"), 0644)
+	writeFile(base, "/assets/base.txt", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithZipLayer(bytes.NewReader(data), int64(len(data))),
+		WithReadOnlyLayer(base),
+	)
+
+	entries, err := ufs.ReadDir("/assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, want := entryNames(entries), []string{"base.txt", "big.txt", "logo.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir: got %v, want %v", names, want)
+	}
+
+	if got, err := readFile(ufs, "/assets/logo.txt"); err != nil || string(got) != "stored logo" {
+		t.Errorf("stored member: got %q, %v", got, err)
+	}
+
+	// Compressed members support random access, including backwards reads
+	f, err := ufs.Open("/assets/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4)
+	for _, off := range []int64{5003, 17, 9996} {
+		if _, err := f.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		want := strings.Repeat("0123456789", 2)[off%10 : off%10+4]
+		if string(buf) != want {
+			t.Errorf("ReadAt(%d): got %q, want %q", off, buf, want)
+		}
+	}
+	if _, err := f.Seek(-3, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(f); err != nil || string(rest) != "789" {
+		t.Errorf("read after Seek: got %q, %v", rest, err)
+	}
+}
+
+// TestTarLayer tests links, implicit directories and whiteouts in a tar
+func TestTarLayer(t *testing.T) {
+	data := buildTar(t)
+	base := mustNewMemFS()
+	writeFile(base, "/etc/motd", []byte("hello"), 0644)
+
+	layer, err := NewTarLayer(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(layer),
+		WithReadOnlyLayer(base),
+	)
+
+	for name, want := range map[string]string{
+		"/usr/lib/libfoo.so":     "libfoo",
+		"/usr/lib64/libfoo.so.1": "libfoo",
+		"/usr/bin/tool-alias":    "tool",
+	} {
+		if got, err := readFile(ufs, name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	info, err := ufs.Stat("/usr/bin")
+	if err != nil || !info.IsDir() {
+		t.Errorf("expected implicit directory, got %v, %v", info, err)
+	}
+	if _, err := ufs.Stat("/etc/motd"); err == nil {
+		t.Error("expected whiteout member to hide lower file")
+	}
+
+	f, err := ufs.Open("/usr/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"libfoo.so", "libfoo.so.1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdirnames: got %v, want %v", names, want)
+	}
+}
+
+// TestArchiveLayerErrors tests malformed archives
+func TestArchiveLayerErrors(t *testing.T) {
+	garbage := []byte("not an archive")
+	if _, err := NewZipLayer(bytes.NewReader(garbage), int64(len(garbage))); err == nil {
+		t.Error("expected error for malformed zip")
+	}
+
+	// Lazily indexed layers report the error on use
+	ufs := New(WithZipLayer(bytes.NewReader(garbage), int64(len(garbage))))
+	if _, err := ufs.Stat("/anything"); err == nil {
+		t.Error("expected indexing error from Stat")
+	}
+}
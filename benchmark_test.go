@@ -295,3 +295,26 @@ func BenchmarkWhiteoutLookup(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkDeepLowerLookup(b *testing.B) {
+	baseLayer := mustNewMemFS()
+	const deep = "/a/b/c/d/e/f/g/h/file.txt"
+	writeFile(baseLayer, deep, []byte("content"), 0644)
+
+	// Two sparse upper layers that share only the first directory
+	opts := []Option{}
+	for i := 0; i < 2; i++ {
+		upper := mustNewMemFS()
+		upper.MkdirAll(fmt.Sprintf("/a/upper%d", i), 0755)
+		opts = append(opts, WithReadOnlyLayer(upper))
+	}
+	opts = append(opts, WithReadOnlyLayer(baseLayer))
+	ufs := New(opts...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ufs.Stat(deep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
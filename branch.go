@@ -0,0 +1,638 @@
+package unionfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+var (
+	// ErrMultipleBranches is returned by operations that need a single
+	// writable layer when the union pools several writable branches or
+	// routes writes
+	ErrMultipleBranches = errors.New("union has several writable branches")
+	// ErrNoWriteRoute is returned for writes to paths outside every write
+	// route when the union has no other writable layer
+	ErrNoWriteRoute = fmt.Errorf("no write route for path: %w", ErrReadOnlyLayer)
+)
+
+// CreatePolicy decides which writable branch new files and directories are
+// created in
+type CreatePolicy int
+
+const (
+	// CreateFirst creates entries in the first writable branch. This is the
+	// default.
+	CreateFirst CreatePolicy = iota
+	// CreateExistingPath creates entries in the first branch that already
+	// has their parent directory, or the nearest ancestor that exists in
+	// any branch, keeping related files together
+	CreateExistingPath
+	// CreateMostFree creates entries in the branch with the most free space
+	CreateMostFree
+	// CreateLeastUsed creates entries in the branch with the least used
+	// space
+	CreateLeastUsed
+	// CreateRoundRobin cycles through the branches
+	CreateRoundRobin
+	// CreatePathPrefix creates entries in the branch of the longest prefix
+	// set with WithBranchPrefix that contains them
+	CreatePathPrefix
+)
+
+// createPolicyNames are the text forms of each CreatePolicy
+var createPolicyNames = map[CreatePolicy]string{
+	CreateFirst:        "first",
+	CreateExistingPath: "existing-path",
+	CreateMostFree:     "most-free",
+	CreateLeastUsed:    "least-used",
+	CreateRoundRobin:   "round-robin",
+	CreatePathPrefix:   "path-prefix",
+}
+
+// String returns the text form of the policy
+func (p CreatePolicy) String() string {
+	if name, ok := createPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("CreatePolicy(%d)", int(p))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p CreatePolicy) MarshalText() ([]byte, error) {
+	if _, ok := createPolicyNames[p]; !ok {
+		return nil, fmt.Errorf("unknown create policy %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *CreatePolicy) UnmarshalText(text []byte) error {
+	for policy, name := range createPolicyNames {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown create policy %q", text)
+}
+
+// SearchPolicy decides which writable branch a file is read from when
+// several branches have it
+type SearchPolicy int
+
+const (
+	// SearchFirstFound reads from the topmost branch that has the file. This
+	// is the default.
+	SearchFirstFound SearchPolicy = iota
+	// SearchNewest reads from the branch whose copy of a file was modified
+	// last. Directories are still found in the topmost branch.
+	SearchNewest
+)
+
+// searchPolicyNames are the text forms of each SearchPolicy
+var searchPolicyNames = map[SearchPolicy]string{
+	SearchFirstFound: "first-found",
+	SearchNewest:     "newest",
+}
+
+// String returns the text form of the policy
+func (p SearchPolicy) String() string {
+	if name, ok := searchPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SearchPolicy(%d)", int(p))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p SearchPolicy) MarshalText() ([]byte, error) {
+	if _, ok := searchPolicyNames[p]; !ok {
+		return nil, fmt.Errorf("unknown search policy %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *SearchPolicy) UnmarshalText(text []byte) error {
+	for policy, name := range searchPolicyNames {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown search policy %q", text)
+}
+
+// SpaceReporter is implemented by layers that can report their disk usage,
+// such as those returned by NewDirLayer. CreateMostFree and CreateLeastUsed
+// skip branches that do not implement it.
+type SpaceReporter interface {
+	Space() (free, used uint64, err error)
+}
+
+// branchPrefix routes new entries under prefix to the branch ref
+type branchPrefix struct {
+	prefix string
+	ref    string
+}
+
+// writeRoute sends writes under prefix to layer
+type writeRoute struct {
+	prefix string
+	layer  *Layer
+}
+
+// WithWritableBranch adds a writable branch below the writable layers added
+// so far, pooling them mergerfs-style. Existing files are modified in the
+// branch that has them; new entries go to the branch chosen by the create
+// policy, and reads follow the search policy. The first writable layer is
+// the primary branch: removals of files that read-only layers still show
+// leave their whiteouts there.
+//
+// Example:
+//
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(disk1, unionfs.LayerName("disk1")),
+//	    unionfs.WithWritableBranch(disk2, unionfs.LayerName("disk2")),
+//	    unionfs.WithReadOnlyLayer(base),
+//	    unionfs.WithCreatePolicy(unionfs.CreateMostFree),
+//	)
+func WithWritableBranch(fs absfs.FileSystem, opts ...LayerOption) Option {
+	return func(ufs *UnionFS) {
+		layer := newLayer(fs, false, opts)
+		n := len(ufs.branches())
+		layers := append(ufs.layers[:n:n], layer)
+		ufs.layers = append(layers, ufs.layers[n:]...)
+		if ufs.writableLayer == nil {
+			ufs.writableLayer = layer
+		}
+	}
+}
+
+// WithCreatePolicy sets which writable branch new entries are created in
+func WithCreatePolicy(policy CreatePolicy) Option {
+	return func(ufs *UnionFS) {
+		ufs.createPolicy = policy
+	}
+}
+
+// WithSearchPolicy sets which writable branch wins reads of a file that
+// several branches have
+func WithSearchPolicy(policy SearchPolicy) Option {
+	return func(ufs *UnionFS) {
+		ufs.searchPolicy = policy
+	}
+}
+
+// WithBranchPrefix routes new entries under prefix to the branch with the
+// given ID or name when the create policy is CreatePathPrefix. The longest
+// matching prefix wins; paths matching none go to the first branch.
+func WithBranchPrefix(prefix, ref string) Option {
+	return func(ufs *UnionFS) {
+		ufs.branchPrefixes = append(ufs.branchPrefixes, branchPrefix{prefix: cleanPath(prefix), ref: ref})
+	}
+}
+
+// WithWriteRoute sends writes under prefix to fs, which is added as a
+// writable branch unless it already is one. The longest matching route
+// decides, and the route's layer also holds the whiteouts and copied-up
+// parent directories of the paths it takes. Paths under no route are
+// written to the other writable layers, or rejected with ErrNoWriteRoute
+// if there are none. Route layers are stacked above the other writable
+// layers, deeper prefixes first, so that markers elsewhere cannot hide what
+// they hold.
+//
+// Example:
+//
+//	ufs := unionfs.New(
+//	    unionfs.WithWriteRoute("/var/log", scratch),
+//	    unionfs.WithWriteRoute("/home", persistent),
+//	    unionfs.WithReadOnlyLayer(base),
+//	)
+func WithWriteRoute(prefix string, fs absfs.FileSystem, opts ...LayerOption) Option {
+	return func(ufs *UnionFS) {
+		layer := ufs.branchByFS(fs)
+		if layer == nil {
+			WithWritableBranch(fs, opts...)(ufs)
+			layer = ufs.branchByFS(fs)
+		}
+		ufs.routes = append(ufs.routes, writeRoute{prefix: cleanPath(prefix), layer: layer})
+	}
+}
+
+// branchByFS returns the writable branch backed by fs, or nil
+func (ufs *UnionFS) branchByFS(fs absfs.FileSystem) *Layer {
+	for _, layer := range ufs.branches() {
+		if sameFS(layer.fs, fs) {
+			return layer
+		}
+	}
+	return nil
+}
+
+// sameFS reports whether a and b are the same filesystem, without
+// panicking on uncomparable implementations
+func sameFS(a, b absfs.FileSystem) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// orderBranches stacks route layers above the other writable branches,
+// deeper prefixes first. The top branch becomes the primary one.
+func (ufs *UnionFS) orderBranches() {
+	if len(ufs.routes) == 0 {
+		return
+	}
+	depth := make(map[*Layer]int)
+	for _, route := range ufs.routes {
+		if d, ok := depth[route.layer]; !ok || len(route.prefix) > d {
+			depth[route.layer] = len(route.prefix)
+		}
+	}
+	branches := ufs.branches()
+	sort.SliceStable(branches, func(i, j int) bool {
+		di, ok := depth[branches[i]]
+		if !ok {
+			di = -1
+		}
+		dj, ok := depth[branches[j]]
+		if !ok {
+			dj = -1
+		}
+		return di > dj
+	})
+	ufs.writableLayer = branches[0]
+}
+
+// routeLayer returns the layer of the longest write route containing name,
+// or nil. The caller must hold ufs.mu.
+func (ufs *UnionFS) routeLayer(name string) *Layer {
+	var best *Layer
+	bestLen := -1
+	for _, route := range ufs.routes {
+		if hasPathPrefix(name, route.prefix) && len(route.prefix) > bestLen {
+			best, bestLen = route.layer, len(route.prefix)
+		}
+	}
+	return best
+}
+
+// unroutedBranches returns the writable branches that no write route sends
+// writes to. The caller must hold ufs.mu.
+func (ufs *UnionFS) unroutedBranches() []*Layer {
+	branches := ufs.branches()
+	if len(ufs.routes) == 0 {
+		return branches
+	}
+	var unrouted []*Layer
+	for _, layer := range branches {
+		routed := false
+		for _, route := range ufs.routes {
+			routed = routed || route.layer == layer
+		}
+		if !routed {
+			unrouted = append(unrouted, layer)
+		}
+	}
+	return unrouted
+}
+
+// pooled reports whether writes are spread over several layers. The caller
+// must hold ufs.mu.
+func (ufs *UnionFS) pooled() bool {
+	return len(ufs.branches()) > 1 || len(ufs.routes) > 0
+}
+
+// noRoute returns the error for a write to p outside every write route
+func noRoute(p string) error {
+	return &os.PathError{Op: "write", Path: p, Err: ErrNoWriteRoute}
+}
+
+// getWritableLayer returns the layer that handles writes to p: the layer of
+// the longest write route containing p, or else the first writable layer
+// outside the routes
+func (ufs *UnionFS) getWritableLayer(p string) (*Layer, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	if ufs.writableLayer == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if layer := ufs.routeLayer(p); layer != nil {
+		return layer, nil
+	}
+	unrouted := ufs.unroutedBranches()
+	if len(unrouted) == 0 {
+		return nil, noRoute(p)
+	}
+	return unrouted[0], nil
+}
+
+// primaryLayer returns the primary writable layer, which snapshots,
+// transactions and layer exports work on
+func (ufs *UnionFS) primaryLayer() (*Layer, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	if ufs.writableLayer == nil {
+		return nil, ErrNoWritableLayer
+	}
+	return ufs.writableLayer, nil
+}
+
+// branches returns the writable layers at the top of the stack. The caller
+// must hold ufs.mu.
+func (ufs *UnionFS) branches() []*Layer {
+	n := 0
+	for n < len(ufs.layers) && !ufs.layers[n].readOnly {
+		n++
+	}
+	return ufs.layers[:n:n]
+}
+
+// branchCount returns the number of writable branches
+func (ufs *UnionFS) branchCount() int {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+	return len(ufs.branches())
+}
+
+// writeTarget returns the branch a write to name goes to, and whether name
+// must be copied into it first. found is the layer name resolves to, or nil
+// if it does not exist; ErrLayersChanged is returned if it has left the
+// stack. A write route containing name decides first. Otherwise
+// existing entries are written in the branch that has them, a branch whose
+// markers hide name takes the write so that the new entry is not hidden by
+// them, and failing that the create policy picks among the branches outside
+// the routes.
+func (ufs *UnionFS) writeTarget(name string, found *Layer) (*Layer, bool, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	if ufs.writableLayer == nil {
+		return nil, false, ErrNoWritableLayer
+	}
+	exists := found != nil
+	if exists && !containsLayer(ufs.layers, found) {
+		return nil, false, ErrLayersChanged
+	}
+	if layer := ufs.routeLayer(name); layer != nil {
+		return layer, exists && found != layer, nil
+	}
+	branches := ufs.unroutedBranches()
+	if len(branches) == 0 {
+		return nil, false, noRoute(name)
+	}
+	if exists && !found.readOnly {
+		return found, false, nil
+	}
+
+	if len(branches) == 1 {
+		return branches[0], exists, nil
+	}
+	if layer := ufs.markedBranch(name, branches); layer != nil {
+		return layer, exists, nil
+	}
+	return ufs.createBranch(name, branches), exists, nil
+}
+
+// markerTarget returns the branch that whiteouts and opaque markers for
+// name are written to: the layer that handles writes to name, or among
+// several, the one whose markers already cover name
+func (ufs *UnionFS) markerTarget(name string) (*Layer, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	if ufs.writableLayer == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if layer := ufs.routeLayer(name); layer != nil {
+		return layer, nil
+	}
+	branches := ufs.unroutedBranches()
+	if len(branches) == 0 {
+		return nil, noRoute(name)
+	}
+	if len(branches) > 1 {
+		if layer := ufs.markedBranch(name, branches); layer != nil {
+			return layer, nil
+		}
+	}
+	return branches[0], nil
+}
+
+// renameTarget returns the branch an entry found in layer found is renamed to
+// newname in, and whether that is the layer the entry is in. A write route
+// containing newname decides first. Otherwise entries move within their
+// branch unless a branch above it has markers hiding newname, and entries
+// of read-only layers or route layers go where a new entry would.
+func (ufs *UnionFS) renameTarget(newname string, found *Layer) (*Layer, bool, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	if ufs.writableLayer == nil {
+		return nil, false, ErrNoWritableLayer
+	}
+	idx := indexOfLayer(ufs.layers, found)
+	if idx < 0 {
+		return nil, false, ErrLayersChanged
+	}
+	if layer := ufs.routeLayer(newname); layer != nil {
+		return layer, found == layer, nil
+	}
+	branches := ufs.unroutedBranches()
+	if len(branches) == 0 {
+		return nil, false, noRoute(newname)
+	}
+	if containsLayer(branches, found) {
+		if layer := ufs.markedBranch(newname, ufs.layers[:idx]); layer != nil {
+			return layer, false, nil
+		}
+		return found, true, nil
+	}
+	if len(branches) == 1 {
+		return branches[0], false, nil
+	}
+	if layer := ufs.markedBranch(newname, branches); layer != nil {
+		return layer, false, nil
+	}
+	return ufs.createBranch(newname, branches), false, nil
+}
+
+// markedBranch returns the topmost branch with a whiteout or opaque marker
+// covering name, or nil. The caller must hold ufs.mu.
+func (ufs *UnionFS) markedBranch(name string, branches []*Layer) *Layer {
+	for _, layer := range branches {
+		if ufs.hasWhiteout(layer, name) {
+			return layer
+		}
+	}
+	return nil
+}
+
+// createBranch picks the branch for a new entry by the create policy. The
+// caller must hold ufs.mu.
+func (ufs *UnionFS) createBranch(name string, branches []*Layer) *Layer {
+	switch ufs.createPolicy {
+	case CreateExistingPath:
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			for _, layer := range branches {
+				info, err := ufs.statLayer(layer, dir)
+				if err == nil && info.IsDir() && !ufs.checkWhiteout(dir, indexOfLayer(ufs.layers, layer)) {
+					return layer
+				}
+			}
+		}
+	case CreateMostFree, CreateLeastUsed:
+		var best *Layer
+		var bestValue uint64
+		for _, layer := range branches {
+			reporter, ok := layer.fs.(SpaceReporter)
+			if !ok {
+				continue
+			}
+			free, used, err := reporter.Space()
+			if err != nil {
+				continue
+			}
+			value := free
+			if ufs.createPolicy == CreateLeastUsed {
+				// Compare the complement so that larger is always better
+				value = ^used
+			}
+			if best == nil || value > bestValue {
+				best, bestValue = layer, value
+			}
+		}
+		if best != nil {
+			return best
+		}
+	case CreateRoundRobin:
+		n := ufs.roundRobin.Add(1) - 1
+		return branches[n%uint64(len(branches))]
+	case CreatePathPrefix:
+		if layer := ufs.prefixBranch(name, branches); layer != nil {
+			return layer
+		}
+	}
+	return branches[0]
+}
+
+// prefixBranch returns the branch of the longest prefix containing name, or
+// nil. The caller must hold ufs.mu.
+func (ufs *UnionFS) prefixBranch(name string, branches []*Layer) *Layer {
+	var best *Layer
+	bestLen := -1
+	for _, rule := range ufs.branchPrefixes {
+		if !hasPathPrefix(name, rule.prefix) || len(rule.prefix) <= bestLen {
+			continue
+		}
+		for _, layer := range branches {
+			if layer.id == rule.ref || layer.name == rule.ref {
+				best, bestLen = layer, len(rule.prefix)
+				break
+			}
+		}
+	}
+	return best
+}
+
+// hasPathPrefix reports whether name is prefix or lies under it
+func hasPathPrefix(name, prefix string) bool {
+	return prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// newestBranch applies SearchNewest to a file found at layer i: it returns
+// the copy in a writable branch below i that was modified last, if it is
+// newer than info. The caller must hold ufs.mu.
+func (ufs *UnionFS) newestBranch(p string, info os.FileInfo, i int, stat func(*Layer, string) (os.FileInfo, error)) (os.FileInfo, int) {
+	if ufs.searchPolicy != SearchNewest || info.IsDir() {
+		return info, i
+	}
+	for j := i + 1; j < len(ufs.layers) && !ufs.layers[j].readOnly; j++ {
+		if ufs.hasWhiteout(ufs.layers[j-1], p) {
+			break
+		}
+		other, err := stat(ufs.layers[j], p)
+		if err == nil && !other.IsDir() && other.ModTime().After(info.ModTime()) {
+			info, i = other, j
+		}
+	}
+	return info, i
+}
+
+// lstatIn returns file info of p in layer without following symlinks
+func (ufs *UnionFS) lstatIn(layer *Layer, p string) (os.FileInfo, error) {
+	return lstatLayer(layer.fs, ufs.layerName(layer, p))
+}
+
+// removeFromBranches deletes p from every writable branch other than skip
+// that shows it, using remove
+func (ufs *UnionFS) removeFromBranches(p string, skip *Layer, remove func(absfs.FileSystem, string) error) error {
+	ufs.mu.RLock()
+	var targets []*Layer
+	for i, layer := range ufs.branches() {
+		if layer == skip || ufs.checkWhiteout(p, i) {
+			continue
+		}
+		if _, err := ufs.lstatIn(layer, p); err == nil {
+			targets = append(targets, layer)
+		}
+	}
+	ufs.mu.RUnlock()
+
+	for _, layer := range targets {
+		if err := remove(layer.fs, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// belowView returns a view of the layers below layer
+func (ufs *UnionFS) belowView(layer *Layer) *UnionFS {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+	return ufs.layerView(ufs.layers[indexOfLayer(ufs.layers, layer)+1:])
+}
+
+// belowIsDir reports whether the layers below layer show a directory at p
+func (ufs *UnionFS) belowIsDir(layer *Layer, p string) bool {
+	info, err := ufs.belowView(layer).Lstat(p)
+	return err == nil && info.IsDir()
+}
+
+// indexOfLayer returns the position of layer in layers, or -1
+func indexOfLayer(layers []*Layer, layer *Layer) int {
+	for i, l := range layers {
+		if l == layer {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeWhiteout hides p with a whiteout in its marker branch
+func (ufs *UnionFS) writeWhiteout(p string) error {
+	layer, err := ufs.markerTarget(p)
+	if err != nil {
+		return err
+	}
+	whiteout := whiteoutPath(p)
+	if err := ufs.ensureDir(layer, whiteout); err != nil {
+		return err
+	}
+	f, err := layer.fs.Create(whiteout)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
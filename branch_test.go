@@ -0,0 +1,388 @@
+package unionfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// spaceFS reports fixed space figures for a branch
+type spaceFS struct {
+	absfs.FileSystem
+	free, used uint64
+}
+
+func (s *spaceFS) Space() (uint64, uint64, error) {
+	return s.free, s.used, nil
+}
+
+// branchOf returns the name of the layer that name resolves to
+func branchOf(t *testing.T, ufs *UnionFS, name string) string {
+	t.Helper()
+	info, err := ufs.Which(name)
+	if err != nil {
+		t.Fatalf("which %s: %v", name, err)
+	}
+	return info.Name
+}
+
+func TestBranchesModifyInPlace(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(a, "/a.txt", []byte("a"), 0644)
+	writeFile(b, "/b.txt", []byte("b"), 0644)
+	writeFile(base, "/base.txt", []byte("base"), 0644)
+	ufs := New(
+		WithWritableLayer(a, LayerName("a")),
+		WithWritableBranch(b, LayerName("b")),
+		WithReadOnlyLayer(base, LayerName("base")),
+	)
+
+	var names []string
+	for _, l := range ufs.Layers() {
+		names = append(names, l.Name)
+	}
+	if want := []string{"a", "b", "base"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("layers = %v, want %v", names, want)
+	}
+
+	// Files owned by a branch are changed there
+	if err := writeFile(ufs, "/b.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Chmod("/b.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readFile(b, "/b.txt"); string(data) != "changed" {
+		t.Errorf("b.txt in branch b = %q", data)
+	}
+	if info, _ := b.Stat("/b.txt"); info.Mode().Perm() != 0600 {
+		t.Errorf("b.txt mode = %v", info.Mode())
+	}
+	if _, err := a.Stat("/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("b.txt copied to branch a: %v", err)
+	}
+
+	// Files of read-only layers are copied to a branch
+	if err := writeFile(ufs, "/base.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, ufs, "/base.txt"); got != "a" {
+		t.Errorf("base.txt copied to %s, want a", got)
+	}
+
+	// Removing a branch file leaves no whiteout; removing a read-only one does
+	if err := ufs.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("b.txt still in branch b: %v", err)
+	}
+	for _, fs := range []absfs.FileSystem{a, b} {
+		if _, err := fs.Stat("/.wh.b.txt"); !os.IsNotExist(err) {
+			t.Errorf("whiteout created for branch-only file: %v", err)
+		}
+	}
+	if err := ufs.Remove("/base.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/base.txt"); !os.IsNotExist(err) {
+		t.Errorf("base.txt reappeared: %v", err)
+	}
+	if _, err := a.Stat("/.wh.base.txt"); err != nil {
+		t.Errorf("whiteout not in primary branch: %v", err)
+	}
+}
+
+func TestCreatePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CreatePolicy
+		opts   []Option
+		paths  []string
+		want   []string
+	}{
+		{name: "first", policy: CreateFirst, paths: []string{"/new"}, want: []string{"a"}},
+		{name: "existing path", policy: CreateExistingPath, paths: []string{"/data/new", "/other/new"}, want: []string{"b", "a"}},
+		{name: "most free", policy: CreateMostFree, paths: []string{"/new"}, want: []string{"b"}},
+		{name: "least used", policy: CreateLeastUsed, paths: []string{"/new"}, want: []string{"a"}},
+		{name: "round robin", policy: CreateRoundRobin, paths: []string{"/1", "/2", "/3"}, want: []string{"a", "b", "a"}},
+		{
+			name:   "path prefix",
+			policy: CreatePathPrefix,
+			opts:   []Option{WithBranchPrefix("/media", "a"), WithBranchPrefix("/media/video", "b")},
+			paths:  []string{"/media/video/clip", "/media/song", "/new"},
+			want:   []string{"b", "a", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &spaceFS{FileSystem: mustNewMemFS(), free: 10, used: 5}
+			b := &spaceFS{FileSystem: mustNewMemFS(), free: 100, used: 50}
+			b.MkdirAll("/data", 0755)
+			base := mustNewMemFS()
+			base.MkdirAll("/data", 0755)
+			base.MkdirAll("/other", 0755)
+			base.MkdirAll("/media/video", 0755)
+
+			opts := []Option{
+				WithWritableLayer(a, LayerName("a")),
+				WithWritableBranch(b, LayerName("b")),
+				WithReadOnlyLayer(base),
+				WithCreatePolicy(tt.policy),
+			}
+			ufs := New(append(opts, tt.opts...)...)
+
+			var got []string
+			for _, p := range tt.paths {
+				f, err := ufs.Create(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+				got = append(got, branchOf(t, ufs, p))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("branches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePolicyWithoutSpace(t *testing.T) {
+	// Branches that cannot report space are skipped, falling back to the first
+	ufs := New(
+		WithWritableLayer(mustNewMemFS(), LayerName("a")),
+		WithWritableBranch(mustNewMemFS(), LayerName("b")),
+		WithCreatePolicy(CreateMostFree),
+	)
+	if err := writeFile(ufs, "/new", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, ufs, "/new"); got != "a" {
+		t.Errorf("new file in %s, want a", got)
+	}
+}
+
+func TestSearchPolicy(t *testing.T) {
+	a, b := mustNewMemFS(), mustNewMemFS()
+	writeFile(a, "/f", []byte("old"), 0644)
+	writeFile(b, "/f", []byte("newer"), 0644)
+	now := time.Now()
+	a.Chtimes("/f", now.Add(-time.Hour), now.Add(-time.Hour))
+	b.Chtimes("/f", now, now)
+
+	first := New(WithWritableLayer(a, LayerName("a")), WithWritableBranch(b, LayerName("b")))
+	if data, _ := readFile(first, "/f"); string(data) != "old" {
+		t.Errorf("first-found read %q", data)
+	}
+
+	ufs := New(
+		WithWritableLayer(a, LayerName("a")),
+		WithWritableBranch(b, LayerName("b")),
+		WithSearchPolicy(SearchNewest),
+	)
+	if data, _ := readFile(ufs, "/f"); string(data) != "newer" {
+		t.Errorf("newest read %q", data)
+	}
+	if got := branchOf(t, ufs, "/f"); got != "b" {
+		t.Errorf("which = %s, want b", got)
+	}
+	if info, err := ufs.Lstat("/f"); err != nil || info.Size() != 5 {
+		t.Errorf("lstat = %v, %v", info, err)
+	}
+	entries, err := ufs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := entries[0].Info(); info.Size() != 5 {
+		t.Errorf("listed size = %d, want 5", info.Size())
+	}
+
+	// Writes go to the copy that reads see
+	if err := writeFile(ufs, "/f", []byte("latest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readFile(b, "/f"); string(data) != "latest" {
+		t.Errorf("branch b has %q", data)
+	}
+	if data, _ := readFile(a, "/f"); string(data) != "old" {
+		t.Errorf("branch a has %q", data)
+	}
+}
+
+func TestBranchMarkers(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/d/old", []byte("base"), 0644)
+	ufs := New(
+		WithWritableLayer(a, LayerName("a")),
+		WithWritableBranch(b, LayerName("b")),
+		WithReadOnlyLayer(base),
+		WithCreatePolicy(CreatePathPrefix),
+		WithBranchPrefix("/d", "b"),
+	)
+
+	if err := ufs.RemoveAll("/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The whiteout in branch a would hide a new entry in branch b, so the
+	// entry goes where the whiteout is
+	if err := writeFile(ufs, "/d/new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, ufs, "/d/new"); got != "a" {
+		t.Errorf("new file in %s, want a", got)
+	}
+	entries, err := ufs.ReadDir("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("entries = %v, want [new]", got)
+	}
+
+	// Renaming onto a hidden name also lands where the markers are
+	writeFile(b, "/moved", []byte("moved"), 0644)
+	writeFile(base, "/target", []byte("base"), 0644)
+	if err := ufs.Remove("/target"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Rename("/moved", "/target"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readFile(ufs, "/target"); string(data) != "moved" {
+		t.Errorf("target = %q", data)
+	}
+	if _, err := b.Stat("/moved"); !os.IsNotExist(err) {
+		t.Errorf("moved still in branch b: %v", err)
+	}
+}
+
+func TestBranchRemoveWhiteouts(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(b, "/only-b", []byte("b"), 0644)
+	writeFile(b, "/both", []byte("b"), 0644)
+	writeFile(base, "/both", []byte("base"), 0644)
+	ufs := New(WithWritableLayer(a), WithWritableBranch(b), WithReadOnlyLayer(base))
+
+	// Only what the read-only layers still show needs a whiteout
+	if err := ufs.Remove("/only-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/both"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := a.ReadDir("/")
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{".wh.both"}) {
+		t.Errorf("branch a = %v, want [.wh.both]", got)
+	}
+	if entries, _ := b.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("branch b = %v, want empty", entryNames(entries))
+	}
+	for _, p := range []string{"/only-b", "/both"} {
+		if _, err := ufs.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s: expected not exist, got %v", p, err)
+		}
+	}
+}
+
+func TestBranchOpaqueListing(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(a, "/dir/top", []byte("a"), 0644)
+	writeFile(b, "/dir/mid", []byte("b"), 0644)
+	writeFile(b, "/dir/"+OpaqueWhiteout, nil, 0644)
+	writeFile(base, "/dir/hidden", []byte("base"), 0644)
+	ufs := New(
+		WithWritableLayer(a),
+		WithWritableBranch(b),
+		WithReadOnlyLayer(base),
+	)
+
+	fromReadDir, fromHandle := listBoth(t, ufs, "/dir")
+	want := []string{"mid", "top"}
+	if !reflect.DeepEqual(fromReadDir, want) || !reflect.DeepEqual(fromHandle, want) {
+		t.Errorf("listing = %v and %v, want %v", fromReadDir, fromHandle, want)
+	}
+}
+
+func TestRenameWithinBranch(t *testing.T) {
+	a, b := mustNewMemFS(), mustNewMemFS()
+	writeFile(b, "/dir/file", []byte("b"), 0644)
+	ufs := New(WithWritableLayer(a, LayerName("a")), WithWritableBranch(b, LayerName("b")))
+
+	if err := ufs.Rename("/dir/file", "/dir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readFile(b, "/moved/renamed"); err != nil || string(data) != "b" {
+		t.Errorf("branch b: %q, %v", data, err)
+	}
+	if entries, _ := a.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("branch a changed: %v", entryNames(entries))
+	}
+}
+
+func TestBranchesUnsupported(t *testing.T) {
+	ufs := New(WithWritableLayer(mustNewMemFS()), WithWritableBranch(mustNewMemFS()))
+
+	if _, err := ufs.Snapshot(); !errors.Is(err, ErrMultipleBranches) {
+		t.Errorf("snapshot: %v", err)
+	}
+	if err := ufs.Begin().Commit(); !errors.Is(err, ErrMultipleBranches) {
+		t.Errorf("begin: %v", err)
+	}
+	if _, err := ufs.Rebase(mustNewMemFS()); !errors.Is(err, ErrMultipleBranches) {
+		t.Errorf("rebase: %v", err)
+	}
+}
+
+func TestBranchManifest(t *testing.T) {
+	a, b := mustNewMemFS(), mustNewMemFS()
+	writeFile(b, "/media/clip", []byte("clip"), 0644)
+	ufs := New(
+		WithWritableLayer(a, LayerName("a")),
+		WithWritableBranch(b, LayerName("b")),
+		WithCreatePolicy(CreatePathPrefix),
+		WithSearchPolicy(SearchNewest),
+		WithBranchPrefix("/media", "b"),
+	)
+
+	m, err := ufs.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Manifest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&decoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.createPolicy != CreatePathPrefix || loaded.searchPolicy != SearchNewest {
+		t.Errorf("policies = %v, %v", loaded.createPolicy, loaded.searchPolicy)
+	}
+	for _, l := range loaded.Layers() {
+		if l.ReadOnly {
+			t.Errorf("layer %s loaded read-only", l.Name)
+		}
+	}
+	if err := writeFile(loaded, "/media/song", []byte("song"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, loaded, "/media/song"); got != "b" {
+		t.Errorf("song in %s, want b", got)
+	}
+}
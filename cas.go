@@ -0,0 +1,620 @@
+package unionfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// digestPrefix is the algorithm prefix of blob digests
+const digestPrefix = "sha256:"
+
+// emptyDigest is the digest of empty content
+const emptyDigest = digestPrefix + "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// ErrInvalidDigest is returned for malformed blob digests
+var ErrInvalidDigest = errors.New("invalid blob digest")
+
+// Digester is implemented by layers that can report the content digest of
+// a file without reading it
+type Digester interface {
+	Digest(name string) (string, error)
+}
+
+// contentLinker is implemented by layers that can reference stored content
+// by digest instead of copying it
+type contentLinker interface {
+	LinkContent(name, digest string, perm os.FileMode) error
+}
+
+// BlobStore stores file contents by SHA-256 digest. A store can be shared
+// by many content-addressed layers, so identical files are kept once.
+type BlobStore struct {
+	fs  absfs.FileSystem
+	dir string
+	mu  sync.Mutex
+}
+
+// NewBlobStore returns a blob store kept in dir of fs
+func NewBlobStore(fs absfs.FileSystem, dir string) (*BlobStore, error) {
+	s := &BlobStore{fs: fs, dir: cleanPath(dir)}
+	for _, d := range []string{"sha256", "tmp"} {
+		if err := fs.MkdirAll(path.Join(s.dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	// The empty blob always exists, so empty metadata files are readable
+	if _, _, err := s.Put(bytes.NewReader(nil)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// blobPath returns the location of a blob
+func (s *BlobStore) blobPath(digest string) (string, error) {
+	hexDigest := strings.TrimPrefix(digest, digestPrefix)
+	if len(hexDigest) != sha256.Size*2 || hexDigest == digest {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	return path.Join(s.dir, "sha256", hexDigest[:2], hexDigest), nil
+}
+
+// Has reports whether the store holds a blob
+func (s *BlobStore) Has(digest string) bool {
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = s.fs.Stat(p)
+	return err == nil
+}
+
+// Size returns the size of a blob
+func (s *BlobStore) Size(digest string) (int64, error) {
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.fs.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Open opens a blob for reading
+func (s *BlobStore) Open(digest string) (absfs.File, error) {
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.Open(p)
+}
+
+// Put stores the contents of r and returns their digest and size
+func (s *BlobStore) Put(r io.Reader) (string, int64, error) {
+	f, tmp, err := s.tempFile()
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		s.fs.Remove(tmp)
+		return "", 0, err
+	}
+	return s.commit(f, tmp)
+}
+
+// tempFile creates a scratch file for content being written
+func (s *BlobStore) tempFile() (absfs.File, string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, "", err
+	}
+	tmp := path.Join(s.dir, "tmp", hex.EncodeToString(buf[:]))
+	f, err := s.fs.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, tmp, nil
+}
+
+// commit hashes a scratch file and moves it into the store, discarding it
+// if the blob already exists. The file is closed.
+func (s *BlobStore) commit(f absfs.File, tmp string) (string, int64, error) {
+	h := sha256.New()
+	_, err := f.Seek(0, io.SeekStart)
+	var size int64
+	if err == nil {
+		size, err = io.Copy(h, f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.fs.Remove(tmp)
+		return "", 0, err
+	}
+
+	digest := digestPrefix + hex.EncodeToString(h.Sum(nil))
+	p, _ := s.blobPath(digest)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.fs.Stat(p); err == nil {
+		// Deduplicated: the content is already stored
+		s.fs.Remove(tmp)
+		return digest, size, nil
+	}
+	if err := s.fs.MkdirAll(path.Dir(p), 0755); err != nil {
+		s.fs.Remove(tmp)
+		return "", 0, err
+	}
+	if err := s.fs.Rename(tmp, p); err != nil {
+		s.fs.Remove(tmp)
+		return "", 0, err
+	}
+	return digest, size, nil
+}
+
+// casLayer is a writable layer that keeps its directory tree in a metadata
+// filesystem and file contents in a BlobStore. Each regular file in the
+// metadata tree holds the digest of its contents.
+type casLayer struct {
+	store *BlobStore
+	meta  absfs.FileSystem
+}
+
+// Ensure casLayer implements the layer interfaces at compile time
+var (
+	_ absfs.FileSystem = (*casLayer)(nil)
+	_ Digester         = (*casLayer)(nil)
+	_ contentLinker    = (*casLayer)(nil)
+)
+
+// NewCASLayer returns a writable layer whose file contents are stored in
+// store and whose tree, modes and times are kept in meta. Layers sharing a
+// store share identical contents, and copy-up from a layer that reports
+// digests links to the existing blob instead of copying it. Contents
+// written through a handle become visible when the handle is closed.
+// Removing files does not delete their blobs.
+//
+// Example:
+//
+//	store, _ := unionfs.NewBlobStore(shared, "/blobs")
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(unionfs.NewCASLayer(store, tenantMeta)),
+//	    unionfs.WithReadOnlyLayer(base),
+//	)
+func NewCASLayer(store *BlobStore, meta absfs.FileSystem) absfs.FileSystem {
+	return &casLayer{store: store, meta: meta}
+}
+
+// Digest returns the content digest of a regular file
+func (l *casLayer) Digest(name string) (string, error) {
+	f, err := l.meta.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", &os.PathError{Op: "digest", Path: name, Err: errors.New("not a regular file")}
+	}
+	data, err := io.ReadAll(io.LimitReader(f, 128))
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(data))
+	if digest == "" {
+		return emptyDigest, nil
+	}
+	if _, err := l.store.blobPath(digest); err != nil {
+		return "", &os.PathError{Op: "digest", Path: name, Err: err}
+	}
+	return digest, nil
+}
+
+// LinkContent points name at a stored blob, creating or replacing the file
+func (l *casLayer) LinkContent(name, digest string, perm os.FileMode) error {
+	if !l.store.Has(digest) {
+		return &os.PathError{Op: "link", Path: name, Err: os.ErrNotExist}
+	}
+	f, err := l.meta.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(digest)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fileInfo reports info with the size of the file's blob
+func (l *casLayer) fileInfo(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	digest, err := l.Digest(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.store.Size(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &casInfo{FileInfo: info, size: size}, nil
+}
+
+// OpenFile implements absfs.Filer
+func (l *casLayer) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	info, err := l.meta.Stat(name)
+	if err == nil && info.IsDir() {
+		dir, err := l.meta.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &casDir{File: dir, layer: l, name: name}, nil
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		digest, err := l.Digest(name)
+		if err != nil {
+			return nil, err
+		}
+		blob, err := l.store.Open(digest)
+		if err != nil {
+			return nil, err
+		}
+		return &casFile{File: blob, layer: l, name: name}, nil
+	}
+
+	// Open the metadata file first so existence and permission checks
+	// behave like the metadata filesystem's
+	existing := err == nil
+	metaFlag := flag &^ (os.O_RDWR | os.O_TRUNC | os.O_APPEND)
+	metaFlag |= os.O_WRONLY
+	mf, err := l.meta.OpenFile(name, metaFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFile, tmp, err := l.store.tempFile()
+	if err != nil {
+		mf.Close()
+		return nil, err
+	}
+	if existing && flag&os.O_TRUNC == 0 {
+		if err := l.copyBlob(name, tmpFile); err != nil {
+			mf.Close()
+			tmpFile.Close()
+			l.store.fs.Remove(tmp)
+			return nil, err
+		}
+		if flag&os.O_APPEND == 0 {
+			tmpFile.Seek(0, io.SeekStart)
+		}
+	}
+	return &casFile{
+		File:   tmpFile,
+		layer:  l,
+		name:   name,
+		meta:   mf,
+		tmp:    tmp,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// copyBlob copies the current contents of name into w
+func (l *casLayer) copyBlob(name string, w io.Writer) error {
+	digest, err := l.Digest(name)
+	if err != nil {
+		return err
+	}
+	blob, err := l.store.Open(digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	_, err = io.Copy(w, blob)
+	return err
+}
+
+// Mkdir implements absfs.Filer
+func (l *casLayer) Mkdir(name string, perm os.FileMode) error {
+	return l.meta.Mkdir(name, perm)
+}
+
+// Remove implements absfs.Filer
+func (l *casLayer) Remove(name string) error {
+	return l.meta.Remove(name)
+}
+
+// Rename implements absfs.Filer
+func (l *casLayer) Rename(oldpath, newpath string) error {
+	return l.meta.Rename(oldpath, newpath)
+}
+
+// Stat implements absfs.Filer
+func (l *casLayer) Stat(name string) (os.FileInfo, error) {
+	info, err := l.meta.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.fileInfo(name, info)
+}
+
+// Chmod implements absfs.Filer
+func (l *casLayer) Chmod(name string, mode os.FileMode) error {
+	return l.meta.Chmod(name, mode)
+}
+
+// Chtimes implements absfs.Filer
+func (l *casLayer) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return l.meta.Chtimes(name, atime, mtime)
+}
+
+// Chown implements absfs.Filer
+func (l *casLayer) Chown(name string, uid, gid int) error {
+	return l.meta.Chown(name, uid, gid)
+}
+
+// ReadDir implements absfs.Filer
+func (l *casLayer) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := l.meta.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			entries[i] = &casDirEntry{DirEntry: entry, layer: l, path: path.Join(name, entry.Name())}
+		}
+	}
+	return entries, nil
+}
+
+// ReadFile implements absfs.Filer
+func (l *casLayer) ReadFile(name string) ([]byte, error) {
+	f, err := l.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Sub implements absfs.Filer
+func (l *casLayer) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(l, dir)
+}
+
+// Chdir implements absfs.FileSystem
+func (l *casLayer) Chdir(dir string) error {
+	return l.meta.Chdir(dir)
+}
+
+// Getwd implements absfs.FileSystem
+func (l *casLayer) Getwd() (string, error) {
+	return l.meta.Getwd()
+}
+
+// TempDir implements absfs.FileSystem
+func (l *casLayer) TempDir() string {
+	return l.meta.TempDir()
+}
+
+// Open implements absfs.FileSystem
+func (l *casLayer) Open(name string) (absfs.File, error) {
+	return l.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create implements absfs.FileSystem
+func (l *casLayer) Create(name string) (absfs.File, error) {
+	return l.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// MkdirAll implements absfs.FileSystem
+func (l *casLayer) MkdirAll(name string, perm os.FileMode) error {
+	return l.meta.MkdirAll(name, perm)
+}
+
+// RemoveAll implements absfs.FileSystem
+func (l *casLayer) RemoveAll(name string) error {
+	return l.meta.RemoveAll(name)
+}
+
+// Truncate implements absfs.FileSystem
+func (l *casLayer) Truncate(name string, size int64) error {
+	f, err := l.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Symlink creates a symlink in the metadata tree
+func (l *casLayer) Symlink(oldname, newname string) error {
+	if linker, ok := l.meta.(interface {
+		Symlink(string, string) error
+	}); ok {
+		return linker.Symlink(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+// Readlink reads a symlink from the metadata tree
+func (l *casLayer) Readlink(name string) (string, error) {
+	if linker, ok := l.meta.(interface {
+		Readlink(string) (string, error)
+	}); ok {
+		return linker.Readlink(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+}
+
+// Lstat stats name without following a final symlink
+func (l *casLayer) Lstat(name string) (os.FileInfo, error) {
+	if lstater, ok := l.meta.(interface {
+		Lstat(string) (os.FileInfo, error)
+	}); ok {
+		info, err := lstater.Lstat(name)
+		if err != nil {
+			return nil, err
+		}
+		return l.fileInfo(name, info)
+	}
+	return l.Stat(name)
+}
+
+// Lchown changes the ownership of a symlink in the metadata tree
+func (l *casLayer) Lchown(name string, uid, gid int) error {
+	if lchowner, ok := l.meta.(interface {
+		Lchown(string, int, int) error
+	}); ok {
+		return lchowner.Lchown(name, uid, gid)
+	}
+	return l.meta.Chown(name, uid, gid)
+}
+
+// casInfo reports a metadata file with its blob's size
+type casInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *casInfo) Size() int64 { return i.size }
+
+// casDirEntry reports a metadata entry with its blob's size
+type casDirEntry struct {
+	fs.DirEntry
+	layer *casLayer
+	path  string
+}
+
+func (e *casDirEntry) Info() (fs.FileInfo, error) {
+	return e.layer.Stat(e.path)
+}
+
+// casDir is a directory handle that reports blob sizes
+type casDir struct {
+	absfs.File
+	layer *casLayer
+	name  string
+}
+
+// Readdir implements absfs.File
+func (d *casDir) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(n)
+	for i, info := range infos {
+		if fixed, statErr := d.layer.fileInfo(path.Join(d.name, info.Name()), info); statErr == nil {
+			infos[i] = fixed
+		}
+	}
+	return infos, err
+}
+
+// ReadDir implements absfs.File
+func (d *casDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.ReadDir(n)
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			entries[i] = &casDirEntry{DirEntry: entry, layer: d.layer, path: path.Join(d.name, entry.Name())}
+		}
+	}
+	return entries, err
+}
+
+// casFile is an open file of a content-addressed layer. Read-only handles
+// read the blob directly; writable handles write to a scratch file that is
+// stored as a blob when the handle is closed.
+type casFile struct {
+	absfs.File // blob or scratch file
+	layer      *casLayer
+	name       string
+	meta       absfs.File // metadata file, for writable handles
+	tmp        string
+	append     bool
+	closed     bool
+}
+
+// Name returns the name the file was opened with
+func (f *casFile) Name() string {
+	return f.name
+}
+
+// Stat reports the metadata file's info with the current content size
+func (f *casFile) Stat() (os.FileInfo, error) {
+	info, err := f.layer.meta.Stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &casInfo{FileInfo: info, size: content.Size()}, nil
+}
+
+// Write implements absfs.File, honouring O_APPEND
+func (f *casFile) Write(b []byte) (int, error) {
+	if f.append {
+		if _, err := f.File.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	return f.File.Write(b)
+}
+
+// WriteString implements absfs.File
+func (f *casFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// Close stores written content and points the metadata file at it
+func (f *casFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.meta == nil {
+		return f.File.Close()
+	}
+
+	digest, _, err := f.layer.store.commit(f.File, f.tmp)
+	if err == nil {
+		if err = f.meta.Truncate(0); err == nil {
+			_, err = f.meta.WriteAt([]byte(digest), 0)
+		}
+	}
+	if closeErr := f.meta.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package unionfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// countBlobs returns the number of blobs in a store
+func countBlobs(t *testing.T, fs absfs.FileSystem, dir string) int {
+	t.Helper()
+	shards, err := fs.ReadDir(path.Join(dir, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, shard := range shards {
+		blobs, err := fs.ReadDir(path.Join(dir, "sha256", shard.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(blobs)
+	}
+	return n
+}
+
+// TestCASLayerDeduplicates tests that identical writes across layers share a blob
+func TestCASLayerDeduplicates(t *testing.T) {
+	shared := mustNewMemFS()
+	store, err := NewBlobStore(shared, "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("defaults"), 0644)
+
+	var tenants []*UnionFS
+	for i := 0; i < 3; i++ {
+		tenants = append(tenants, New(
+			WithWritableLayer(NewCASLayer(store, mustNewMemFS())),
+			WithReadOnlyLayer(base),
+		))
+	}
+	before := countBlobs(t, shared, "/blobs")
+	for _, ufs := range tenants {
+		if err := writeFile(ufs, "/etc/app.conf", []byte("tuned"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(ufs, "/data/notes.txt", []byte("same notes"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The copied-up original, the tuned config and the notes
+	if added := countBlobs(t, shared, "/blobs") - before; added != 3 {
+		t.Errorf("expected 3 new blobs for identical writes, got %d", added)
+	}
+
+	for _, ufs := range tenants {
+		data, err := readFile(ufs, "/etc/app.conf")
+		if err != nil || string(data) != "tuned" {
+			t.Errorf("read: got %q, %v", data, err)
+		}
+	}
+	if tmp, _ := shared.ReadDir("/blobs/tmp"); len(tmp) != 0 {
+		t.Errorf("expected scratch files to be cleaned up, got %d", len(tmp))
+	}
+}
+
+// TestCASLayerCopyUpLinks tests that copy-up from a digest-aware layer reuses its blob
+func TestCASLayerCopyUpLinks(t *testing.T) {
+	shared := mustNewMemFS()
+	store, err := NewBlobStore(shared, "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseLayer := NewCASLayer(store, mustNewMemFS())
+	if err := writeFile(baseLayer, "/lib/big.so", []byte(strings.Repeat("x", 4096)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	baseDigest, _ := baseLayer.(Digester).Digest("/lib/big.so")
+
+	overlayMeta := mustNewMemFS()
+	overlay := NewCASLayer(store, overlayMeta)
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(baseLayer),
+	)
+	before := countBlobs(t, shared, "/blobs")
+
+	if err := ufs.Chmod("/lib/big.so", 0700); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := overlay.(Digester).Digest("/lib/big.so")
+	if err != nil || digest != baseDigest {
+		t.Errorf("expected copy-up to link %s, got %s, %v", baseDigest, digest, err)
+	}
+	if after := countBlobs(t, shared, "/blobs"); after != before {
+		t.Errorf("expected no new blobs, went from %d to %d", before, after)
+	}
+	info, err := ufs.Stat("/lib/big.so")
+	if err != nil || info.Size() != 4096 || info.Mode().Perm() != 0700 {
+		t.Errorf("Stat: got %v, %v", info, err)
+	}
+}
+
+// TestCASLayerFileOps tests writes, appends, truncation and listings
+func TestCASLayerFileOps(t *testing.T) {
+	store, err := NewBlobStore(mustNewMemFS(), "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mustNewMemFS()
+	writeFile(base, "/log.txt", []byte("one\n"), 0644)
+	writeFile(base, "/gone.txt", []byte("gone"), 0644)
+	ufs := New(
+		WithWritableLayer(NewCASLayer(store, mustNewMemFS())),
+		WithReadOnlyLayer(base),
+	)
+
+	f, err := ufs.OpenFile("/log.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("two\n"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readFile(ufs, "/log.txt"); string(data) != "one\ntwo\n" {
+		t.Errorf("append: got %q", data)
+	}
+
+	adapter := ufs.FileSystem()
+	if err := adapter.Truncate("/log.txt", 3); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ufs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "log.txt" {
+			continue
+		}
+		if info, _ := entry.Info(); info.Size() != 3 {
+			t.Errorf("expected listed size 3, got %d", info.Size())
+		}
+	}
+
+	if err := ufs.Remove("/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/gone.txt"); err == nil {
+		t.Error("expected whiteout in CAS layer to hide file")
+	}
+}
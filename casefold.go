@@ -0,0 +1,220 @@
+package unionfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirOrdering controls the order of merged directory listings
+type DirOrdering int
+
+const (
+	// OrderByName sorts entries by byte-wise file name, matching os.ReadDir
+	// and fs.ReadDir. This is the default.
+	OrderByName DirOrdering = iota
+	// OrderCaseFolded sorts entries case-insensitively, breaking ties between
+	// names that differ only in case by byte-wise name
+	OrderCaseFolded
+	// OrderLayer returns entries unsorted, top layer first. It is the cheapest
+	// ordering and streams any layer without loading it fully.
+	OrderLayer
+)
+
+// dirOrderingNames are the text forms of each DirOrdering
+var dirOrderingNames = map[DirOrdering]string{
+	OrderByName:     "name",
+	OrderCaseFolded: "case-folded",
+	OrderLayer:      "layer",
+}
+
+// String returns the text form of the ordering
+func (o DirOrdering) String() string {
+	if name, ok := dirOrderingNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("DirOrdering(%d)", int(o))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (o DirOrdering) MarshalText() ([]byte, error) {
+	if _, ok := dirOrderingNames[o]; !ok {
+		return nil, fmt.Errorf("unknown directory ordering %d", int(o))
+	}
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (o *DirOrdering) UnmarshalText(text []byte) error {
+	for ordering, name := range dirOrderingNames {
+		if name == string(text) {
+			*o = ordering
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown directory ordering %q", text)
+}
+
+// caseFoldedLess orders names case-insensitively with a byte-wise tie-break
+func caseFoldedLess(a, b string) bool {
+	la, lb := strings.ToLower(a), strings.ToLower(b)
+	if la != lb {
+		return la < lb
+	}
+	return a < b
+}
+
+// nameKey returns the key used to match names across layers
+func (ufs *UnionFS) nameKey(name string) string {
+	if ufs.caseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// dirLess returns the comparison used to sort merged listings, or nil if
+// entries are left in layer order
+func (ufs *UnionFS) dirLess() func(a, b string) bool {
+	switch ufs.dirOrdering {
+	case OrderLayer:
+		return nil
+	case OrderCaseFolded:
+		return caseFoldedLess
+	default:
+		return func(a, b string) bool { return a < b }
+	}
+}
+
+// maxCaseDirs bounds the number of directories whose spellings are cached
+const maxCaseDirs = 1024
+
+// caseIndex caches the spellings in layer directories by folded name. A
+// directory is read again when its modification time changes, so entries
+// added outside the union are found too.
+type caseIndex struct {
+	mu   sync.Mutex
+	dirs map[caseDirKey]caseDir
+}
+
+// caseDirKey identifies a directory of a layer
+type caseDirKey struct {
+	layer *Layer
+	dir   string
+}
+
+// caseDir holds the spellings of a directory's entries by folded name
+type caseDir struct {
+	modTime time.Time
+	names   map[string]string
+}
+
+// lookup returns the spelling of name in directory dir of layer, or "" if
+// the directory has no entry matching it case-insensitively
+func (c *caseIndex) lookup(layer *Layer, dir, name string) string {
+	info, err := layer.fs.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	key := caseDirKey{layer: layer, dir: dir}
+
+	c.mu.Lock()
+	d, ok := c.dirs[key]
+	c.mu.Unlock()
+	if !ok || !d.modTime.Equal(info.ModTime()) {
+		d = caseDir{modTime: info.ModTime(), names: make(map[string]string)}
+		for _, entry := range readLayerDir(layer, dir) {
+			folded := strings.ToLower(entry.Name())
+			if _, dup := d.names[folded]; !dup {
+				d.names[folded] = entry.Name()
+			}
+		}
+		c.mu.Lock()
+		if c.dirs == nil || len(c.dirs) >= maxCaseDirs {
+			c.dirs = make(map[caseDirKey]caseDir)
+		}
+		c.dirs[key] = d
+		c.mu.Unlock()
+	}
+	return d.names[strings.ToLower(name)]
+}
+
+// layerName maps p to the spelling it has in layer. In case-insensitive mode
+// each component that does not exist verbatim is matched against the
+// layer's directory listing; otherwise p is returned unchanged.
+func (ufs *UnionFS) layerName(layer *Layer, p string) string {
+	if !ufs.caseInsensitive {
+		return p
+	}
+	if _, err := layer.fs.Stat(p); err == nil {
+		return p
+	}
+
+	resolved := "/"
+	for _, part := range splitPath(p) {
+		next := path.Join(resolved, part)
+		if _, err := layer.fs.Stat(next); err != nil {
+			match := ufs.folded.lookup(layer, resolved, part)
+			if match == "" {
+				return p
+			}
+			next = path.Join(resolved, match)
+		}
+		resolved = next
+	}
+	return resolved
+}
+
+// statLayer stats p in a single layer, matching names case-insensitively
+// when the union is configured to
+func (ufs *UnionFS) statLayer(layer *Layer, p string) (os.FileInfo, error) {
+	info, err := layer.fs.Stat(p)
+	if err == nil || !ufs.caseInsensitive || !os.IsNotExist(err) {
+		return info, err
+	}
+	if resolved := ufs.layerName(layer, p); resolved != p {
+		return layer.fs.Stat(resolved)
+	}
+	return nil, err
+}
+
+// resolveCase maps p to the spelling visible in the merged view, so that in
+// case-insensitive mode writes land on the existing entry instead of
+// creating a sibling that differs only in case. Components that do not exist
+// yet keep the caller's spelling.
+func (ufs *UnionFS) resolveCase(p string) string {
+	if !ufs.caseInsensitive {
+		return p
+	}
+
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	resolved := "/"
+	for _, part := range splitPath(p) {
+		resolved = path.Join(resolved, ufs.visibleName(resolved, part))
+	}
+	return resolved
+}
+
+// visibleName returns the spelling of name in directory dir that the merged
+// view shows: that of the topmost layer with a matching entry that is not
+// whited out. The caller must hold ufs.mu.
+func (ufs *UnionFS) visibleName(dir, name string) string {
+	p := path.Join(dir, name)
+	for i, layer := range ufs.layers {
+		if ufs.checkWhiteout(p, i) {
+			break
+		}
+		layerDir := ufs.layerName(layer, dir)
+		if _, err := layer.fs.Stat(path.Join(layerDir, name)); err == nil {
+			return name
+		}
+		if match := ufs.folded.lookup(layer, layerDir, name); match != "" {
+			return match
+		}
+	}
+	return name
+}
@@ -0,0 +1,244 @@
+package unionfs
+
+import (
+	"io/fs"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// orderingUnion builds a two-layer union with names that differ only in case
+func orderingUnion(opts ...Option) *UnionFS {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(overlay, "/dir/b.txt", []byte("overlay"), 0644)
+	writeFile(overlay, "/dir/README", []byte("overlay"), 0644)
+	writeFile(base, "/dir/a.txt", []byte("base"), 0644)
+	writeFile(base, "/dir/readme", []byte("base"), 0644)
+	writeFile(base, "/dir/C.txt", []byte("base"), 0644)
+
+	return New(append([]Option{
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+	}, opts...)...)
+}
+
+// listBoth returns names from ReadDir and from a directory handle
+func listBoth(t *testing.T, ufs *UnionFS, dir string) ([]string, []string) {
+	t.Helper()
+	entries, err := ufs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	f, err := ufs.Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatalf("Readdirnames: %v", err)
+	}
+	return entryNames(entries), names
+}
+
+// TestDirOrdering tests each ordering on ReadDir and directory handles
+func TestDirOrdering(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		want     []string
+		unsorted bool
+	}{
+		{"default", nil, []string{"C.txt", "README", "a.txt", "b.txt", "readme"}, false},
+		{"by name", []Option{WithDirOrdering(OrderByName)}, []string{"C.txt", "README", "a.txt", "b.txt", "readme"}, false},
+		{"case folded", []Option{WithDirOrdering(OrderCaseFolded)}, []string{"a.txt", "b.txt", "C.txt", "README", "readme"}, false},
+		{"layer", []Option{WithDirOrdering(OrderLayer)}, []string{"C.txt", "README", "a.txt", "b.txt", "readme"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readDir, handle := listBoth(t, orderingUnion(tt.opts...), "/dir")
+			if tt.unsorted {
+				// Layer order promises only the set of names
+				readDir = sortedCopy(readDir)
+				handle = sortedCopy(handle)
+			}
+			if !reflect.DeepEqual(readDir, tt.want) {
+				t.Errorf("ReadDir: got %v, want %v", readDir, tt.want)
+			}
+			if !reflect.DeepEqual(handle, tt.want) {
+				t.Errorf("Readdirnames: got %v, want %v", handle, tt.want)
+			}
+		})
+	}
+}
+
+// sortedCopy returns a byte-wise sorted copy of names
+func sortedCopy(names []string) []string {
+	out := append([]string(nil), names...)
+	sort.Strings(out)
+	return out
+}
+
+// TestCaseInsensitiveMerge tests that names differing only in case merge across layers
+func TestCaseInsensitiveMerge(t *testing.T) {
+	ufs := orderingUnion(WithCaseInsensitive())
+
+	readDir, handle := listBoth(t, ufs, "/dir")
+	want := []string{"C.txt", "README", "a.txt", "b.txt"}
+	if !reflect.DeepEqual(readDir, want) {
+		t.Errorf("ReadDir: got %v, want %v", readDir, want)
+	}
+	if !reflect.DeepEqual(handle, want) {
+		t.Errorf("Readdirnames: got %v, want %v", handle, want)
+	}
+
+	// Lookups match any case, and the upper layer wins
+	data, err := readFile(ufs, "/DIR/ReadMe")
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(data) != "overlay" {
+		t.Errorf("expected overlay copy, got %q", data)
+	}
+	if _, err := ufs.Stat("/dir/c.TXT"); err != nil {
+		t.Errorf("expected case-insensitive stat to succeed: %v", err)
+	}
+}
+
+// TestCaseInsensitiveWhiteoutAndWrite tests whiteouts and writes in case-insensitive mode
+func TestCaseInsensitiveWhiteoutAndWrite(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/Config/App.ini", []byte("base"), 0644)
+	writeFile(base, "/Config/Old.ini", []byte("base"), 0644)
+	writeFile(overlay, "/Config/.wh.old.ini", nil, 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+		WithCaseInsensitive(),
+	)
+
+	if _, err := ufs.Stat("/config/OLD.ini"); err == nil {
+		t.Error("expected whiteout to hide file regardless of case")
+	}
+
+	// Writing through a different spelling modifies the existing file
+	if err := writeFile(ufs, "/config/app.INI", []byte("modified"), 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	entries, err := ufs.ReadDir("/Config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"App.ini"}) {
+		t.Errorf("expected a single App.ini, got %v", names)
+	}
+	data, _ := readFile(ufs, "/Config/App.ini")
+	if string(data) != "modified" {
+		t.Errorf("expected modified contents, got %q", data)
+	}
+}
+
+// TestCaseInsensitiveStatCache tests that a cached lookup under one spelling
+// is dropped by a change made under another
+func TestCaseInsensitiveStatCache(t *testing.T) {
+	overlay, base := mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/foo", []byte("base"), 0644)
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+		WithCaseInsensitive(),
+		WithStatCache(true, time.Minute),
+	)
+
+	if _, err := ufs.Stat("/FOO"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/FOO"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/FOO) after Remove(/foo) = %v, want not exist", err)
+	}
+}
+
+// TestCaseOnlyRename tests renaming an entry to a spelling of its own name
+func TestCaseOnlyRename(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(overlay, "/Readme", []byte("overlay"), 0644)
+	writeFile(base, "/docs/Guide", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+		WithCaseInsensitive(),
+	)
+
+	for _, rename := range [][2]string{{"/Readme", "/README"}, {"/docs/Guide", "/DOCS/guide"}} {
+		if err := ufs.Rename(rename[0], rename[1]); err != nil {
+			t.Fatalf("rename %s: %v", rename[0], err)
+		}
+	}
+
+	for dir, want := range map[string][]string{"/": {"README", "docs"}, "/docs": {"guide"}} {
+		entries, err := ufs.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := entryNames(entries); !reflect.DeepEqual(names, want) {
+			t.Errorf("%s = %v, want %v", dir, names, want)
+		}
+	}
+	if data, _ := readFile(ufs, "/docs/GUIDE"); string(data) != "base" {
+		t.Errorf("guide = %q", data)
+	}
+}
+
+// readDirCountFS counts directory listings made on a layer
+type readDirCountFS struct {
+	absfs.FileSystem
+	reads *int
+}
+
+func (r *readDirCountFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	*r.reads++
+	return r.FileSystem.ReadDir(name)
+}
+
+// TestCaseInsensitiveLookupsCached tests that directory spellings are read
+// once and read again after the directory changes
+func TestCaseInsensitiveLookupsCached(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/Data/File.txt", []byte("base"), 0644)
+
+	reads := 0
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(&readDirCountFS{FileSystem: base, reads: &reads}),
+		WithCaseInsensitive(),
+	)
+
+	for i := 0; i < 10; i++ {
+		if _, err := ufs.Stat("/data/file.TXT"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads > 2 {
+		t.Errorf("%d directory reads for repeated lookups", reads)
+	}
+
+	// Entries added behind the union's back are found
+	time.Sleep(time.Millisecond)
+	writeFile(base, "/Data/New.txt", []byte("new"), 0644)
+	if _, err := ufs.Stat("/data/NEW.txt"); err != nil {
+		t.Errorf("new entry not found: %v", err)
+	}
+}
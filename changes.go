@@ -0,0 +1,120 @@
+package unionfs
+
+import (
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// ChangeKind classifies an entry of a changeset
+type ChangeKind int
+
+const (
+	// ChangeAdded is a path the lower layers do not have
+	ChangeAdded ChangeKind = iota
+	// ChangeModified is a path the writable layer replaces
+	ChangeModified
+	// ChangeDeleted is a lower path hidden by a whiteout or opaque marker
+	ChangeDeleted
+)
+
+// String returns the kind's name
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	}
+	return "deleted"
+}
+
+// Change is one path changed by the writable layer
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// Changes returns the changeset of the writable layer against the layers
+// below, in path order. Copied-up files count as modified even if their
+// contents are unchanged; directories count as modified only when their
+// mode changed. Unions with several writable branches or write routes get
+// ErrMultipleBranches.
+func (ufs *UnionFS) Changes() ([]Change, error) {
+	ufs.mu.RLock()
+	top := ufs.writableLayer
+	pooled := ufs.pooled()
+	lower := ufs.layerView(ufs.layers[1:])
+	ufs.mu.RUnlock()
+	if top == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if pooled {
+		return nil, ErrMultipleBranches
+	}
+
+	var changes []Change
+	if err := collectChanges(top.fs, lower, "/", false, &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// collectChanges appends the changes under dir. Below an added directory
+// everything is added.
+func collectChanges(upper absfs.FileSystem, lower *UnionFS, dir string, added bool, changes *[]Change) error {
+	entries, err := upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if isOpaqueWhiteout(p) {
+			lowerEntries, err := lower.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range lowerEntries {
+				if !present[e.Name()] {
+					*changes = append(*changes, Change{Path: path.Join(dir, e.Name()), Kind: ChangeDeleted})
+				}
+			}
+			continue
+		}
+		if target, ok := originalPath(p); ok {
+			if _, err := lower.Lstat(target); err == nil && !present[path.Base(target)] {
+				*changes = append(*changes, Change{Path: target, Kind: ChangeDeleted})
+			}
+			continue
+		}
+
+		info, err := lstatLayer(upper, p)
+		if err != nil {
+			return err
+		}
+		kind, changed := ChangeAdded, true
+		if !added {
+			if lowerInfo, err := lower.Lstat(p); err == nil {
+				kind = ChangeModified
+				changed = !info.IsDir() || !lowerInfo.IsDir() || info.Mode() != lowerInfo.Mode()
+			}
+		}
+		if changed {
+			*changes = append(*changes, Change{Path: p, Kind: kind})
+		}
+		if info.IsDir() {
+			if err := collectChanges(upper, lower, p, kind == ChangeAdded, changes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// changesUnion returns a union with one change of each kind
+func changesUnion(t *testing.T) *UnionFS {
+	t.Helper()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	writeFile(base, "/opt/tool/bin", []byte("base"), 0755)
+	writeFile(base, "/opt/tool/lib", []byte("base"), 0644)
+
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay, LayerName("upper")), WithReadOnlyLayer(base, LayerName("base")))
+	writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644)
+	ufs.Remove("/etc/hosts")
+	writeFile(ufs, "/srv/www/index.html", []byte("new"), 0644)
+	writeFile(overlay, "/opt/tool/"+OpaqueWhiteout, nil, 0644)
+	writeFile(overlay, "/opt/tool/bin", []byte("new"), 0755)
+	return ufs
+}
+
+func TestChanges(t *testing.T) {
+	ufs := changesUnion(t)
+	changes, err := ufs.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"/etc/app.conf", ChangeModified},
+		{"/etc/hosts", ChangeDeleted},
+		{"/opt/tool/bin", ChangeModified},
+		{"/opt/tool/lib", ChangeDeleted},
+		{"/srv", ChangeAdded},
+		{"/srv/www", ChangeAdded},
+		{"/srv/www/index.html", ChangeAdded},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+}
+
+func TestChangesBranches(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/f", []byte("base"), 0644)
+	ufs := New(WithWritableLayer(a), WithWritableBranch(b), WithReadOnlyLayer(base))
+	writeFile(b, "/g", []byte("b"), 0644)
+
+	// The file added in branch b is neither a change of branch a nor part
+	// of its base
+	if _, err := ufs.Changes(); err != ErrMultipleBranches {
+		t.Errorf("Changes = %v, want ErrMultipleBranches", err)
+	}
+}
+
+func TestWhich(t *testing.T) {
+	ufs := changesUnion(t)
+	for p, want := range map[string]string{
+		"/etc/app.conf":       "upper",
+		"/opt/tool/bin":       "upper",
+		"/srv/www/index.html": "upper",
+	} {
+		info, err := ufs.Which(p)
+		if err != nil || info.Name != want {
+			t.Errorf("Which(%s) = %q, %v, want %q", p, info.Name, err, want)
+		}
+	}
+
+	base := mustNewMemFS()
+	writeFile(base, "/only-base", nil, 0644)
+	ufs = New(WithWritableLayer(mustNewMemFS()), WithReadOnlyLayer(base, LayerName("base")))
+	if info, err := ufs.Which("/only-base"); err != nil || info.Name != "base" || info.Index != 1 {
+		t.Errorf("Which(/only-base) = %+v, %v", info, err)
+	}
+	if _, err := ufs.Which("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Which(/missing) = %v", err)
+	}
+}
+
+func TestOCILayerRoundTrip(t *testing.T) {
+	ufs := changesUnion(t)
+	var buf bytes.Buffer
+	if err := ufs.ExportOCILayer(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	for _, want := range []string{"etc/.wh.hosts", "opt/tool/.wh..wh..opq", "srv/www/index.html"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("%s missing from %v", want, names)
+		}
+	}
+
+	// Importing the layer over the same base reproduces the view
+	imported := mustNewMemFS()
+	if err := ImportOCILayer(imported, &buf); err != nil {
+		t.Fatal(err)
+	}
+	base := ufs.layers[1].fs
+	rebuilt := New(WithReadOnlyLayer(imported), WithReadOnlyLayer(base))
+	if got, want := snapshotView(t, rebuilt), snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported view:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	ufs := changesUnion(t)
+	var buf bytes.Buffer
+	if err := ufs.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	flat := mustNewMemFS()
+	if err := importTar(flat, &buf, "/", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snapshotView(t, New(WithReadOnlyLayer(flat))), snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("exported view:\n got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,284 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// IssueKind classifies an inconsistency found by Check
+type IssueKind int
+
+const (
+	// IssueShadowedWhiteout is a whiteout next to an entry of the same name
+	// in the same layer. The entry wins, so the whiteout is dead weight.
+	IssueShadowedWhiteout IssueKind = iota
+	// IssueTruncatedCopyUp is a copy whose contents are a strict prefix of
+	// the lower file, as left by an interrupted copy-up. A file deliberately
+	// truncated to a prefix looks the same, so review before repairing.
+	IssueTruncatedCopyUp
+	// IssueOrphanOpaque is an opaque marker in a directory that no lower
+	// layer has
+	IssueOrphanOpaque
+	// IssueUncopiedParent is a whiteout whose parent directory was created
+	// with default permissions instead of being copied up from the lower
+	// directory
+	IssueUncopiedParent
+)
+
+var issueKindNames = []string{"shadowed-whiteout", "truncated-copy-up", "orphan-opaque", "uncopied-parent"}
+
+// String returns the kind's name
+func (k IssueKind) String() string {
+	if int(k) < len(issueKindNames) {
+		return issueKindNames[k]
+	}
+	return fmt.Sprintf("IssueKind(%d)", int(k))
+}
+
+// Issue is one inconsistency in the writable layer
+type Issue struct {
+	Path     string // the affected entry; the directory for opaque markers
+	Kind     IssueKind
+	Repaired bool
+}
+
+// CheckOptions controls how thoroughly Check scans
+type CheckOptions struct {
+	// Contents compares copied-up files with the lower files to find
+	// truncated copy-ups. It reads every copy, so it is off by default.
+	Contents bool
+}
+
+// CheckReport lists the inconsistencies found by Check
+type CheckReport struct {
+	Scanned int // entries of the writable layer examined
+	Issues  []Issue
+
+	layer *Layer
+}
+
+// Check scans the writable layer for inconsistencies left by crashes or
+// external edits, judging them by the same rules lookups and listings use.
+// It changes nothing; pass the report, or a filtered copy of its issues, to
+// Repair to fix them. Unions with several writable branches or write routes
+// get ErrMultipleBranches.
+//
+// Example:
+//
+//	report, err := ufs.Check(unionfs.CheckOptions{Contents: true})
+//	for _, issue := range report.Issues {
+//	    log.Printf("%s: %s", issue.Path, issue.Kind)
+//	}
+//	err = ufs.Repair(report)
+func (ufs *UnionFS) Check(opts CheckOptions) (*CheckReport, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	top := ufs.writableLayer
+	if top == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if ufs.pooled() {
+		return nil, ErrMultipleBranches
+	}
+	c := &checker{
+		ufs:    ufs,
+		top:    top,
+		lower:  ufs.layerView(ufs.layers[1:]),
+		opts:   opts,
+		report: &CheckReport{layer: top},
+	}
+	if err := c.checkDir("/"); err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	sort.SliceStable(c.report.Issues, func(i, j int) bool { return c.report.Issues[i].Path < c.report.Issues[j].Path })
+	return c.report, nil
+}
+
+// checker scans the writable layer against the layers below
+type checker struct {
+	ufs    *UnionFS
+	top    *Layer
+	lower  *UnionFS
+	opts   CheckOptions
+	report *CheckReport
+}
+
+// checkDir checks the entries of dir, recursively
+func (c *checker) checkDir(dir string) error {
+	entries, err := c.top.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		c.report.Scanned++
+		p := path.Join(dir, entry.Name())
+		switch {
+		case isOpaqueWhiteout(p):
+			if info, err := c.lower.Stat(dir); err != nil || !info.IsDir() {
+				c.add(dir, IssueOrphanOpaque)
+			}
+		case isWhiteout(entry.Name()):
+			target, _ := originalPath(p)
+			if names[path.Base(target)] {
+				c.add(target, IssueShadowedWhiteout)
+			}
+			if err := c.checkParent(dir); err != nil {
+				return err
+			}
+		case entry.IsDir():
+			if err := c.checkDir(p); err != nil {
+				return err
+			}
+		case c.opts.Contents && entry.Type().IsRegular():
+			truncated, err := c.truncated(p)
+			if err != nil {
+				return err
+			}
+			if truncated {
+				c.add(p, IssueTruncatedCopyUp)
+			}
+		}
+	}
+	return nil
+}
+
+// add records an issue, once per path and kind
+func (c *checker) add(p string, kind IssueKind) {
+	for _, issue := range c.report.Issues {
+		if issue.Path == p && issue.Kind == kind {
+			return
+		}
+	}
+	c.report.Issues = append(c.report.Issues, Issue{Path: p, Kind: kind})
+}
+
+// checkParent reports dir if it holds a whiteout but kept the default
+// permissions given to directories created for whiteouts, rather than
+// those of the lower directory
+func (c *checker) checkParent(dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	info, err := c.top.fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	lowerInfo, err := c.lower.Stat(dir)
+	if err != nil || !lowerInfo.IsDir() {
+		return nil
+	}
+	if info.Mode().Perm() == 0755 && lowerInfo.Mode().Perm() != 0755 {
+		c.add(dir, IssueUncopiedParent)
+	}
+	return nil
+}
+
+// truncated reports whether the copy of p is a strict prefix of the lower
+// file it shadows
+func (c *checker) truncated(p string) (bool, error) {
+	if c.ufs.hasWhiteout(c.top, p) {
+		return false, nil
+	}
+	info, err := c.top.fs.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	lowerInfo, err := c.lower.Stat(p)
+	if err != nil || !lowerInfo.Mode().IsRegular() || info.Size() >= lowerInfo.Size() {
+		return false, nil
+	}
+
+	upper, err := c.top.fs.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer upper.Close()
+	lower, err := c.lower.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer lower.Close()
+
+	data, err := io.ReadAll(upper)
+	if err != nil {
+		return false, err
+	}
+	prefix := make([]byte, len(data))
+	if _, err := io.ReadFull(lower, prefix); err != nil {
+		return false, err
+	}
+	return bytes.Equal(data, prefix), nil
+}
+
+// Repair fixes the issues in a report from Check: shadowed whiteouts and
+// orphan opaque markers are removed, truncated copy-ups are copied again
+// from the lower layers, and uncopied parents get the lower directory's
+// mode and times. Fixed issues are marked Repaired. The report must come
+// from the current writable layer.
+func (ufs *UnionFS) Repair(report *CheckReport) error {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+	defer ufs.cache.clear()
+
+	top := ufs.writableLayer
+	if top == nil || top != report.layer {
+		return ErrLayersChanged
+	}
+	if ufs.pooled() {
+		return ErrMultipleBranches
+	}
+	lower := ufs.layerView(ufs.layers[1:])
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		if issue.Repaired {
+			continue
+		}
+		var err error
+		switch issue.Kind {
+		case IssueShadowedWhiteout:
+			err = removeLayerPath(top.fs, whiteoutPath(issue.Path))
+		case IssueOrphanOpaque:
+			err = removeLayerPath(top.fs, path.Join(issue.Path, OpaqueWhiteout))
+		case IssueTruncatedCopyUp:
+			err = recopy(top, lower, issue.Path)
+		case IssueUncopiedParent:
+			var info os.FileInfo
+			if info, err = lower.Stat(issue.Path); err == nil {
+				err = top.fs.Chmod(issue.Path, info.Mode())
+				top.fs.Chtimes(issue.Path, info.ModTime(), info.ModTime())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("repair %s: %w", issue.Path, err)
+		}
+		issue.Repaired = true
+	}
+	return nil
+}
+
+// recopy copies p from the lower layers over the writable layer's copy
+func recopy(top *Layer, lower *UnionFS, p string) error {
+	info, err := lower.Stat(p)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(lower, top.fs, p, info); err != nil {
+		return err
+	}
+	if err := top.fs.Chmod(p, info.Mode()); err != nil {
+		return err
+	}
+	top.fs.Chtimes(p, info.ModTime(), info.ModTime())
+	return nil
+}
@@ -0,0 +1,126 @@
+package unionfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// damagedUnion returns a union whose writable layer has one of each issue
+func damagedUnion(t *testing.T) (*UnionFS, *Layer) {
+	t.Helper()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("complete contents"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	base.MkdirAll("/private", 0700)
+	writeFile(base, "/private/key", []byte("base"), 0600)
+	base.Chmod("/private", os.ModeDir|0700)
+
+	overlay := mustNewMemFS()
+	// A copy-up interrupted part way
+	writeFile(overlay, "/etc/app.conf", []byte("complete"), 0644)
+	// A whiteout next to a real file of the same name
+	writeFile(overlay, "/etc/hosts", []byte("overlay"), 0644)
+	writeFile(overlay, "/etc/.wh.hosts", nil, 0644)
+	// An opaque marker with nothing below it
+	writeFile(overlay, "/new/"+OpaqueWhiteout, nil, 0644)
+	// A whiteout in a parent created with default permissions
+	writeFile(overlay, "/private/.wh.key", nil, 0644)
+
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+	return ufs, ufs.layers[0]
+}
+
+func TestCheck(t *testing.T) {
+	ufs, _ := damagedUnion(t)
+
+	report, err := ufs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Issue{
+		{Path: "/etc/hosts", Kind: IssueShadowedWhiteout},
+		{Path: "/new", Kind: IssueOrphanOpaque},
+		{Path: "/private", Kind: IssueUncopiedParent},
+	}
+	if !reflect.DeepEqual(report.Issues, want) {
+		t.Errorf("issues = %v, want %v", report.Issues, want)
+	}
+
+	report, err = ufs.Check(CheckOptions{Contents: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]Issue{{Path: "/etc/app.conf", Kind: IssueTruncatedCopyUp}}, want...)
+	if !reflect.DeepEqual(report.Issues, want) {
+		t.Errorf("issues with contents = %v, want %v", report.Issues, want)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ufs, overlay := damagedUnion(t)
+	report, err := ufs.Check(CheckOptions{Contents: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Repair(report); err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			t.Errorf("%s: %s not repaired", issue.Path, issue.Kind)
+		}
+	}
+
+	if data, _ := readFile(ufs, "/etc/app.conf"); string(data) != "complete contents" {
+		t.Errorf("/etc/app.conf = %q", data)
+	}
+	if data, _ := readFile(ufs, "/etc/hosts"); string(data) != "overlay" {
+		t.Errorf("/etc/hosts = %q", data)
+	}
+	if _, err := overlay.fs.Stat("/etc/.wh.hosts"); !os.IsNotExist(err) {
+		t.Errorf("shadowed whiteout left: %v", err)
+	}
+	if info, err := ufs.Stat("/private"); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("/private mode = %v, %v", info.Mode(), err)
+	}
+
+	report, err = ufs.Check(CheckOptions{Contents: true})
+	if err != nil || len(report.Issues) != 0 {
+		t.Errorf("after repair: %v, %v", report.Issues, err)
+	}
+}
+
+func TestRepairStaleReport(t *testing.T) {
+	ufs, _ := damagedUnion(t)
+	report, err := ufs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Repair(report); err != ErrLayersChanged {
+		t.Errorf("Repair = %v, want ErrLayersChanged", err)
+	}
+}
+
+func TestCheckBranches(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(b, "/f", []byte("b"), 0644)
+	writeFile(a, "/.wh.f", nil, 0644)
+	ufs := New(WithWritableLayer(a), WithWritableBranch(b), WithReadOnlyLayer(base))
+
+	// The whiteout in branch a hides a file of branch b, which is not a
+	// lower layer of a, so it cannot be judged against it
+	if _, err := ufs.Check(CheckOptions{}); err != ErrMultipleBranches {
+		t.Errorf("Check = %v, want ErrMultipleBranches", err)
+	}
+	report := &CheckReport{layer: ufs.writableLayer, Issues: []Issue{{Path: "/f", Kind: IssueShadowedWhiteout}}}
+	if err := ufs.Repair(report); err != ErrMultipleBranches {
+		t.Errorf("Repair = %v, want ErrMultipleBranches", err)
+	}
+	if _, err := a.Stat("/.wh.f"); err != nil {
+		t.Errorf("whiteout removed: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+// Command unionfs inspects and manipulates unions of directory-backed
+// layers.
+//
+// Layers are given top to bottom with -upper and -lower, or loaded from a
+// manifest with -manifest:
+//
+//	unionfs -upper ./upper -lower ./app -lower ./base ls -r /etc
+//	unionfs -upper ./upper -lower ./base which /etc/app.conf
+//	unionfs -upper ./upper -lower ./base diff
+//	unionfs -upper ./upper -lower ./base commit ./app-v2
+//	unionfs -lower ./l1 -lower ./l2 -lower ./l3 squash 0 2 ./flat
+//	unionfs -upper ./upper -lower ./base export --oci layer.tar
+//	unionfs import layer.tar ./imported
+//	unionfs -upper ./upper -lower ./base fsck --repair
+//	unionfs -upper ./upper -lower ./base compact
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/unionfs"
+)
+
+const usage = `usage: unionfs [-upper DIR] [-lower DIR]... [-manifest FILE] COMMAND [ARGS]
+
+Commands:
+  ls [-r] [PATH]            list the merged view with each entry's layer
+  which PATH                show the layer PATH resolves to
+  diff                      list the changes in the upper layer
+  commit DIR                move the upper layer's changes into a new layer DIR
+  squash FROM TO DIR        flatten layers FROM..TO into DIR
+  export [--oci] FILE       write the merged view, or with --oci the upper
+                            layer as an OCI layer, as a tar ("-" for stdout)
+  import FILE DIR           extract an OCI layer tar into a new layer DIR
+  fsck [--contents] [--repair]
+                            check the upper layer for inconsistencies
+  compact                   remove redundant entries from the upper layer
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "unionfs:", err)
+		os.Exit(1)
+	}
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// errUsage reports a malformed command line
+var errUsage = errors.New("invalid arguments; run with -h for usage")
+
+// run executes the command line args, writing output to stdout
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("unionfs", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	var upper, manifest string
+	var lowers stringList
+	flags.StringVar(&upper, "upper", "", "writable layer directory")
+	flags.Var(&lowers, "lower", "read-only layer directory, top to bottom (repeatable)")
+	flags.StringVar(&manifest, "manifest", "", "manifest describing the layers")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "import" {
+		return importLayer(args)
+	}
+
+	ufs, err := openUnion(upper, lowers, manifest)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "ls":
+		return list(ufs, args, stdout)
+	case "which":
+		return which(ufs, args, stdout)
+	case "diff":
+		return diff(ufs, args, stdout)
+	case "commit":
+		return commit(ufs, upper, args, stdout)
+	case "squash":
+		return squash(ufs, args)
+	case "export":
+		return export(ufs, args, stdout)
+	case "fsck":
+		return fsck(ufs, args, stdout)
+	case "compact":
+		return compact(ufs, args, stdout)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// openUnion builds the union from directories or a manifest. Layers are
+// named after their directories.
+func openUnion(upper string, lowers []string, manifest string) (*unionfs.UnionFS, error) {
+	if manifest != "" {
+		if upper != "" || len(lowers) > 0 {
+			return nil, errors.New("-manifest cannot be combined with -upper or -lower")
+		}
+		data, err := os.ReadFile(manifest)
+		if err != nil {
+			return nil, err
+		}
+		var m unionfs.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", manifest, err)
+		}
+		return unionfs.Load(&m, nil)
+	}
+
+	m := &unionfs.Manifest{Version: unionfs.ManifestVersion}
+	if upper != "" {
+		m.Layers = append(m.Layers, unionfs.LayerSpec{Type: unionfs.LayerTypeDir, Location: upper, Writable: true, Name: upper})
+	}
+	for _, dir := range lowers {
+		m.Layers = append(m.Layers, unionfs.LayerSpec{Type: unionfs.LayerTypeDir, Location: dir, Name: dir})
+	}
+	if len(m.Layers) == 0 {
+		return nil, errors.New("no layers given; use -upper, -lower or -manifest")
+	}
+	return unionfs.Load(m, nil)
+}
+
+// list prints the merged listing of a directory with each entry's layer
+func list(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "list subdirectories recursively")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	dir := "/"
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		return errUsage
+	}
+	return listDir(ufs, path.Clean("/"+dir), *recursive, stdout)
+}
+
+// listDir prints one directory of a listing
+func listDir(ufs *unionfs.UnionFS, dir string, recursive bool, stdout io.Writer) error {
+	entries, err := ufs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		info, err := ufs.Lstat(p)
+		if err != nil {
+			return err
+		}
+		layer, err := ufs.Which(p)
+		if err != nil {
+			return err
+		}
+		name := p
+		if info.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(stdout, "%s %10d  %-40s %s\n", info.Mode(), info.Size(), name, layer.Name)
+		if recursive && info.IsDir() {
+			if err := listDir(ufs, p, true, stdout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// which prints the layer a path resolves to
+func which(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	layer, err := ufs.Which(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d %s\n", layer.Index, layer.Name)
+	return nil
+}
+
+// diff prints the upper layer's changeset
+func diff(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	changes, err := ufs.Changes()
+	if err != nil {
+		return err
+	}
+	marks := map[unionfs.ChangeKind]string{
+		unionfs.ChangeAdded:    "A",
+		unionfs.ChangeModified: "M",
+		unionfs.ChangeDeleted:  "D",
+	}
+	for _, c := range changes {
+		fmt.Fprintf(stdout, "%s %s\n", marks[c.Kind], c.Path)
+	}
+	return nil
+}
+
+// commit squashes the upper layer into a new layer directory and empties
+// the upper directory, so the new layer can be added below it
+func commit(ufs *unionfs.UnionFS, upper string, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if upper == "" {
+		return errors.New("commit needs -upper")
+	}
+	dst, err := newLayerDir(args[0])
+	if err != nil {
+		return err
+	}
+	if err := ufs.Squash(0, 0, dst, unionfs.LayerName(args[0])); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(upper, entry.Name())); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "committed %s to %s; add it with -lower %s\n", upper, args[0], args[0])
+	return nil
+}
+
+// squash flattens a span of layers into a new layer directory
+func squash(ufs *unionfs.UnionFS, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	from, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("FROM: %w", err)
+	}
+	to, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("TO: %w", err)
+	}
+	dst, err := newLayerDir(args[2])
+	if err != nil {
+		return err
+	}
+	return ufs.Squash(from, to, dst, unionfs.LayerName(args[2]))
+}
+
+// export writes the merged view or the upper layer as a tar archive
+func export(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	oci := flags.Bool("oci", false, "export the upper layer as an OCI image layer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	w := stdout
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *oci {
+		return ufs.ExportOCILayer(w)
+	}
+	return ufs.ExportTar(w)
+}
+
+// importLayer extracts an OCI layer tar into a new layer directory
+func importLayer(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst, err := newLayerDir(args[1])
+	if err != nil {
+		return err
+	}
+	return unionfs.ImportOCILayer(dst, f)
+}
+
+// fsck checks the upper layer and optionally repairs it
+func fsck(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	contents := flags.Bool("contents", false, "compare copied-up files with the lower files")
+	repair := flags.Bool("repair", false, "fix the issues found")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errUsage
+	}
+
+	report, err := ufs.Check(unionfs.CheckOptions{Contents: *contents})
+	if err != nil {
+		return err
+	}
+	if *repair {
+		if err := ufs.Repair(report); err != nil {
+			return err
+		}
+	}
+	for _, issue := range report.Issues {
+		status := ""
+		if issue.Repaired {
+			status = " (repaired)"
+		}
+		fmt.Fprintf(stdout, "%s: %s%s\n", issue.Path, issue.Kind, status)
+	}
+	fmt.Fprintf(stdout, "%d entries checked, %d issues\n", report.Scanned, len(report.Issues))
+	if len(report.Issues) > 0 && !*repair {
+		return errors.New("inconsistencies found")
+	}
+	return nil
+}
+
+// compact removes redundant entries from the upper layer
+func compact(ufs *unionfs.UnionFS, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := ufs.Compact()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "removed %d whiteouts, %d opaque markers, %d files, %d directories; reclaimed %d bytes\n",
+		report.Whiteouts, report.OpaqueMarkers, report.Files, report.Dirs, report.BytesReclaimed)
+	return nil
+}
+
+// newLayerDir creates an empty directory for a new layer
+func newLayerDir(dir string) (absfs.FileSystem, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s: layer directory is not empty", dir)
+	}
+	return unionfs.NewDirLayer(dir)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCmd runs the command line and returns its output
+func runCmd(t *testing.T, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return out.String()
+}
+
+// TestCommands tests inspecting, committing and exporting a union
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	upper := filepath.Join(dir, "upper")
+	base := filepath.Join(dir, "base")
+	os.MkdirAll(upper, 0755)
+	os.MkdirAll(filepath.Join(base, "etc"), 0755)
+	os.WriteFile(filepath.Join(base, "etc", "app.conf"), []byte("base"), 0644)
+	os.WriteFile(filepath.Join(base, "etc", "old.conf"), []byte("old"), 0644)
+	os.MkdirAll(filepath.Join(upper, "etc"), 0755)
+	os.WriteFile(filepath.Join(upper, "etc", "app.conf"), []byte("changed"), 0644)
+	os.WriteFile(filepath.Join(upper, "etc", ".wh.old.conf"), nil, 0644)
+	os.WriteFile(filepath.Join(upper, "new.txt"), []byte("new"), 0644)
+	layers := []string{"-upper", upper, "-lower", base}
+
+	if got := runCmd(t, append(layers, "which", "/etc/app.conf")...); got != "0 "+upper+"\n" {
+		t.Errorf("which: got %q", got)
+	}
+	listing := runCmd(t, append(layers, "ls", "-r")...)
+	if !strings.Contains(listing, "/etc/app.conf") || strings.Contains(listing, "old.conf") {
+		t.Errorf("ls: got\n%s", listing)
+	}
+
+	want := "M /etc/app.conf\nD /etc/old.conf\nA /new.txt\n"
+	if got := runCmd(t, append(layers, "diff")...); got != want {
+		t.Errorf("diff: got\n%s", got)
+	}
+	runCmd(t, append(layers, "fsck")...)
+
+	// Export the upper layer and import it elsewhere
+	tarPath := filepath.Join(dir, "layer.tar")
+	runCmd(t, append(layers, "export", "--oci", tarPath)...)
+	imported := filepath.Join(dir, "imported")
+	runCmd(t, "import", tarPath, imported)
+	if _, err := os.Stat(filepath.Join(imported, "etc", ".wh.old.conf")); err != nil {
+		t.Errorf("expected imported whiteout: %v", err)
+	}
+
+	// Commit moves the changes into a new layer and empties the upper one
+	committed := filepath.Join(dir, "v2")
+	runCmd(t, append(layers, "commit", committed)...)
+	if entries, _ := os.ReadDir(upper); len(entries) != 0 {
+		t.Errorf("expected empty upper layer, got %d entries", len(entries))
+	}
+	stacked := []string{"-upper", upper, "-lower", committed, "-lower", base}
+	if got := runCmd(t, append(stacked, "diff")...); got != "" {
+		t.Errorf("expected no changes after commit, got\n%s", got)
+	}
+	if got := runCmd(t, append(stacked, "which", "/new.txt")...); got != "1 "+committed+"\n" {
+		t.Errorf("which after commit: got %q", got)
+	}
+	listing = runCmd(t, append(stacked, "ls", "/etc")...)
+	if strings.Contains(listing, "old.conf") {
+		t.Errorf("expected whiteout to survive commit, got\n%s", listing)
+	}
+}
+
+// TestUsageErrors tests malformed command lines
+func TestUsageErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{},
+		{"ls"},
+		{"-lower", dir, "frobnicate"},
+		{"-lower", dir, "which"},
+		{"-lower", dir, "-manifest", "m.json", "ls"},
+	} {
+		var out bytes.Buffer
+		if err := run(args, &out); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+// TestSymlinkedLower tests that symlinks in lower directories are listed
+// and exported as links rather than followed
+func TestSymlinkedLower(t *testing.T) {
+	dir := t.TempDir()
+	upper := filepath.Join(dir, "upper")
+	base := filepath.Join(dir, "base")
+	os.MkdirAll(upper, 0755)
+	os.MkdirAll(filepath.Join(base, "etc"), 0755)
+	os.WriteFile(filepath.Join(base, "etc", "app.conf"), []byte("base"), 0644)
+	if err := os.Symlink(".", filepath.Join(base, "etc", "self")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	layers := []string{"-upper", upper, "-lower", base}
+
+	listing := runCmd(t, append(layers, "ls", "-r")...)
+	if !strings.Contains(listing, "/etc/self ") || strings.Contains(listing, "/etc/self/") {
+		t.Errorf("ls: expected /etc/self as a link, got\n%s", listing)
+	}
+
+	tarPath := filepath.Join(dir, "union.tar")
+	runCmd(t, append(layers, "export", tarPath)...)
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var link *tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimPrefix(hdr.Name, "/") == "etc/self" {
+			link = hdr
+		}
+	}
+	if link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "." {
+		t.Errorf("expected etc/self -> . in export, got %+v", link)
+	}
+}
@@ -0,0 +1,217 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// CompactReport describes what Compact removed from the writable layer
+type CompactReport struct {
+	Whiteouts      int   // whiteouts that masked nothing
+	OpaqueMarkers  int   // opaque markers over missing or empty lower directories
+	Files          int   // files and symlinks identical to the lower version
+	Dirs           int   // directories identical to the lower version once emptied
+	BytesReclaimed int64 // total size of the removed files
+}
+
+// Compact removes entries from the writable layer that do not change the
+// merged view: whiteouts that mask nothing, opaque markers over missing or
+// empty lower directories, copied-up files and symlinks identical to the
+// version they shadow, and directories left empty that match the lower
+// directory. Contents and modes are compared; timestamps are not. Reads
+// and writes are held off while it runs. Unions with several writable
+// branches or write routes get ErrMultipleBranches.
+func (ufs *UnionFS) Compact() (*CompactReport, error) {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	top := ufs.writableLayer
+	if top == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if ufs.pooled() {
+		return nil, ErrMultipleBranches
+	}
+	c := &compactor{
+		ufs:    ufs,
+		top:    top,
+		lower:  ufs.layerView(ufs.layers[1:]),
+		report: &CompactReport{},
+	}
+	_, err := c.compactDir("/")
+	ufs.cache.clear()
+	if err != nil {
+		return c.report, fmt.Errorf("compact: %w", err)
+	}
+	return c.report, nil
+}
+
+// compactor walks the writable layer comparing it with the layers below
+type compactor struct {
+	ufs    *UnionFS
+	top    *Layer
+	lower  *UnionFS
+	report *CompactReport
+}
+
+// compactDir compacts dir and reports whether it was left empty
+func (c *compactor) compactDir(dir string) (bool, error) {
+	entries, err := c.top.fs.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	// Markers go first, since they decide whether entries shadow anything
+	sort.SliceStable(entries, func(i, j int) bool {
+		return isWhiteout(entries[i].Name()) && !isWhiteout(entries[j].Name())
+	})
+
+	remaining := len(entries)
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		var removed bool
+		switch {
+		case isOpaqueWhiteout(p):
+			lowerEntries, err := c.lower.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			if len(lowerEntries) == 0 {
+				if removed, err = c.remove(p); err != nil {
+					return false, err
+				}
+				c.report.OpaqueMarkers++
+			}
+		case isWhiteout(entry.Name()):
+			target, _ := originalPath(p)
+			_, err := c.lower.Lstat(target)
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			if err != nil {
+				if removed, err = c.remove(p); err != nil {
+					return false, err
+				}
+				c.report.Whiteouts++
+			}
+		default:
+			info, err := lstatLayer(c.top.fs, p)
+			if err != nil {
+				return false, err
+			}
+			if info.IsDir() {
+				empty, err := c.compactDir(p)
+				if err != nil {
+					return false, err
+				}
+				if !empty {
+					continue
+				}
+			}
+			same, err := c.sameAsLower(p, info)
+			if err != nil {
+				return false, err
+			}
+			if !same {
+				continue
+			}
+			if removed, err = c.remove(p); err != nil {
+				return false, err
+			}
+			if info.IsDir() {
+				c.report.Dirs++
+			} else {
+				c.report.Files++
+				c.report.BytesReclaimed += info.Size()
+				c.ufs.forgetOrigins(p, false)
+			}
+		}
+		if removed {
+			remaining--
+		}
+	}
+	return remaining == 0, nil
+}
+
+// remove deletes p from the writable layer
+func (c *compactor) remove(p string) (bool, error) {
+	if err := c.top.fs.Remove(p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameAsLower reports whether removing p from the writable layer would
+// leave the merged view unchanged
+func (c *compactor) sameAsLower(p string, info os.FileInfo) (bool, error) {
+	if c.ufs.hasWhiteout(c.top, p) {
+		// The lower version is masked, so removing p would not reveal it
+		return false, nil
+	}
+	lowerInfo, err := c.lower.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if lowerInfo.Mode() != info.Mode() {
+		return false, nil
+	}
+
+	switch {
+	case info.IsDir():
+		return true, nil
+	case info.Mode()&os.ModeSymlink != 0:
+		upper, err := readlinkLayer(c.top.fs, p)
+		if err != nil {
+			return false, err
+		}
+		lower, err := c.lower.Readlink(p)
+		return err == nil && upper == lower, err
+	case info.Mode().IsRegular():
+		if lowerInfo.Size() != info.Size() {
+			return false, nil
+		}
+		return c.sameContents(p)
+	}
+	return false, nil
+}
+
+// sameContents compares the writable layer's copy of p with the lower one
+func (c *compactor) sameContents(p string) (bool, error) {
+	upper, err := c.top.fs.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer upper.Close()
+	lower, err := c.lower.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer lower.Close()
+
+	bufA := make([]byte, c.ufs.copyBufferSize)
+	bufB := make([]byte, c.ufs.copyBufferSize)
+	for {
+		n, errA := io.ReadFull(upper, bufA)
+		m, errB := io.ReadFull(lower, bufB)
+		if n != m || !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA && doneB, nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package unionfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveWhiteoutOnlyWhenNeeded(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/shared", []byte("base"), 0644)
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+
+	writeFile(ufs, "/scratch", []byte("new"), 0644)
+	if err := ufs.Remove("/scratch"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overlay.Stat("/.wh.scratch"); !os.IsNotExist(err) {
+		t.Errorf("whiteout created for overlay-only file: %v", err)
+	}
+
+	// A copied-up file still needs a whiteout for the lower version
+	writeFile(ufs, "/shared", []byte("changed"), 0644)
+	if err := ufs.Remove("/shared"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/shared"); !os.IsNotExist(err) {
+		t.Errorf("lower version reappeared: %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	writeFile(base, "/etc/removed", []byte("base"), 0644)
+	writeFile(base, "/var/lib/state", []byte("base"), 0644)
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+
+	// Copied up and restored: redundant
+	writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644)
+	writeFile(ufs, "/etc/app.conf", []byte("base"), 0644)
+	// Copied up and changed: kept
+	writeFile(ufs, "/etc/hosts", []byte("changed!"), 0644)
+	// Whiteout over a lower file: kept
+	ufs.Remove("/etc/removed")
+	// Whiteout and opaque marker masking nothing: redundant
+	writeFile(overlay, "/etc/.wh.ghost", nil, 0644)
+	writeFile(overlay, "/tmp/"+OpaqueWhiteout, nil, 0644)
+	writeFile(overlay, "/tmp/scratch", []byte("new"), 0644)
+	// Directory copied up by a chmod that was undone: redundant
+	ufs.Chmod("/var/lib", os.ModeDir|0700)
+	ufs.Chmod("/var/lib", os.ModeDir|0755)
+
+	before := snapshotView(t, ufs)
+	report, err := ufs.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CompactReport{Whiteouts: 1, OpaqueMarkers: 1, Files: 1, Dirs: 2, BytesReclaimed: 4}
+	if *report != want {
+		t.Errorf("report = %+v, want %+v", *report, want)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("view changed:\n got %v\nwant %v", got, before)
+	}
+
+	for _, p := range []string{"/etc/app.conf", "/etc/.wh.ghost", "/tmp/" + OpaqueWhiteout, "/var"} {
+		if _, err := overlay.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s not compacted: %v", p, err)
+		}
+	}
+	for _, p := range []string{"/etc/hosts", "/etc/.wh.removed", "/tmp/scratch"} {
+		if _, err := overlay.Stat(p); err != nil {
+			t.Errorf("%s removed: %v", p, err)
+		}
+	}
+
+	// A second pass finds nothing
+	if report, err := ufs.Compact(); err != nil || *report != (CompactReport{}) {
+		t.Errorf("second Compact = %+v, %v", report, err)
+	}
+}
+
+func TestCompactKeepsMaskedCopies(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/dir/file", []byte("base"), 0644)
+	writeFile(base, "/dir/other", []byte("base"), 0644)
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+
+	// The opaque directory hides /dir/other, so its identical copy of
+	// /dir/file is what keeps the file visible
+	writeFile(overlay, "/dir/"+OpaqueWhiteout, nil, 0644)
+	writeFile(overlay, "/dir/file", []byte("base"), 0644)
+
+	before := snapshotView(t, ufs)
+	if _, err := ufs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("view changed:\n got %v\nwant %v", got, before)
+	}
+}
+
+func TestCompactNoWritableLayer(t *testing.T) {
+	if _, err := New(WithReadOnlyLayer(mustNewMemFS())).Compact(); err != ErrNoWritableLayer {
+		t.Errorf("Compact = %v, want ErrNoWritableLayer", err)
+	}
+}
+
+func TestCompactBranches(t *testing.T) {
+	a, b, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/f", []byte("base"), 0644)
+	writeFile(a, "/f", []byte("base"), 0644)
+	writeFile(b, "/f", []byte("b"), 0644)
+	ufs := New(WithWritableLayer(a), WithWritableBranch(b), WithReadOnlyLayer(base))
+
+	// Branch b is not a lower layer of branch a, so the copy in a must not
+	// be judged against it
+	if _, err := ufs.Compact(); err != ErrMultipleBranches {
+		t.Errorf("Compact = %v, want ErrMultipleBranches", err)
+	}
+	if _, err := a.Stat("/f"); err != nil {
+		t.Errorf("branch a changed: %v", err)
+	}
+}
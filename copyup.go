@@ -1,19 +1,16 @@
 package unionfs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path"
 )
 
-// copyUp copies a file from a lower layer to the writable layer
-func (ufs *UnionFS) copyUp(path string, info os.FileInfo) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
-		return err
-	}
-
+// copyUp copies a file from the layer it is found in to layer
+func (ufs *UnionFS) copyUp(layer *Layer, path string, info os.FileInfo) error {
 	// Check if file already exists in writable layer
 	if _, err := layer.fs.Stat(path); err == nil {
 		// File already exists in writable layer, nothing to do
@@ -21,80 +18,107 @@ func (ufs *UnionFS) copyUp(path string, info os.FileInfo) error {
 	}
 
 	// Ensure parent directory exists
-	if err := ufs.ensureDir(path); err != nil {
+	if err := ufs.ensureDir(layer, path); err != nil {
 		return err
 	}
 
 	// Handle directories
 	if info.IsDir() {
-		return ufs.copyUpDir(path, info)
+		return ufs.copyUpDir(layer, path, info)
 	}
 
 	// Handle regular files
-	return ufs.copyUpFile(path, info)
+	return ufs.copyUpFile(layer, path, info)
 }
 
-// copyUpFile copies a regular file to the writable layer
-func (ufs *UnionFS) copyUpFile(path string, info os.FileInfo) error {
-	layer, err := ufs.getWritableLayer()
+// copyUpFile copies a regular file to layer
+func (ufs *UnionFS) copyUpFile(layer *Layer, path string, info os.FileInfo) error {
+	// Find the source file in the other layers
+	_, sourceLayer, err := ufs.findLayer(path)
 	if err != nil {
 		return err
 	}
+	if sourceLayer == layer {
+		// Already in the target layer
+		return nil
+	}
 
-	// Find the source file in lower layers
-	_, layerIdx, err := ufs.findFile(path)
-	if err != nil {
-		return err
+	// Content-addressed layers can reference the source's blob directly
+	digest := linkContent(layer, sourceLayer, ufs.layerName(sourceLayer, path), path, info)
+	if digest == "" {
+		if digest, err = ufs.copyFileContents(layer, sourceLayer, path, info); err != nil {
+			return err
+		}
 	}
+	ufs.recordOrigin(path, fileVersion{Mode: info.Mode(), Digest: digest})
 
-	if layerIdx == 0 {
-		// Already in writable layer
-		return nil
+	// Preserve file metadata
+	if err := layer.fs.Chmod(path, info.Mode()); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+
+	if err := layer.fs.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		// Non-fatal error
+		_ = err
 	}
 
-	sourceLayer := ufs.layers[layerIdx]
+	return nil
+}
 
+// copyFileContents copies the bytes of a file from sourceLayer to layer and
+// returns their content digest
+func (ufs *UnionFS) copyFileContents(layer, sourceLayer *Layer, path string, info os.FileInfo) (string, error) {
 	// Open source file
-	srcFile, err := sourceLayer.fs.Open(path)
+	srcFile, err := sourceLayer.fs.Open(ufs.layerName(sourceLayer, path))
 	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
+		return "", fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer srcFile.Close()
 
 	// Create destination file
 	dstFile, err := layer.fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return "", fmt.Errorf("failed to create destination file: %w", err)
 	}
-	defer dstFile.Close()
 
-	// Copy file contents
+	// Copy file contents, hashing them on the way
+	h := sha256.New()
 	buf := make([]byte, ufs.copyBufferSize)
-	if _, err := io.CopyBuffer(dstFile, srcFile, buf); err != nil {
-		return fmt.Errorf("failed to copy file contents: %w", err)
+	if _, err := io.CopyBuffer(dstFile, io.TeeReader(srcFile, h), buf); err != nil {
+		dstFile.Close()
+		return "", fmt.Errorf("failed to copy file contents: %w", err)
 	}
-
-	// Preserve file metadata
-	if err := layer.fs.Chmod(path, info.Mode()); err != nil {
-		return fmt.Errorf("failed to set file mode: %w", err)
-	}
-
-	if err := layer.fs.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
-		// Non-fatal error
-		_ = err
+	if err := dstFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close destination file: %w", err)
 	}
-
-	return nil
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// copyUpDir creates a directory in the writable layer
-func (ufs *UnionFS) copyUpDir(path string, info os.FileInfo) error {
-	layer, err := ufs.getWritableLayer()
+// linkContent points dst at the content of src when dst is a
+// content-addressed layer and src can report the file's digest. It returns
+// the digest, or "" if the content must be copied instead.
+func linkContent(dst, src *Layer, srcName, dstName string, info os.FileInfo) string {
+	linker, ok := dst.fs.(contentLinker)
+	if !ok {
+		return ""
+	}
+	digester, ok := src.fs.(Digester)
+	if !ok {
+		return ""
+	}
+	digest, err := digester.Digest(srcName)
 	if err != nil {
-		return err
+		return ""
 	}
+	if linker.LinkContent(dstName, digest, info.Mode()) != nil {
+		return ""
+	}
+	return digest
+}
 
-	// Create directory in writable layer
+// copyUpDir creates a directory in layer
+func (ufs *UnionFS) copyUpDir(layer *Layer, path string, info os.FileInfo) error {
+	// Create directory in the target layer
 	if err := layer.fs.MkdirAll(path, info.Mode()); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
@@ -112,30 +136,26 @@ func (ufs *UnionFS) copyUpDir(path string, info os.FileInfo) error {
 	return nil
 }
 
-// copyUpParents ensures all parent directories exist in the writable layer
-func (ufs *UnionFS) copyUpParents(p string) error {
+// copyUpParents ensures all parent directories exist in layer
+func (ufs *UnionFS) copyUpParents(layer *Layer, p string) error {
 	dir := path.Dir(p)
 	if dir == "/" || dir == "." {
 		return nil
 	}
 
 	// Check if parent directory exists in any layer
-	info, layerIdx, err := ufs.findFile(dir)
+	info, found, err := ufs.findLayer(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Parent doesn't exist, create it
-			layer, err := ufs.getWritableLayer()
-			if err != nil {
-				return err
-			}
 			return layer.fs.MkdirAll(dir, 0755)
 		}
 		return err
 	}
 
-	// If parent exists in a lower layer, copy it up
-	if layerIdx > 0 && info.IsDir() {
-		return ufs.copyUpDir(dir, info)
+	// If parent exists in another layer, copy it up
+	if found != layer && info.IsDir() {
+		return ufs.copyUpDir(layer, dir, info)
 	}
 
 	return nil
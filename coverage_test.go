@@ -1,9 +1,11 @@
 package unionfs
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path"
+	"syscall"
 	"testing"
 	"time"
 
@@ -1121,7 +1123,7 @@ func TestCopyUpDir(t *testing.T) {
 	info, _, _ := ufs.findFile("/testdir")
 
 	// Trigger copy-up of directory
-	err := ufs.copyUpDir("/testdir", info)
+	err := ufs.copyUpDir(ufs.writableLayer, "/testdir", info)
 	if err != nil {
 		t.Fatalf("copyUpDir failed: %v", err)
 	}
@@ -1151,7 +1153,7 @@ func TestCopyUpParents(t *testing.T) {
 	)
 
 	// Copy up parents for a deeply nested file
-	err := ufs.copyUpParents("/a/b/c/newfile.txt")
+	err := ufs.copyUpParents(ufs.writableLayer, "/a/b/c/newfile.txt")
 	if err != nil {
 		t.Fatalf("copyUpParents failed: %v", err)
 	}
@@ -1173,7 +1175,7 @@ func TestCopyUpParentsNonExistent(t *testing.T) {
 	)
 
 	// Copy up parents for path where parents don't exist
-	err := ufs.copyUpParents("/newdir/newfile.txt")
+	err := ufs.copyUpParents(ufs.writableLayer, "/newdir/newfile.txt")
 	if err != nil {
 		t.Fatalf("copyUpParents failed: %v", err)
 	}
@@ -1831,6 +1833,44 @@ func TestRemoveAllFromWritableLayer(t *testing.T) {
 	}
 }
 
+// TestRenameMergedDirectory tests that renaming a directory whose contents
+// span layers fails with EXDEV and leaves it in place
+func TestRenameMergedDirectory(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/dir/sub/lower.txt", []byte("lower"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+	)
+	writeFile(ufs, "/dir/upper.txt", []byte("upper"), 0644)
+
+	if err := ufs.Rename("/dir", "/dir/inside"); err == nil {
+		t.Error("expected error moving a directory into itself")
+	}
+	if err := ufs.Rename("/dir", "/moved"); !errors.Is(err, syscall.EXDEV) {
+		t.Fatalf("expected EXDEV, got %v", err)
+	}
+	for name, want := range map[string]string{"/dir/sub/lower.txt": "lower", "/dir/upper.txt": "upper"} {
+		if got, err := readFile(ufs, name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	if _, err := ufs.Stat("/moved"); !os.IsNotExist(err) {
+		t.Errorf("/moved: expected not to exist, got %v", err)
+	}
+
+	// Directories only in the writable layer are renamed in place
+	writeFile(ufs, "/new/file.txt", []byte("new"), 0644)
+	if err := ufs.Rename("/new", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFile(ufs, "/moved/file.txt"); err != nil || string(got) != "new" {
+		t.Errorf("/moved/file.txt: got %q, %v", got, err)
+	}
+}
+
 // TestRenameInWritableLayer tests renaming a file within writable layer only
 func TestRenameInWritableLayer(t *testing.T) {
 	overlay := mustNewMemFS()
@@ -1945,7 +1985,7 @@ func TestCopyUpFileAlreadyInWritable(t *testing.T) {
 
 	// Try to copy up - should be no-op
 	info, _, _ := ufs.findFile("/test.txt")
-	err := ufs.copyUpFile("/test.txt", info)
+	err := ufs.copyUpFile(ufs.writableLayer, "/test.txt", info)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1966,7 +2006,7 @@ func TestCopyUpAlreadyInWritable(t *testing.T) {
 
 	// Try to copy up - should be no-op
 	info, _, _ := ufs.findFile("/test.txt")
-	err := ufs.copyUp("/test.txt", info)
+	err := ufs.copyUp(ufs.writableLayer, "/test.txt", info)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2220,6 +2260,26 @@ func TestOpenFileNonExistent(t *testing.T) {
 	}
 }
 
+// TestOpenFileExclusiveLowerFile tests that O_EXCL sees lower layer files
+func TestOpenFileExclusiveLowerFile(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/file.txt", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+	)
+
+	_, err := ufs.OpenFile("/file.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if !os.IsExist(err) {
+		t.Errorf("expected exist error, got %v", err)
+	}
+	if got, _ := readFile(ufs, "/file.txt"); string(got) != "base" {
+		t.Errorf("expected lower file untouched, got %q", got)
+	}
+}
+
 // TestReaddirError tests Readdir error propagation
 func TestReaddirError(t *testing.T) {
 	overlay := mustNewMemFS()
@@ -5,30 +5,28 @@ import (
 	"io/fs"
 	"os"
 	"path"
-	"sort"
-	"strings"
 
 	"github.com/absfs/absfs"
 )
 
-// unionDir implements absfs.File for directories, merging contents across layers
+// unionDir implements absfs.File for directories, merging contents across
+// layers as a stream so that layers implementing SortedLister are never
+// fully loaded
 type unionDir struct {
-	ufs        *UnionFS
-	path       string
-	entries    []os.FileInfo
-	offset     int
-	baseLayer  absfs.FileSystem
-	layerIdx   int
-	closed     bool
+	ufs       *UnionFS
+	path      string
+	merger    *dirMerger // opened on first read
+	offset    int        // number of entries consumed from the merger
+	baseLayer absfs.FileSystem
+	closed    bool
 }
 
 // newUnionDir creates a new union directory
-func newUnionDir(ufs *UnionFS, path string, baseLayer absfs.FileSystem, layerIdx int) (*unionDir, error) {
+func newUnionDir(ufs *UnionFS, path string, baseLayer absfs.FileSystem) (*unionDir, error) {
 	return &unionDir{
 		ufs:       ufs,
 		path:      path,
 		baseLayer: baseLayer,
-		layerIdx:  layerIdx,
 		offset:    0,
 		closed:    false,
 	}, nil
@@ -36,6 +34,10 @@ func newUnionDir(ufs *UnionFS, path string, baseLayer absfs.FileSystem, layerIdx
 
 // Close closes the directory
 func (d *unionDir) Close() error {
+	if d.merger != nil {
+		d.merger.close()
+		d.merger = nil
+	}
 	d.closed = true
 	return nil
 }
@@ -56,27 +58,70 @@ func (d *unionDir) Seek(offset int64, whence int) (int64, error) {
 		return 0, os.ErrClosed
 	}
 
+	var target int
 	switch whence {
 	case io.SeekStart:
-		d.offset = int(offset)
+		target = int(offset)
 	case io.SeekCurrent:
-		d.offset += int(offset)
+		target = d.offset + int(offset)
 	case io.SeekEnd:
-		if d.entries == nil {
-			if err := d.loadEntries(); err != nil {
-				return 0, err
-			}
+		// Count the remaining entries to find the end
+		for d.next() != nil {
 		}
-		d.offset = len(d.entries) + int(offset)
+		target = d.offset + int(offset)
+	default:
+		target = d.offset
+	}
+
+	if target < 0 {
+		target = 0
 	}
 
-	if d.offset < 0 {
-		d.offset = 0
+	// Streams only move forward; restart to go back
+	if target < d.offset {
+		d.reset()
+	}
+	for d.offset < target && d.next() != nil {
 	}
+	d.offset = target
 
 	return int64(d.offset), nil
 }
 
+// next returns the next merged entry, opening the stream if needed
+func (d *unionDir) next() os.FileInfo {
+	if d.merger == nil {
+		d.merger = d.ufs.newDirMerger(d.path)
+	}
+	info := d.merger.next()
+	if info != nil {
+		d.offset++
+	}
+	return info
+}
+
+// reset rewinds the listing to the first entry
+func (d *unionDir) reset() {
+	if d.merger != nil {
+		d.merger.close()
+		d.merger = nil
+	}
+	d.offset = 0
+}
+
+// readEntries returns up to count entries, or all remaining if count <= 0
+func (d *unionDir) readEntries(count int) []os.FileInfo {
+	var result []os.FileInfo
+	for count <= 0 || len(result) < count {
+		info := d.next()
+		if info == nil {
+			break
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
 // Write is not supported for directories
 func (d *unionDir) Write(p []byte) (n int, err error) {
 	return 0, os.ErrInvalid
@@ -98,32 +143,7 @@ func (d *unionDir) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, os.ErrClosed
 	}
 
-	if d.entries == nil {
-		if err := d.loadEntries(); err != nil {
-			return nil, err
-		}
-	}
-
-	if d.offset >= len(d.entries) {
-		if count > 0 {
-			return nil, io.EOF
-		}
-		return nil, nil
-	}
-
-	var end int
-	if count <= 0 {
-		end = len(d.entries)
-	} else {
-		end = d.offset + count
-		if end > len(d.entries) {
-			end = len(d.entries)
-		}
-	}
-
-	result := d.entries[d.offset:end]
-	d.offset = end
-
+	result := d.readEntries(count)
 	if count > 0 && len(result) == 0 {
 		return nil, io.EOF
 	}
@@ -179,129 +199,16 @@ func (d *unionDir) ReadDir(n int) ([]fs.DirEntry, error) {
 		return nil, os.ErrClosed
 	}
 
-	if d.entries == nil {
-		if err := d.loadEntries(); err != nil {
-			return nil, err
-		}
-	}
-
-	if d.offset >= len(d.entries) {
-		if n > 0 {
-			return nil, io.EOF
-		}
-		return nil, nil
-	}
-
-	var end int
-	if n <= 0 {
-		end = len(d.entries)
-	} else {
-		end = d.offset + n
-		if end > len(d.entries) {
-			end = len(d.entries)
-		}
+	infos := d.readEntries(n)
+	if n > 0 && len(infos) == 0 {
+		return nil, io.EOF
 	}
 
 	// Convert FileInfo entries to DirEntry
-	result := make([]fs.DirEntry, end-d.offset)
-	for i := d.offset; i < end; i++ {
-		result[i-d.offset] = fs.FileInfoToDirEntry(d.entries[i])
-	}
-	d.offset = end
-
-	if n > 0 && len(result) == 0 {
-		return nil, io.EOF
+	result := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		result[i] = fs.FileInfoToDirEntry(info)
 	}
 
 	return result, nil
 }
-
-// loadEntries loads and merges directory entries from all layers
-func (d *unionDir) loadEntries() error {
-	seen := make(map[string]bool)
-	whiteouts := make(map[string]bool)
-	var entries []os.FileInfo
-
-	d.ufs.mu.RLock()
-	defer d.ufs.mu.RUnlock()
-
-	// Check for opaque directory whiteout in upper layers
-	isOpaque := false
-	for i := 0; i < len(d.ufs.layers); i++ {
-		layer := d.ufs.layers[i]
-		opaquePath := path.Join(d.path, OpaqueWhiteout)
-		if _, err := layer.fs.Stat(opaquePath); err == nil {
-			isOpaque = true
-			break
-		}
-	}
-
-	// Iterate through all layers
-	for i := 0; i < len(d.ufs.layers); i++ {
-		// If we found an opaque whiteout, stop processing lower layers
-		if isOpaque && i > 0 {
-			break
-		}
-
-		layer := d.ufs.layers[i]
-
-		// Try to read directory from this layer
-		dir, err := layer.fs.Open(d.path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-			// Skip layers with errors
-			continue
-		}
-
-		// Read all entries from this layer
-		layerEntries, err := dir.Readdir(-1)
-		dir.Close()
-
-		if err != nil {
-			continue
-		}
-
-		// Process entries from this layer
-		for _, entry := range layerEntries {
-			name := entry.Name()
-
-			// Check if this is a whiteout file
-			if isWhiteout(name) {
-				// Mark the original file as whited out
-				if original, ok := originalPath(path.Join(d.path, name)); ok {
-					whiteouts[path.Base(original)] = true
-				}
-				continue
-			}
-
-			// Skip opaque whiteout markers
-			if isOpaqueWhiteout(name) {
-				continue
-			}
-
-			// Skip if already seen in upper layer
-			if seen[name] {
-				continue
-			}
-
-			// Skip if whited out
-			if whiteouts[name] {
-				continue
-			}
-
-			// Add entry
-			seen[name] = true
-			entries = append(entries, entry)
-		}
-	}
-
-	// Sort entries by name
-	sort.Slice(entries, func(i, j int) bool {
-		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
-	})
-
-	d.entries = entries
-	return nil
-}
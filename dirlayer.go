@@ -0,0 +1,226 @@
+package unionfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// NewDirLayer returns a writable layer backed by the host directory root.
+// Paths are confined to root, but symlinks stored in the layer are
+// followed by the host, so targets should be relative. The layer implements
+// SpaceReporter on Linux.
+//
+// Example:
+//
+//	upper, err := unionfs.NewDirLayer("/var/lib/app/upper")
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(upper),
+//	    unionfs.WithReadOnlyFSLayer(os.DirFS("/var/lib/app/base")),
+//	)
+func NewDirLayer(root string) (absfs.FileSystem, error) {
+	return newDirLayer(root, false)
+}
+
+// newDirLayer backs a layer with the host directory root. A read-only layer
+// fails every mutating method with ErrReadOnlyLayer, but unlike os.DirFS
+// it keeps Lstat and Readlink, so symlinks are not followed.
+func newDirLayer(root string, readOnly bool) (absfs.FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: root, Err: errors.New("not a directory")}
+	}
+	fs := absfs.ExtendFiler(&dirLayer{root: root, readOnly: readOnly}).(absfs.SymlinkFileSystem)
+	return &dirLayerFS{SymlinkFileSystem: fs, root: root}, nil
+}
+
+// dirLayerFS is the filesystem of a directory layer. It reports the space
+// of the host filesystem, for the free-space create policies.
+type dirLayerFS struct {
+	absfs.SymlinkFileSystem
+	root string
+}
+
+// Ensure dirLayerFS implements SpaceReporter at compile time
+var _ SpaceReporter = (*dirLayerFS)(nil)
+
+// Space implements SpaceReporter
+func (d *dirLayerFS) Space() (free, used uint64, err error) {
+	return hostSpace(d.root)
+}
+
+// dirLayer implements absfs.Filer and the symlink methods over a host
+// directory
+type dirLayer struct {
+	root     string
+	readOnly bool
+}
+
+// Ensure dirLayer implements absfs.Filer and absfs.SymLinker at compile time
+var (
+	_ absfs.Filer     = (*dirLayer)(nil)
+	_ absfs.SymLinker = (*dirLayer)(nil)
+)
+
+// host maps a layer path to a path under the root. Cleaning the path as an
+// absolute one keeps ".." from escaping the root.
+func (d *dirLayer) host(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// pathErr reports errors with the layer path instead of the host path
+func pathErr(err error, name string) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return &os.PathError{Op: pe.Op, Path: name, Err: pe.Err}
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return &os.LinkError{Op: le.Op, Old: le.Old, New: name, Err: le.Err}
+	}
+	return err
+}
+
+// OpenFile implements absfs.Filer
+func (d *dirLayer) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if d.readOnly && flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, readOnly("open", name)
+	}
+	f, err := os.OpenFile(d.host(name), flag, perm)
+	if err != nil {
+		return nil, pathErr(err, name)
+	}
+	return &dirLayerFile{File: f, name: name}, nil
+}
+
+// Mkdir implements absfs.Filer
+func (d *dirLayer) Mkdir(name string, perm os.FileMode) error {
+	if d.readOnly {
+		return readOnly("mkdir", name)
+	}
+	return pathErr(os.Mkdir(d.host(name), perm), name)
+}
+
+// Remove implements absfs.Filer
+func (d *dirLayer) Remove(name string) error {
+	if d.readOnly {
+		return readOnly("remove", name)
+	}
+	return pathErr(os.Remove(d.host(name)), name)
+}
+
+// Rename implements absfs.Filer
+func (d *dirLayer) Rename(oldpath, newpath string) error {
+	if d.readOnly {
+		return readOnly("rename", oldpath)
+	}
+	if err := os.Rename(d.host(oldpath), d.host(newpath)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.Unwrap(err)}
+	}
+	return nil
+}
+
+// Stat implements absfs.Filer
+func (d *dirLayer) Stat(name string) (os.FileInfo, error) {
+	info, err := os.Stat(d.host(name))
+	return info, pathErr(err, name)
+}
+
+// Chmod implements absfs.Filer
+func (d *dirLayer) Chmod(name string, mode os.FileMode) error {
+	if d.readOnly {
+		return readOnly("chmod", name)
+	}
+	return pathErr(os.Chmod(d.host(name), mode), name)
+}
+
+// Chtimes implements absfs.Filer
+func (d *dirLayer) Chtimes(name string, atime, mtime time.Time) error {
+	if d.readOnly {
+		return readOnly("chtimes", name)
+	}
+	return pathErr(os.Chtimes(d.host(name), atime, mtime), name)
+}
+
+// Chown implements absfs.Filer
+func (d *dirLayer) Chown(name string, uid, gid int) error {
+	if d.readOnly {
+		return readOnly("chown", name)
+	}
+	return pathErr(os.Chown(d.host(name), uid, gid), name)
+}
+
+// ReadDir implements absfs.Filer
+func (d *dirLayer) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := os.ReadDir(d.host(name))
+	return entries, pathErr(err, name)
+}
+
+// ReadFile implements absfs.Filer
+func (d *dirLayer) ReadFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(d.host(name))
+	return data, pathErr(err, name)
+}
+
+// Sub implements absfs.Filer
+func (d *dirLayer) Sub(dir string) (fs.FS, error) {
+	info, err := d.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "sub", Path: dir, Err: errors.New("not a directory")}
+	}
+	return os.DirFS(d.host(dir)), nil
+}
+
+// Lstat implements absfs.SymLinker
+func (d *dirLayer) Lstat(name string) (os.FileInfo, error) {
+	info, err := os.Lstat(d.host(name))
+	return info, pathErr(err, name)
+}
+
+// Lchown implements absfs.SymLinker
+func (d *dirLayer) Lchown(name string, uid, gid int) error {
+	if d.readOnly {
+		return readOnly("lchown", name)
+	}
+	return pathErr(os.Lchown(d.host(name), uid, gid), name)
+}
+
+// Readlink implements absfs.SymLinker
+func (d *dirLayer) Readlink(name string) (string, error) {
+	target, err := os.Readlink(d.host(name))
+	return filepath.ToSlash(target), pathErr(err, name)
+}
+
+// Symlink implements absfs.SymLinker
+func (d *dirLayer) Symlink(oldname, newname string) error {
+	if d.readOnly {
+		return readOnly("symlink", newname)
+	}
+	return pathErr(os.Symlink(filepath.FromSlash(oldname), d.host(newname)), newname)
+}
+
+// dirLayerFile is an open host file that reports its layer path as its name
+type dirLayerFile struct {
+	*os.File
+	name string
+}
+
+// Name returns the file's path within the layer
+func (f *dirLayerFile) Name() string {
+	return f.name
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package unionfs
+
+import "syscall"
+
+// hostSpace returns the bytes available to unprivileged users and the
+// bytes in use on the filesystem holding root
+func hostSpace(root string) (free, used uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return st.Bavail * bsize, (st.Blocks - st.Bfree) * bsize, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package unionfs
+
+import "errors"
+
+// hostSpace is only available on Linux; elsewhere directory layers are
+// skipped by the free-space create policies
+func hostSpace(root string) (free, used uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,142 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestDirLayer(t *testing.T) {
+	root := t.TempDir()
+	upper, err := NewDirLayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	ufs := New(WithWritableLayer(upper), WithReadOnlyLayer(base))
+
+	if err := writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Symlink("app.conf", "/etc/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes land in the host directory
+	if data, err := os.ReadFile(filepath.Join(root, "etc", "app.conf")); err != nil || string(data) != "changed" {
+		t.Errorf("host app.conf = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc", ".wh.hosts")); err != nil {
+		t.Errorf("host whiteout: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "etc", "link")); err != nil || target != "app.conf" {
+		t.Errorf("host link = %q, %v", target, err)
+	}
+
+	got := snapshotView(t, ufs)
+	want := map[string]string{"/etc": "<dir>", "/etc/app.conf": "changed", "/etc/link": "changed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("view:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestDirLayerConfined(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "layer")
+	os.Mkdir(root, 0755)
+	layer, err := NewDirLayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := layer.Create("/../../escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := f.Name(); name != "/../../escape" {
+		t.Errorf("Name() = %q", name)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(root, "escape")); err != nil {
+		t.Errorf("file not created inside root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+		t.Errorf("file escaped the root: %v", err)
+	}
+
+	if _, err := layer.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/missing) = %v", err)
+	} else if pe, ok := err.(*os.PathError); !ok || pe.Path != "/missing" {
+		t.Errorf("error path = %v", err)
+	}
+	if _, ok := layer.(absfs.SymLinker); !ok {
+		t.Error("dir layer does not support symlinks")
+	}
+	if _, err := NewDirLayer(filepath.Join(parent, "nope")); err == nil {
+		t.Error("NewDirLayer of missing directory succeeded")
+	}
+}
+
+func TestDirLayerSpace(t *testing.T) {
+	upper, err := NewDirLayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter, ok := upper.(SpaceReporter)
+	if !ok {
+		t.Fatal("directory layer does not report space")
+	}
+	free, used, err := reporter.Space()
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("space reporting unsupported on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free == 0 && used == 0 {
+		t.Error("expected non-zero space figures")
+	}
+}
+
+func TestDirLayerReadOnly(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	if err := os.Symlink(".", filepath.Join(root, "self")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	layer, err := newDirLayer(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := layer.Create("/b.txt"); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Create: expected ErrReadOnlyLayer, got %v", err)
+	}
+	if err := layer.Remove("/a.txt"); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Remove: expected ErrReadOnlyLayer, got %v", err)
+	}
+	if err := layer.Chmod("/a.txt", 0600); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Chmod: expected ErrReadOnlyLayer, got %v", err)
+	}
+	if data, err := layer.ReadFile("/a.txt"); err != nil || string(data) != "a" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+
+	// Symlinks are reported, not followed
+	linker := layer.(absfs.SymlinkFileSystem)
+	if info, err := linker.Lstat("/self"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat /self = %v, %v", info, err)
+	}
+	if target, err := linker.Readlink("/self"); err != nil || target != "." {
+		t.Errorf("Readlink /self = %q, %v", target, err)
+	}
+}
@@ -0,0 +1,341 @@
+package unionfs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// dirBatchSize is the number of entries read from a layer at a time while
+// streaming a merged directory
+const dirBatchSize = 256
+
+// SortedLister is implemented by layer filesystems whose directory handles
+// return Readdir results in byte-wise name order. Directories in such layers
+// are merged as a stream with bounded memory. Other layers, including memfs
+// and operating system directories, are read in full when a merged listing
+// starts, so memory grows with the size of their directories.
+type SortedLister interface {
+	SortedReaddir() bool
+}
+
+// isSortedLayer reports whether a layer lists directories in name order
+func isSortedLayer(fs absfs.FileSystem) bool {
+	s, ok := fs.(SortedLister)
+	return ok && s.SortedReaddir()
+}
+
+// listsInOrder reports whether a layer's full listings come in name order.
+// memfs keeps directories sorted but copies the whole directory on every
+// Readdir(n) call, so it is read in one pass, without sorting, rather than
+// streamed.
+func listsInOrder(fs absfs.FileSystem) bool {
+	_, ok := fs.(*memfs.FileSystem)
+	return ok || isSortedLayer(fs)
+}
+
+// layerCursor yields the entries of one layer's directory, in name order
+// when the merge is sorted
+type layerCursor struct {
+	idx       int        // layer index in the stack captured when the merge started
+	dir       absfs.File // open handle while entries remain to be read
+	buf       []os.FileInfo
+	pos       int
+	ordered   bool            // entries are streamed in byte-wise name order
+	whiteouts map[string]bool // names hidden by the markers read so far
+}
+
+// newLayerCursor opens p in layer. If less is non-nil and the layer cannot
+// stream in that order, the layer is read in full, and sorted unless inOrder
+// says it already is. It returns nil if the layer does not have the
+// directory or cannot read it.
+func newLayerCursor(layer *Layer, idx int, p string, less func(a, b string) bool, streamable, inOrder bool) *layerCursor {
+	dir, err := layer.fs.Open(p)
+	if err != nil {
+		return nil
+	}
+
+	c := &layerCursor{idx: idx, dir: dir, ordered: less != nil && streamable, whiteouts: make(map[string]bool)}
+	if less != nil && !streamable {
+		// Other layers are loaded up front
+		infos, err := dir.Readdir(-1)
+		c.close()
+		if err != nil {
+			return nil
+		}
+		if !inOrder {
+			sort.Slice(infos, func(i, j int) bool { return less(infos[i].Name(), infos[j].Name()) })
+		}
+		for _, info := range infos {
+			c.record(info.Name())
+		}
+		c.buf = infos
+	}
+	return c
+}
+
+// record notes the name hidden by name if it is a whiteout marker
+func (c *layerCursor) record(name string) {
+	if original, ok := strings.CutPrefix(name, WhiteoutPrefix); ok && name != OpaqueWhiteout {
+		c.whiteouts[original] = true
+	}
+}
+
+// read reports whether every marker for name has been seen: the layer is
+// read in full, or streamed in name order past the marker's position
+func (c *layerCursor) read(marker string) bool {
+	if c.dir == nil {
+		return true
+	}
+	if !c.ordered {
+		return false
+	}
+	info := c.head()
+	return info == nil || info.Name() > marker
+}
+
+// head returns the current entry, reading the next batch if needed. It
+// returns nil once the layer is exhausted.
+func (c *layerCursor) head() os.FileInfo {
+	for c.pos >= len(c.buf) {
+		if c.dir == nil {
+			return nil
+		}
+		batch, err := c.dir.Readdir(dirBatchSize)
+		if len(batch) == 0 || err != nil {
+			// Read errors end the layer, matching how merges skip failing layers
+			c.close()
+		}
+		c.buf, c.pos = batch, 0
+	}
+	return c.buf[c.pos]
+}
+
+// skipMarkers advances past whiteout markers, which are never listed, and
+// returns the new head
+func (c *layerCursor) skipMarkers() os.FileInfo {
+	info := c.head()
+	for info != nil && isWhiteout(info.Name()) {
+		c.record(info.Name())
+		c.pos++
+		info = c.head()
+	}
+	return info
+}
+
+// close releases the layer's directory handle
+func (c *layerCursor) close() {
+	if c.dir != nil {
+		c.dir.Close()
+		c.dir = nil
+	}
+}
+
+// dirMerger merges per-layer directory streams into one deduplicated stream
+// with whiteouts applied. Sorted listings are produced by a k-way merge over
+// per-layer sorted cursors; OrderLayer listings drain the layers one after
+// another. Either way at most one batch per layer is held in memory, except
+// for layers that are read up front. Whiteouts are collected from the
+// listings as they are read.
+type dirMerger struct {
+	ufs      *UnionFS
+	path     string
+	layers   []*Layer // layer stack captured when the merge started
+	cursors  []*layerCursor
+	byLayer  []*layerCursor         // cursor of each layer, nil if it lacks the directory
+	less     func(a, b string) bool // merge order; nil drains layers in order
+	keyLess  func(a, b string) bool // order of match keys, consistent with less
+	current  int                    // cursor being drained in layer order
+	sorted   []os.FileInfo          // fully sorted output, when streaming is impossible
+	buffered bool
+	newest   int // leading layers whose newest copy of a file wins, for SearchNewest
+}
+
+// newDirMerger starts a merged listing of directory p
+func (ufs *UnionFS) newDirMerger(p string) *dirMerger {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	m := &dirMerger{
+		ufs:    ufs,
+		path:   p,
+		layers: append([]*Layer(nil), ufs.layers...),
+		less:   ufs.dirLess(),
+	}
+	if ufs.searchPolicy == SearchNewest {
+		m.newest = len(ufs.branches())
+	}
+
+	// Case-insensitive merges must visit names that differ only in case
+	// together, so they run in case-folded order and are re-sorted if the
+	// requested order differs
+	byName := m.less != nil && ufs.dirOrdering == OrderByName
+	if ufs.caseInsensitive && m.less != nil {
+		m.less = caseFoldedLess
+		m.keyLess = func(a, b string) bool { return strings.ToLower(a) < strings.ToLower(b) }
+	} else {
+		m.keyLess = m.less
+	}
+
+	// Layers below an opaque marker or a whiteout for p do not contribute
+	layerCount := ufs.listedLayers(p)
+
+	m.byLayer = make([]*layerCursor, layerCount)
+	ufs.forEachLayer(layerCount, func(i int) {
+		layer := m.layers[i]
+		inOrder := byName && !ufs.caseInsensitive && listsInOrder(layer.fs)
+		streamable := inOrder && isSortedLayer(layer.fs)
+		m.byLayer[i] = newLayerCursor(layer, i, ufs.layerName(layer, p), m.less, streamable, inOrder)
+	})
+	for _, c := range m.byLayer {
+		if c != nil {
+			m.cursors = append(m.cursors, c)
+		}
+	}
+
+	if ufs.caseInsensitive && byName {
+		m.buffered = true
+	}
+	return m
+}
+
+// next returns the next visible entry, or nil when the listing is exhausted
+func (m *dirMerger) next() os.FileInfo {
+	if m.buffered {
+		// Collect the case-folded merge once, then serve it in name order
+		for info := m.nextSorted(); info != nil; info = m.nextSorted() {
+			m.sorted = append(m.sorted, info)
+		}
+		sort.Slice(m.sorted, func(i, j int) bool { return m.sorted[i].Name() < m.sorted[j].Name() })
+		m.buffered = false
+	}
+	if m.sorted != nil {
+		if len(m.sorted) == 0 {
+			return nil
+		}
+		info := m.sorted[0]
+		m.sorted = m.sorted[1:]
+		return info
+	}
+	if m.less == nil {
+		return m.nextInLayerOrder()
+	}
+	return m.nextSorted()
+}
+
+// nextSorted returns the next entry of the k-way merge
+func (m *dirMerger) nextSorted() os.FileInfo {
+	for {
+		// Find the smallest name among the layer heads. Cursors are ordered
+		// by layer, so the first match is the one with highest precedence.
+		var winner *layerCursor
+		var winnerInfo os.FileInfo
+		for _, c := range m.cursors {
+			info := c.skipMarkers()
+			if info == nil {
+				continue
+			}
+			if winner == nil || m.keyLess(info.Name(), winnerInfo.Name()) {
+				winner, winnerInfo = c, info
+			}
+		}
+		if winner == nil {
+			return nil
+		}
+
+		// Consume the name from every layer that has it
+		key := m.ufs.nameKey(winnerInfo.Name())
+		for _, c := range m.cursors {
+			for info := c.skipMarkers(); info != nil && m.ufs.nameKey(info.Name()) == key; info = c.skipMarkers() {
+				if m.newerBranchCopy(c, info, winner, winnerInfo) {
+					winner, winnerInfo = c, info
+				}
+				c.pos++
+			}
+		}
+
+		if m.whitedOut(path.Join(m.path, winnerInfo.Name()), winner.idx) {
+			continue
+		}
+		return winnerInfo
+	}
+}
+
+// newerBranchCopy reports whether info, listed by cursor c, is a newer copy
+// of the file winner lists that SearchNewest prefers
+func (m *dirMerger) newerBranchCopy(c *layerCursor, info os.FileInfo, winner *layerCursor, winnerInfo os.FileInfo) bool {
+	if c.idx <= winner.idx || c.idx >= m.newest || info.IsDir() || winnerInfo.IsDir() {
+		return false
+	}
+	if !info.ModTime().After(winnerInfo.ModTime()) {
+		return false
+	}
+	return !m.whitedOut(path.Join(m.path, info.Name()), c.idx)
+}
+
+// nextInLayerOrder returns the next entry when listing in layer order. An
+// entry is shown by the topmost layer that has it, so entries of lower
+// layers are checked against the layers above.
+func (m *dirMerger) nextInLayerOrder() os.FileInfo {
+	for m.current < len(m.cursors) {
+		c := m.cursors[m.current]
+		info := c.skipMarkers()
+		if info == nil {
+			m.current++
+			continue
+		}
+		c.pos++
+
+		p := path.Join(m.path, info.Name())
+		if m.shadowed(p, c.idx) || m.whitedOut(p, c.idx) {
+			continue
+		}
+		return info
+	}
+	return nil
+}
+
+// shadowed reports whether a layer above idx also has p
+func (m *dirMerger) shadowed(p string, idx int) bool {
+	for i := 0; i < idx; i++ {
+		if _, err := m.ufs.statLayer(m.layers[i], p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// whitedOut reports whether p is hidden by a whiteout above layer idx.
+// Markers for the directory's entries are looked up in the listings; only
+// markers the listing has not reached yet, or any in case-insensitive mode,
+// need a Stat.
+func (m *dirMerger) whitedOut(p string, idx int) bool {
+	name := path.Base(p)
+	for i := 0; i < idx; i++ {
+		c := m.byLayer[i]
+		switch {
+		case c == nil:
+			// A layer without the directory has no markers in it
+		case c.whiteouts[name]:
+			return true
+		case m.ufs.caseInsensitive || !c.read(WhiteoutPrefix+name):
+			if _, err := m.ufs.statLayer(m.layers[i], whiteoutPath(p)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// close releases all layer handles
+func (m *dirMerger) close() {
+	for _, c := range m.cursors {
+		c.close()
+	}
+	m.cursors = nil
+	m.sorted = nil
+}
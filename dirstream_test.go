@@ -0,0 +1,213 @@
+package unionfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// sortedFS marks a memfs layer as listing in name order and counts the
+// directory entries read through it
+type sortedFS struct {
+	absfs.FileSystem
+	read *int
+}
+
+func (s *sortedFS) SortedReaddir() bool { return true }
+
+func (s *sortedFS) Open(name string) (absfs.File, error) {
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingDir{File: f, read: s.read}, nil
+}
+
+// countingDir counts entries returned by Readdir
+type countingDir struct {
+	absfs.File
+	read *int
+}
+
+func (d *countingDir) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(n)
+	*d.read += len(infos)
+	return infos, err
+}
+
+// TestStreamingReaddirBounded tests that a partial read does not load the whole directory
+func TestStreamingReaddirBounded(t *testing.T) {
+	base := mustNewMemFS()
+	base.MkdirAll("/big", 0755)
+	for i := 0; i < 5000; i++ {
+		f, _ := base.Create(fmt.Sprintf("/big/file%05d", i))
+		f.Close()
+	}
+
+	read := 0
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(&sortedFS{FileSystem: base, read: &read}),
+	)
+
+	dir, err := ufs.Open("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	infos, err := dir.Readdir(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 100 || infos[0].Name() != "file00000" || infos[99].Name() != "file00099" {
+		t.Fatalf("unexpected first batch: %d entries", len(infos))
+	}
+	if read > 2*dirBatchSize {
+		t.Errorf("read %d entries from layer for a batch of 100", read)
+	}
+
+	// The rest of the stream continues in order
+	infos, err = dir.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 4900 || infos[0].Name() != "file00100" {
+		t.Errorf("unexpected remainder: %d entries", len(infos))
+	}
+}
+
+// TestStreamingMergeWhiteoutsAndDedup tests merging sorted and unsorted layers
+func TestStreamingMergeWhiteoutsAndDedup(t *testing.T) {
+	overlay := mustNewMemFS()
+	middle := mustNewMemFS()
+	base := mustNewMemFS()
+
+	writeFile(base, "/dir/a", []byte("base"), 0644)
+	writeFile(base, "/dir/b", []byte("base"), 0644)
+	writeFile(base, "/dir/c", []byte("base"), 0644)
+	writeFile(base, "/dir/e", []byte("base"), 0644)
+	writeFile(middle, "/dir/a", []byte("middle"), 0644)
+	writeFile(middle, "/dir/.wh.b", nil, 0644)
+	writeFile(middle, "/dir/d", []byte("middle"), 0644)
+	writeFile(overlay, "/dir/.wh.e", nil, 0644)
+	writeFile(overlay, "/dir/B", []byte("overlay"), 0644)
+
+	read := 0
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(&sortedFS{FileSystem: middle, read: &read}),
+		WithReadOnlyLayer(base),
+	)
+
+	dir, err := ufs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, batch...)
+	}
+
+	want := []string{"B", "a", "c", "d"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	// The visible "a" comes from the middle layer
+	info, _, err := ufs.findFile("/dir/a")
+	if err != nil || info.Size() != int64(len("middle")) {
+		t.Errorf("expected middle layer copy of /dir/a")
+	}
+}
+
+// statCountFS counts Stat calls made on a layer
+type statCountFS struct {
+	absfs.FileSystem
+	stats *int
+}
+
+func (s *statCountFS) Stat(name string) (os.FileInfo, error) {
+	*s.stats++
+	return s.FileSystem.Stat(name)
+}
+
+// TestStreamingWhiteoutsFromListing tests that whiteouts are taken from the
+// upper layers' listings instead of a Stat per entry
+func TestStreamingWhiteoutsFromListing(t *testing.T) {
+	overlay, middle, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	base.MkdirAll("/dir", 0755)
+	for i := 0; i < 1000; i++ {
+		f, _ := base.Create(fmt.Sprintf("/dir/file%04d", i))
+		f.Close()
+	}
+	// "-early" sorts before the whiteout prefix, so its marker is read late
+	writeFile(base, "/dir/-early", nil, 0644)
+	writeFile(middle, "/dir/.wh.-early", nil, 0644)
+	writeFile(middle, "/dir/.wh.file0001", nil, 0644)
+	writeFile(overlay, "/dir/.wh.file0002", nil, 0644)
+
+	stats, read := 0, 0
+	ufs := New(
+		WithWritableLayer(&statCountFS{FileSystem: overlay, stats: &stats}),
+		WithReadOnlyLayer(&sortedFS{FileSystem: &statCountFS{FileSystem: middle, stats: &stats}, read: &read}),
+		WithReadOnlyLayer(base),
+	)
+
+	dir, err := ufs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 998 || names[0] != "file0000" || names[1] != "file0003" {
+		t.Errorf("got %d entries starting %v", len(names), names[:2])
+	}
+	if stats > 20 {
+		t.Errorf("%d Stat calls for listing 1000 entries", stats)
+	}
+}
+
+// TestStreamingSeekRestart tests seeking backwards restarts the stream
+func TestStreamingSeekRestart(t *testing.T) {
+	base := mustNewMemFS()
+	for _, n := range []string{"a", "b", "c", "d"} {
+		writeFile(base, "/dir/"+n, nil, 0644)
+	}
+	ufs := New(WithReadOnlyLayer(base))
+
+	dir, err := ufs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	dir.Readdir(3)
+	if _, err := dir.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"b", "c", "d"}) {
+		t.Errorf("got %v after seek", names)
+	}
+}
@@ -69,6 +69,44 @@ You can stack multiple read-only layers with a single writable layer on top:
 
 Layers are searched in order, so files in higher layers take precedence over lower layers.
 
+Layers can carry a name, ID and labels, so tooling can refer to them by identity
+rather than position. Layers() lists them, and LayerDigest hashes a layer's tree:
+
+	ufs := unionfs.New(
+	    unionfs.WithWritableLayer(overlay, unionfs.LayerName("scratch")),
+	    unionfs.WithReadOnlyLayer(deps, unionfs.LayerName("app-deps:1.0"),
+	        unionfs.LayerLabels(map[string]string{"team": "platform"})),
+	)
+	digest, err := ufs.LayerDigest("app-deps:1.0")
+
+Any io/fs filesystem, such as an embed.FS or os.DirFS, can serve as a read-only layer:
+
+	//go:embed assets
+	var assets embed.FS
+
+	ufs := unionfs.New(
+	    unionfs.WithWritableLayer(overlay),
+	    unionfs.WithReadOnlyFSLayer(assets),
+	)
+
+Zip and uncompressed tar archives can be layered without extracting them.
+WithZipLayer and WithTarLayer index the archive once and read contents in place:
+
+	f, _ := os.Open("bundle.zip")
+	info, _ := f.Stat()
+	ufs := unionfs.New(
+	    unionfs.WithWritableLayer(overlay),
+	    unionfs.WithZipLayer(f, info.Size()),
+	)
+
+NewHTTPLayer serves a remote tar blob the same way: it downloads the table of
+contents written by BuildTOC up front and fetches file contents lazily with HTTP
+Range requests, caching chunks in memory.
+
+NewCASLayer returns a writable layer that stores file contents by SHA-256 digest
+in a BlobStore shared between layers, so identical files across many overlays are
+stored once and copy-up from another content-addressed layer links to its blob.
+
 # Copy-on-Write
 
 When you modify a file that exists in a read-only lower layer, the file is automatically
@@ -112,6 +150,25 @@ writable layer. This is a special file with the prefix ".wh." that marks the fil
 	_, err = baseLayer.Stat("/file.txt")  // nil error
 
 Whiteout files follow the AUFS/Docker convention using the ".wh." prefix.
+As in AUFS and overlayfs, a whiteout for a directory hides everything the lower
+layers hold under it, and a directory created where a whiteout hid a lower
+directory is marked opaque with ".wh.__dir_opaque", so it starts out empty
+instead of showing the old contents again:
+
+	ufs.RemoveAll("/dir")   // writes /.wh.dir; /dir/sub/file is hidden too
+	ufs.Mkdir("/dir", 0755) // writes /dir/.wh.__dir_opaque; /dir is empty
+
+To undo changes instead of layering a deletion on top, Revert drops the
+writable layer's copy, whiteout and opaque marker for a path so the lower
+version shows again, and RevertTree does the same for a whole subtree:
+
+	ufs.Revert("/file.txt")  // base version is visible again
+
+Compact garbage-collects the writable layer: whiteouts that mask nothing,
+redundant opaque markers, and copies identical to what they shadow.
+Check finds inconsistencies left by crashes or external edits, such as
+interrupted copy-ups or whiteouts next to files of the same name, and
+Repair fixes them.
 
 # Directory Merging
 
@@ -125,6 +182,54 @@ When reading a directory, UnionFS merges the contents from all layers:
 	// Returns all three files: file1.txt, file2.txt, file3.txt
 
 Whiteouts are respected during directory merging, so deleted files don't appear in listings.
+Entries are sorted by byte-wise name like os.ReadDir; use WithDirOrdering to sort
+case-insensitively or to skip sorting, and WithCaseInsensitive to match names across
+layers regardless of case. Sorted listings are merged as a stream only from layers
+implementing SortedLister, such as tar and zip layers. Unsorted layers, including
+memfs and host directories, are read in full and buffered when a listing starts, so
+memory grows with their directory sizes; OrderLayer streams them in batches instead.
+
+# Writable Branches
+
+WithWritableBranch pools several writable layers, such as one per disk, in the
+style of mergerfs. Files are modified in the branch that has them instead of
+being copied to the top layer; only files of read-only layers are copied up.
+The create policy picks the branch for new entries, and the search policy picks
+which branch's copy of a file is read when several have one:
+
+	ufs := unionfs.New(
+	    unionfs.WithWritableLayer(disk1, unionfs.LayerName("disk1")),
+	    unionfs.WithWritableBranch(disk2, unionfs.LayerName("disk2")),
+	    unionfs.WithReadOnlyLayer(base),
+	    unionfs.WithCreatePolicy(unionfs.CreateMostFree),
+	    unionfs.WithSearchPolicy(unionfs.SearchNewest),
+	)
+
+The create policies are CreateFirst, CreateExistingPath, CreateMostFree and
+CreateLeastUsed (for layers implementing SpaceReporter, like NewDirLayer),
+CreateRoundRobin and CreatePathPrefix with WithBranchPrefix rules. Removing a
+file deletes it from every branch; whiteouts for files of read-only layers go
+to the first branch, and new entries under a whiteout or opaque directory are
+created in the branch holding it so they are not hidden. Snapshots,
+transactions, Rebase, Changes, Compact and Check need a single writable layer and fail with
+ErrMultipleBranches.
+
+# Write Routes
+
+WithWriteRoute sends writes under a path prefix to a layer of their own, with
+the longest matching prefix deciding. Writes elsewhere go to the other writable
+layers, or fail with ErrNoWriteRoute if there are none:
+
+	ufs := unionfs.New(
+	    unionfs.WithWriteRoute("/var/log", scratch),
+	    unionfs.WithWriteRoute("/home", persistent),
+	    unionfs.WithReadOnlyLayer(base),
+	)
+
+A route's layer holds everything needed to change the paths it takes: copied-up
+files, parent directories copied up with their metadata, whiteouts and opaque
+markers. Route layers are stacked above the other writable layers, deeper
+prefixes first.
 
 # Use Cases
 
@@ -155,6 +260,68 @@ Container Filesystems:
 	    unionfs.WithReadOnlyLayer(baseOS),
 	)
 
+# Manifests
+
+A union's layer stack and options can be saved as a JSON Manifest and rebuilt
+with Load. Layers loaded from a manifest keep their description, and memfs
+layers are described by a tar snapshot of their contents:
+
+	m, err := ufs.Manifest()
+	data, _ := json.Marshal(m)
+
+	// Elsewhere
+	var m unionfs.Manifest
+	json.Unmarshal(data, &m)
+	ufs, err := unionfs.Load(&m, unionfs.DefaultResolver{})
+
+NewDirLayer backs a layer with a host directory, and Changes, Which,
+ExportOCILayer and ImportOCILayer support build workflows on top of it. The
+unionfs command in cmd/unionfs wraps these for directory-backed unions:
+
+	unionfs -upper ./upper -lower ./base diff
+	unionfs -upper ./upper -lower ./base commit ./app-v2
+
+# Rebasing
+
+Rebase moves the writable layer onto new lower layers, for example when a
+base image is updated. Paths changed both in the overlay and in the new
+base are reported as conflicts and resolved by WithRebasePolicy:
+
+	report, err := ufs.Rebase(newBase)
+	if errors.Is(err, unionfs.ErrRebaseConflict) {
+		// report.Conflicts lists the paths; the union is unchanged
+	}
+
+Conflicts are judged against the lower version each file was copied up
+from, which is recorded in memory at copy-up. RebaseOnto does the same but
+takes layer options, such as names and labels, for the new layers.
+
+# Snapshots
+
+Snapshot checkpoints the writable layer by freezing it and stacking a
+throwaway layer on top, so it copies nothing. Rollback returns to the
+checkpoint and DiscardSnapshot keeps the changes, merging them down:
+
+	id, err := ufs.Snapshot()
+	if err := step(ufs); err != nil {
+		ufs.Rollback(id)
+	} else {
+		ufs.DiscardSnapshot(id)
+	}
+
+Handles opened for writing on a frozen or discarded layer fail with
+ErrStaleHandle. WithScratchLayers chooses where throwaway layers live.
+
+Begin starts a transaction whose changes are staged in a private layer and
+applied with Commit, so readers see either none or all of them:
+
+	tx := ufs.Begin()
+	if err := update(tx); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+
 # Performance Considerations
 
   - File lookups traverse layers from top to bottom, so fewer layers = better performance
@@ -197,6 +364,16 @@ Compose with other absfs packages:
 	// - retryfs:   Add retry logic (reliability)
 	// - permfs:    Add access control (security)
 
+The webdav subpackage serves a union to WebDAV clients:
+
+	http.ListenAndServe(":8080", webdav.NewHandler(ufs))
+
+The p9 subpackage serves it over 9P2000.L, for example to a VM that mounts
+it with v9fs:
+
+	l, _ := net.Listen("tcp", ":5640")
+	p9.NewServer(ufs).Serve(l)
+
 This demonstrates the absfs philosophy: each package has a single responsibility,
 and complex behaviors emerge from simple composition.
 
@@ -209,9 +386,21 @@ UnionFS implements both:
 Use ExtendFiler or FileSystem() to get the full absfs.FileSystem interface with
 convenience methods and working directory support.
 
+IOFS() returns a read-only io/fs view implementing fs.StatFS, fs.ReadDirFS,
+fs.ReadFileFS, fs.GlobFS and fs.SubFS, for use with template.ParseFS, http.FS
+and fs.WalkDir:
+
+	tmpl, err := template.ParseFS(ufs.IOFS(), "templates/*.html")
+
+FileServer() is an http.Handler like http.FileServer whose ETags combine a
+content hash with the layer serving the file, so they change when a file is
+copied up or overridden even if its modification time is kept:
+
+	http.Handle("/assets/", http.StripPrefix("/assets", ufs.FileServer()))
+
 # Limitations
 
-  - Only one writable layer is supported (topmost layer)
+  - Snapshots, transactions and Rebase support only one writable layer
   - Hard links are not supported across layers
   - Symlink resolution is currently basic (advanced cross-layer symlinks not yet implemented)
   - File locking behavior across layers is filesystem-dependent
@@ -7,6 +7,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -35,8 +36,9 @@ func (ufs *UnionFS) Lstat(name string) (os.FileInfo, error) {
 		if lstater, ok := layer.fs.(interface {
 			Lstat(string) (os.FileInfo, error)
 		}); ok {
-			info, err := lstater.Lstat(name)
+			info, err := lstater.Lstat(ufs.layerName(layer, name))
 			if err == nil {
+				info, _ = ufs.newestBranch(name, info, i, ufs.lstatIn)
 				return info, nil
 			}
 			if !os.IsNotExist(err) {
@@ -44,8 +46,9 @@ func (ufs *UnionFS) Lstat(name string) (os.FileInfo, error) {
 			}
 		} else {
 			// Fallback to Stat if Lstat not available
-			info, err := layer.fs.Stat(name)
+			info, err := ufs.statLayer(layer, name)
 			if err == nil {
+				info, _ = ufs.newestBranch(name, info, i, ufs.lstatIn)
 				return info, nil
 			}
 			if !os.IsNotExist(err) {
@@ -64,31 +67,35 @@ func (ufs *UnionFS) Open(name string) (absfs.File, error) {
 
 // OpenFile opens a file with the specified flags and permissions
 func (ufs *UnionFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	name = cleanPath(name)
+	name = ufs.resolveCase(cleanPath(name))
 
 	// Check if this is a write operation
 	isWrite := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
 
 	if isWrite {
-		// Write operations go to the writable layer
-		layer, err := ufs.getWritableLayer()
+		// Check if file exists in another layer and needs copy-on-write
+		info, found, err := ufs.findLayer(name)
+		existed := err == nil
+
+		// Write operations go to the branch that has the file, or the one
+		// chosen for new files
+		layer, needCopy, err := ufs.writeTarget(name, found)
 		if err != nil {
 			return nil, err
 		}
+		if existed && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			// The target layer alone would not see names from other layers
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
 
 		// Ensure parent directory exists
-		if err := ufs.ensureDir(name); err != nil {
+		if err := ufs.ensureDir(layer, name); err != nil {
 			return nil, err
 		}
-
-		// Check if file exists in a lower layer and needs copy-on-write
-		if flag&os.O_CREATE == 0 || flag&os.O_EXCL == 0 {
-			info, layerIdx, err := ufs.findFile(name)
-			if err == nil && layerIdx > 0 {
-				// File exists in a lower layer, copy it first
-				if err := ufs.copyUp(name, info); err != nil {
-					return nil, err
-				}
+		if needCopy {
+			// File exists in a read-only layer, copy it first
+			if err := ufs.copyUp(layer, name, info); err != nil {
+				return nil, err
 			}
 		}
 
@@ -100,22 +107,28 @@ func (ufs *UnionFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.Fil
 		ufs.InvalidateCache(name)
 
 		// Open file in writable layer
-		return layer.fs.OpenFile(name, flag, perm)
+		f, err := layer.fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if !existed && flag&os.O_CREATE != 0 {
+			ufs.notify(Create, name)
+		}
+		f = &layerFile{File: f, layer: layer}
+		return ufs.wrapWatched(f, name, existed && flag&os.O_TRUNC != 0), nil
 	}
 
 	// Read-only operation - find the file in layers
-	info, layerIdx, err := ufs.findFile(name)
+	info, layer, err := ufs.findLayer(name)
 	if err != nil {
 		return nil, err
 	}
-
-	layer := ufs.layers[layerIdx]
 	if info.IsDir() {
 		// For directories, we need to return a merged view
-		return newUnionDir(ufs, name, layer.fs, layerIdx)
+		return newUnionDir(ufs, name, layer.fs)
 	}
 
-	return layer.fs.Open(name)
+	return layer.fs.Open(ufs.layerName(layer, name))
 }
 
 // Create creates a file in the writable layer
@@ -125,274 +138,303 @@ func (ufs *UnionFS) Create(name string) (absfs.File, error) {
 
 // Mkdir creates a directory in the writable layer
 func (ufs *UnionFS) Mkdir(name string, perm os.FileMode) error {
-	layer, err := ufs.getWritableLayer()
+	name = ufs.resolveCase(cleanPath(name))
+
+	_, found, _ := ufs.findLayer(name)
+	layer, _, err := ufs.writeTarget(name, found)
 	if err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
 	// Ensure parent directory exists
-	if err := ufs.ensureDir(name); err != nil {
+	if err := ufs.ensureDir(layer, name); err != nil {
 		return err
 	}
 
-	// Remove whiteout if it exists
+	// Remove whiteout if it exists; a directory it hid stays hidden
 	whiteout := whiteoutPath(name)
-	layer.fs.Remove(whiteout)
+	opaque := layer.fs.Remove(whiteout) == nil && ufs.belowIsDir(layer, name)
 
 	err = layer.fs.Mkdir(name, perm)
+	if err == nil && opaque {
+		err = writeMarker(layer.fs, path.Join(name, OpaqueWhiteout))
+	}
 	if err == nil {
 		ufs.InvalidateCache(name)
+		ufs.notify(Create, name)
 	}
 	return err
 }
 
 // MkdirAll creates a directory and all parent directories
 func (ufs *UnionFS) MkdirAll(name string, perm os.FileMode) error {
-	layer, err := ufs.getWritableLayer()
+	name = ufs.resolveCase(cleanPath(name))
+	info, found, statErr := ufs.findLayer(name)
+
+	layer, _, err := ufs.writeTarget(name, found)
 	if err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
-	// Remove whiteouts for this path and parents
+	// Remove whiteouts for this path and parents; directories they hid
+	// stay hidden
+	var opaque []string
 	parts := splitPath(name)
 	current := "/"
 	for _, part := range parts {
 		current = path.Join(current, part)
 		whiteout := whiteoutPath(current)
-		layer.fs.Remove(whiteout)
+		if layer.fs.Remove(whiteout) == nil && ufs.belowIsDir(layer, current) {
+			opaque = append(opaque, current)
+		}
 	}
 
-	err = layer.fs.MkdirAll(name, perm)
+	// Directories the union already shows keep their metadata
+	if len(opaque) == 0 {
+		err = ufs.ensureDir(layer, name)
+		if _, lerr := layer.fs.Stat(name); err == nil && lerr != nil && statErr == nil && info.IsDir() {
+			err = ufs.copyUpDir(layer, name, info)
+		}
+	}
+	if err == nil {
+		err = layer.fs.MkdirAll(name, perm)
+	}
+	for _, dir := range opaque {
+		if err == nil {
+			err = writeMarker(layer.fs, path.Join(dir, OpaqueWhiteout))
+		}
+	}
 	if err == nil {
 		ufs.InvalidateCacheTree(name)
+		if statErr != nil {
+			ufs.notify(Create, name)
+		}
 	}
 	return err
 }
 
-// Remove deletes a file or empty directory by creating a whiteout
+// Remove deletes a file or empty directory, creating a whiteout if a lower
+// layer has it
 func (ufs *UnionFS) Remove(name string) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
+	name = ufs.resolveCase(cleanPath(name))
+	if _, err := ufs.getWritableLayer(name); err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
 	// Check if file exists
-	info, layerIdx, err := ufs.findFile(name)
-	if err != nil {
+	if _, _, err := ufs.findFile(name); err != nil {
 		return err
 	}
 
-	// If file exists in writable layer, actually delete it
-	if layerIdx == 0 {
-		if err := layer.fs.Remove(name); err != nil {
-			return err
-		}
+	// Delete it from the writable branches that have it
+	if err := ufs.removeFromBranches(name, nil, absfs.FileSystem.Remove); err != nil {
+		return err
 	}
 
-	// If file exists in a lower layer, create whiteout
-	if layerIdx > 0 || info != nil {
-		whiteout := whiteoutPath(name)
-		if err := ufs.ensureDir(whiteout); err != nil {
-			return err
-		}
-		// Create empty whiteout file
-		f, err := layer.fs.Create(whiteout)
-		if err != nil {
+	// If the file still exists in a lower layer, create whiteout
+	if ufs.lowerHas(name) {
+		if err := ufs.writeWhiteout(name); err != nil {
 			return err
 		}
-		f.Close()
 	}
 
 	ufs.InvalidateCache(name)
+	ufs.notify(Remove, name)
 	return nil
 }
 
 // RemoveAll removes a path and all children
 func (ufs *UnionFS) RemoveAll(name string) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
+	name = ufs.resolveCase(cleanPath(name))
+	if _, err := ufs.getWritableLayer(name); err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
 	// Check if path exists
-	info, layerIdx, err := ufs.findFile(name)
-	if err != nil {
+	if _, _, err := ufs.findFile(name); err != nil {
 		return err
 	}
 
-	// If path exists in writable layer, remove it
-	if layerIdx == 0 {
-		if err := layer.fs.RemoveAll(name); err != nil {
-			return err
-		}
+	// Remove it from the writable branches that have it
+	if err := ufs.removeFromBranches(name, nil, absfs.FileSystem.RemoveAll); err != nil {
+		return err
 	}
 
 	// If path exists in a lower layer, create whiteout to hide it
-	if layerIdx > 0 {
-		whiteout := whiteoutPath(name)
-		if err := ufs.ensureDir(whiteout); err != nil {
+	if ufs.lowerHas(name) {
+		if err := ufs.writeWhiteout(name); err != nil {
 			return err
 		}
-		// Create empty whiteout file
-		f, err := layer.fs.Create(whiteout)
-		if err != nil {
-			return err
-		}
-		f.Close()
 	}
 
-	// Suppress unused variable warning
-	_ = info
-
 	ufs.InvalidateCacheTree(name)
+	ufs.notify(Remove, name)
 	return nil
 }
 
-// Rename renames a file or directory
+// Rename renames a file or directory. A directory whose contents are
+// partly in other layers cannot be moved without copying them, so as on
+// overlayfs the rename fails with syscall.EXDEV and callers such as mv fall
+// back to copying and removing the tree.
 func (ufs *UnionFS) Rename(oldname, newname string) error {
-	layer, err := ufs.getWritableLayer()
+	oldname = ufs.resolveCase(cleanPath(oldname))
+	newname = cleanPath(newname)
+	if resolved := ufs.resolveCase(newname); resolved != oldname {
+		newname = resolved
+	} else {
+		// A case-only rename keeps the new spelling
+		newname = path.Join(path.Dir(resolved), path.Base(newname))
+	}
+	for _, name := range []string{oldname, newname} {
+		if _, err := ufs.getWritableLayer(name); err != nil {
+			return err
+		}
+	}
+
+	// Check if old file exists
+	info, found, err := ufs.findLayer(oldname)
 	if err != nil {
 		return err
 	}
 
-	oldname = cleanPath(oldname)
-	newname = cleanPath(newname)
+	// A directory cannot be moved into itself
+	if info.IsDir() && strings.HasPrefix(newname, oldname+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrInvalid}
+	}
 
-	// Check if old file exists
-	info, layerIdx, err := ufs.findFile(oldname)
+	layer, inPlace, err := ufs.renameTarget(newname, found)
 	if err != nil {
 		return err
 	}
 
-	// If file is in a lower layer, copy it up first
-	if layerIdx > 0 {
-		if err := ufs.copyUp(oldname, info); err != nil {
+	// Directories with contents in other layers would have to be copied
+	// whole, so like overlayfs the caller is left to copy them
+	if info.IsDir() && newname != oldname && (!inPlace || ufs.belowIsDir(layer, oldname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	if !inPlace {
+		// If file is in another layer, copy it first
+		if err := ufs.copyUp(layer, oldname, info); err != nil {
 			return err
 		}
 	}
+	// Copies of newname in other branches would shadow the moved entry
+	if err := ufs.removeFromBranches(newname, layer, absfs.FileSystem.Remove); err != nil {
+		return err
+	}
 
 	// Ensure destination directory exists
-	if err := ufs.ensureDir(newname); err != nil {
+	if err := ufs.ensureDir(layer, newname); err != nil {
 		return err
 	}
 
-	// Remove whiteout for new name if it exists
+	// Remove whiteout for new name if it exists; a directory it hid stays
+	// hidden under the renamed one
 	newWhiteout := whiteoutPath(newname)
-	layer.fs.Remove(newWhiteout)
+	opaque := layer.fs.Remove(newWhiteout) == nil && info.IsDir() && ufs.belowIsDir(layer, newname)
 
-	// Perform rename in writable layer
+	// Perform rename in the target layer
 	if err := layer.fs.Rename(oldname, newname); err != nil {
 		return err
 	}
-
-	// Create whiteout for old name if it existed in a lower layer
-	if layerIdx > 0 {
-		oldWhiteout := whiteoutPath(oldname)
-		if err := ufs.ensureDir(oldWhiteout); err != nil {
+	if opaque {
+		if err := writeMarker(layer.fs, path.Join(newname, OpaqueWhiteout)); err != nil {
 			return err
 		}
-		f, err := layer.fs.Create(oldWhiteout)
-		if err != nil {
+	}
+
+	// Drop the old name from other branches, and create a whiteout for it
+	// if a lower layer still has it
+	if err := ufs.removeFromBranches(oldname, layer, removeLayerPath); err != nil {
+		return err
+	}
+	if ufs.lowerHas(oldname) {
+		if err := ufs.writeWhiteout(oldname); err != nil {
 			return err
 		}
-		f.Close()
 	}
 
-	ufs.InvalidateCache(oldname)
-	ufs.InvalidateCache(newname)
+	if info.IsDir() {
+		ufs.InvalidateCacheTree(oldname)
+		ufs.InvalidateCacheTree(newname)
+	} else {
+		ufs.InvalidateCache(oldname)
+		ufs.InvalidateCache(newname)
+	}
+	ufs.notifyEvent(Event{Op: Rename, Path: newname, OldPath: oldname})
 	return nil
 }
 
 // Chmod changes file permissions
 func (ufs *UnionFS) Chmod(name string, mode os.FileMode) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
-		return err
-	}
-
-	name = cleanPath(name)
-
-	// Check if file exists and copy up if needed
-	info, layerIdx, err := ufs.findFile(name)
+	layer, name, err := ufs.prepareWrite(name)
 	if err != nil {
 		return err
 	}
 
-	if layerIdx > 0 {
-		if err := ufs.copyUp(name, info); err != nil {
-			return err
-		}
-	}
-
 	err = layer.fs.Chmod(name, mode)
 	if err == nil {
 		ufs.InvalidateCache(name)
+		ufs.notify(Chmod, name)
 	}
 	return err
 }
 
 // Chown changes file ownership
 func (ufs *UnionFS) Chown(name string, uid, gid int) error {
-	layer, err := ufs.getWritableLayer()
+	layer, name, err := ufs.prepareWrite(name)
 	if err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
-	// Check if file exists and copy up if needed
-	info, layerIdx, err := ufs.findFile(name)
-	if err != nil {
-		return err
-	}
-
-	if layerIdx > 0 {
-		if err := ufs.copyUp(name, info); err != nil {
-			return err
-		}
-	}
-
 	err = layer.fs.Chown(name, uid, gid)
 	if err == nil {
 		ufs.InvalidateCache(name)
+		ufs.notify(Chmod, name)
 	}
 	return err
 }
 
 // Chtimes changes file access and modification times
 func (ufs *UnionFS) Chtimes(name string, atime, mtime time.Time) error {
-	layer, err := ufs.getWritableLayer()
+	layer, name, err := ufs.prepareWrite(name)
 	if err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
+	err = layer.fs.Chtimes(name, atime, mtime)
+	if err == nil {
+		ufs.InvalidateCache(name)
+		ufs.notify(Chmod, name)
+	}
+	return err
+}
+
+// prepareWrite finds the existing file name and the branch that changes to
+// it go to, copying it there if needed. It returns the branch and the
+// resolved name.
+func (ufs *UnionFS) prepareWrite(name string) (*Layer, string, error) {
+	name = ufs.resolveCase(cleanPath(name))
+	if _, err := ufs.getWritableLayer(name); err != nil {
+		return nil, "", err
+	}
 
 	// Check if file exists and copy up if needed
-	info, layerIdx, err := ufs.findFile(name)
+	info, found, err := ufs.findLayer(name)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	if layerIdx > 0 {
-		if err := ufs.copyUp(name, info); err != nil {
-			return err
-		}
+	layer, needCopy, err := ufs.writeTarget(name, found)
+	if err != nil {
+		return nil, "", err
 	}
-
-	err = layer.fs.Chtimes(name, atime, mtime)
-	if err == nil {
-		ufs.InvalidateCache(name)
+	if needCopy {
+		if err := ufs.copyUp(layer, name, info); err != nil {
+			return nil, "", err
+		}
 	}
-	return err
+	return layer, name, nil
 }
 
 // splitPath splits a path into components
@@ -436,63 +478,26 @@ func (ufs *UnionFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	seen := make(map[string]bool)
 	whiteouts := make(map[string]bool)
 	var entries []fs.DirEntry
+	var origins []int // layer of each entry
 
 	ufs.mu.RLock()
 	defer ufs.mu.RUnlock()
 
-	// Check for opaque directory whiteout in upper layers
-	isOpaque := false
-	for i := 0; i < len(ufs.layers); i++ {
-		layer := ufs.layers[i]
-		opaquePath := path.Join(name, OpaqueWhiteout)
-		if _, err := layer.fs.Stat(opaquePath); err == nil {
-			isOpaque = true
-			break
-		}
-	}
-
-	// Iterate through all layers
-	for i := 0; i < len(ufs.layers); i++ {
-		// If we found an opaque whiteout, stop processing lower layers
-		if isOpaque && i > 0 {
-			break
-		}
+	// Layers below an opaque marker or a whiteout for the directory do not
+	// contribute
+	layerCount := ufs.listedLayers(name)
 
+	// Read the directory from every contributing layer
+	results := make([][]fs.DirEntry, layerCount)
+	ufs.forEachLayer(layerCount, func(i int) {
 		layer := ufs.layers[i]
+		results[i] = readLayerDir(layer, ufs.layerName(layer, name))
+	})
 
-		// Try to read directory from this layer using ReadDir if available
-		var layerEntries []fs.DirEntry
-		if reader, ok := layer.fs.(interface{ ReadDir(string) ([]fs.DirEntry, error) }); ok {
-			layerEntries, err = reader.ReadDir(name)
-			if err != nil {
-				if os.IsNotExist(err) {
-					continue
-				}
-				continue
-			}
-		} else {
-			// Fallback to Open + Readdir
-			dir, err := layer.fs.Open(name)
-			if err != nil {
-				if os.IsNotExist(err) {
-					continue
-				}
-				continue
-			}
-
-			infos, err := dir.Readdir(-1)
-			dir.Close()
-
-			if err != nil {
-				continue
-			}
-
-			// Convert FileInfo to DirEntry
-			layerEntries = make([]fs.DirEntry, len(infos))
-			for j, info := range infos {
-				layerEntries[j] = fs.FileInfoToDirEntry(info)
-			}
-		}
+	// Merge layers top-down
+	for i, layerEntries := range results {
+		// Whiteouts hide entries of the layers below, not of their own
+		var layerWhiteouts []string
 
 		// Process entries from this layer
 		for _, entry := range layerEntries {
@@ -502,7 +507,7 @@ func (ufs *UnionFS) ReadDir(name string) ([]fs.DirEntry, error) {
 			if isWhiteout(name) {
 				// Mark the original file as whited out
 				if original, ok := originalPath(path.Join(name, name)); ok {
-					whiteouts[path.Base(original)] = true
+					layerWhiteouts = append(layerWhiteouts, ufs.nameKey(path.Base(original)))
 				}
 				continue
 			}
@@ -512,37 +517,94 @@ func (ufs *UnionFS) ReadDir(name string) ([]fs.DirEntry, error) {
 				continue
 			}
 
+			key := ufs.nameKey(name)
+
 			// Skip if already seen in upper layer
-			if seen[name] {
+			if seen[key] {
 				continue
 			}
 
 			// Skip if whited out
-			if whiteouts[name] {
+			if whiteouts[key] {
 				continue
 			}
 
 			// Add entry
-			seen[name] = true
+			seen[key] = true
 			entries = append(entries, entry)
+			origins = append(origins, i)
+		}
+		for _, key := range layerWhiteouts {
+			whiteouts[key] = true
 		}
 	}
 
-	// Sort entries by name
-	sort.Slice(entries, func(i, j int) bool {
-		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
-	})
+	// Files several branches have are listed from their newest copy
+	if ufs.searchPolicy == SearchNewest {
+		for j, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if newest, i := ufs.newestBranch(path.Join(name, entry.Name()), info, origins[j], ufs.lstatIn); i != origins[j] {
+				entries[j] = fs.FileInfoToDirEntry(newest)
+			}
+		}
+	}
+
+	// Sort entries according to the configured ordering
+	if less := ufs.dirLess(); less != nil {
+		sort.Slice(entries, func(i, j int) bool {
+			return less(entries[i].Name(), entries[j].Name())
+		})
+	}
 
 	return entries, nil
 }
 
+// readLayerDir reads a directory from a single layer, returning nil if the
+// layer does not have it or cannot read it
+func readLayerDir(layer *Layer, name string) []fs.DirEntry {
+	// Try to read directory from this layer using ReadDir if available
+	if reader, ok := layer.fs.(interface{ ReadDir(string) ([]fs.DirEntry, error) }); ok {
+		entries, err := reader.ReadDir(name)
+		if err != nil {
+			return nil
+		}
+		return entries
+	}
+
+	// Fallback to Open + Readdir
+	dir, err := layer.fs.Open(name)
+	if err != nil {
+		return nil
+	}
+
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+
+	if err != nil {
+		return nil
+	}
+
+	// Convert FileInfo to DirEntry
+	entries := make([]fs.DirEntry, len(infos))
+	for j, info := range infos {
+		entries[j] = fs.FileInfoToDirEntry(info)
+	}
+	return entries
+}
+
 // ReadFile reads the named file and returns its contents.
 // It reads from the first layer (highest precedence) that contains the file.
 func (ufs *UnionFS) ReadFile(name string) ([]byte, error) {
-	name = cleanPath(name)
+	name = ufs.resolveCase(cleanPath(name))
 
 	// Find the file in the layers
-	info, layerIdx, err := ufs.findFile(name)
+	info, layer, err := ufs.findLayer(name)
 	if err != nil {
 		return nil, err
 	}
@@ -551,9 +613,7 @@ func (ufs *UnionFS) ReadFile(name string) ([]byte, error) {
 		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrInvalid}
 	}
 
-	ufs.mu.RLock()
-	layer := ufs.layers[layerIdx]
-	ufs.mu.RUnlock()
+	name = ufs.layerName(layer, name)
 
 	// Try to use ReadFile if available
 	if reader, ok := layer.fs.(interface{ ReadFile(string) ([]byte, error) }); ok {
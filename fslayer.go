@@ -0,0 +1,257 @@
+package unionfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// WithReadOnlyFSLayer adds any io/fs filesystem (embed.FS, os.DirFS,
+// fstest.MapFS, ...) as a read-only layer. Whiteout and opaque markers
+// stored in the filesystem are honoured like in any other layer.
+func WithReadOnlyFSLayer(fsys fs.FS, opts ...LayerOption) Option {
+	return WithReadOnlyLayer(newFSLayer(fsys), opts...)
+}
+
+// fsLayer adapts an fs.FS to absfs.FileSystem. All mutating methods fail
+// with ErrReadOnlyLayer.
+type fsLayer struct {
+	fsys fs.FS
+	cwd  string
+}
+
+// Ensure fsLayer implements absfs.FileSystem at compile time
+var _ absfs.FileSystem = (*fsLayer)(nil)
+
+// newFSLayer wraps fsys as a read-only absfs.FileSystem
+func newFSLayer(fsys fs.FS) *fsLayer {
+	return &fsLayer{fsys: fsys, cwd: "/"}
+}
+
+// fsName converts an absfs path to an fs.FS name
+func (l *fsLayer) fsName(name string) string {
+	if !path.IsAbs(name) {
+		name = path.Join(l.cwd, name)
+	}
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// readOnly returns the error reported by every mutating operation
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: ErrReadOnlyLayer}
+}
+
+// OpenFile implements absfs.Filer
+func (l *fsLayer) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, readOnly("open", name)
+	}
+	f, err := l.fsys.Open(l.fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	return &fsLayerFile{File: f, name: name}, nil
+}
+
+// Mkdir implements absfs.Filer
+func (l *fsLayer) Mkdir(name string, perm os.FileMode) error {
+	return readOnly("mkdir", name)
+}
+
+// Remove implements absfs.Filer
+func (l *fsLayer) Remove(name string) error {
+	return readOnly("remove", name)
+}
+
+// Rename implements absfs.Filer
+func (l *fsLayer) Rename(oldpath, newpath string) error {
+	return readOnly("rename", oldpath)
+}
+
+// Stat implements absfs.Filer
+func (l *fsLayer) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(l.fsys, l.fsName(name))
+}
+
+// Chmod implements absfs.Filer
+func (l *fsLayer) Chmod(name string, mode os.FileMode) error {
+	return readOnly("chmod", name)
+}
+
+// Chtimes implements absfs.Filer
+func (l *fsLayer) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return readOnly("chtimes", name)
+}
+
+// Chown implements absfs.Filer
+func (l *fsLayer) Chown(name string, uid, gid int) error {
+	return readOnly("chown", name)
+}
+
+// ReadDir implements absfs.Filer
+func (l *fsLayer) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(l.fsys, l.fsName(name))
+}
+
+// ReadFile implements absfs.Filer
+func (l *fsLayer) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(l.fsys, l.fsName(name))
+}
+
+// Sub implements absfs.Filer
+func (l *fsLayer) Sub(dir string) (fs.FS, error) {
+	return fs.Sub(l.fsys, l.fsName(dir))
+}
+
+// SortedReaddir implements SortedLister for filesystems that list
+// directories in name order
+func (l *fsLayer) SortedReaddir() bool {
+	s, ok := l.fsys.(SortedLister)
+	return ok && s.SortedReaddir()
+}
+
+// Chdir implements absfs.FileSystem
+func (l *fsLayer) Chdir(dir string) error {
+	info, err := l.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: dir, Err: errors.New("not a directory")}
+	}
+	if name := l.fsName(dir); name == "." {
+		l.cwd = "/"
+	} else {
+		l.cwd = "/" + name
+	}
+	return nil
+}
+
+// Getwd implements absfs.FileSystem
+func (l *fsLayer) Getwd() (string, error) {
+	return l.cwd, nil
+}
+
+// TempDir implements absfs.FileSystem
+func (l *fsLayer) TempDir() string {
+	return "/tmp"
+}
+
+// Open implements absfs.FileSystem
+func (l *fsLayer) Open(name string) (absfs.File, error) {
+	return l.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create implements absfs.FileSystem
+func (l *fsLayer) Create(name string) (absfs.File, error) {
+	return nil, readOnly("create", name)
+}
+
+// MkdirAll implements absfs.FileSystem
+func (l *fsLayer) MkdirAll(name string, perm os.FileMode) error {
+	return readOnly("mkdir", name)
+}
+
+// RemoveAll implements absfs.FileSystem
+func (l *fsLayer) RemoveAll(name string) error {
+	return readOnly("removeall", name)
+}
+
+// Truncate implements absfs.FileSystem
+func (l *fsLayer) Truncate(name string, size int64) error {
+	return readOnly("truncate", name)
+}
+
+// fsLayerFile adapts an fs.File to absfs.File
+type fsLayerFile struct {
+	fs.File
+	name string
+}
+
+// Name returns the name the file was opened with
+func (f *fsLayerFile) Name() string {
+	return f.name
+}
+
+// ReadAt reads from the file at an offset, if the underlying file supports it
+func (f *fsLayerFile) ReadAt(b []byte, off int64) (int, error) {
+	if ra, ok := f.File.(io.ReaderAt); ok {
+		return ra.ReadAt(b, off)
+	}
+	return 0, &os.PathError{Op: "readat", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+// Seek seeks within the file, if the underlying file supports it
+func (f *fsLayerFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+// Write is not supported on read-only layers
+func (f *fsLayerFile) Write(b []byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+// WriteAt is not supported on read-only layers
+func (f *fsLayerFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+// WriteString is not supported on read-only layers
+func (f *fsLayerFile) WriteString(s string) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+// Truncate is not supported on read-only layers
+func (f *fsLayerFile) Truncate(size int64) error {
+	return readOnly("truncate", f.name)
+}
+
+// Sync is a no-op for read-only files
+func (f *fsLayerFile) Sync() error {
+	return nil
+}
+
+// ReadDir reads directory entries, if the file is a directory
+func (f *fsLayerFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+// Readdir reads directory entries as FileInfo values
+func (f *fsLayerFile) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.ReadDir(n)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			return infos, infoErr
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+// Readdirnames reads directory entry names
+func (f *fsLayerFile) Readdirnames(n int) ([]string, error) {
+	entries, err := f.ReadDir(n)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, err
+}
@@ -0,0 +1,118 @@
+package unionfs
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// TestReadOnlyFSLayer tests an io/fs filesystem as the base layer
+func TestReadOnlyFSLayer(t *testing.T) {
+	lower := fstest.MapFS{
+		"etc/app.conf":    {Data: []byte("base"), Mode: 0644},
+		"etc/legacy.conf": {Data: []byte("legacy")},
+		"www/index.html":  {Data: []byte("<index>")},
+	}
+	middle := fstest.MapFS{
+		"etc/.wh.legacy.conf": {},
+		"www/new.html":        {Data: []byte("<new>")},
+	}
+	overlay := mustNewMemFS()
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyFSLayer(middle),
+		WithReadOnlyFSLayer(lower),
+	)
+
+	data, err := readFile(ufs, "/etc/app.conf")
+	if err != nil || string(data) != "base" {
+		t.Fatalf("read: got %q, %v", data, err)
+	}
+
+	f, err := ufs.Open("/www/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 1); err != nil || string(buf) != "index" {
+		t.Errorf("ReadAt: got %q, %v", buf, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Errorf("Seek: %v", err)
+	}
+	f.Close()
+
+	// Markers stored in the fs.FS hide lower layers
+	if _, err := ufs.Stat("/etc/legacy.conf"); err == nil {
+		t.Error("expected whiteout in fs.FS layer to hide file")
+	}
+	entries, err := ufs.ReadDir("/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"index.html", "new.html"}) {
+		t.Errorf("www: got %v", names)
+	}
+	entries, err = ufs.ReadDir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"app.conf"}) {
+		t.Errorf("etc: got %v", names)
+	}
+
+	// Writes copy up into the writable layer
+	if err := writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if data, _ := readFile(overlay, "/etc/app.conf"); string(data) != "changed" {
+		t.Errorf("expected copy-up in overlay, got %q", data)
+	}
+	if string(lower["etc/app.conf"].Data) != "base" {
+		t.Error("fs.FS layer was modified")
+	}
+}
+
+// TestFSLayerReadOnly tests that the adapter rejects mutations
+func TestFSLayerReadOnly(t *testing.T) {
+	l := newFSLayer(fstest.MapFS{"a.txt": {Data: []byte("a")}})
+
+	if _, err := l.Create("/b.txt"); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Create: expected ErrReadOnlyLayer, got %v", err)
+	}
+	if err := l.Remove("/a.txt"); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Remove: expected ErrReadOnlyLayer, got %v", err)
+	}
+	f, err := l.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrReadOnlyLayer) {
+		t.Errorf("Write: expected ErrReadOnlyLayer, got %v", err)
+	}
+
+	if err := l.Chdir("/"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := l.ReadFile("a.txt"); err != nil || string(data) != "a" {
+		t.Errorf("relative ReadFile: got %q, %v", data, err)
+	}
+}
+
+func TestFSLayerChdirHidden(t *testing.T) {
+	l := newFSLayer(fstest.MapFS{".config/app.ini": {Data: []byte("app")}})
+
+	if err := l.Chdir("/.config"); err != nil {
+		t.Fatal(err)
+	}
+	if wd, _ := l.Getwd(); wd != "/.config" {
+		t.Errorf("Getwd = %q, want /.config", wd)
+	}
+	if data, err := l.ReadFile("app.ini"); err != nil || string(data) != "app" {
+		t.Errorf("relative ReadFile: got %q, %v", data, err)
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/absfs/absfs v1.0.0
 	github.com/absfs/fstesting v1.0.0
 	github.com/absfs/memfs v1.0.0
+	golang.org/x/net v0.35.0
 )
 
 require github.com/absfs/inode v1.0.0 // indirect
@@ -0,0 +1,287 @@
+package unionfs
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Default chunk cache settings for HTTP layers
+const (
+	defaultHTTPChunkSize   = 1 << 20 // 1MB
+	defaultHTTPCacheChunks = 64
+)
+
+// ErrRangeUnsupported is returned when an HTTP layer's server ignores Range
+// requests
+var ErrRangeUnsupported = errors.New("server does not support range requests")
+
+// TOC is the table of contents of a remote layer blob. The blob is an
+// uncompressed tar archive; the TOC records where each member's contents
+// start so that files can be read with Range requests without scanning
+// the archive.
+type TOC struct {
+	Entries []TOCEntry `json:"entries"`
+}
+
+// TOCEntry describes one member of a remote layer blob
+type TOCEntry struct {
+	Name     string      `json:"name"`
+	Mode     fs.FileMode `json:"mode"`
+	Size     int64       `json:"size,omitempty"`
+	ModTime  time.Time   `json:"modTime"`
+	Offset   int64       `json:"offset,omitempty"`   // start of contents in the blob
+	LinkName string      `json:"linkName,omitempty"` // symlink target
+}
+
+// BuildTOC indexes an uncompressed tar archive and returns its table of
+// contents, for publishing next to the archive. Hard links are recorded as
+// regular files sharing their target's contents.
+func BuildTOC(r io.ReaderAt, size int64) (*TOC, error) {
+	a := newArchiveFS(func(a *archiveFS) error {
+		return a.indexTar(r, size)
+	})
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(a.index))
+	for name := range a.index {
+		if name != "." {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	toc := &TOC{Entries: make([]TOCEntry, 0, len(names))}
+	for _, name := range names {
+		e := a.index[name]
+		if e.data != nil && e.offset < 0 {
+			return nil, fmt.Errorf("%s: sparse members cannot be served by range", name)
+		}
+		entry := TOCEntry{
+			Name:     name,
+			Mode:     e.mode,
+			ModTime:  e.modTime,
+			LinkName: e.link,
+		}
+		if e.data != nil {
+			entry.Size, entry.Offset = e.size, e.offset
+		}
+		toc.Entries = append(toc.Entries, entry)
+	}
+	return toc, nil
+}
+
+// HTTPLayerConfig configures a read-only layer served over HTTP
+type HTTPLayerConfig struct {
+	URL         string       // URL of the uncompressed tar blob
+	TOCURL      string       // URL of the JSON TOC; defaults to URL + ".toc.json"
+	Client      *http.Client // defaults to http.DefaultClient
+	ChunkSize   int64        // bytes fetched per Range request; defaults to 1MB
+	CacheChunks int          // chunks kept in memory; defaults to 64
+}
+
+// NewHTTPLayer returns a read-only layer backed by a remote tar blob. Only
+// the TOC is downloaded up front; file contents are fetched lazily with
+// Range requests in fixed-size chunks and kept in an LRU chunk cache, so a
+// union can serve reads before the blob has been downloaded.
+//
+// Example:
+//
+//	layer, err := unionfs.NewHTTPLayer(unionfs.HTTPLayerConfig{
+//	    URL: "https://images.example.com/base.tar",
+//	})
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(overlay),
+//	    unionfs.WithReadOnlyLayer(layer),
+//	)
+func NewHTTPLayer(cfg HTTPLayerConfig) (absfs.FileSystem, error) {
+	if cfg.TOCURL == "" {
+		cfg.TOCURL = cfg.URL + ".toc.json"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = defaultHTTPChunkSize
+	}
+	if cfg.CacheChunks <= 0 {
+		cfg.CacheChunks = defaultHTTPCacheChunks
+	}
+
+	toc, err := fetchTOC(cfg.Client, cfg.TOCURL)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := newRangeReader(cfg)
+	a := newArchiveFS(func(a *archiveFS) error {
+		for _, entry := range toc.Entries {
+			name := archiveName(entry.Name)
+			if name == "" {
+				continue
+			}
+			e := &archiveEntry{
+				mode:    entry.Mode,
+				modTime: entry.ModTime,
+				link:    entry.LinkName,
+				sys:     entry,
+			}
+			if entry.Mode.IsRegular() && entry.Size > 0 {
+				e.size, e.offset = entry.Size, entry.Offset
+				e.data = io.NewSectionReader(blob, entry.Offset, entry.Size)
+			}
+			a.add(name, e)
+		}
+		return nil
+	})
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return newFSLayer(a), nil
+}
+
+// fetchTOC downloads and decodes a layer's table of contents
+func fetchTOC(client *http.Client, url string) (*TOC, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch TOC: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch TOC: %s", resp.Status)
+	}
+	var toc TOC
+	if err := json.NewDecoder(resp.Body).Decode(&toc); err != nil {
+		return nil, fmt.Errorf("decode TOC: %w", err)
+	}
+	return &toc, nil
+}
+
+// rangeReader is an io.ReaderAt over a remote blob. Reads are served from
+// fixed-size chunks fetched with Range requests; concurrent readers of the
+// same chunk share one request.
+type rangeReader struct {
+	client    *http.Client
+	url       string
+	chunkSize int64
+	maxChunks int
+
+	mu     sync.Mutex
+	chunks map[int64]*rangeChunk
+	lru    *list.List // of chunk indexes, most recently used first
+}
+
+// rangeChunk is a cached or in-flight chunk
+type rangeChunk struct {
+	data []byte
+	err  error
+	done chan struct{}
+	elem *list.Element
+}
+
+// newRangeReader returns a reader for cfg.URL using cfg's chunk settings
+func newRangeReader(cfg HTTPLayerConfig) *rangeReader {
+	return &rangeReader{
+		client:    cfg.Client,
+		url:       cfg.URL,
+		chunkSize: cfg.ChunkSize,
+		maxChunks: cfg.CacheChunks,
+		chunks:    make(map[int64]*rangeChunk),
+		lru:       list.New(),
+	}
+}
+
+// ReadAt implements io.ReaderAt
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		idx := (off + int64(n)) / r.chunkSize
+		data, err := r.chunk(idx)
+		if err != nil {
+			return n, err
+		}
+		start := off + int64(n) - idx*r.chunkSize
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+		if int64(len(data)) < r.chunkSize && n < len(p) {
+			// A short chunk is the end of the blob
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// chunk returns the contents of chunk idx, fetching it if needed
+func (r *rangeReader) chunk(idx int64) ([]byte, error) {
+	r.mu.Lock()
+	c, ok := r.chunks[idx]
+	if ok {
+		if c.elem != nil {
+			r.lru.MoveToFront(c.elem)
+		}
+		r.mu.Unlock()
+		<-c.done
+		return c.data, c.err
+	}
+	c = &rangeChunk{done: make(chan struct{})}
+	r.chunks[idx] = c
+	r.mu.Unlock()
+
+	c.data, c.err = r.fetch(idx)
+	close(c.done)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.err != nil {
+		// Failed chunks are retried by the next reader
+		delete(r.chunks, idx)
+		return nil, c.err
+	}
+	c.elem = r.lru.PushFront(idx)
+	for r.lru.Len() > r.maxChunks {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.chunks, oldest.Value.(int64))
+	}
+	return c.data, nil
+}
+
+// fetch downloads chunk idx with a Range request
+func (r *rangeReader) fetch(idx int64) ([]byte, error) {
+	start := idx * r.chunkSize
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+r.chunkSize-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(io.LimitReader(resp.Body, r.chunkSize))
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case http.StatusOK:
+		return nil, ErrRangeUnsupported
+	default:
+		return nil, fmt.Errorf("fetch %s: %s", r.url, resp.Status)
+	}
+}
@@ -0,0 +1,135 @@
+package unionfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blobServer serves a tar blob and its TOC, counting Range requests
+func blobServer(t *testing.T, blob []byte, ranges bool) (*httptest.Server, *int64) {
+	t.Helper()
+	toc, err := BuildTOC(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/base.tar.toc.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(toc)
+	})
+	mux.HandleFunc("/base.tar", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if !ranges {
+			w.Write(blob)
+			return
+		}
+		http.ServeContent(w, r, "base.tar", time.Time{}, bytes.NewReader(blob))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// TestHTTPLayer tests lazy reads through a remote layer
+func TestHTTPLayer(t *testing.T) {
+	srv, requests := blobServer(t, buildTar(t), true)
+
+	layer, err := NewHTTPLayer(HTTPLayerConfig{URL: srv.URL + "/base.tar", ChunkSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(layer),
+	)
+
+	// Metadata comes from the TOC alone
+	entries, err := ufs.ReadDir("/usr/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, want := entryNames(entries), []string{"libfoo.so", "libfoo.so.1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir: got %v, want %v", names, want)
+	}
+	if info, err := ufs.Stat("/usr/bin/tool"); err != nil || info.Size() != 4 {
+		t.Errorf("Stat: got %v, %v", info, err)
+	}
+	if n := atomic.LoadInt64(requests); n != 0 {
+		t.Errorf("expected no blob requests for metadata, got %d", n)
+	}
+
+	for name, want := range map[string]string{
+		"/usr/lib/libfoo.so":  "libfoo",
+		"/usr/bin/tool-alias": "tool",
+	} {
+		if got, err := readFile(ufs, name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// Repeated reads are served from the chunk cache
+	before := atomic.LoadInt64(requests)
+	if _, err := readFile(ufs, "/usr/bin/tool"); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt64(requests); after != before {
+		t.Errorf("expected cached read, requests went from %d to %d", before, after)
+	}
+}
+
+// TestHTTPLayerLargeFile tests reads spanning several chunks
+func TestHTTPLayerLargeFile(t *testing.T) {
+	content := strings.Repeat("abcdefgh", 1000)
+	var buf bytes.Buffer
+	writeTar(t, &buf, "big.txt", content)
+	srv, requests := blobServer(t, buf.Bytes(), true)
+
+	layer, err := NewHTTPLayer(HTTPLayerConfig{URL: srv.URL + "/base.tar", ChunkSize: 1000, CacheChunks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := layer.Open("/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A small read touches only the chunks it covers
+	p := make([]byte, 8)
+	if _, err := f.ReadAt(p, 4000); err != nil || string(p) != "abcdefgh" {
+		t.Errorf("ReadAt: got %q, %v", p, err)
+	}
+	if n := atomic.LoadInt64(requests); n > 2 {
+		t.Errorf("expected at most 2 range requests, got %d", n)
+	}
+
+	data, err := layer.ReadFile("/big.txt")
+	if err != nil || string(data) != content {
+		t.Errorf("ReadFile: got %d bytes, %v", len(data), err)
+	}
+}
+
+// TestHTTPLayerNoRange tests servers that ignore Range headers
+func TestHTTPLayerNoRange(t *testing.T) {
+	srv, _ := blobServer(t, buildTar(t), false)
+
+	layer, err := NewHTTPLayer(HTTPLayerConfig{URL: srv.URL + "/base.tar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layer.ReadFile("/usr/bin/tool"); !errors.Is(err, ErrRangeUnsupported) {
+		t.Errorf("expected ErrRangeUnsupported, got %v", err)
+	}
+
+	if _, err := NewHTTPLayer(HTTPLayerConfig{URL: srv.URL + "/missing.tar"}); err == nil {
+		t.Error("expected error for missing TOC")
+	}
+}
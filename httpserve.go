@@ -0,0 +1,226 @@
+package unionfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// maxETags bounds the number of cached entity tags of a file server
+const maxETags = 4096
+
+// fileServer serves the merged view over HTTP
+type fileServer struct {
+	ufs   *UnionFS
+	mu    sync.Mutex
+	etags map[etagKey]string
+}
+
+// etagKey identifies a version of a file in a layer
+type etagKey struct {
+	layer *Layer
+	tag   string // stable key of the layer, see layerTag
+	path  string
+	size  int64
+	mtime int64
+}
+
+// FileServer returns an http.Handler serving the merged view, like
+// http.FileServer but with entity tags that identify both the content and
+// the layer it is served from. Files get Last-Modified and ETag headers and
+// support Range and conditional requests; directories are listed from the
+// merged ReadDir, or served from their index.html.
+//
+// ETags combine a hash of the content with a key for the layer serving it:
+// its name, or for unnamed layers its position from the bottom of the stack.
+// They change whenever a file is copied up or overridden by an upper layer,
+// even if its modification time is preserved, and stay the same across
+// restarts of a server built from the same layers. Content hashes are cached
+// per layer, path, size and modification time.
+//
+// Example:
+//
+//	http.Handle("/assets/", http.StripPrefix("/assets", ufs.FileServer()))
+func (ufs *UnionFS) FileServer() http.Handler {
+	return &fileServer{ufs: ufs, etags: make(map[etagKey]string)}
+}
+
+// ServeHTTP serves a file or directory listing
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	info, err := s.ufs.Stat(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	// Directories are addressed with a trailing slash and files without
+	trailing := strings.HasSuffix(r.URL.Path, "/")
+	if info.IsDir() && !trailing {
+		localRedirect(w, r, path.Base(r.URL.Path)+"/")
+		return
+	}
+	if !info.IsDir() && trailing && name != "/" {
+		localRedirect(w, r, "../"+path.Base(name))
+		return
+	}
+
+	if info.IsDir() {
+		index := path.Join(name, "index.html")
+		if indexInfo, err := s.ufs.Stat(index); err == nil && indexInfo.Mode().IsRegular() {
+			name = index
+		} else {
+			s.serveDir(w, r, name)
+			return
+		}
+	}
+	s.serveFile(w, r, name)
+}
+
+// serveFile serves a regular file with its layer-aware entity tag
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, layer, depth, info, err := s.ufs.openInLayer(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer f.Close()
+	if !info.Mode().IsRegular() {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+
+	etag, err := s.etag(layer, layerTag(layer, depth), name, info)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// layerTag returns the stable key of a layer at depth from the bottom of
+// the stack
+func layerTag(layer *Layer, depth int) string {
+	if layer.name != "" {
+		return "name:" + layer.name
+	}
+	return fmt.Sprintf("depth:%d", depth)
+}
+
+// etag returns the entity tag of name as found in layer: a hash of its
+// content prefixed with a hash of the layer's tag
+func (s *fileServer) etag(layer *Layer, tag, name string, info os.FileInfo) (string, error) {
+	key := etagKey{layer: layer, tag: tag, path: name, size: info.Size(), mtime: info.ModTime().UnixNano()}
+	s.mu.Lock()
+	etag, ok := s.etags[key]
+	s.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+
+	f, err := layer.fs.Open(s.ufs.layerName(layer, name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	tagSum := sha256.Sum256([]byte(tag))
+	etag = fmt.Sprintf("%q", hex.EncodeToString(tagSum[:4])+"-"+hex.EncodeToString(h.Sum(nil))[:32])
+
+	s.mu.Lock()
+	if len(s.etags) >= maxETags {
+		s.etags = make(map[etagKey]string)
+	}
+	s.etags[key] = etag
+	s.mu.Unlock()
+	return etag, nil
+}
+
+// serveDir renders the merged listing of a directory
+func (s *fileServer) serveDir(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := s.ufs.ReadDir(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	for _, entry := range entries {
+		display := entry.Name()
+		if entry.IsDir() {
+			display += "/"
+		}
+		link := url.URL{Path: display}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(display))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// openInLayer opens a file for reading and returns the layer it was found
+// in, with that layer's position from the bottom of the stack
+func (ufs *UnionFS) openInLayer(name string) (absfs.File, *Layer, int, os.FileInfo, error) {
+	name = ufs.resolveCase(cleanPath(name))
+
+	ufs.mu.RLock()
+	info, idx, err := ufs.findFileLocked(name)
+	if err != nil {
+		ufs.mu.RUnlock()
+		return nil, nil, 0, nil, err
+	}
+	layer, depth := ufs.layers[idx], len(ufs.layers)-1-idx
+	ufs.mu.RUnlock()
+
+	f, err := layer.fs.Open(ufs.layerName(layer, name))
+	if err != nil {
+		return nil, nil, 0, nil, err
+	}
+	return f, layer, depth, info, nil
+}
+
+// serveError replies with the HTTP status matching err
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// localRedirect redirects to a path relative to the request, keeping the
+// query
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
@@ -0,0 +1,170 @@
+package unionfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveRequest requests path from h with optional headers
+func serveRequest(h http.Handler, method, path string, header map[string]string) *http.Response {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// readBody reads a response body
+func readBody(resp *http.Response) string {
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return string(data)
+}
+
+func TestFileServer(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/css/site.css", []byte("body { color: black }"), 0644)
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+	h := ufs.FileServer()
+
+	resp := serveRequest(h, "GET", "/css/site.css", nil)
+	if resp.StatusCode != http.StatusOK || readBody(resp) != "body { color: black }" {
+		t.Fatalf("GET: %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("expected validators, got %v", resp.Header)
+	}
+
+	// Conditional and range requests
+	if resp := serveRequest(h, "GET", "/css/site.css", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", resp.StatusCode)
+	}
+	resp = serveRequest(h, "GET", "/css/site.css", map[string]string{"Range": "bytes=0-3"})
+	if resp.StatusCode != http.StatusPartialContent || readBody(resp) != "body" {
+		t.Errorf("Range: %d", resp.StatusCode)
+	}
+	resp = serveRequest(h, "GET", "/css/site.css", map[string]string{"Range": "bytes=0-3", "If-Range": `"stale"`})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("If-Range with stale tag: %d", resp.StatusCode)
+	}
+	if resp := serveRequest(h, "HEAD", "/css/site.css", nil); resp.StatusCode != http.StatusOK || readBody(resp) != "" {
+		t.Errorf("HEAD: %d", resp.StatusCode)
+	}
+	if resp := serveRequest(h, "POST", "/css/site.css", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", resp.StatusCode)
+	}
+	if resp := serveRequest(h, "GET", "/missing", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing: %d", resp.StatusCode)
+	}
+}
+
+// TestFileServerETagLayers tests that copy-up and overrides change the ETag
+// even when content and modification time are unchanged
+func TestFileServerETagLayers(t *testing.T) {
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cdn := mustNewMemFS()
+	writeFile(cdn, "/logo.svg", []byte("<svg/>"), 0644)
+	cdn.Chtimes("/logo.svg", mtime, mtime)
+	customer := mustNewMemFS()
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(customer), WithReadOnlyLayer(cdn))
+	h := ufs.FileServer()
+
+	etag := serveRequest(h, "GET", "/logo.svg", nil).Header.Get("ETag")
+	if again := serveRequest(h, "GET", "/logo.svg", nil).Header.Get("ETag"); again != etag {
+		t.Errorf("ETag not stable: %s, %s", etag, again)
+	}
+
+	// An override with identical content and mtime in a middle layer
+	writeFile(customer, "/logo.svg", []byte("<svg/>"), 0644)
+	customer.Chtimes("/logo.svg", mtime, mtime)
+	overridden := serveRequest(h, "GET", "/logo.svg", nil).Header.Get("ETag")
+	if overridden == etag {
+		t.Error("expected override to change the ETag")
+	}
+
+	// Copy-up preserves mtime and content
+	if err := ufs.Chmod("/logo.svg", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := ufs.Stat("/logo.svg"); !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected copy-up to preserve mtime, got %v", info.ModTime())
+	}
+	copied := serveRequest(h, "GET", "/logo.svg", nil).Header.Get("ETag")
+	if copied == overridden || copied == etag {
+		t.Error("expected copy-up to change the ETag")
+	}
+	if resp := serveRequest(h, "GET", "/logo.svg", map[string]string{"If-None-Match": overridden}); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-None-Match with old tag: %d", resp.StatusCode)
+	}
+}
+
+// TestFileServerETagRestart tests that a server rebuilt from the same layers
+// serves the same ETags, although the layers get new random IDs
+func TestFileServerETagRestart(t *testing.T) {
+	cdn, customer := mustNewMemFS(), mustNewMemFS()
+	writeFile(cdn, "/logo.svg", []byte("<svg/>"), 0644)
+	writeFile(customer, "/app.css", []byte("body{}"), 0644)
+
+	serve := func() map[string]string {
+		ufs := New(
+			WithWritableLayer(mustNewMemFS()),
+			WithReadOnlyLayer(customer, LayerName("customer")),
+			WithReadOnlyLayer(cdn),
+		)
+		h := ufs.FileServer()
+		etags := make(map[string]string)
+		for _, name := range []string{"/logo.svg", "/app.css"} {
+			etags[name] = serveRequest(h, "GET", name, nil).Header.Get("ETag")
+		}
+		return etags
+	}
+	first, second := serve(), serve()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("ETags changed across restarts: %v, %v", first, second)
+	}
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/docs/a.html", []byte("a"), 0644)
+	writeFile(base, "/docs/old.html", []byte("old"), 0644)
+	writeFile(base, "/docs/sub/b.html", []byte("b"), 0644)
+	writeFile(base, "/site/index.html", []byte("home"), 0644)
+	overlay := mustNewMemFS()
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+	writeFile(ufs, "/docs/new & improved.html", []byte("new"), 0644)
+	ufs.Remove("/docs/old.html")
+	h := ufs.FileServer()
+
+	resp := serveRequest(h, "GET", "/docs", nil)
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "docs/" {
+		t.Errorf("redirect: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	listing := readBody(serveRequest(h, "GET", "/docs/", nil))
+	for _, want := range []string{`<a href="a.html">a.html</a>`, `<a href="sub/">sub/</a>`, "new &amp; improved.html"} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("expected %q in listing:\n%s", want, listing)
+		}
+	}
+	if strings.Contains(listing, "old.html") || strings.Contains(listing, WhiteoutPrefix) {
+		t.Errorf("expected whiteouts hidden:\n%s", listing)
+	}
+
+	if got := readBody(serveRequest(h, "GET", "/site/", nil)); got != "home" {
+		t.Errorf("index: got %q", got)
+	}
+	if resp := serveRequest(h, "GET", "/docs/a.html/", nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("file with slash: %d", resp.StatusCode)
+	}
+}
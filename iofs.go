@@ -0,0 +1,141 @@
+package unionfs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+)
+
+// ioFS is a read-only io/fs view of a UnionFS rooted at a directory
+type ioFS struct {
+	ufs  *UnionFS
+	root string // absolute union path of the view's root
+}
+
+// Ensure ioFS implements the io/fs interfaces at compile time
+var (
+	_ fs.FS         = (*ioFS)(nil)
+	_ fs.StatFS     = (*ioFS)(nil)
+	_ fs.ReadDirFS  = (*ioFS)(nil)
+	_ fs.ReadFileFS = (*ioFS)(nil)
+	_ fs.GlobFS     = (*ioFS)(nil)
+	_ fs.SubFS      = (*ioFS)(nil)
+)
+
+// IOFS returns a read-only io/fs view of the merged filesystem. The view
+// implements fs.FS, fs.StatFS, fs.ReadDirFS, fs.ReadFileFS, fs.GlobFS and
+// fs.SubFS, and accepts only names valid under fs.ValidPath. It can be
+// passed directly to template.ParseFS, http.FS or fs.WalkDir.
+//
+// Example:
+//
+//	fsys := ufs.IOFS()
+//	tmpl, err := template.ParseFS(fsys, "templates/*.html")
+//	http.Handle("/", http.FileServer(http.FS(fsys)))
+func (ufs *UnionFS) IOFS() fs.FS {
+	return &ioFS{ufs: ufs, root: "/"}
+}
+
+// fullPath validates name and returns the union path it refers to
+func (f *ioFS) fullPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(f.root, name), nil
+}
+
+// pathError reports err against the name the caller used rather than the
+// union path
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open implements fs.FS
+func (f *ioFS) Open(name string) (fs.File, error) {
+	full, err := f.fullPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.ufs.Open(full)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return file, nil
+}
+
+// Stat implements fs.StatFS
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := f.fullPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.ufs.Stat(full)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := f.fullPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.ufs.ReadDir(full)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	return entries, nil
+}
+
+// ReadFile implements fs.ReadFileFS
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	full, err := f.fullPath("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.ufs.ReadFile(full)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return data, nil
+}
+
+// Glob implements fs.GlobFS
+func (f *ioFS) Glob(pattern string) ([]string, error) {
+	// fs.Glob falls back to ReadDir when the filesystem has no Glob method
+	return fs.Glob(globFS{f}, pattern)
+}
+
+// Sub implements fs.SubFS
+func (f *ioFS) Sub(dir string) (fs.FS, error) {
+	full, err := f.fullPath("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "." {
+		return f, nil
+	}
+	info, err := f.ufs.Stat(full)
+	if err != nil {
+		return nil, pathError("sub", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: errors.New("not a directory")}
+	}
+	return &ioFS{ufs: f.ufs, root: full}, nil
+}
+
+// globFS exposes an ioFS without its Glob method so fs.Glob does not recurse
+type globFS struct {
+	f *ioFS
+}
+
+func (g globFS) Open(name string) (fs.File, error) { return g.f.Open(name) }
+
+func (g globFS) ReadDir(name string) ([]fs.DirEntry, error) { return g.f.ReadDir(name) }
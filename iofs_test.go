@@ -0,0 +1,78 @@
+package unionfs
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// iofsUnion builds a union with files in several layers and a whiteout
+func iofsUnion(t *testing.T) *UnionFS {
+	t.Helper()
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/templates/base.html", []byte("<base>"), 0644)
+	writeFile(base, "/templates/old.html", []byte("<old>"), 0644)
+	writeFile(base, "/static/app.css", []byte("body{}"), 0644)
+	writeFile(overlay, "/templates/page.html", []byte("<page>"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+	)
+	if err := ufs.Remove("/templates/old.html"); err != nil {
+		t.Fatal(err)
+	}
+	return ufs
+}
+
+// TestIOFSTestFS runs the standard library conformance checks
+func TestIOFSTestFS(t *testing.T) {
+	fsys := iofsUnion(t).IOFS()
+	if err := fstest.TestFS(fsys, "templates/base.html", "templates/page.html", "static/app.css"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "base.html", "page.html"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIOFSInterfaces tests the optional interfaces directly
+func TestIOFSInterfaces(t *testing.T) {
+	fsys := iofsUnion(t).IOFS()
+
+	matches, err := fs.Glob(fsys, "templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"templates/base.html", "templates/page.html"}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("Glob: got %v, want %v", matches, want)
+	}
+
+	data, err := fs.ReadFile(fsys, "static/app.css")
+	if err != nil || string(data) != "body{}" {
+		t.Errorf("ReadFile: got %q, %v", data, err)
+	}
+
+	if _, err := fs.Stat(fsys, "templates/old.html"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected whited out file to not exist, got %v", err)
+	}
+
+	for _, name := range []string{"/templates", "templates/../static", "./static", ""} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Open(%q): expected ErrInvalid, got %v", name, err)
+		}
+	}
+
+	var pe *fs.PathError
+	if _, err := fsys.Open("missing.txt"); !errors.As(err, &pe) || pe.Path != "missing.txt" {
+		t.Errorf("expected PathError for relative name, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package unionfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrLayerNotFound is returned when no layer matches a reference
+var ErrLayerNotFound = errors.New("layer not found")
+
+// LayerOption sets metadata on a layer as it is added
+type LayerOption func(*Layer)
+
+// LayerName gives a layer a human-readable name, such as "app-deps:1.0"
+func LayerName(name string) LayerOption {
+	return func(l *Layer) {
+		l.name = name
+	}
+}
+
+// LayerID sets a layer's ID. Layers without one get a random ID.
+func LayerID(id string) LayerOption {
+	return func(l *Layer) {
+		l.id = id
+	}
+}
+
+// LayerLabels attaches free-form labels to a layer
+func LayerLabels(labels map[string]string) LayerOption {
+	return func(l *Layer) {
+		l.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			l.labels[k] = v
+		}
+	}
+}
+
+// LayerInfo describes a layer of the union
+type LayerInfo struct {
+	ID       string
+	Name     string
+	Labels   map[string]string
+	ReadOnly bool
+	Index    int // position in the stack, 0 being the top
+}
+
+// newLayer creates a layer and applies its options
+func newLayer(fs absfs.FileSystem, readOnly bool, opts []LayerOption) *Layer {
+	l := &Layer{fs: fs, readOnly: readOnly}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.id == "" {
+		l.id = newLayerID()
+	}
+	return l
+}
+
+// newLayerID returns a random layer ID
+func newLayerID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// String returns the layer's name, or its ID if it has no name
+func (l *Layer) String() string {
+	if l.name != "" {
+		return l.name
+	}
+	return l.id
+}
+
+// info returns the layer's descriptor at index i
+func (l *Layer) info(i int) LayerInfo {
+	labels := make(map[string]string, len(l.labels))
+	for k, v := range l.labels {
+		labels[k] = v
+	}
+	return LayerInfo{
+		ID:       l.id,
+		Name:     l.name,
+		Labels:   labels,
+		ReadOnly: l.readOnly,
+		Index:    i,
+	}
+}
+
+// Layers returns descriptors of the layers, top to bottom
+func (ufs *UnionFS) Layers() []LayerInfo {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	infos := make([]LayerInfo, len(ufs.layers))
+	for i, layer := range ufs.layers {
+		infos[i] = layer.info(i)
+	}
+	return infos
+}
+
+// Which returns the layer that name resolves to in the merged view
+func (ufs *UnionFS) Which(name string) (LayerInfo, error) {
+	name = ufs.resolveCase(cleanPath(name))
+
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+	_, idx, err := ufs.findFileLocked(name)
+	if err != nil {
+		return LayerInfo{}, err
+	}
+	return ufs.layers[idx].info(idx), nil
+}
+
+// layerByRef finds a layer by ID or name, and reports whether it is
+// read-only at the time of the lookup
+func (ufs *UnionFS) layerByRef(ref string) (*Layer, bool, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	for _, layer := range ufs.layers {
+		if layer.id == ref {
+			return layer, layer.readOnly, nil
+		}
+	}
+	for _, layer := range ufs.layers {
+		if layer.name == ref {
+			return layer, layer.readOnly, nil
+		}
+	}
+	return nil, false, fmt.Errorf("%w: %q", ErrLayerNotFound, ref)
+}
+
+// LayerDigest returns a content digest of the layer with the given ID or
+// name. The digest covers paths, modes, symlink targets and file contents,
+// but not timestamps, so layers with identical trees share a digest. It is
+// computed on first request and cached for read-only layers; writable
+// layers are hashed on every call.
+func (ufs *UnionFS) LayerDigest(ref string) (string, error) {
+	layer, readOnly, err := ufs.layerByRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if !readOnly {
+		return treeDigest(layer.fs)
+	}
+
+	layer.digestMu.Lock()
+	defer layer.digestMu.Unlock()
+	if layer.digest == "" {
+		digest, err := treeDigest(layer.fs)
+		if err != nil {
+			return "", fmt.Errorf("layer %s: %w", layer, err)
+		}
+		layer.digest = digest
+	}
+	return layer.digest, nil
+}
+
+// treeDigest hashes the tree of fs in name order
+func treeDigest(fs absfs.FileSystem) (string, error) {
+	h := sha256.New()
+	if err := digestDir(h, fs, "/"); err != nil {
+		return "", err
+	}
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestDir adds the entries of dir to h, recursively
+func digestDir(h hash.Hash, fs absfs.FileSystem, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		info, err := lstatLayer(fs, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", p, uint32(info.Mode()))
+
+		switch {
+		case info.IsDir():
+			if err := digestDir(h, fs, p); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := readlinkLayer(fs, p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case info.Mode().IsRegular():
+			f, err := fs.Open(p)
+			if err != nil {
+				return err
+			}
+			content := sha256.New()
+			n, err := io.Copy(content, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%d\x00%x\x00", n, content.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// layerView returns a union over the given layers with the same lookup
+// options, for inspecting part of the stack. Views have no writable layer
+// and no watchers.
+func (ufs *UnionFS) layerView(layers []*Layer) *UnionFS {
+	view := &UnionFS{
+		cache:           newCache(false, 0, 0, 0),
+		copyBufferSize:  ufs.copyBufferSize,
+		dirOrdering:     ufs.dirOrdering,
+		caseInsensitive: ufs.caseInsensitive,
+	}
+	for _, layer := range layers {
+		view.layers = append(view.layers, &Layer{fs: layer.fs, readOnly: true, id: layer.id, name: layer.name})
+	}
+	return view
+}
@@ -0,0 +1,117 @@
+package unionfs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestLayerMetadata tests names, IDs and labels reported by Layers
+func TestLayerMetadata(t *testing.T) {
+	ufs := New(
+		WithWritableLayer(mustNewMemFS(), LayerName("scratch")),
+		WithReadOnlyLayer(mustNewMemFS(), LayerName("app-deps:1.0"), LayerID("deps"), LayerLabels(map[string]string{"team": "platform"})),
+		WithReadOnlyLayer(mustNewMemFS()),
+	)
+
+	layers := ufs.Layers()
+	if len(layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(layers))
+	}
+	want := LayerInfo{ID: "deps", Name: "app-deps:1.0", Labels: map[string]string{"team": "platform"}, ReadOnly: true, Index: 1}
+	if !reflect.DeepEqual(layers[1], want) {
+		t.Errorf("got %+v, want %+v", layers[1], want)
+	}
+	if layers[0].Name != "scratch" || layers[0].ReadOnly {
+		t.Errorf("unexpected top layer %+v", layers[0])
+	}
+	if layers[2].ID == "" || layers[2].ID == layers[0].ID {
+		t.Errorf("expected unique generated IDs, got %q and %q", layers[2].ID, layers[0].ID)
+	}
+
+	// Descriptors are copies
+	layers[1].Labels["team"] = "changed"
+	if ufs.Layers()[1].Labels["team"] != "platform" {
+		t.Error("expected labels to be copied")
+	}
+}
+
+// TestLayerDigest tests content digests of layers
+func TestLayerDigest(t *testing.T) {
+	a := mustNewMemFS()
+	b := mustNewMemFS()
+	writeFile(a, "/lib/libc.so", []byte("libc"), 0755)
+	writeFile(b, "/lib/libc.so", []byte("libc"), 0755)
+	b.Chtimes("/lib/libc.so", time.Unix(0, 0), time.Unix(0, 0))
+
+	overlay := mustNewMemFS()
+	ufs := New(
+		WithWritableLayer(overlay, LayerName("top")),
+		WithReadOnlyLayer(a, LayerName("a")),
+		WithReadOnlyLayer(b, LayerName("b")),
+	)
+
+	da, err := ufs.LayerDigest("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ufs.LayerDigest("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if da != db {
+		t.Errorf("expected identical trees to share a digest, got %s and %s", da, db)
+	}
+
+	// Read-only digests are cached; writable layers are rehashed
+	writeFile(a, "/lib/extra.so", []byte("extra"), 0755)
+	if again, _ := ufs.LayerDigest("a"); again != da {
+		t.Error("expected cached digest for read-only layer")
+	}
+	before, _ := ufs.LayerDigest("top")
+	writeFile(ufs, "/new.txt", []byte("new"), 0644)
+	if after, _ := ufs.LayerDigest("top"); after == before {
+		t.Error("expected writable layer digest to change")
+	}
+
+	if _, err := ufs.LayerDigest("missing"); !errors.Is(err, ErrLayerNotFound) {
+		t.Errorf("expected ErrLayerNotFound, got %v", err)
+	}
+}
+
+// TestLayerDigestDuringSnapshots tests digests of a layer that snapshots
+// freeze and thaw concurrently
+func TestLayerDigestDuringSnapshots(t *testing.T) {
+	overlay := mustNewMemFS()
+	writeFile(overlay, "/etc/app.conf", []byte("app"), 0644)
+	ufs := New(WithWritableLayer(overlay, LayerName("top")), WithReadOnlyLayer(mustNewMemFS()))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			id, err := ufs.Snapshot()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := ufs.DiscardSnapshot(id); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := ufs.LayerDigest("top"); err != nil {
+			t.Error(err)
+			<-done
+			return
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package unionfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// ManifestVersion is the manifest format written by Manifest
+const ManifestVersion = 1
+
+// Layer types understood by DefaultResolver
+const (
+	LayerTypeMemFS = "memfs" // in-memory layer, optionally seeded from a tar snapshot
+	LayerTypeDir   = "dir"   // host directory
+	LayerTypeTar   = "tar"   // uncompressed tar archive
+	LayerTypeZip   = "zip"   // zip archive
+	LayerTypeFS    = "fs"    // fs.FS registered with the resolver by name
+	LayerTypeHTTP  = "http"  // remote tar blob served with Range requests
+)
+
+var (
+	// ErrUnsupportedLayer is returned when a resolver cannot build a layer
+	ErrUnsupportedLayer = errors.New("unsupported layer")
+	// ErrNotDescribable is returned by Manifest for layers that were not
+	// loaded from a manifest and have no serializable form
+	ErrNotDescribable = errors.New("layer cannot be described by a manifest")
+)
+
+// Manifest is a serializable description of a union: its layers, top to
+// bottom, and its options. Manifests are plain JSON, so deployments can
+// rebuild an identical union from configuration with Load.
+type Manifest struct {
+	Version int             `json:"version"`
+	Layers  []LayerSpec     `json:"layers"`
+	Options ManifestOptions `json:"options"`
+}
+
+// LayerSpec describes one layer of a manifest
+type LayerSpec struct {
+	Type     string            `json:"type"`
+	Location string            `json:"location,omitempty"` // path, URL or registered name
+	Writable bool              `json:"writable,omitempty"`
+	Snapshot []byte            `json:"snapshot,omitempty"` // tar of a memfs layer's contents
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// ManifestOptions records the union options that have a serializable form
+type ManifestOptions struct {
+	Cache           *CacheSpec        `json:"cache,omitempty"`
+	CopyBufferSize  int               `json:"copyBufferSize,omitempty"`
+	ParallelLookup  int               `json:"parallelLookup,omitempty"`
+	DirOrdering     DirOrdering       `json:"dirOrdering,omitempty"`
+	CaseInsensitive bool              `json:"caseInsensitive,omitempty"`
+	CreatePolicy    CreatePolicy      `json:"createPolicy,omitempty"`
+	SearchPolicy    SearchPolicy      `json:"searchPolicy,omitempty"`
+	BranchPrefixes  map[string]string `json:"branchPrefixes,omitempty"` // prefix to branch ID or name
+	WriteRoutes     map[string]string `json:"writeRoutes,omitempty"`    // prefix to writable layer ID or name
+}
+
+// CacheSpec records stat cache settings
+type CacheSpec struct {
+	StatTTL     string `json:"statTTL"`
+	NegativeTTL string `json:"negativeTTL"`
+	MaxEntries  int    `json:"maxEntries"`
+}
+
+// Resolver builds the filesystem for a layer spec
+type Resolver interface {
+	ResolveLayer(spec LayerSpec) (absfs.FileSystem, error)
+}
+
+// DefaultResolver resolves the built-in layer types. Paths are host paths;
+// fs layers are looked up by name in FS. Writable layers must be memfs or
+// host directories. Wrap it to support further types.
+type DefaultResolver struct {
+	FS     map[string]fs.FS
+	Client *http.Client // for http layers; defaults to http.DefaultClient
+}
+
+// ResolveLayer implements Resolver
+func (r DefaultResolver) ResolveLayer(spec LayerSpec) (absfs.FileSystem, error) {
+	if spec.Writable && spec.Type != LayerTypeMemFS && spec.Type != LayerTypeDir {
+		return nil, fmt.Errorf("%w: writable %s layer", ErrUnsupportedLayer, spec.Type)
+	}
+
+	switch spec.Type {
+	case LayerTypeMemFS:
+		mfs, err := memfs.NewFS()
+		if err != nil {
+			return nil, err
+		}
+		if spec.Location != "" {
+			f, err := os.Open(spec.Location)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			if err := importTar(mfs, f, "/", false); err != nil {
+				return nil, err
+			}
+		}
+		if len(spec.Snapshot) > 0 {
+			if err := importTar(mfs, bytes.NewReader(spec.Snapshot), "/", false); err != nil {
+				return nil, err
+			}
+		}
+		return mfs, nil
+
+	case LayerTypeDir:
+		return newDirLayer(spec.Location, !spec.Writable)
+
+	case LayerTypeTar, LayerTypeZip:
+		// The archive stays open for the lifetime of the layer
+		f, err := os.Open(spec.Location)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		newLayer := NewTarLayer
+		if spec.Type == LayerTypeZip {
+			newLayer = NewZipLayer
+		}
+		layer, err := newLayer(f, info.Size())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return layer, nil
+
+	case LayerTypeFS:
+		fsys, ok := r.FS[spec.Location]
+		if !ok {
+			return nil, fmt.Errorf("%w: no fs.FS registered as %q", ErrUnsupportedLayer, spec.Location)
+		}
+		return newFSLayer(fsys), nil
+
+	case LayerTypeHTTP:
+		return NewHTTPLayer(HTTPLayerConfig{URL: spec.Location, Client: r.Client})
+	}
+	return nil, fmt.Errorf("%w: type %q", ErrUnsupportedLayer, spec.Type)
+}
+
+// Load builds a union from a manifest. A nil resolver uses DefaultResolver.
+//
+// Example:
+//
+//	var m unionfs.Manifest
+//	json.Unmarshal(config, &m)
+//	ufs, err := unionfs.Load(&m, unionfs.DefaultResolver{
+//	    FS: map[string]fs.FS{"assets": assets},
+//	})
+func Load(m *Manifest, resolver Resolver) (*UnionFS, error) {
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if resolver == nil {
+		resolver = DefaultResolver{}
+	}
+
+	var opts []Option
+	writable := make(map[string]absfs.FileSystem)
+	for i, spec := range m.Layers {
+		if spec.Writable && i != 0 && !m.Layers[i-1].Writable {
+			return nil, fmt.Errorf("layer %d: writable layers must be at the top", i)
+		}
+		layerFS, err := resolver.ResolveLayer(spec)
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+		layerOpts := []LayerOption{LayerID(spec.ID), LayerName(spec.Name), layerSpec(spec)}
+		if spec.Labels != nil {
+			layerOpts = append(layerOpts, LayerLabels(spec.Labels))
+		}
+		if spec.Writable {
+			writable[spec.ID], writable[spec.Name] = layerFS, layerFS
+		}
+		if spec.Writable && i == 0 {
+			opts = append(opts, WithWritableLayer(layerFS, layerOpts...))
+		} else if spec.Writable {
+			opts = append(opts, WithWritableBranch(layerFS, layerOpts...))
+		} else {
+			opts = append(opts, WithReadOnlyLayer(layerFS, layerOpts...))
+		}
+	}
+
+	o := m.Options
+	if o.Cache != nil {
+		statTTL, err := time.ParseDuration(o.Cache.StatTTL)
+		if err != nil {
+			return nil, fmt.Errorf("cache statTTL: %w", err)
+		}
+		negativeTTL, err := time.ParseDuration(o.Cache.NegativeTTL)
+		if err != nil {
+			return nil, fmt.Errorf("cache negativeTTL: %w", err)
+		}
+		opts = append(opts, WithCacheConfig(true, statTTL, negativeTTL, o.Cache.MaxEntries))
+	}
+	if o.CopyBufferSize > 0 {
+		opts = append(opts, WithCopyBufferSize(o.CopyBufferSize))
+	}
+	if o.ParallelLookup > 0 {
+		opts = append(opts, WithParallelLookup(o.ParallelLookup))
+	}
+	opts = append(opts, WithDirOrdering(o.DirOrdering))
+	if o.CaseInsensitive {
+		opts = append(opts, WithCaseInsensitive())
+	}
+	opts = append(opts, WithCreatePolicy(o.CreatePolicy), WithSearchPolicy(o.SearchPolicy))
+	for prefix, ref := range o.BranchPrefixes {
+		opts = append(opts, WithBranchPrefix(prefix, ref))
+	}
+	for prefix, ref := range o.WriteRoutes {
+		layerFS, ok := writable[ref]
+		if !ok || ref == "" {
+			return nil, fmt.Errorf("write route %s: no writable layer %q", prefix, ref)
+		}
+		opts = append(opts, WithWriteRoute(prefix, layerFS))
+	}
+
+	return New(opts...), nil
+}
+
+// layerSpec records the manifest entry a layer is loaded from
+func layerSpec(spec LayerSpec) LayerOption {
+	return func(l *Layer) {
+		l.spec = &spec
+	}
+}
+
+// Manifest describes the union's current layers and options. Layers loaded
+// from a manifest keep their spec; memfs layers are described by a tar
+// snapshot of their current contents. Other layers cannot be described and
+// yield ErrNotDescribable.
+func (ufs *UnionFS) Manifest() (*Manifest, error) {
+	ufs.mu.RLock()
+	layers := append([]*Layer(nil), ufs.layers...)
+	routes := append([]writeRoute(nil), ufs.routes...)
+	ufs.mu.RUnlock()
+
+	m := &Manifest{Version: ManifestVersion, Layers: make([]LayerSpec, 0, len(layers))}
+	for _, layer := range layers {
+		var spec LayerSpec
+		if layer.spec != nil {
+			spec = *layer.spec
+		}
+		if _, ok := layer.fs.(*memfs.FileSystem); ok && (layer.spec == nil || spec.Type == LayerTypeMemFS) {
+			var buf bytes.Buffer
+			if err := exportTar(&buf, layer.fs, "/", false); err != nil {
+				return nil, fmt.Errorf("layer %s: %w", layer, err)
+			}
+			spec = LayerSpec{Type: LayerTypeMemFS, Snapshot: buf.Bytes()}
+		} else if layer.spec == nil {
+			return nil, fmt.Errorf("layer %s: %w", layer, ErrNotDescribable)
+		}
+		info := layer.info(0)
+		spec.Writable = !layer.readOnly
+		spec.ID, spec.Name = info.ID, info.Name
+		spec.Labels = nil
+		if len(info.Labels) > 0 {
+			spec.Labels = info.Labels
+		}
+		m.Layers = append(m.Layers, spec)
+	}
+
+	m.Options = ManifestOptions{
+		ParallelLookup:  ufs.parallelism,
+		DirOrdering:     ufs.dirOrdering,
+		CaseInsensitive: ufs.caseInsensitive,
+		CreatePolicy:    ufs.createPolicy,
+		SearchPolicy:    ufs.searchPolicy,
+	}
+	if len(ufs.branchPrefixes) > 0 {
+		// Earlier rules for the same prefix take precedence
+		m.Options.BranchPrefixes = make(map[string]string, len(ufs.branchPrefixes))
+		for i := len(ufs.branchPrefixes) - 1; i >= 0; i-- {
+			rule := ufs.branchPrefixes[i]
+			m.Options.BranchPrefixes[rule.prefix] = rule.ref
+		}
+	}
+	if len(routes) > 0 {
+		// Earlier routes for the same prefix take precedence
+		m.Options.WriteRoutes = make(map[string]string, len(routes))
+		for i := len(routes) - 1; i >= 0; i-- {
+			route := routes[i]
+			m.Options.WriteRoutes[route.prefix] = route.layer.info(0).ID
+		}
+	}
+	if ufs.copyBufferSize != 32*1024 {
+		m.Options.CopyBufferSize = ufs.copyBufferSize
+	}
+	if ufs.cache.enabled {
+		m.Options.Cache = &CacheSpec{
+			StatTTL:     ufs.cache.statTTL.String(),
+			NegativeTTL: ufs.cache.negativeTTL.String(),
+			MaxEntries:  ufs.cache.maxEntries,
+		}
+	}
+	return m, nil
+}
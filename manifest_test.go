@@ -0,0 +1,144 @@
+package unionfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// TestManifestRoundTrip tests that a described union reloads identically
+func TestManifestRoundTrip(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/old.conf", []byte("old"), 0600)
+	base.(absfs.SymLinker).Symlink("/etc/app.conf", "/etc/link.conf")
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+		WithStatCache(true, 5*time.Second),
+		WithDirOrdering(OrderCaseFolded),
+	)
+	writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644)
+	ufs.Remove("/etc/old.conf")
+
+	m, err := ufs.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Manifest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Options.DirOrdering != OrderCaseFolded || decoded.Options.Cache == nil {
+		t.Errorf("options not preserved: %+v", decoded.Options)
+	}
+
+	loaded, err := Load(&decoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readFile(loaded, "/etc/app.conf"); string(got) != "changed" {
+		t.Errorf("expected overlay contents, got %q", got)
+	}
+	if _, err := loaded.Stat("/etc/old.conf"); err == nil {
+		t.Error("expected whiteout to survive the round trip")
+	}
+	if target, err := loaded.Readlink("/etc/link.conf"); err != nil || target != "/etc/app.conf" {
+		t.Errorf("Readlink: got %q, %v", target, err)
+	}
+	if info, err := loaded.Stat("/etc/app.conf"); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Stat: got %v, %v", info, err)
+	}
+
+	// Writes to the reloaded union do not touch the original
+	writeFile(loaded, "/new.txt", []byte("new"), 0644)
+	if _, err := ufs.Stat("/new.txt"); err == nil {
+		t.Error("expected reloaded union to be independent")
+	}
+}
+
+// TestLoadLayerTypes tests loading archive, directory and fs.FS layers
+func TestLoadLayerTypes(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "base.tar")
+	if err := os.WriteFile(tarPath, buildTar(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hostDir := filepath.Join(dir, "host")
+	os.MkdirAll(filepath.Join(hostDir, "srv"), 0755)
+	os.WriteFile(filepath.Join(hostDir, "srv", "site.txt"), []byte("site"), 0644)
+
+	m := &Manifest{
+		Version: ManifestVersion,
+		Layers: []LayerSpec{
+			{Type: LayerTypeMemFS, Writable: true},
+			{Type: LayerTypeFS, Location: "assets", ID: "l1", Name: "assets", Labels: map[string]string{"tier": "static"}},
+			{Type: LayerTypeDir, Location: hostDir, ID: "l2"},
+			{Type: LayerTypeTar, Location: tarPath, ID: "l3", Name: "base:1.0"},
+		},
+		Options: ManifestOptions{ParallelLookup: 4},
+	}
+	ufs, err := Load(m, DefaultResolver{FS: map[string]fs.FS{"assets": fstest.MapFS{
+		"assets/logo.txt": {Data: []byte("logo")},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"/assets/logo.txt":   "logo",
+		"/srv/site.txt":      "site",
+		"/usr/lib/libfoo.so": "libfoo",
+	} {
+		if got, err := readFile(ufs, name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// Loaded layers keep their specs; the writable memfs is snapshotted
+	described, err := ufs.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(described.Layers[1:], m.Layers[1:]) {
+		t.Errorf("layer specs changed: %+v", described.Layers[1:])
+	}
+	if described.Options.ParallelLookup != 4 {
+		t.Errorf("expected parallel lookup to be recorded, got %d", described.Options.ParallelLookup)
+	}
+}
+
+// TestManifestErrors tests invalid manifests and undescribable layers
+func TestManifestErrors(t *testing.T) {
+	if _, err := Load(&Manifest{Version: 99}, nil); err == nil {
+		t.Error("expected error for unknown version")
+	}
+	m := &Manifest{Version: ManifestVersion, Layers: []LayerSpec{{Type: "nfs"}}}
+	if _, err := Load(m, nil); !errors.Is(err, ErrUnsupportedLayer) {
+		t.Errorf("expected ErrUnsupportedLayer, got %v", err)
+	}
+	m = &Manifest{Version: ManifestVersion, Layers: []LayerSpec{{Type: LayerTypeMemFS}, {Type: LayerTypeMemFS, Writable: true}}}
+	if _, err := Load(m, nil); err == nil {
+		t.Error("expected error for writable lower layer")
+	}
+
+	data := buildZip(t)
+	ufs := New(WithZipLayer(bytes.NewReader(data), int64(len(data))))
+	if _, err := ufs.Manifest(); !errors.Is(err, ErrNotDescribable) {
+		t.Errorf("expected ErrNotDescribable, got %v", err)
+	}
+}
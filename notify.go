@@ -0,0 +1,223 @@
+package unionfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/absfs/absfs"
+)
+
+// Op describes the kind of change reported by an Event
+type Op uint32
+
+const (
+	// Create reports that a file, directory or symlink appeared
+	Create Op = 1 << iota
+	// Write reports that file contents changed
+	Write
+	// Remove reports that a path disappeared from the merged view
+	Remove
+	// Rename reports that a path was moved; Event.OldPath holds the source
+	Rename
+	// Chmod reports a change to permissions, ownership or timestamps
+	Chmod
+)
+
+// String returns a human readable representation of the operation set
+func (op Op) String() string {
+	var names []string
+	for _, n := range []struct {
+		op   Op
+		name string
+	}{
+		{Create, "CREATE"},
+		{Write, "WRITE"},
+		{Remove, "REMOVE"},
+		{Rename, "RENAME"},
+		{Chmod, "CHMOD"},
+	} {
+		if op&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is a change to the merged view of a UnionFS
+type Event struct {
+	Op      Op
+	Path    string
+	OldPath string // set for Rename
+}
+
+// watchBufferSize is the number of events buffered per subscription.
+// Events are dropped for subscribers that fall further behind.
+const watchBufferSize = 256
+
+// subscription is a single Watch registration
+type subscription struct {
+	path      string
+	recursive bool
+	ch        chan Event
+}
+
+// matches reports whether p is covered by the subscription. Non-recursive
+// subscriptions see the path itself and its direct children.
+func (s *subscription) matches(p string) bool {
+	if p == s.path {
+		return true
+	}
+	if s.recursive {
+		return s.path == "/" || strings.HasPrefix(p, s.path+"/")
+	}
+	return path.Dir(p) == s.path
+}
+
+// notifier fans out events to subscribers
+type notifier struct {
+	mu     sync.RWMutex
+	subs   map[*subscription]struct{}
+	active int32 // number of subscribers, read without locking on hot paths
+}
+
+// Watch subscribes to changes at p as seen through the union. If recursive
+// is true, changes anywhere below p are reported; otherwise only p and its
+// direct children are. Events come from the union's own mutators and from
+// any configured LayerWatcher. The returned function cancels the
+// subscription and closes the channel. Events are dropped if the receiver
+// falls more than a few hundred events behind.
+func (ufs *UnionFS) Watch(p string, recursive bool) (<-chan Event, func()) {
+	sub := &subscription{
+		path:      cleanPath(p),
+		recursive: recursive,
+		ch:        make(chan Event, watchBufferSize),
+	}
+
+	n := &ufs.notifier
+	n.mu.Lock()
+	if n.subs == nil {
+		n.subs = make(map[*subscription]struct{})
+	}
+	n.subs[sub] = struct{}{}
+	atomic.AddInt32(&n.active, 1)
+	n.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			n.mu.Lock()
+			delete(n.subs, sub)
+			atomic.AddInt32(&n.active, -1)
+			close(sub.ch)
+			n.mu.Unlock()
+		})
+	}
+	return sub.ch, cancel
+}
+
+// watching reports whether anyone is subscribed to events
+func (ufs *UnionFS) watching() bool {
+	return atomic.LoadInt32(&ufs.notifier.active) > 0
+}
+
+// notify delivers an event for p to all matching subscribers
+func (ufs *UnionFS) notify(op Op, p string) {
+	ufs.notifyEvent(Event{Op: op, Path: p})
+}
+
+// notifyEvent delivers ev to all subscribers watching its path or old path
+func (ufs *UnionFS) notifyEvent(ev Event) {
+	if !ufs.watching() {
+		return
+	}
+
+	n := &ufs.notifier
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for sub := range n.subs {
+		if !sub.matches(ev.Path) && (ev.OldPath == "" || !sub.matches(ev.OldPath)) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// Subscriber is not keeping up; drop rather than block writers
+		}
+	}
+}
+
+// watchedFile reports a Write event when a modified file is closed
+type watchedFile struct {
+	absfs.File
+	ufs     *UnionFS
+	path    string
+	written bool
+}
+
+// wrapWatched wraps f so that writes are reported on Close, if anyone is watching
+func (ufs *UnionFS) wrapWatched(f absfs.File, p string, truncated bool) absfs.File {
+	if !ufs.watching() {
+		return f
+	}
+	return &watchedFile{File: f, ufs: ufs, path: p, written: truncated}
+}
+
+func (f *watchedFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	if n > 0 {
+		f.written = true
+	}
+	return n, err
+}
+
+func (f *watchedFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	if n > 0 {
+		f.written = true
+	}
+	return n, err
+}
+
+func (f *watchedFile) WriteString(s string) (int, error) {
+	n, err := f.File.WriteString(s)
+	if n > 0 {
+		f.written = true
+	}
+	return n, err
+}
+
+func (f *watchedFile) Truncate(size int64) error {
+	err := f.File.Truncate(size)
+	if err == nil {
+		f.written = true
+	}
+	return err
+}
+
+// Close closes the file and reports a Write event if its contents changed
+func (f *watchedFile) Close() error {
+	err := f.File.Close()
+	if f.written {
+		f.written = false
+		f.ufs.notify(Write, f.path)
+	}
+	return err
+}
+
+// whiteoutEventOp maps a change to a whiteout marker to the change it causes
+// for the masked path: a new whiteout removes it, a removed whiteout reveals it
+func whiteoutEventOp(op Op) Op {
+	switch {
+	case op&Create != 0:
+		return Remove
+	case op&Remove != 0:
+		return Create
+	}
+	return op
+}
@@ -0,0 +1,168 @@
+package unionfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event on ch
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+// TestWatchMutators tests that union mutators raise events
+func TestWatchMutators(t *testing.T) {
+	baseLayer := mustNewMemFS()
+	overlay := mustNewMemFS()
+	writeFile(baseLayer, "/app/config.yml", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(baseLayer),
+	)
+
+	events, cancel := ufs.Watch("/app", true)
+	defer cancel()
+
+	// Modifying a lower-layer file is a write, not a create
+	f, err := ufs.OpenFile("/app/config.yml", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	f.Write([]byte("overlay"))
+	f.Close()
+	if ev := nextEvent(t, events); ev.Op != Write || ev.Path != "/app/config.yml" {
+		t.Errorf("expected WRITE /app/config.yml, got %v %s", ev.Op, ev.Path)
+	}
+
+	// New files raise a create followed by a write on close
+	if err := writeFile(ufs, "/app/new.yml", []byte("new"), 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Op != Create || ev.Path != "/app/new.yml" {
+		t.Errorf("expected CREATE /app/new.yml, got %v %s", ev.Op, ev.Path)
+	}
+	if ev := nextEvent(t, events); ev.Op != Write {
+		t.Errorf("expected WRITE, got %v", ev.Op)
+	}
+
+	if err := ufs.Chmod("/app/new.yml", 0600); err != nil {
+		t.Fatalf("failed to chmod: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Op != Chmod {
+		t.Errorf("expected CHMOD, got %v", ev.Op)
+	}
+
+	if err := ufs.Rename("/app/new.yml", "/app/renamed.yml"); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	ev := nextEvent(t, events)
+	if ev.Op != Rename || ev.Path != "/app/renamed.yml" || ev.OldPath != "/app/new.yml" {
+		t.Errorf("unexpected rename event: %+v", ev)
+	}
+
+	if err := ufs.Remove("/app/config.yml"); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Op != Remove || ev.Path != "/app/config.yml" {
+		t.Errorf("expected REMOVE /app/config.yml, got %v %s", ev.Op, ev.Path)
+	}
+}
+
+// TestWatchScope tests recursive and non-recursive subscriptions
+func TestWatchScope(t *testing.T) {
+	ufs := New(WithWritableLayer(mustNewMemFS()))
+	ufs.MkdirAll("/a/b", 0755)
+
+	shallow, cancelShallow := ufs.Watch("/a", false)
+	defer cancelShallow()
+	deep, cancelDeep := ufs.Watch("/a", true)
+	defer cancelDeep()
+
+	ufs.Mkdir("/a/b/c", 0755)
+	ufs.Mkdir("/a/d", 0755)
+	ufs.Mkdir("/ab", 0755)
+
+	if ev := nextEvent(t, deep); ev.Path != "/a/b/c" {
+		t.Errorf("expected /a/b/c on recursive watch, got %s", ev.Path)
+	}
+	if ev := nextEvent(t, deep); ev.Path != "/a/d" {
+		t.Errorf("expected /a/d on recursive watch, got %s", ev.Path)
+	}
+	if ev := nextEvent(t, shallow); ev.Path != "/a/d" {
+		t.Errorf("expected /a/d on shallow watch, got %s", ev.Path)
+	}
+
+	select {
+	case ev := <-deep:
+		t.Errorf("unexpected event %v %s", ev.Op, ev.Path)
+	case ev := <-shallow:
+		t.Errorf("unexpected event %v %s", ev.Op, ev.Path)
+	default:
+	}
+
+	cancelDeep()
+	if _, ok := <-deep; ok {
+		t.Error("expected channel to be closed after cancel")
+	}
+}
+
+// TestWatchShadowedLayerEvents tests that changes hidden by upper layers are
+// not reported
+func TestWatchShadowedLayerEvents(t *testing.T) {
+	top, base := mustNewMemFS(), mustNewMemFS()
+	writeFile(top, "/f", []byte("top"), 0644)
+	writeFile(base, "/f", []byte("base"), 0644)
+	writeFile(base, "/gone", []byte("base"), 0644)
+	writeFile(top, "/"+WhiteoutPrefix+"gone", nil, 0644)
+	base.MkdirAll("/dir", 0755)
+	top.MkdirAll("/dir", 0755)
+	ufs := New(
+		WithWritableLayer(top, LayerName("top")),
+		WithReadOnlyLayer(base, LayerName("base")),
+	)
+
+	events, cancel := ufs.Watch("/", true)
+	defer cancel()
+
+	ufs.handleLayerEvent(LayerEvent{Path: "/f", Op: Write, Layer: "base"})
+	ufs.handleLayerEvent(LayerEvent{Path: "/gone", Op: Write, Layer: "base"})
+	ufs.handleLayerEvent(LayerEvent{Path: "/dir", Op: Chmod, Layer: "base"})
+
+	// Changes under a merged directory show through
+	ufs.handleLayerEvent(LayerEvent{Path: "/dir", Tree: true, Op: Create, Layer: "base"})
+	if ev := nextEvent(t, events); ev.Op != Create || ev.Path != "/dir" {
+		t.Errorf("expected CREATE /dir, got %v %s", ev.Op, ev.Path)
+	}
+	ufs.handleLayerEvent(LayerEvent{Path: "/f", Op: Write, Layer: "top"})
+	if ev := nextEvent(t, events); ev.Op != Write || ev.Path != "/f" {
+		t.Errorf("expected WRITE /f, got %v %s", ev.Op, ev.Path)
+	}
+}
+
+// TestWatchLayerEvents tests that layer watcher events reach subscribers
+func TestWatchLayerEvents(t *testing.T) {
+	ufs := New(WithWritableLayer(mustNewMemFS()))
+
+	events, cancel := ufs.Watch("/", true)
+	defer cancel()
+
+	ufs.handleLayerEvent(LayerEvent{Path: "/etc/app.conf", Op: Write})
+	if ev := nextEvent(t, events); ev.Op != Write || ev.Path != "/etc/app.conf" {
+		t.Errorf("expected WRITE /etc/app.conf, got %v %s", ev.Op, ev.Path)
+	}
+
+	// A whiteout appearing in a layer removes the masked file from the view
+	ufs.handleLayerEvent(LayerEvent{Path: "/etc/.wh.old.conf", Op: Create})
+	if ev := nextEvent(t, events); ev.Op != Remove || ev.Path != "/etc/old.conf" {
+		t.Errorf("expected REMOVE /etc/old.conf, got %v %s", ev.Op, ev.Path)
+	}
+}
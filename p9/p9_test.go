@@ -0,0 +1,428 @@
+package p9
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+	"github.com/absfs/unionfs"
+)
+
+// client is a minimal 9P2000.L client
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+	next uint32 // next unused fid
+}
+
+// rpc sends a request built by body and returns the response body, or the
+// Rlerror as an errnoError
+func (c *client) rpc(typ uint8, body func(e *encoder)) (*decoder, error) {
+	c.t.Helper()
+	c.tag++
+	e := newMessage(typ, c.tag)
+	if body != nil {
+		body(e)
+	}
+	if _, err := c.conn.Write(e.bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	rtyp, rtag, d, err := readMessage(c.conn, DefaultMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if rtag != c.tag {
+		c.t.Fatalf("got tag %d, want %d", rtag, c.tag)
+	}
+	if rtyp == msgRlerror {
+		return nil, errnoError(d.u32())
+	}
+	if rtyp != typ+1 {
+		c.t.Fatalf("got message type %d, want %d", rtyp, typ+1)
+	}
+	return d, nil
+}
+
+// must fails the test if err is set
+func (c *client) must(d *decoder, err error) *decoder {
+	c.t.Helper()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return d
+}
+
+// walk walks from the root fid to a new fid for names
+func (c *client) walk(names ...string) (uint32, error) {
+	c.next++
+	n := c.next
+	d, err := c.rpc(msgTwalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(n)
+		e.u16(uint16(len(names)))
+		for _, name := range names {
+			e.str(name)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if got := d.u16(); int(got) != len(names) {
+		return 0, fmt.Errorf("partial walk: %d of %d", got, len(names))
+	}
+	return n, nil
+}
+
+func (c *client) open(flags uint32, names ...string) uint32 {
+	c.t.Helper()
+	n, err := c.walk(names...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.must(c.rpc(msgTlopen, func(e *encoder) { e.u32(n); e.u32(flags) }))
+	return n
+}
+
+func (c *client) read(n uint32, offset uint64) string {
+	c.t.Helper()
+	d := c.must(c.rpc(msgTread, func(e *encoder) { e.u32(n); e.u64(offset); e.u32(4096) }))
+	return string(d.next(int(d.u32())))
+}
+
+func (c *client) write(n uint32, offset uint64, data string) {
+	c.t.Helper()
+	d := c.must(c.rpc(msgTwrite, func(e *encoder) {
+		e.u32(n)
+		e.u64(offset)
+		e.u32(uint32(len(data)))
+		e.b = append(e.b, data...)
+	}))
+	if got := d.u32(); int(got) != len(data) {
+		c.t.Fatalf("short write: %d", got)
+	}
+}
+
+func (c *client) clunk(n uint32) {
+	c.t.Helper()
+	c.must(c.rpc(msgTclunk, func(e *encoder) { e.u32(n) }))
+}
+
+// readdir lists a directory with reads of at most count bytes
+func (c *client) readdir(count uint32, names ...string) []string {
+	c.t.Helper()
+	n := c.open(0, names...)
+	defer c.clunk(n)
+	var entries []string
+	var offset uint64
+	for {
+		d := c.must(c.rpc(msgTreaddir, func(e *encoder) { e.u32(n); e.u64(offset); e.u32(count) }))
+		data := &decoder{b: d.next(int(d.u32()))}
+		if len(data.b) == 0 {
+			return entries
+		}
+		for len(data.b) > 0 {
+			data.qid()
+			offset = data.u64()
+			data.u8()
+			entries = append(entries, data.str())
+		}
+	}
+}
+
+// getattr returns the mode and size of a file
+func (c *client) getattr(names ...string) (uint32, uint64, time.Time) {
+	c.t.Helper()
+	n, err := c.walk(names...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer c.clunk(n)
+	d := c.must(c.rpc(msgTgetattr, func(e *encoder) { e.u32(n); e.u64(getattrBasic) }))
+	d.u64()
+	d.qid()
+	mode := d.u32()
+	d.u32()
+	d.u32()
+	d.u64()
+	d.u64()
+	size := d.u64()
+	d.u64()
+	d.u64()
+	d.u64()
+	d.u64()
+	mtime := timeOf(d.u64(), d.u64())
+	return mode, size, mtime
+}
+
+// newClient serves a union with a populated base layer over a unix socket
+// and returns a client attached to it
+func newClient(t *testing.T) (*client, *unionfs.UnionFS, absfs.FileSystem, absfs.FileSystem) {
+	t.Helper()
+	overlay, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.MkdirAll("/etc/conf.d", 0755)
+	for name, data := range map[string]string{
+		"/etc/app.conf":        "base app",
+		"/etc/hosts":           "127.0.0.1 localhost",
+		"/etc/old.conf":        "old",
+		"/etc/conf.d/a.conf":   "a",
+		"/etc/conf.d/b.conf":   "b",
+		"/usr/share/readme.md": "readme",
+	} {
+		base.MkdirAll(filepath.Dir(name), 0755)
+		f, err := base.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+		f.Close()
+	}
+	ufs := unionfs.New(unionfs.WithWritableLayer(overlay), unionfs.WithReadOnlyLayer(base))
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "9p.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewServer(ufs).Serve(l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &client{t: t, conn: conn}
+	d := c.must(c.rpc(msgTversion, func(e *encoder) { e.u32(65536); e.str(Version) }))
+	if msize, version := d.u32(), d.str(); msize != 65536 || version != Version {
+		t.Fatalf("version: got %d %q", msize, version)
+	}
+	c.must(c.rpc(msgTattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(^uint32(0))
+		e.str("user")
+		e.str("")
+		e.u32(1000)
+	}))
+	return c, ufs, overlay, base
+}
+
+// TestReadWrite tests reading lower files and writing through copy-up
+func TestReadWrite(t *testing.T) {
+	c, ufs, overlay, base := newClient(t)
+
+	n := c.open(0, "etc", "app.conf")
+	if got := c.read(n, 0); got != "base app" {
+		t.Errorf("read: got %q", got)
+	}
+	if got := c.read(n, 5); got != "app" {
+		t.Errorf("read at offset: got %q", got)
+	}
+	c.clunk(n)
+
+	// Writing a lower file copies it up
+	n = c.open(openRdwr|openTrunc, "etc", "app.conf")
+	c.write(n, 0, "edited")
+	c.clunk(n)
+	if data, _ := ufs.ReadFile("/etc/app.conf"); string(data) != "edited" {
+		t.Errorf("expected edited contents, got %q", data)
+	}
+	if _, err := overlay.Stat("/etc/app.conf"); err != nil {
+		t.Errorf("expected copy-up into the writable layer: %v", err)
+	}
+	if f, err := base.Open("/etc/app.conf"); err == nil {
+		buf := make([]byte, 64)
+		m, _ := f.Read(buf)
+		f.Close()
+		if string(buf[:m]) != "base app" {
+			t.Errorf("base layer modified: %q", buf[:m])
+		}
+	}
+
+	// Creating a file turns the directory fid into the new file
+	dir, err := c.walk("etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.must(c.rpc(msgTlcreate, func(e *encoder) {
+		e.u32(dir)
+		e.str("new.conf")
+		e.u32(openWronly | openCreate)
+		e.u32(0o640)
+		e.u32(0)
+	}))
+	c.write(dir, 0, "hello")
+	c.write(dir, 5, " world")
+	c.clunk(dir)
+	if data, _ := ufs.ReadFile("/etc/new.conf"); string(data) != "hello world" {
+		t.Errorf("expected created contents, got %q", data)
+	}
+	if info, err := ufs.Stat("/etc/new.conf"); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("Stat: got %v, %v", info, err)
+	}
+}
+
+// TestReaddir tests merged listings with whiteouts applied, read in pages
+func TestReaddir(t *testing.T) {
+	c, ufs, _, _ := newClient(t)
+	ufs.Remove("/etc/old.conf")
+	if f, err := ufs.Create("/etc/upper.conf"); err == nil {
+		f.Close()
+	}
+
+	want := []string{"app.conf", "conf.d", "hosts", "upper.conf"}
+	for _, count := range []uint32{4096, 40} {
+		got := c.readdir(count, "etc")
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("count %d: got %v, want %v", count, got, want)
+		}
+	}
+}
+
+// TestAttributes tests getattr and setattr
+func TestAttributes(t *testing.T) {
+	c, ufs, _, _ := newClient(t)
+
+	mode, size, _ := c.getattr("etc", "hosts")
+	if mode != modeFile|0o644 && mode != modeFile|0o666 || size != 19 {
+		t.Errorf("getattr: mode %o size %d", mode, size)
+	}
+	if mode, _, _ := c.getattr("etc"); mode&modeDir == 0 {
+		t.Errorf("expected directory mode, got %o", mode)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	n, err := c.walk("etc", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.must(c.rpc(msgTsetattr, func(e *encoder) {
+		e.u32(n)
+		e.u32(setMode | setSize | setMtime | setMtimeSet)
+		e.u32(0o600)
+		e.u32(0)
+		e.u32(0)
+		e.u64(9)
+		e.u64(0)
+		e.u64(0)
+		e.u64(uint64(mtime.Unix()))
+		e.u64(0)
+	}))
+	c.clunk(n)
+
+	mode, size, got := c.getattr("etc", "hosts")
+	if mode != modeFile|0o600 || size != 9 || !got.Equal(mtime) {
+		t.Errorf("after setattr: mode %o size %d mtime %v", mode, size, got)
+	}
+	if data, _ := ufs.ReadFile("/etc/hosts"); string(data) != "127.0.0.1" {
+		t.Errorf("expected truncated contents, got %q", data)
+	}
+}
+
+// TestNamespaceOps tests mkdir, symlink, rename and unlink
+func TestNamespaceOps(t *testing.T) {
+	c, ufs, _, _ := newClient(t)
+	root, err := c.walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.must(c.rpc(msgTmkdir, func(e *encoder) { e.u32(root); e.str("srv"); e.u32(0o755); e.u32(0) }))
+	if info, err := ufs.Stat("/srv"); err != nil || !info.IsDir() {
+		t.Errorf("mkdir: got %v, %v", info, err)
+	}
+
+	etc, _ := c.walk("etc")
+	c.must(c.rpc(msgTsymlink, func(e *encoder) { e.u32(etc); e.str("link.conf"); e.str("app.conf"); e.u32(0) }))
+	link, _ := c.walk("etc", "link.conf")
+	if d := c.must(c.rpc(msgTreadlink, func(e *encoder) { e.u32(link) })); d.str() != "app.conf" {
+		t.Error("readlink: wrong target")
+	}
+
+	// Renaming a lower directory is left to the client to copy, as on
+	// overlayfs; one created in the writable layer moves
+	_, err = c.rpc(msgTrenameat, func(e *encoder) { e.u32(etc); e.str("conf.d"); e.u32(root); e.str("conf") })
+	if !errors.Is(err, errnoError(errXDev)) {
+		t.Errorf("rename lower directory: got %v", err)
+	}
+	if data, err := ufs.ReadFile("/etc/conf.d/b.conf"); err != nil || string(data) != "b" {
+		t.Errorf("after failed rename: got %q, %v", data, err)
+	}
+	c.must(c.rpc(msgTrenameat, func(e *encoder) { e.u32(root); e.str("srv"); e.u32(root); e.str("srv2") }))
+	if info, err := ufs.Stat("/srv2"); err != nil || !info.IsDir() {
+		t.Errorf("rename: got %v, %v", info, err)
+	}
+
+	// Trename moves the fid along with the file
+	hosts, _ := c.walk("etc", "hosts")
+	c.must(c.rpc(msgTrename, func(e *encoder) { e.u32(hosts); e.u32(root); e.str("hosts") }))
+	c.must(c.rpc(msgTlopen, func(e *encoder) { e.u32(hosts); e.u32(0) }))
+	if got := c.read(hosts, 0); got != "127.0.0.1 localhost" {
+		t.Errorf("read renamed: got %q", got)
+	}
+
+	unlink := func(dir uint32, name string, flags uint32) error {
+		_, err := c.rpc(msgTunlinkat, func(e *encoder) { e.u32(dir); e.str(name); e.u32(flags) })
+		return err
+	}
+	if err := unlink(root, "usr", 0); !errors.Is(err, errnoError(errIsDir)) {
+		t.Errorf("unlink directory without flag: got %v", err)
+	}
+	if err := unlink(etc, "app.conf", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/etc/app.conf"); !os.IsNotExist(err) {
+		t.Errorf("expected unlinked file to be hidden, got %v", err)
+	}
+	if err := unlink(root, "srv2", removeDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestErrors tests error replies
+func TestErrors(t *testing.T) {
+	c, _, _, _ := newClient(t)
+
+	if _, err := c.walk("etc", "missing"); err == nil {
+		t.Error("expected partial walk to fail")
+	}
+	if _, err := c.walk("missing"); !errors.Is(err, errnoError(errNoEnt)) {
+		t.Errorf("walk missing: got %v", err)
+	}
+	if _, err := c.rpc(msgTclunk, func(e *encoder) { e.u32(999) }); !errors.Is(err, errnoError(errBadF)) {
+		t.Errorf("clunk unknown fid: got %v", err)
+	}
+	if _, err := c.rpc(msgTlcreate, func(e *encoder) {
+		e.u32(0)
+		e.str("../escape")
+		e.u32(openCreate)
+		e.u32(0o644)
+		e.u32(0)
+	}); !errors.Is(err, errnoError(errInval)) {
+		t.Errorf("create with slash: got %v", err)
+	}
+	if _, err := c.rpc(msgTlcreate, func(e *encoder) {
+		e.u32(0)
+		e.str("etc")
+		e.u32(openCreate | openExcl)
+		e.u32(0o644)
+		e.u32(0)
+	}); err == nil {
+		t.Error("expected exclusive create of an existing name to fail")
+	}
+}
@@ -0,0 +1,373 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/absfs/unionfs"
+)
+
+// Version is the protocol version spoken by the server
+const Version = "9P2000.L"
+
+// Message types of 9P2000.L. Each R-message is its T-message plus one.
+const (
+	msgRlerror   = 7
+	msgTstatfs   = 8
+	msgTlopen    = 12
+	msgTlcreate  = 14
+	msgTsymlink  = 16
+	msgTrename   = 20
+	msgTreadlink = 22
+	msgTgetattr  = 24
+	msgTsetattr  = 26
+	msgTreaddir  = 40
+	msgTfsync    = 50
+	msgTlock     = 52
+	msgTgetlock  = 54
+	msgTmkdir    = 72
+	msgTrenameat = 74
+	msgTunlinkat = 76
+	msgTversion  = 100
+	msgTattach   = 104
+	msgTflush    = 108
+	msgTwalk     = 110
+	msgTread     = 116
+	msgTwrite    = 118
+	msgTclunk    = 120
+	msgTremove   = 122
+)
+
+const (
+	// headerSize is the size of the size, type and tag fields
+	headerSize = 7
+	// ioHeaderSize is the overhead of Rread and Twrite around the data
+	ioHeaderSize = headerSize + 4 + 8 + 4
+)
+
+// Qid types
+const (
+	qidDir     = 0x80
+	qidSymlink = 0x02
+	qidFile    = 0x00
+)
+
+// Linux file type and special mode bits, as carried in getattr and create
+const (
+	modeFIFO   = 0o010000
+	modeChar   = 0o020000
+	modeDir    = 0o040000
+	modeBlock  = 0o060000
+	modeFile   = 0o100000
+	modeLink   = 0o120000
+	modeSocket = 0o140000
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+// Linux open flags, as carried in lopen and lcreate
+const (
+	openWronly = 0o1
+	openRdwr   = 0o2
+	openCreate = 0o100
+	openExcl   = 0o200
+	openTrunc  = 0o1000
+	openAppend = 0o2000
+)
+
+// Attribute masks of setattr and getattr
+const (
+	setMode     = 0x1
+	setUID      = 0x2
+	setGID      = 0x4
+	setSize     = 0x8
+	setAtime    = 0x10
+	setMtime    = 0x20
+	setAtimeSet = 0x80
+	setMtimeSet = 0x100
+
+	getattrBasic = 0x7ff
+
+	removeDir = 0x200 // AT_REMOVEDIR in unlinkat
+
+	direntDir  = 4
+	direntFile = 8
+	direntLink = 10
+)
+
+// Linux error numbers sent in Rlerror
+const (
+	errPerm     = 1
+	errNoEnt    = 2
+	errIO       = 5
+	errBadF     = 9
+	errAccess   = 13
+	errExist    = 17
+	errXDev     = 18
+	errNotDir   = 20
+	errIsDir    = 21
+	errInval    = 22
+	errNoSpace  = 28
+	errROFS     = 30
+	errNameLong = 36
+	errNoSys    = 38
+	errNotEmpty = 39
+	errLoop     = 40
+	errNotSupp  = 95
+	errStale    = 116
+)
+
+// linuxErrno maps host error numbers to Linux ones
+var linuxErrno = map[syscall.Errno]uint32{
+	syscall.EPERM:        errPerm,
+	syscall.ENOENT:       errNoEnt,
+	syscall.EIO:          errIO,
+	syscall.EBADF:        errBadF,
+	syscall.EACCES:       errAccess,
+	syscall.EEXIST:       errExist,
+	syscall.EXDEV:        errXDev,
+	syscall.ENOTDIR:      errNotDir,
+	syscall.EISDIR:       errIsDir,
+	syscall.EINVAL:       errInval,
+	syscall.ENOSPC:       errNoSpace,
+	syscall.EROFS:        errROFS,
+	syscall.ENAMETOOLONG: errNameLong,
+	syscall.ENOSYS:       errNoSys,
+	syscall.ENOTEMPTY:    errNotEmpty,
+	syscall.ELOOP:        errLoop,
+	syscall.EOPNOTSUPP:   errNotSupp,
+	syscall.ESTALE:       errStale,
+}
+
+// errnoOf returns the Linux error number reported for err
+func errnoOf(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if n, ok := linuxErrno[errno]; ok {
+			return n
+		}
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errNoEnt
+	case errors.Is(err, fs.ErrExist):
+		return errExist
+	case errors.Is(err, fs.ErrPermission):
+		return errAccess
+	case errors.Is(err, unionfs.ErrReadOnlyLayer), errors.Is(err, unionfs.ErrNoWritableLayer):
+		return errROFS
+	case errors.Is(err, unionfs.ErrStaleHandle):
+		return errStale
+	case errors.Is(err, fs.ErrInvalid):
+		return errInval
+	case errors.Is(err, fs.ErrClosed):
+		return errBadF
+	case errors.Is(err, errors.ErrUnsupported):
+		return errNotSupp
+	}
+	return errIO
+}
+
+// errnoError is an error carrying a Linux error number
+type errnoError uint32
+
+func (e errnoError) Error() string {
+	return "p9: errno " + strconv.FormatUint(uint64(e), 10)
+}
+
+// qid identifies a file to the client
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// qidOf returns the qid of the file at p. The qid path is a hash of the
+// union path, so it is stable for as long as the file is not renamed.
+func qidOf(p string, info os.FileInfo) qid {
+	h := fnv.New64a()
+	io.WriteString(h, p)
+	q := qid{path: h.Sum64()}
+	switch {
+	case info.IsDir():
+		q.typ = qidDir
+	case info.Mode()&os.ModeSymlink != 0:
+		q.typ = qidSymlink
+	default:
+		q.typ = qidFile
+		q.version = uint32(info.ModTime().UnixNano())
+	}
+	return q
+}
+
+// linuxMode converts a FileMode to Linux mode bits
+func linuxMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= modeDir
+	case m&os.ModeSymlink != 0:
+		mode |= modeLink
+	case m&os.ModeNamedPipe != 0:
+		mode |= modeFIFO
+	case m&os.ModeSocket != 0:
+		mode |= modeSocket
+	case m&os.ModeCharDevice != 0:
+		mode |= modeChar
+	case m&os.ModeDevice != 0:
+		mode |= modeBlock
+	default:
+		mode |= modeFile
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
+
+// fileMode converts the permission and special bits of a Linux mode
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// openFlags converts Linux open flags to os flags
+func openFlags(flags uint32) int {
+	var flag int
+	switch {
+	case flags&openRdwr != 0:
+		flag = os.O_RDWR
+	case flags&openWronly != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if flags&openCreate != 0 {
+		flag |= os.O_CREATE
+	}
+	if flags&openExcl != 0 {
+		flag |= os.O_EXCL
+	}
+	if flags&openTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if flags&openAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	return flag
+}
+
+// timeOf converts seconds and nanoseconds to a time
+func timeOf(sec, nsec uint64) time.Time {
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// decoder reads the fields of a message. After a short read every field is
+// zero and err is set.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errnoError(errInval)
+		if n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8   { return d.next(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+func (d *decoder) qid() qid {
+	return qid{typ: d.u8(), version: d.u32(), path: d.u64()}
+}
+
+// encoder builds a message, starting with its header
+type encoder struct {
+	b []byte
+}
+
+// newMessage starts a message of type typ with tag
+func newMessage(typ uint8, tag uint16) *encoder {
+	e := &encoder{b: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8)   { e.b = append(e.b, v) }
+func (e *encoder) u16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *encoder) u32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *encoder) u64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+// bytes finishes the message by filling in its size
+func (e *encoder) bytes() []byte {
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+	return e.b
+}
+
+// readMessage reads one message of at most msize bytes and returns its
+// type, tag and body
+func readMessage(r io.Reader, msize uint32) (uint8, uint16, *decoder, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < headerSize || n > msize {
+		return 0, 0, nil, errors.New("p9: invalid message size")
+	}
+	b := make([]byte, n-4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, 0, nil, err
+	}
+	d := &decoder{b: b[3:]}
+	return b[0], binary.LittleEndian.Uint16(b[1:3]), d, nil
+}
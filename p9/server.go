@@ -0,0 +1,733 @@
+// Package p9 serves a UnionFS over 9P2000.L, the protocol used by Linux
+// v9fs mounts and by many lightweight VMs and sandboxes. Operations map onto
+// the union's methods, so writes go to the writable layer with the usual
+// copy-on-write and whiteout handling.
+//
+// Example:
+//
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(overlay),
+//	    unionfs.WithReadOnlyLayer(base),
+//	)
+//	l, _ := net.Listen("tcp", ":5640")
+//	p9.NewServer(ufs).Serve(l)
+//
+// and on a Linux guest:
+//
+//	mount -t 9p -o trans=tcp,port=5640,version=9p2000.L host /mnt
+package p9
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/unionfs"
+)
+
+// DefaultMsize is the largest message size the server negotiates
+const DefaultMsize = 1 << 20
+
+// Server serves a UnionFS over 9P2000.L
+type Server struct {
+	ufs *unionfs.UnionFS
+	fs  absfs.FileSystem
+}
+
+// NewServer returns a server for ufs
+func NewServer(ufs *unionfs.UnionFS) *Server {
+	return &Server{ufs: ufs, fs: ufs.FileSystem()}
+}
+
+// Serve accepts connections on l and serves each on its own goroutine. It
+// returns when l fails, for example because it was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one connection until it is closed or a malformed message
+// arrives. Requests are handled in order.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	c := &conn9{srv: s, msize: DefaultMsize, fids: make(map[uint32]*fid)}
+	defer conn.Close()
+	defer c.clunkAll()
+	for {
+		typ, tag, d, err := readMessage(conn, c.msize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		resp := c.handle(typ, tag, d)
+		if _, err := conn.Write(resp.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// fid is a client's reference to a file
+type fid struct {
+	path    string
+	file    absfs.File    // set once opened
+	append  bool          // opened with O_APPEND, so writes ignore offsets
+	entries []fs.DirEntry // listing captured by the first readdir
+}
+
+// conn9 is the state of one connection
+type conn9 struct {
+	srv   *Server
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+// handle runs one request and returns its response
+func (c *conn9) handle(typ uint8, tag uint16, d *decoder) *encoder {
+	resp := newMessage(typ+1, tag)
+	err := c.dispatch(typ, d, resp)
+	if err == nil && d.err != nil {
+		err = d.err
+	}
+	if err != nil {
+		resp = newMessage(msgRlerror, tag)
+		var errno errnoError
+		if !errors.As(err, &errno) {
+			errno = errnoError(errnoOf(err))
+		}
+		resp.u32(uint32(errno))
+	}
+	return resp
+}
+
+// dispatch decodes a request, runs it and encodes the response body
+func (c *conn9) dispatch(typ uint8, d *decoder, e *encoder) error {
+	switch typ {
+	case msgTversion:
+		return c.version(d, e)
+	case msgTattach:
+		return c.attach(d, e)
+	case msgTwalk:
+		return c.walk(d, e)
+	case msgTlopen:
+		return c.lopen(d, e)
+	case msgTlcreate:
+		return c.lcreate(d, e)
+	case msgTread:
+		return c.read(d, e)
+	case msgTwrite:
+		return c.write(d, e)
+	case msgTreaddir:
+		return c.readdir(d, e)
+	case msgTgetattr:
+		return c.getattr(d, e)
+	case msgTsetattr:
+		return c.setattr(d)
+	case msgTmkdir:
+		return c.mkdir(d, e)
+	case msgTsymlink:
+		return c.symlink(d, e)
+	case msgTreadlink:
+		return c.readlink(d, e)
+	case msgTrename:
+		return c.rename(d)
+	case msgTrenameat:
+		return c.renameat(d)
+	case msgTunlinkat:
+		return c.unlinkat(d)
+	case msgTremove:
+		return c.remove(d)
+	case msgTclunk:
+		return c.clunk(d)
+	case msgTstatfs:
+		return c.statfs(d, e)
+	case msgTfsync:
+		_, err := c.fid(d.u32())
+		return err
+	case msgTflush:
+		// Requests are handled in order, so the flushed one has finished
+		d.u16()
+		return nil
+	case msgTlock:
+		return c.lock(d, e)
+	case msgTgetlock:
+		return c.getlock(d, e)
+	}
+	// Authentication, extended attributes, hard links and device nodes
+	// are not supported
+	return errnoError(errNotSupp)
+}
+
+// fid returns the fid numbered n
+func (c *conn9) fid(n uint32) (*fid, error) {
+	f, ok := c.fids[n]
+	if !ok {
+		return nil, errnoError(errBadF)
+	}
+	return f, nil
+}
+
+// child returns the path of name in the directory of fid n
+func (c *conn9) child(n uint32, name string) (string, error) {
+	dir, err := c.fid(n)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", errnoError(errInval)
+	}
+	return path.Join(dir.path, name), nil
+}
+
+// clunkAll releases every fid
+func (c *conn9) clunkAll() {
+	for n, f := range c.fids {
+		if f.file != nil {
+			f.file.Close()
+		}
+		delete(c.fids, n)
+	}
+}
+
+// stat returns the qid of the file at p
+func (c *conn9) stat(p string) (qid, os.FileInfo, error) {
+	info, err := c.srv.ufs.Lstat(p)
+	if err != nil {
+		return qid{}, nil, err
+	}
+	return qidOf(p, info), info, nil
+}
+
+// iounit is the largest read or write that fits in one message
+func (c *conn9) iounit() uint32 {
+	return c.msize - ioHeaderSize
+}
+
+func (c *conn9) version(d *decoder, e *encoder) error {
+	msize, version := d.u32(), d.str()
+	if msize < 4096 {
+		return errnoError(errInval)
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	c.clunkAll()
+	if !strings.HasPrefix(version, Version) {
+		version = "unknown"
+	} else {
+		version = Version
+	}
+	e.u32(c.msize)
+	e.str(version)
+	return nil
+}
+
+func (c *conn9) attach(d *decoder, e *encoder) error {
+	n, _ := d.u32(), d.u32() // fid, afid
+	d.str()                  // uname
+	d.str()                  // aname
+	d.u32()                  // n_uname
+	if _, ok := c.fids[n]; ok {
+		return errnoError(errBadF)
+	}
+	q, _, err := c.stat("/")
+	if err != nil {
+		return err
+	}
+	c.fids[n] = &fid{path: "/"}
+	e.qid(q)
+	return nil
+}
+
+func (c *conn9) walk(d *decoder, e *encoder) error {
+	n, newN, count := d.u32(), d.u32(), d.u16()
+	names := make([]string, 0, count)
+	for i := 0; i < int(count) && d.err == nil; i++ {
+		names = append(names, d.str())
+	}
+	f, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.fids[newN]; ok && newN != n {
+		return errnoError(errBadF)
+	}
+
+	p := f.path
+	qids := make([]qid, 0, len(names))
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "/") {
+			err = errnoError(errInval)
+			break
+		}
+		next := path.Join(p, name) // ".." stops at the root
+		var q qid
+		if q, _, err = c.stat(next); err != nil {
+			break
+		}
+		qids = append(qids, q)
+		p = next
+	}
+	if len(qids) == 0 && len(names) > 0 {
+		return err
+	}
+
+	// A partial walk returns the qids found and leaves newfid unused
+	if len(qids) == len(names) {
+		if newN == n {
+			f.path = p
+		} else {
+			c.fids[newN] = &fid{path: p}
+		}
+	}
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return nil
+}
+
+func (c *conn9) lopen(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	flags := d.u32()
+	if err != nil {
+		return err
+	}
+	if f.file != nil {
+		return errnoError(errBadF)
+	}
+	file, err := c.srv.ufs.OpenFile(f.path, openFlags(flags&^(openCreate|openExcl)), 0)
+	if err != nil {
+		return err
+	}
+	q, _, err := c.stat(f.path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.append = file, flags&openAppend != 0
+	e.qid(q)
+	e.u32(c.iounit())
+	return nil
+}
+
+func (c *conn9) lcreate(d *decoder, e *encoder) error {
+	n, name, flags, mode := d.u32(), d.str(), d.u32(), d.u32()
+	d.u32() // gid
+	p, err := c.child(n, name)
+	if err != nil {
+		return err
+	}
+	f := c.fids[n]
+	if f.file != nil {
+		return errnoError(errBadF)
+	}
+	file, err := c.srv.ufs.OpenFile(p, openFlags(flags)|os.O_CREATE, fileMode(mode))
+	if err != nil {
+		return err
+	}
+	q, _, err := c.stat(p)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.path, f.file, f.append = p, file, flags&openAppend != 0
+	e.qid(q)
+	e.u32(c.iounit())
+	return nil
+}
+
+func (c *conn9) read(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	offset, count := d.u64(), d.u32()
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		return errnoError(errBadF)
+	}
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+	buf := make([]byte, count)
+	n, err := f.file.ReadAt(buf, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	e.u32(uint32(n))
+	e.b = append(e.b, buf[:n]...)
+	return nil
+}
+
+func (c *conn9) write(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	offset, count := d.u64(), d.u32()
+	data := d.next(int(count))
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		return errnoError(errBadF)
+	}
+	var n int
+	if f.append {
+		n, err = f.file.Write(data)
+	} else {
+		n, err = f.file.WriteAt(data, int64(offset))
+	}
+	if err != nil {
+		return err
+	}
+	e.u32(uint32(n))
+	return nil
+}
+
+func (c *conn9) readdir(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	offset, count := d.u64(), d.u32()
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		return errnoError(errBadF)
+	}
+
+	// The listing is captured when a client starts reading at offset 0, and
+	// offsets are positions in it
+	if offset == 0 || f.entries == nil {
+		if f.entries, err = c.srv.ufs.ReadDir(f.path); err != nil {
+			return err
+		}
+	}
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+
+	data := &encoder{}
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		entry := f.entries[i]
+		if len(data.b)+13+8+1+2+len(entry.Name()) > int(count) {
+			break
+		}
+		h := qidOf(path.Join(f.path, entry.Name()), fileInfo{entry})
+		typ := uint8(direntFile)
+		switch {
+		case entry.IsDir():
+			typ = direntDir
+		case entry.Type()&os.ModeSymlink != 0:
+			typ = direntLink
+		}
+		data.qid(h)
+		data.u64(i + 1)
+		data.u8(typ)
+		data.str(entry.Name())
+	}
+	e.u32(uint32(len(data.b)))
+	e.b = append(e.b, data.b...)
+	return nil
+}
+
+// fileInfo gives a directory entry enough of os.FileInfo to compute its
+// qid without a stat per entry
+type fileInfo struct {
+	fs.DirEntry
+}
+
+func (i fileInfo) Size() int64        { return 0 }
+func (i fileInfo) Mode() os.FileMode  { return i.Type() }
+func (i fileInfo) ModTime() time.Time { return time.Time{} }
+func (i fileInfo) Sys() any           { return nil }
+
+func (c *conn9) getattr(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	d.u64() // request mask; all basic attributes are returned
+	if err != nil {
+		return err
+	}
+	q, info, err := c.stat(f.path)
+	if err != nil {
+		return err
+	}
+	nlink := uint64(1)
+	if info.IsDir() {
+		nlink = 2
+	}
+	size := uint64(info.Size())
+	mtime := info.ModTime()
+	e.u64(getattrBasic)
+	e.qid(q)
+	e.u32(linuxMode(info.Mode()))
+	e.u32(0) // uid
+	e.u32(0) // gid
+	e.u64(nlink)
+	e.u64(0) // rdev
+	e.u64(size)
+	e.u64(4096)
+	e.u64((size + 511) / 512)
+	for i := 0; i < 3; i++ { // atime, mtime, ctime
+		e.u64(uint64(mtime.Unix()))
+		e.u64(uint64(mtime.Nanosecond()))
+	}
+	e.u64(0) // btime
+	e.u64(0)
+	e.u64(0) // gen
+	e.u64(0) // data version
+	return nil
+}
+
+func (c *conn9) setattr(d *decoder) error {
+	f, err := c.fid(d.u32())
+	valid, mode, uid, gid, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u64()
+	atime := timeOf(d.u64(), d.u64())
+	mtime := timeOf(d.u64(), d.u64())
+	if err != nil || d.err != nil {
+		return errors.Join(err, d.err)
+	}
+	ufs := c.srv.ufs
+
+	if valid&setMode != 0 {
+		info, err := ufs.Lstat(f.path)
+		if err != nil {
+			return err
+		}
+		if err := ufs.Chmod(f.path, info.Mode().Type()|fileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if valid&(setUID|setGID) != 0 {
+		uidArg, gidArg := -1, -1
+		if valid&setUID != 0 {
+			uidArg = int(uid)
+		}
+		if valid&setGID != 0 {
+			gidArg = int(gid)
+		}
+		if err := ufs.Lchown(f.path, uidArg, gidArg); err != nil {
+			return err
+		}
+	}
+	if valid&setSize != 0 {
+		if err := c.srv.fs.Truncate(f.path, int64(size)); err != nil {
+			return err
+		}
+	}
+	if valid&(setAtime|setMtime) != 0 {
+		info, err := ufs.Lstat(f.path)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		// Without a stored access time, an unchanged one follows mtime
+		newA, newM := info.ModTime(), info.ModTime()
+		if valid&setAtime != 0 {
+			newA = now
+			if valid&setAtimeSet != 0 {
+				newA = atime
+			}
+		}
+		if valid&setMtime != 0 {
+			newM = now
+			if valid&setMtimeSet != 0 {
+				newM = mtime
+			}
+		}
+		if err := ufs.Chtimes(f.path, newA, newM); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn9) mkdir(d *decoder, e *encoder) error {
+	n, name, mode := d.u32(), d.str(), d.u32()
+	d.u32() // gid
+	p, err := c.child(n, name)
+	if err != nil {
+		return err
+	}
+	if err := c.srv.ufs.Mkdir(p, fileMode(mode)); err != nil {
+		return err
+	}
+	q, _, err := c.stat(p)
+	if err != nil {
+		return err
+	}
+	e.qid(q)
+	return nil
+}
+
+func (c *conn9) symlink(d *decoder, e *encoder) error {
+	n, name, target := d.u32(), d.str(), d.str()
+	d.u32() // gid
+	p, err := c.child(n, name)
+	if err != nil {
+		return err
+	}
+	if err := c.srv.ufs.Symlink(target, p); err != nil {
+		return err
+	}
+	q, _, err := c.stat(p)
+	if err != nil {
+		return err
+	}
+	e.qid(q)
+	return nil
+}
+
+func (c *conn9) readlink(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	target, err := c.srv.ufs.Readlink(f.path)
+	if err != nil {
+		return err
+	}
+	e.str(target)
+	return nil
+}
+
+func (c *conn9) rename(d *decoder) error {
+	f, err := c.fid(d.u32())
+	dir, name := d.u32(), d.str()
+	if err != nil {
+		return err
+	}
+	p, err := c.child(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := c.srv.ufs.Rename(f.path, p); err != nil {
+		return err
+	}
+	c.moved(f.path, p)
+	return nil
+}
+
+func (c *conn9) renameat(d *decoder) error {
+	oldDir, oldName, newDir, newName := d.u32(), d.str(), d.u32(), d.str()
+	oldPath, err := c.child(oldDir, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := c.child(newDir, newName)
+	if err != nil {
+		return err
+	}
+	if err := c.srv.ufs.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	c.moved(oldPath, newPath)
+	return nil
+}
+
+// moved updates the fids under oldPath after a rename
+func (c *conn9) moved(oldPath, newPath string) {
+	for _, f := range c.fids {
+		switch {
+		case f.path == oldPath:
+			f.path = newPath
+		case strings.HasPrefix(f.path, oldPath+"/"):
+			f.path = newPath + f.path[len(oldPath):]
+		}
+	}
+}
+
+func (c *conn9) unlinkat(d *decoder) error {
+	dir, name, flags := d.u32(), d.str(), d.u32()
+	p, err := c.child(dir, name)
+	if err != nil {
+		return err
+	}
+	info, err := c.srv.ufs.Lstat(p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case flags&removeDir != 0 && !info.IsDir():
+		return errnoError(errNotDir)
+	case flags&removeDir == 0 && info.IsDir():
+		return errnoError(errIsDir)
+	}
+	return c.srv.ufs.Remove(p)
+}
+
+func (c *conn9) remove(d *decoder) error {
+	n := d.u32()
+	f, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	// The fid is clunked even if the remove fails
+	if f.file != nil {
+		f.file.Close()
+	}
+	delete(c.fids, n)
+	return c.srv.ufs.Remove(f.path)
+}
+
+func (c *conn9) clunk(d *decoder) error {
+	n := d.u32()
+	f, err := c.fid(n)
+	if err != nil {
+		return err
+	}
+	delete(c.fids, n)
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+func (c *conn9) statfs(d *decoder, e *encoder) error {
+	if _, err := c.fid(d.u32()); err != nil {
+		return err
+	}
+	e.u32(0x01021997) // V9FS_MAGIC
+	e.u32(4096)       // block size
+	e.u64(0)          // blocks
+	e.u64(0)          // free blocks
+	e.u64(0)          // available blocks
+	e.u64(0)          // files
+	e.u64(0)          // free files
+	e.u64(0)          // fs id
+	e.u32(255)        // max name length
+	return nil
+}
+
+// lock grants every byte-range lock; locks are advisory and the union does
+// not track them
+func (c *conn9) lock(d *decoder, e *encoder) error {
+	if _, err := c.fid(d.u32()); err != nil {
+		return err
+	}
+	e.u8(0) // success
+	return nil
+}
+
+// getlock reports that no conflicting lock is held
+func (c *conn9) getlock(d *decoder, e *encoder) error {
+	_, err := c.fid(d.u32())
+	d.u8()
+	start, length, proc, client := d.u64(), d.u64(), d.u32(), d.str()
+	if err != nil {
+		return err
+	}
+	e.u8(2) // F_UNLCK
+	e.u64(start)
+	e.u64(length)
+	e.u32(proc)
+	e.str(client)
+	return nil
+}
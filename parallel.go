@@ -0,0 +1,125 @@
+package unionfs
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+// parallel reports whether per-layer probes should run concurrently.
+// The caller must hold ufs.mu.
+func (ufs *UnionFS) parallel() bool {
+	return ufs.parallelism > 1 && len(ufs.layers) > 1
+}
+
+// forEachLayer calls fn for layer indexes 0..n-1, concurrently with at most
+// ufs.parallelism calls in flight when parallel lookups are enabled, and in
+// order otherwise. The caller must hold ufs.mu.
+func (ufs *UnionFS) forEachLayer(n int, fn func(i int)) {
+	if !ufs.parallel() || n <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	sem := make(chan struct{}, ufs.parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// layerProbe is the result of probing a single layer for a path
+type layerProbe struct {
+	info   os.FileInfo
+	err    error
+	masked bool // layer holds a whiteout for the path or an opaque parent
+}
+
+// findFileParallel is findFile with all layers probed concurrently. Results
+// are resolved top-down exactly like the sequential loop: a whiteout in layer
+// j hides the path in every layer below j. The caller must hold ufs.mu.
+func (ufs *UnionFS) findFileParallel(p string) (os.FileInfo, int, error) {
+	probes := make([]layerProbe, len(ufs.layers))
+	ufs.forEachLayer(len(ufs.layers), func(i int) {
+		layer := ufs.layers[i]
+		probes[i].info, probes[i].err = ufs.statLayer(layer, p)
+		probes[i].masked = ufs.hasWhiteout(layer, p)
+	})
+
+	for i, probe := range probes {
+		if probe.err == nil {
+			info, i := ufs.newestBranch(p, probe.info, i, ufs.statLayer)
+			ufs.cache.putStat(ufs.nameKey(p), info, i)
+			return info, i, nil
+		}
+		if !os.IsNotExist(probe.err) {
+			return nil, -1, probe.err
+		}
+		if probe.masked {
+			// Every lower layer is hidden by this whiteout
+			break
+		}
+	}
+
+	ufs.cache.putNegative(ufs.nameKey(p))
+	return nil, -1, os.ErrNotExist
+}
+
+// hasWhiteout reports whether layer hides p with a whiteout marker, or a
+// whiteout or opaque marker for one of its parent directories. A whiteout
+// hides everything the lower layers have under the path, so a directory
+// removed with RemoveAll stays empty when lower layers still hold it.
+//
+// Markers for p live in its parent directories, so the walk goes down from
+// the root and stops at the first parent the layer lacks: a layer without
+// /a costs two Stats for any path under /a, and one holding every parent
+// costs two per level. A layer is assumed not to hold an entry and its own
+// whiteout, as Create, Mkdir and Symlink remove the whiteout first.
+func (ufs *UnionFS) hasWhiteout(layer *Layer, p string) bool {
+	dir := "/"
+	for _, part := range splitPath(path.Dir(p)) {
+		dir = path.Join(dir, part)
+		info, err := ufs.statLayer(layer, dir)
+		if err != nil {
+			_, err := ufs.statLayer(layer, whiteoutPath(dir))
+			return err == nil
+		}
+		if !info.IsDir() {
+			return false
+		}
+		if _, err := ufs.statLayer(layer, path.Join(dir, OpaqueWhiteout)); err == nil {
+			return true
+		}
+	}
+	_, err := ufs.statLayer(layer, whiteoutPath(p))
+	return err == nil
+}
+
+// listedLayers returns how many layers from the top a listing of dir
+// merges: down to the topmost layer that marks dir opaque or hides it with
+// a whiteout, since the layers below that one do not show through. The
+// caller must hold ufs.mu.
+func (ufs *UnionFS) listedLayers(dir string) int {
+	opaquePath := path.Join(dir, OpaqueWhiteout)
+	found := make([]bool, len(ufs.layers))
+	ufs.forEachLayer(len(ufs.layers), func(i int) {
+		layer := ufs.layers[i]
+		_, err := ufs.statLayer(layer, opaquePath)
+		found[i] = err == nil || (dir != "/" && ufs.hasWhiteout(layer, dir))
+	})
+	for i, f := range found {
+		if f {
+			return i + 1
+		}
+	}
+	return len(ufs.layers)
+}
@@ -0,0 +1,120 @@
+package unionfs
+
+import (
+	"io/fs"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// slowFS delays Stat calls and records the peak number of concurrent calls
+type slowFS struct {
+	absfs.FileSystem
+	delay    time.Duration
+	inflight *int32
+	peak     *int32
+}
+
+func (s *slowFS) Stat(name string) (os.FileInfo, error) {
+	n := atomic.AddInt32(s.inflight, 1)
+	defer atomic.AddInt32(s.inflight, -1)
+	for {
+		p := atomic.LoadInt32(s.peak)
+		if n <= p || atomic.CompareAndSwapInt32(s.peak, p, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	return s.FileSystem.Stat(name)
+}
+
+// entryNames returns the names of directory entries in order
+func entryNames(entries []fs.DirEntry) []string {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names
+}
+
+// TestParallelLookupMatchesSequential tests that parallel probing resolves
+// precedence and whiteouts exactly like the sequential path
+func TestParallelLookupMatchesSequential(t *testing.T) {
+	overlay := mustNewMemFS()
+	middle := mustNewMemFS()
+	base := mustNewMemFS()
+
+	writeFile(base, "/dir/a.txt", []byte("base-a"), 0644)
+	writeFile(base, "/dir/b.txt", []byte("base-b"), 0644)
+	writeFile(base, "/hidden/x.txt", []byte("x"), 0644)
+	writeFile(middle, "/dir/a.txt", []byte("middle-a"), 0644)
+	writeFile(middle, "/dir/.wh.b.txt", nil, 0644)
+	writeFile(middle, "/dir/c.txt", []byte("middle-c"), 0644)
+	writeFile(overlay, "/hidden/"+OpaqueWhiteout, nil, 0644)
+	writeFile(overlay, "/hidden/y.txt", []byte("y"), 0644)
+
+	newUnion := func(opts ...Option) *UnionFS {
+		return New(append([]Option{
+			WithWritableLayer(overlay),
+			WithReadOnlyLayer(middle),
+			WithReadOnlyLayer(base),
+		}, opts...)...)
+	}
+	seq := newUnion()
+	par := newUnion(WithParallelLookup(4))
+
+	for _, p := range []string{"/dir/a.txt", "/dir/b.txt", "/dir/c.txt", "/hidden/x.txt", "/hidden/y.txt", "/missing"} {
+		_, seqLayer, seqErr := seq.findFile(p)
+		_, parLayer, parErr := par.findFile(p)
+		if seqLayer != parLayer || (seqErr == nil) != (parErr == nil) {
+			t.Errorf("%s: sequential (%d, %v) != parallel (%d, %v)", p, seqLayer, seqErr, parLayer, parErr)
+		}
+	}
+
+	for _, dir := range []string{"/dir", "/hidden"} {
+		seqEntries, err := seq.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("sequential ReadDir(%s): %v", dir, err)
+		}
+		parEntries, err := par.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("parallel ReadDir(%s): %v", dir, err)
+		}
+		if !reflect.DeepEqual(entryNames(seqEntries), entryNames(parEntries)) {
+			t.Errorf("ReadDir(%s): sequential %v != parallel %v", dir, entryNames(seqEntries), entryNames(parEntries))
+		}
+
+		seqInfos, _ := readDir(seq, dir)
+		parInfos, _ := readDir(par, dir)
+		if len(seqInfos) != len(parInfos) {
+			t.Errorf("Readdir(%s): sequential %d entries != parallel %d", dir, len(seqInfos), len(parInfos))
+		}
+	}
+}
+
+// TestParallelLookupBounded tests that slow layers are probed concurrently
+// without exceeding the worker limit
+func TestParallelLookupBounded(t *testing.T) {
+	var inflight, peak int32
+	opts := []Option{WithParallelLookup(3)}
+	for i := 0; i < 6; i++ {
+		layer := &slowFS{FileSystem: mustNewMemFS(), delay: 10 * time.Millisecond, inflight: &inflight, peak: &peak}
+		opts = append(opts, WithReadOnlyLayer(layer))
+	}
+	ufs := New(opts...)
+
+	if _, err := ufs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+
+	if peak < 2 {
+		t.Errorf("expected concurrent probes, peak was %d", peak)
+	}
+	if peak > 3 {
+		t.Errorf("expected at most 3 concurrent probes, peak was %d", peak)
+	}
+}
@@ -0,0 +1,322 @@
+package unionfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrRebaseConflict is returned by Rebase under RebaseFail when the overlay
+// and the new lower layers both changed a path
+var ErrRebaseConflict = errors.New("rebase conflict")
+
+// RebasePolicy decides how Rebase resolves conflicts
+type RebasePolicy int
+
+const (
+	// RebaseFail reports conflicts and leaves the union unchanged
+	RebaseFail RebasePolicy = iota
+	// RebaseKeepOverlay keeps the overlay's version of conflicting paths
+	RebaseKeepOverlay
+	// RebaseTakeBase drops the overlay's changes to conflicting paths, so
+	// the new lower layers' version shows through
+	RebaseTakeBase
+)
+
+// ConflictKind classifies a rebase conflict
+type ConflictKind int
+
+const (
+	// ConflictModified means the overlay has its own version of a path whose
+	// lower version changed
+	ConflictModified ConflictKind = iota
+	// ConflictRemoved means the overlay whited out a path whose lower
+	// version changed
+	ConflictRemoved
+)
+
+// String returns the kind's name
+func (k ConflictKind) String() string {
+	if k == ConflictRemoved {
+		return "removed"
+	}
+	return "modified"
+}
+
+// RebaseConflict is a path changed both in the overlay and in the lower
+// layers
+type RebaseConflict struct {
+	Path string
+	Kind ConflictKind
+}
+
+// RebaseReport describes the outcome of a rebase
+type RebaseReport struct {
+	Checked   int              // overlay files and whiteouts compared
+	Conflicts []RebaseConflict // in path order
+	Policy    RebasePolicy     // how the conflicts were resolved
+}
+
+// fileVersion identifies the contents of a non-directory entry
+type fileVersion struct {
+	Mode   os.FileMode
+	Digest string // content digest, or digest of the target for symlinks
+}
+
+// Lower is a new lower layer for RebaseOnto, with the options that name and
+// label it
+type Lower struct {
+	FS      absfs.FileSystem
+	Options []LayerOption
+}
+
+// Rebase moves the writable layer onto newLowers, which replace all lower
+// layers, and resolves conflicts as RebaseOnto does. The new layers get
+// fresh IDs and no names; use RebaseOnto to set them.
+//
+// Example:
+//
+//	report, err := ufs.Rebase(newBase)
+//	if errors.Is(err, unionfs.ErrRebaseConflict) {
+//	    for _, c := range report.Conflicts {
+//	        log.Printf("%s: %s", c.Path, c.Kind)
+//	    }
+//	}
+func (ufs *UnionFS) Rebase(newLowers ...absfs.FileSystem) (*RebaseReport, error) {
+	lowers := make([]Lower, len(newLowers))
+	for i, fs := range newLowers {
+		lowers[i] = Lower{FS: fs}
+	}
+	return ufs.RebaseOnto(lowers...)
+}
+
+// RebaseOnto moves the writable layer onto newLowers, which replace all
+// lower layers. A path conflicts when the overlay changed it and its
+// version in the new lower layers differs from the one the overlay started
+// from: the version recorded at copy-up, or for other paths the version in
+// the current lower layers. Conflicts are resolved by the policy set with
+// WithRebasePolicy; under RebaseTakeBase a failure removing the overlay's
+// versions puts back those already removed. Writes are held off while the
+// rebase runs.
+//
+// RebaseOnto is not available while snapshots are held, since their frozen
+// layers would be replaced, nor in unions with several writable branches or
+// write routes.
+//
+// Example:
+//
+//	report, err := ufs.RebaseOnto(unionfs.Lower{
+//	    FS:      newBase,
+//	    Options: []unionfs.LayerOption{unionfs.LayerName("base:2")},
+//	})
+func (ufs *UnionFS) RebaseOnto(newLowers ...Lower) (*RebaseReport, error) {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	top := ufs.writableLayer
+	if top == nil {
+		return nil, ErrNoWritableLayer
+	}
+	if len(ufs.snapshots) > 0 {
+		return nil, errors.New("rebase: snapshots are held")
+	}
+	if ufs.pooled() {
+		return nil, ErrMultipleBranches
+	}
+
+	lowers := make([]*Layer, len(newLowers))
+	for i, lower := range newLowers {
+		lowers[i] = newLayer(lower.FS, true, lower.Options)
+	}
+	r := &rebaser{
+		ufs:      ufs,
+		overlay:  top.fs,
+		oldView:  ufs.layerView(ufs.layers[1:]),
+		newView:  ufs.layerView(lowers),
+		versions: make(map[string]fileVersion),
+	}
+	report := &RebaseReport{Policy: ufs.rebasePolicy}
+	if err := r.scan("/", report); err != nil {
+		return nil, fmt.Errorf("rebase: %w", err)
+	}
+	sort.Slice(report.Conflicts, func(i, j int) bool { return report.Conflicts[i].Path < report.Conflicts[j].Path })
+
+	if len(report.Conflicts) > 0 {
+		switch ufs.rebasePolicy {
+		case RebaseFail:
+			return report, ErrRebaseConflict
+		case RebaseTakeBase:
+			if err := r.takeBase(report.Conflicts); err != nil {
+				ufs.cache.clear()
+				return report, fmt.Errorf("rebase: %w", err)
+			}
+		}
+	}
+
+	ufs.setLayers(append([]*Layer{top}, lowers...))
+	ufs.originMu.Lock()
+	ufs.origins = r.versions
+	ufs.originMu.Unlock()
+	ufs.cache.clear()
+	return report, nil
+}
+
+// takeBase removes the overlay's versions of the conflicting paths. The
+// removals are journaled first and undone if any of them fails.
+func (r *rebaser) takeBase(conflicts []RebaseConflict) error {
+	targets := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		targets[i] = c.Path
+		if c.Kind == ConflictRemoved {
+			targets[i] = whiteoutPath(c.Path)
+		}
+	}
+	journal, err := r.ufs.newJournal()
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if err := journal.save(r.overlay, target); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets {
+		if err := removeLayerPath(r.overlay, target); err != nil {
+			return errors.Join(err, journal.undo(r.overlay))
+		}
+	}
+	for _, c := range conflicts {
+		delete(r.versions, c.Path)
+	}
+	return nil
+}
+
+// rebaser compares an overlay against old and new lower layers
+type rebaser struct {
+	ufs      *UnionFS
+	overlay  absfs.FileSystem
+	oldView  *UnionFS
+	newView  *UnionFS
+	versions map[string]fileVersion // new lower version of overlay files
+}
+
+// scan compares the overlay's entries under dir, recursively
+func (r *rebaser) scan(dir string, report *RebaseReport) error {
+	entries, err := r.overlay.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if isOpaqueWhiteout(p) {
+			// Opaque directories replace the lower contents wholesale
+			continue
+		}
+		if target, ok := originalPath(p); ok {
+			report.Checked++
+			newVersion, inNew, err := lowerVersion(r.newView, target)
+			if err != nil {
+				return err
+			}
+			if !inNew {
+				continue
+			}
+			oldVersion, inOld, err := lowerVersion(r.oldView, target)
+			if err != nil {
+				return err
+			}
+			if !inOld || oldVersion != newVersion {
+				report.Conflicts = append(report.Conflicts, RebaseConflict{Path: target, Kind: ConflictRemoved})
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			if err := r.scan(p, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		report.Checked++
+		newVersion, inNew, err := lowerVersion(r.newView, p)
+		if err != nil {
+			return err
+		}
+		oldVersion, inOld := r.ufs.origin(p)
+		if !inOld {
+			if oldVersion, inOld, err = lowerVersion(r.oldView, p); err != nil {
+				return err
+			}
+		}
+		if inNew {
+			r.versions[p] = newVersion
+		}
+		if inOld != inNew || oldVersion != newVersion {
+			report.Conflicts = append(report.Conflicts, RebaseConflict{Path: p, Kind: ConflictModified})
+		}
+	}
+	return nil
+}
+
+// recordOrigin remembers the lower version a file was copied up from
+func (ufs *UnionFS) recordOrigin(p string, version fileVersion) {
+	ufs.originMu.Lock()
+	defer ufs.originMu.Unlock()
+	if ufs.origins == nil {
+		ufs.origins = make(map[string]fileVersion)
+	}
+	ufs.origins[p] = version
+}
+
+// origin returns the lower version p was copied up from, if recorded
+func (ufs *UnionFS) origin(p string) (fileVersion, bool) {
+	ufs.originMu.Lock()
+	defer ufs.originMu.Unlock()
+	version, ok := ufs.origins[p]
+	return version, ok
+}
+
+// lowerVersion returns the version of p in view. Directories all share one
+// version, since only their contents can conflict.
+func lowerVersion(view *UnionFS, p string) (fileVersion, bool, error) {
+	info, err := view.Lstat(p)
+	if os.IsNotExist(err) {
+		return fileVersion{}, false, nil
+	}
+	if err != nil {
+		return fileVersion{}, false, err
+	}
+
+	h := sha256.New()
+	switch {
+	case info.IsDir():
+		return fileVersion{Mode: os.ModeDir}, true, nil
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := view.Readlink(p)
+		if err != nil {
+			return fileVersion{}, false, err
+		}
+		io.WriteString(h, target)
+	case info.Mode().IsRegular():
+		f, err := view.Open(p)
+		if err != nil {
+			return fileVersion{}, false, err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fileVersion{}, false, err
+		}
+	}
+	return fileVersion{Mode: info.Mode(), Digest: digestPrefix + hex.EncodeToString(h.Sum(nil))}, true, nil
+}
@@ -0,0 +1,186 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// rebaseStack returns a union whose overlay modifies, removes and adds
+// files, and a new base that changes some of the same files
+func rebaseStack(t *testing.T, policy RebasePolicy) (*UnionFS, absfs.FileSystem) {
+	t.Helper()
+	base := mustNewMemFS()
+	for _, name := range []string{"/etc/a", "/etc/b", "/etc/c", "/etc/gone"} {
+		writeFile(base, name, []byte("v1"), 0644)
+	}
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(base),
+		WithRebasePolicy(policy),
+	)
+	if err := writeFile(ufs, "/etc/a", []byte("overlay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/etc/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ufs, "/new", []byte("overlay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newBase := mustNewMemFS()
+	writeFile(newBase, "/etc/a", []byte("v2"), 0644)
+	writeFile(newBase, "/etc/b", []byte("v2"), 0644)
+	writeFile(newBase, "/etc/c", []byte("v2"), 0644)
+	return ufs, newBase
+}
+
+var rebaseConflicts = []RebaseConflict{
+	{Path: "/etc/a", Kind: ConflictModified},
+	{Path: "/etc/c", Kind: ConflictRemoved},
+}
+
+func TestRebaseFail(t *testing.T) {
+	ufs, newBase := rebaseStack(t, RebaseFail)
+	before := snapshotView(t, ufs)
+
+	report, err := ufs.Rebase(newBase)
+	if !errors.Is(err, ErrRebaseConflict) {
+		t.Fatalf("Rebase = %v, want ErrRebaseConflict", err)
+	}
+	if !reflect.DeepEqual(report.Conflicts, rebaseConflicts) {
+		t.Errorf("conflicts = %v, want %v", report.Conflicts, rebaseConflicts)
+	}
+	if report.Checked != 3 {
+		t.Errorf("checked = %d, want 3", report.Checked)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("union changed:\n got %v\nwant %v", got, before)
+	}
+}
+
+func TestRebasePolicies(t *testing.T) {
+	tests := []struct {
+		policy RebasePolicy
+		want   map[string]string
+	}{
+		{RebaseKeepOverlay, map[string]string{
+			"/etc": "<dir>", "/etc/a": "overlay", "/etc/b": "v2", "/new": "overlay",
+		}},
+		{RebaseTakeBase, map[string]string{
+			"/etc": "<dir>", "/etc/a": "v2", "/etc/b": "v2", "/etc/c": "v2", "/new": "overlay",
+		}},
+	}
+	for _, tt := range tests {
+		ufs, newBase := rebaseStack(t, tt.policy)
+		report, err := ufs.Rebase(newBase)
+		if err != nil {
+			t.Fatalf("policy %d: %v", tt.policy, err)
+		}
+		if !reflect.DeepEqual(report.Conflicts, rebaseConflicts) {
+			t.Errorf("policy %d: conflicts = %v", tt.policy, report.Conflicts)
+		}
+		if got := snapshotView(t, ufs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("policy %d:\n got %v\nwant %v", tt.policy, got, tt.want)
+		}
+		if n := len(ufs.Layers()); n != 2 {
+			t.Errorf("policy %d: %d layers, want 2", tt.policy, n)
+		}
+	}
+}
+
+func TestRebaseUsesCopyUpOrigin(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/f", []byte("v1"), 0644)
+	ufs := New(WithWritableLayer(mustNewMemFS()), WithReadOnlyLayer(base))
+	if err := writeFile(ufs, "/f", []byte("overlay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old base changes behind the union's back after the copy-up; the
+	// new base matches what was copied up, so there is no conflict
+	writeFile(base, "/f", []byte("changed"), 0644)
+	newBase := mustNewMemFS()
+	writeFile(newBase, "/f", []byte("v1"), 0644)
+
+	report, err := ufs.Rebase(newBase)
+	if err != nil {
+		t.Fatalf("Rebase = %v, conflicts %v", err, report.Conflicts)
+	}
+
+	// The recorded origin now refers to the new base
+	newer := mustNewMemFS()
+	writeFile(newer, "/f", []byte("v3"), 0644)
+	if report, err := ufs.Rebase(newer); !errors.Is(err, ErrRebaseConflict) || len(report.Conflicts) != 1 {
+		t.Errorf("second Rebase = %v, %v", report, err)
+	}
+}
+
+func TestRebaseErrors(t *testing.T) {
+	if _, err := New(WithReadOnlyLayer(mustNewMemFS())).Rebase(mustNewMemFS()); !errors.Is(err, ErrNoWritableLayer) {
+		t.Errorf("Rebase without writable layer = %v", err)
+	}
+
+	ufs, newBase := rebaseStack(t, RebaseKeepOverlay)
+	if _, err := ufs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Rebase(newBase); err == nil {
+		t.Error("Rebase with a held snapshot succeeded")
+	}
+}
+
+func TestRebaseOntoLayerOptions(t *testing.T) {
+	ufs, newBase := rebaseStack(t, RebaseKeepOverlay)
+	_, err := ufs.RebaseOnto(Lower{
+		FS:      newBase,
+		Options: []LayerOption{LayerName("base:2"), LayerID("base-2"), LayerLabels(map[string]string{"channel": "stable"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ufs.Which("/etc/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "base-2" || info.Name != "base:2" || info.Labels["channel"] != "stable" {
+		t.Errorf("new lower = %+v", info)
+	}
+}
+
+// removeFailFS fails removing the path named fail, once
+type removeFailFS struct {
+	absfs.FileSystem
+	fail string
+}
+
+func (f *removeFailFS) RemoveAll(name string) error {
+	if name == f.fail {
+		f.fail = ""
+		return &os.PathError{Op: "remove", Path: name, Err: errFailed}
+	}
+	return f.FileSystem.RemoveAll(name)
+}
+
+// TestRebaseTakeBaseFailure tests that a failed removal under
+// RebaseTakeBase leaves the overlay as it was
+func TestRebaseTakeBaseFailure(t *testing.T) {
+	ufs, newBase := rebaseStack(t, RebaseTakeBase)
+	top := ufs.layers[0]
+	top.fs = &removeFailFS{FileSystem: top.fs, fail: whiteoutPath("/etc/c")}
+	before := snapshotView(t, ufs)
+
+	if _, err := ufs.Rebase(newBase); !errors.Is(err, errFailed) {
+		t.Fatalf("Rebase = %v, want injected failure", err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("after failed rebase:\n got %v\nwant %v", got, before)
+	}
+	if data, _ := readFile(top.fs, "/etc/a"); string(data) != "overlay" {
+		t.Errorf("overlay /etc/a = %q, want overlay", data)
+	}
+}
@@ -0,0 +1,129 @@
+package unionfs
+
+import (
+	"path"
+	"strings"
+)
+
+// Revert undoes the writable layer's changes to name itself, so the lower
+// layers' version shows again. A copied-up or created file is deleted from
+// the writable layer and a whiteout for name is removed. For a directory
+// that also exists below, its opaque marker is removed and its mode and
+// times are reset to the lower ones; its children keep their own state, so
+// a directory can end up with a mix of reverted and changed children. A
+// directory that exists only in the writable layer must be empty. Use
+// RevertTree to revert everything under a directory. With write routes,
+// the layer that handles name is reverted.
+//
+// Paths under a whited out or opaque directory stay hidden until that
+// directory is reverted too.
+func (ufs *UnionFS) Revert(name string) error {
+	name = ufs.resolveCase(cleanPath(name))
+	layer, err := ufs.getWritableLayer(name)
+	if err != nil {
+		return err
+	}
+	_, _, beforeErr := ufs.findFile(name)
+
+	lowerInfo, lowerErr := ufs.belowView(layer).Lstat(name)
+	if info, err := lstatLayer(layer.fs, name); err == nil {
+		if info.IsDir() && lowerErr == nil && lowerInfo.IsDir() {
+			if err := removeLayerPath(layer.fs, path.Join(name, OpaqueWhiteout)); err != nil {
+				return err
+			}
+			if err := layer.fs.Chmod(name, lowerInfo.Mode()); err != nil {
+				return err
+			}
+			layer.fs.Chtimes(name, lowerInfo.ModTime(), lowerInfo.ModTime())
+		} else if err := layer.fs.Remove(name); err != nil {
+			return err
+		}
+	}
+	if name != "/" {
+		if err := removeLayerPath(layer.fs, whiteoutPath(name)); err != nil {
+			return err
+		}
+	}
+
+	ufs.forgetOrigins(name, false)
+	ufs.InvalidateCacheTree(name)
+	ufs.notifyRevert(name, beforeErr == nil)
+	return nil
+}
+
+// RevertTree undoes the writable layer's changes to prefix and everything
+// under it: copies, new entries, whiteouts and opaque markers are all
+// deleted from the writable layer.
+func (ufs *UnionFS) RevertTree(prefix string) error {
+	prefix = ufs.resolveCase(cleanPath(prefix))
+	layer, err := ufs.getWritableLayer(prefix)
+	if err != nil {
+		return err
+	}
+	_, _, beforeErr := ufs.findFile(prefix)
+
+	if prefix == "/" {
+		entries, err := layer.fs.ReadDir("/")
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeLayerPath(layer.fs, path.Join("/", entry.Name())); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := removeLayerPath(layer.fs, prefix); err != nil {
+			return err
+		}
+		if err := removeLayerPath(layer.fs, whiteoutPath(prefix)); err != nil {
+			return err
+		}
+	}
+
+	ufs.forgetOrigins(prefix, true)
+	ufs.InvalidateCacheTree(prefix)
+	ufs.notifyRevert(prefix, beforeErr == nil)
+	return nil
+}
+
+// lowerHas reports whether the layers below the branch that takes the
+// markers for p show it
+func (ufs *UnionFS) lowerHas(p string) bool {
+	layer, err := ufs.markerTarget(p)
+	if err != nil {
+		return false
+	}
+	_, err = ufs.belowView(layer).Lstat(p)
+	return err == nil
+}
+
+// notifyRevert reports the change a revert made to name
+func (ufs *UnionFS) notifyRevert(name string, existed bool) {
+	_, _, err := ufs.findFile(name)
+	switch {
+	case existed && err == nil:
+		ufs.notify(Write, name)
+	case existed:
+		ufs.notify(Remove, name)
+	case err == nil:
+		ufs.notify(Create, name)
+	}
+}
+
+// forgetOrigins drops the recorded copy-up origin of p, and of everything
+// under it if tree is set
+func (ufs *UnionFS) forgetOrigins(p string, tree bool) {
+	ufs.originMu.Lock()
+	defer ufs.originMu.Unlock()
+	delete(ufs.origins, p)
+	if !tree {
+		return
+	}
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for name := range ufs.origins {
+		if strings.HasPrefix(name, prefix) {
+			delete(ufs.origins, name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package unionfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// revertUnion returns a union whose overlay changes a mixed directory
+func revertUnion(t *testing.T) (*UnionFS, *Layer) {
+	t.Helper()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	writeFile(base, "/etc/old/a", []byte("base"), 0644)
+	writeFile(base, "/etc/old/b", []byte("base"), 0644)
+
+	ufs := New(WithWritableLayer(mustNewMemFS()), WithReadOnlyLayer(base))
+	if err := writeFile(ufs, "/etc/app.conf", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ufs, "/etc/new.conf", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ufs, "/etc/old/a", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Chmod("/etc/old", os.ModeDir|0700); err != nil {
+		t.Fatal(err)
+	}
+	return ufs, ufs.layers[0]
+}
+
+func TestRevert(t *testing.T) {
+	ufs, overlay := revertUnion(t)
+
+	for _, name := range []string{"/etc/app.conf", "/etc/hosts", "/etc/new.conf"} {
+		if err := ufs.Revert(name); err != nil {
+			t.Fatalf("Revert(%s): %v", name, err)
+		}
+	}
+	if data, err := readFile(ufs, "/etc/app.conf"); err != nil || string(data) != "base" {
+		t.Errorf("/etc/app.conf = %q, %v", data, err)
+	}
+	if data, err := readFile(ufs, "/etc/hosts"); err != nil || string(data) != "base" {
+		t.Errorf("/etc/hosts = %q, %v", data, err)
+	}
+	if _, err := ufs.Stat("/etc/new.conf"); !os.IsNotExist(err) {
+		t.Errorf("/etc/new.conf still exists: %v", err)
+	}
+	if _, err := overlay.fs.Stat("/etc/.wh.hosts"); !os.IsNotExist(err) {
+		t.Errorf("whiteout left behind: %v", err)
+	}
+
+	// Reverting a mixed directory resets it but keeps the changed child
+	writeFile(overlay.fs, "/etc/old/"+OpaqueWhiteout, nil, 0644)
+	if err := ufs.Revert("/etc/old"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ufs.Stat("/etc/old")
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("/etc/old mode = %v, %v", info.Mode(), err)
+	}
+	entries, err := ufs.ReadDir("/etc/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := entryNames(entries)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("/etc/old entries = %v, want %v", got, want)
+	}
+	if data, _ := readFile(ufs, "/etc/old/a"); string(data) != "changed" {
+		t.Errorf("/etc/old/a = %q, want changed", data)
+	}
+
+	// A directory only in the overlay must be emptied first
+	if err := ufs.MkdirAll("/srv/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Revert("/srv"); err == nil {
+		t.Error("Revert of non-empty overlay directory succeeded")
+	}
+}
+
+func TestRevertTree(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	writeFile(base, "/etc/old/a", []byte("base"), 0644)
+	writeFile(base, "/etc/old/b", []byte("base"), 0644)
+	baseOnly := New(WithReadOnlyLayer(base))
+	want := snapshotView(t, baseOnly)
+
+	ufs, overlay := revertUnion(t)
+	writeFile(overlay.fs, "/etc/old/"+OpaqueWhiteout, nil, 0644)
+	if err := ufs.RemoveAll("/etc/old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.RevertTree("/etc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after RevertTree:\n got %v\nwant %v", got, want)
+	}
+
+	ufs, _ = revertUnion(t)
+	writeFile(ufs, "/top", []byte("new"), 0644)
+	if err := ufs.RevertTree("/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after RevertTree(/):\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestRevertEvents(t *testing.T) {
+	ufs, _ := revertUnion(t)
+	events, cancel := ufs.Watch("/etc", false)
+	defer cancel()
+
+	ufs.Revert("/etc/app.conf")
+	ufs.Revert("/etc/hosts")
+	ufs.Revert("/etc/new.conf")
+
+	want := []Event{
+		{Op: Write, Path: "/etc/app.conf"},
+		{Op: Create, Path: "/etc/hosts"},
+		{Op: Remove, Path: "/etc/new.conf"},
+	}
+	for _, w := range want {
+		if got := <-events; got != w {
+			t.Errorf("event = %v, want %v", got, w)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package unionfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// newRoutedFS returns a union that sends /var/log to a scratch layer and
+// /home to a persistent one, over a read-only base
+func newRoutedFS(t *testing.T) (ufs *UnionFS, scratch, home, base absfs.FileSystem) {
+	t.Helper()
+	scratch, home, base = mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	base.MkdirAll("/home/user", 0755)
+	base.Chmod("/home/user", os.ModeDir|0750)
+	base.MkdirAll("/var/log", 0755)
+	base.MkdirAll("/etc", 0755)
+	writeFile(base, "/home/user/notes.txt", []byte("notes"), 0644)
+	writeFile(base, "/var/log/old.log", []byte("old"), 0644)
+	writeFile(base, "/etc/hosts", []byte("hosts"), 0644)
+	ufs = New(
+		WithWriteRoute("/home", home, LayerName("home")),
+		WithWriteRoute("/var/log", scratch, LayerName("scratch")),
+		WithReadOnlyLayer(base, LayerName("base")),
+	)
+	return ufs, scratch, home, base
+}
+
+func TestWriteRoutes(t *testing.T) {
+	ufs, scratch, home, _ := newRoutedFS(t)
+
+	var names []string
+	for _, l := range ufs.Layers() {
+		names = append(names, l.Name)
+	}
+	if want := []string{"scratch", "home", "base"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("layers = %v, want %v", names, want)
+	}
+
+	if err := writeFile(ufs, "/var/log/app.log", []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, ufs, "/var/log/app.log"); got != "scratch" {
+		t.Errorf("app.log in %s, want scratch", got)
+	}
+	if err := writeFile(ufs, "/home/user/notes.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readFile(home, "/home/user/notes.txt"); string(data) != "changed" {
+		t.Errorf("notes.txt in home = %q", data)
+	}
+
+	// Parents are copied up with their metadata
+	info, err := home.Stat("/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("copied-up /home/user mode = %v, want 0750", info.Mode().Perm())
+	}
+	if _, err := scratch.Stat("/home"); !os.IsNotExist(err) {
+		t.Errorf("/home created in scratch: %v", err)
+	}
+
+	// Paths outside every route are read-only
+	rejected := map[string]error{
+		"write":  writeFile(ufs, "/etc/hosts", []byte("changed"), 0644),
+		"create": writeFile(ufs, "/etc/new", []byte("new"), 0644),
+		"mkdir":  ufs.Mkdir("/tmp", 0755),
+		"remove": ufs.Remove("/etc/hosts"),
+		"chmod":  ufs.Chmod("/etc/hosts", 0600),
+		"rename": ufs.Rename("/home/user/notes.txt", "/etc/notes.txt"),
+	}
+	for op, err := range rejected {
+		if !errors.Is(err, ErrNoWriteRoute) || !errors.Is(err, ErrReadOnlyLayer) {
+			t.Errorf("%s outside routes: %v", op, err)
+		}
+	}
+	if data, _ := readFile(ufs, "/etc/hosts"); string(data) != "hosts" {
+		t.Errorf("hosts = %q", data)
+	}
+}
+
+func TestWriteRouteWhiteouts(t *testing.T) {
+	ufs, scratch, home, _ := newRoutedFS(t)
+
+	// Whiteouts live in the layer that handles the path
+	if err := ufs.Remove("/var/log/old.log"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scratch.Stat("/var/log/.wh.old.log"); err != nil {
+		t.Errorf("whiteout not in scratch: %v", err)
+	}
+	if _, err := home.Stat("/var"); !os.IsNotExist(err) {
+		t.Errorf("/var created in home: %v", err)
+	}
+	if _, err := ufs.Stat("/var/log/old.log"); !os.IsNotExist(err) {
+		t.Errorf("old.log still visible: %v", err)
+	}
+
+	// Moving between routes moves the entry and hides the source in its layer
+	if err := ufs.Rename("/home/user/notes.txt", "/var/log/notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, ufs, "/var/log/notes.txt"); got != "scratch" {
+		t.Errorf("notes.txt in %s, want scratch", got)
+	}
+	if _, err := home.Stat("/home/user/.wh.notes.txt"); err != nil {
+		t.Errorf("whiteout not in home: %v", err)
+	}
+	if _, err := ufs.Stat("/home/user/notes.txt"); !os.IsNotExist(err) {
+		t.Errorf("notes.txt still visible: %v", err)
+	}
+
+	// Recreating a removed directory masks the lower contents in the route
+	if err := ufs.RemoveAll("/var/log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Mkdir("/var/log", 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ufs.ReadDir("/var/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); len(names) != 0 {
+		t.Errorf("/var/log = %v, want empty", names)
+	}
+	if _, err := scratch.Stat("/var/log/" + OpaqueWhiteout); err != nil {
+		t.Errorf("opaque marker not in scratch: %v", err)
+	}
+}
+
+func TestWriteRouteFallback(t *testing.T) {
+	primary, data, cache, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	base.MkdirAll("/data/cache", 0755)
+	writeFile(base, "/data/cache/old", []byte("old"), 0644)
+	ufs := New(
+		WithWritableLayer(primary, LayerName("primary")),
+		WithWriteRoute("/data", data, LayerName("data")),
+		WithWriteRoute("/data/cache", cache, LayerName("cache")),
+		WithWriteRoute("/data/tmp", cache),
+		WithReadOnlyLayer(base, LayerName("base")),
+	)
+
+	var names []string
+	for _, l := range ufs.Layers() {
+		names = append(names, l.Name)
+	}
+	if want := []string{"cache", "data", "primary", "base"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("layers = %v, want %v", names, want)
+	}
+
+	// The longest route decides, and unrouted paths use the other layers
+	for name, want := range map[string]string{
+		"/data/file":       "data",
+		"/data/cache/file": "cache",
+		"/data/tmp/file":   "cache",
+		"/etc/file":        "primary",
+	} {
+		if err := ufs.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(ufs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := branchOf(t, ufs, name); got != want {
+			t.Errorf("%s in %s, want %s", name, got, want)
+		}
+	}
+
+	if err := ufs.Remove("/data/cache/old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Stat("/data/cache/.wh.old"); err != nil {
+		t.Errorf("whiteout not in cache: %v", err)
+	}
+
+	if _, err := ufs.Snapshot(); !errors.Is(err, ErrMultipleBranches) {
+		t.Errorf("snapshot: %v", err)
+	}
+}
+
+func TestWriteRouteManifest(t *testing.T) {
+	primary, logs := mustNewMemFS(), mustNewMemFS()
+	ufs := New(
+		WithWritableLayer(primary, LayerName("primary")),
+		WithWriteRoute("/var/log", logs, LayerName("logs")),
+	)
+
+	m, err := ufs.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Manifest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&decoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(loaded.Layers()); n != 2 {
+		t.Fatalf("loaded %d layers, want 2", n)
+	}
+	if err := loaded.MkdirAll("/var/log", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(loaded, "/var/log/app.log", []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := branchOf(t, loaded, "/var/log/app.log"); got != "logs" {
+		t.Errorf("app.log in %s, want logs", got)
+	}
+
+	decoded.Options.WriteRoutes["/tmp"] = "missing"
+	if _, err := Load(&decoded, nil); err == nil {
+		t.Error("load with unknown route layer succeeded")
+	}
+}
@@ -0,0 +1,394 @@
+package unionfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+var (
+	// ErrSnapshotNotFound is returned for unknown, discarded or superseded
+	// snapshots
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrStaleHandle is returned when writing through a handle whose layer
+	// was frozen by a snapshot or discarded by a rollback
+	ErrStaleHandle = errors.New("file handle is stale")
+)
+
+// SnapshotID identifies a checkpoint of the writable layer
+type SnapshotID uint64
+
+// Snapshot takes a checkpoint of the writable layer. The writable layer is
+// frozen and a throwaway writable layer is stacked on top of it, so taking a
+// snapshot copies nothing; later writes copy up into the new layer as usual.
+//
+// Handles opened for writing before the snapshot fail with ErrStaleHandle,
+// since writing through them would change the checkpoint. Snapshots should
+// not be taken while other goroutines are writing to the union. Unions with
+// several writable branches or write routes cannot take snapshots and get
+// ErrMultipleBranches.
+//
+// Example:
+//
+//	id, _ := ufs.Snapshot()
+//	if err := step(ufs); err != nil {
+//	    ufs.Rollback(id)
+//	} else {
+//	    ufs.DiscardSnapshot(id)
+//	}
+func (ufs *UnionFS) Snapshot() (SnapshotID, error) {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	frozen := ufs.writableLayer
+	if frozen == nil {
+		return 0, ErrNoWritableLayer
+	}
+	if ufs.pooled() {
+		return 0, ErrMultipleBranches
+	}
+	ufs.lastSnapshot++
+	id := ufs.lastSnapshot
+	scratch, err := ufs.freezeWritable(fmt.Sprintf("snapshot-%d", id))
+	if err != nil {
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+
+	if ufs.snapshots == nil {
+		ufs.snapshots = make(map[SnapshotID]*Layer)
+	}
+	ufs.snapshots[id] = scratch
+	return id, nil
+}
+
+// Rollback restores the union to the state of snapshot id, discarding every
+// change made since. Snapshots taken after id are discarded with it; id
+// itself stays valid and can be rolled back to again. Handles opened for
+// writing since the snapshot fail with ErrStaleHandle; read handles keep
+// reading the contents they opened.
+func (ufs *UnionFS) Rollback(id SnapshotID) error {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	idx, err := ufs.snapshotIndex(id)
+	if err != nil {
+		return err
+	}
+	scratch, err := ufs.scratchLayer(ufs.layers[idx].name)
+	if err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+
+	discarded := ufs.layers[:idx+1]
+	for _, layer := range discarded {
+		layer.sealed.Store(true)
+	}
+	for other, layer := range ufs.snapshots {
+		if other != id && containsLayer(discarded, layer) {
+			delete(ufs.snapshots, other)
+		}
+	}
+
+	ufs.setLayers(append([]*Layer{scratch}, ufs.layers[idx+1:]...))
+	ufs.writableLayer = scratch
+	ufs.snapshots[id] = scratch
+	ufs.cache.clear()
+	return nil
+}
+
+// DiscardSnapshot drops snapshot id, keeping the changes made since. The
+// snapshot's layer is merged into the layer below it, which becomes writable
+// again if it is now the top layer. Handles opened for writing since the
+// snapshot fail with ErrStaleHandle.
+func (ufs *UnionFS) DiscardSnapshot(id SnapshotID) error {
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	idx, err := ufs.snapshotIndex(id)
+	if err != nil {
+		return err
+	}
+	scratch, lower := ufs.layers[idx], ufs.layers[idx+1]
+	if err := ufs.mergeLayer(scratch.fs, lower.fs, "/"); err != nil {
+		return fmt.Errorf("discard snapshot: %w", err)
+	}
+
+	scratch.sealed.Store(true)
+	delete(ufs.snapshots, id)
+	ufs.setLayers(append(ufs.layers[:idx:idx], ufs.layers[idx+1:]...))
+	if ufs.writableLayer == scratch {
+		lower.digestMu.Lock()
+		lower.digest = ""
+		lower.digestMu.Unlock()
+		lower.readOnly = false
+		lower.sealed.Store(false)
+		ufs.writableLayer = lower
+	}
+	ufs.cache.clear()
+	return nil
+}
+
+// snapshotIndex returns the position of snapshot id's layer. The caller
+// must hold ufs.mu.
+func (ufs *UnionFS) snapshotIndex(id SnapshotID) (int, error) {
+	if layer, ok := ufs.snapshots[id]; ok {
+		for i, l := range ufs.layers {
+			if l == layer && i+1 < len(ufs.layers) {
+				return i, nil
+			}
+		}
+		// The layer was squashed away
+		delete(ufs.snapshots, id)
+	}
+	return -1, fmt.Errorf("%w: %d", ErrSnapshotNotFound, id)
+}
+
+// freezeWritable makes the writable layer read-only and stacks a new
+// scratch layer named name on top of it to take later writes. The caller
+// must hold ufs.mu.
+func (ufs *UnionFS) freezeWritable(name string) (*Layer, error) {
+	scratch, err := ufs.scratchLayer(name)
+	if err != nil {
+		return nil, err
+	}
+	frozen := ufs.writableLayer
+	frozen.readOnly = true
+	frozen.sealed.Store(true)
+	ufs.setLayers(append([]*Layer{scratch}, ufs.layers...))
+	ufs.writableLayer = scratch
+	ufs.cache.clear()
+	return scratch, nil
+}
+
+// scratchLayer creates a throwaway writable layer
+func (ufs *UnionFS) scratchLayer(name string) (*Layer, error) {
+	newFS := ufs.newScratch
+	if newFS == nil {
+		newFS = func() (absfs.FileSystem, error) { return memfs.NewFS() }
+	}
+	fs, err := newFS()
+	if err != nil {
+		return nil, err
+	}
+	return newLayer(fs, false, []LayerOption{LayerName(name)}), nil
+}
+
+// containsLayer reports whether layers holds layer
+func containsLayer(layers []*Layer, layer *Layer) bool {
+	for _, l := range layers {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLayer applies the contents of upper under dir onto lower, so that
+// lower alone shows what upper stacked on lower showed. Whiteouts remove
+// what they mask from lower and are kept for the layers below; opaque
+// markers clear lower's directory first.
+func (ufs *UnionFS) mergeLayer(upper, lower absfs.FileSystem, dir string) error {
+	entries, err := upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Markers go first so they cannot remove entries copied from upper
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if isOpaqueWhiteout(p) {
+			stale, err := lower.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, e := range stale {
+				if err := removeLayerPath(lower, path.Join(dir, e.Name())); err != nil {
+					return err
+				}
+			}
+		} else if target, ok := originalPath(p); ok {
+			if err := removeLayerPath(lower, target); err != nil {
+				return err
+			}
+		} else {
+			continue
+		}
+		if err := writeMarker(lower, p); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if isWhiteout(entry.Name()) {
+			continue
+		}
+		p := path.Join(dir, entry.Name())
+		info, err := lstatLayer(upper, p)
+		if err != nil {
+			return err
+		}
+		if existing, err := lstatLayer(lower, p); err == nil && !(existing.IsDir() && info.IsDir()) {
+			if err := lower.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := readlinkLayer(upper, p)
+			if err != nil {
+				return err
+			}
+			linker, ok := lower.(absfs.SymLinker)
+			if !ok {
+				return &os.LinkError{Op: "symlink", Old: target, New: p, Err: errors.ErrUnsupported}
+			}
+			if err := linker.Symlink(target, p); err != nil {
+				return err
+			}
+			continue
+		case info.IsDir():
+			if err := lower.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			if err := ufs.mergeLayer(upper, lower, p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := ufs.copyLayerContents(upper, lower, p, info); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if err := lower.Chmod(p, info.Mode()); err != nil {
+			return err
+		}
+		lower.Chtimes(p, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// removeLayerPath removes p and anything under it from fs, if it exists
+func removeLayerPath(fs absfs.FileSystem, p string) error {
+	if err := fs.RemoveAll(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyLayerTree copies p and anything under it from one layer's filesystem
+// to the same path in another's, markers included
+func (ufs *UnionFS) copyLayerTree(src, dst absfs.FileSystem, p string) error {
+	info, err := lstatLayer(src, p)
+	if err != nil {
+		return err
+	}
+	if err := dst.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := readlinkLayer(src, p)
+		if err != nil {
+			return err
+		}
+		linker, ok := dst.(absfs.SymLinker)
+		if !ok {
+			return &os.LinkError{Op: "symlink", Old: target, New: p, Err: errors.ErrUnsupported}
+		}
+		return linker.Symlink(target, p)
+	case info.IsDir():
+		if err := dst.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+		entries, err := src.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := ufs.copyLayerTree(src, dst, path.Join(p, entry.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := ufs.copyLayerContents(src, dst, p, info); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := dst.Chmod(p, info.Mode()); err != nil {
+		return err
+	}
+	return dst.Chtimes(p, info.ModTime(), info.ModTime())
+}
+
+// copyLayerContents copies the regular file p from one layer's filesystem
+// to another's
+func (ufs *UnionFS) copyLayerContents(src, dst absfs.FileSystem, p string, info os.FileInfo) error {
+	in, err := src.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, ufs.copyBufferSize)
+	_, err = io.CopyBuffer(out, in, buf)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// layerFile is a handle opened for writing on a layer. Writes fail once the
+// layer is frozen by a snapshot or discarded by a rollback.
+type layerFile struct {
+	absfs.File
+	layer *Layer
+}
+
+// stale returns ErrStaleHandle if the handle's layer no longer takes writes
+func (f *layerFile) stale(op string) error {
+	if f.layer.sealed.Load() {
+		return &os.PathError{Op: op, Path: f.Name(), Err: ErrStaleHandle}
+	}
+	return nil
+}
+
+func (f *layerFile) Write(b []byte) (int, error) {
+	if err := f.stale("write"); err != nil {
+		return 0, err
+	}
+	return f.File.Write(b)
+}
+
+func (f *layerFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.stale("write"); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(b, off)
+}
+
+func (f *layerFile) WriteString(s string) (int, error) {
+	if err := f.stale("write"); err != nil {
+		return 0, err
+	}
+	return f.File.WriteString(s)
+}
+
+func (f *layerFile) Truncate(size int64) error {
+	if err := f.stale("truncate"); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
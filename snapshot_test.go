@@ -0,0 +1,253 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// snapshotUnion returns a union over a base layer with some overlay state
+func snapshotUnion(t *testing.T) (*UnionFS, *Layer) {
+	t.Helper()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app.conf", []byte("base"), 0644)
+	writeFile(base, "/etc/hosts", []byte("base"), 0644)
+	writeFile(base, "/data/keep", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(mustNewMemFS(), LayerName("overlay")),
+		WithReadOnlyLayer(base),
+	)
+	if err := writeFile(ufs, "/etc/app.conf", []byte("overlay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ufs, ufs.layers[0]
+}
+
+// mutate makes a mix of writes, removals and creations
+func mutate(t *testing.T, ufs *UnionFS) {
+	t.Helper()
+	if err := writeFile(ufs, "/etc/app.conf", []byte("step"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Remove("/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.RemoveAll("/data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.MkdirAll("/data/new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ufs, "/data/new/file", []byte("step"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpaqueListingBelowTop tests that an opaque directory under a scratch
+// layer still lists the entries of the layers down to the marker
+func TestOpaqueListingBelowTop(t *testing.T) {
+	for _, inTx := range []bool{false, true} {
+		ufs, _ := snapshotUnion(t)
+		if err := ufs.RemoveAll("/data"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ufs.Mkdir("/data", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(ufs, "/data/a", []byte("a"), 0644)
+
+		view := ufs
+		if inTx {
+			tx := ufs.Begin()
+			defer tx.Abort()
+			view = tx.UnionFS
+		} else if _, err := ufs.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(view, "/data/b", []byte("b"), 0644)
+
+		entries, err := view.ReadDir("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := entryNames(entries); !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Errorf("tx %v: ReadDir = %v, want [a b]", inTx, names)
+		}
+		f, err := view.Open("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, _ := f.Readdirnames(-1)
+		f.Close()
+		if !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Errorf("tx %v: Readdirnames = %v, want [a b]", inTx, names)
+		}
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	ufs, _ := snapshotUnion(t)
+	before := snapshotView(t, ufs)
+
+	id, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutate(t, ufs)
+	if reflect.DeepEqual(snapshotView(t, ufs), before) {
+		t.Fatal("mutations not visible")
+	}
+
+	if err := ufs.Rollback(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("after rollback:\n got %v\nwant %v", got, before)
+	}
+
+	// The snapshot survives a rollback and can be used again
+	mutate(t, ufs)
+	if err := ufs.Rollback(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("after second rollback:\n got %v\nwant %v", got, before)
+	}
+	if n := len(ufs.Layers()); n != 3 {
+		t.Errorf("layer count = %d, want 3", n)
+	}
+}
+
+func TestSnapshotRollbackCache(t *testing.T) {
+	ufs, _ := snapshotUnion(t)
+	ufs.cache = newCache(true, 1<<40, 1<<40, 100)
+
+	id, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ufs, "/created", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/created"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Rollback(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/created"); err == nil {
+		t.Error("stale cache entry survived rollback")
+	}
+}
+
+func TestNestedSnapshots(t *testing.T) {
+	ufs, _ := snapshotUnion(t)
+	first, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(ufs, "/one", []byte("1"), 0644)
+	afterOne := snapshotView(t, ufs)
+
+	second, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(ufs, "/two", []byte("2"), 0644)
+
+	if err := ufs.Rollback(second); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, afterOne) {
+		t.Errorf("after rollback to second:\n got %v\nwant %v", got, afterOne)
+	}
+
+	// Rolling back past a snapshot discards it
+	if err := ufs.Rollback(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/one"); err == nil {
+		t.Error("/one survived rollback to first snapshot")
+	}
+	if err := ufs.Rollback(second); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Rollback(second) = %v, want ErrSnapshotNotFound", err)
+	}
+}
+
+func TestDiscardSnapshot(t *testing.T) {
+	ufs, overlay := snapshotUnion(t)
+	id, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutate(t, ufs)
+	want := snapshotView(t, ufs)
+
+	if err := ufs.DiscardSnapshot(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after discard:\n got %v\nwant %v", got, want)
+	}
+
+	// The original overlay is writable again and holds the changes
+	if ufs.writableLayer != overlay || overlay.readOnly {
+		t.Fatal("original overlay is not the writable layer")
+	}
+	if data, err := readFile(overlay.fs, "/data/new/file"); err != nil || string(data) != "step" {
+		t.Errorf("overlay /data/new/file = %q, %v", data, err)
+	}
+	if _, err := overlay.fs.Stat("/etc/.wh.hosts"); err != nil {
+		t.Errorf("whiteout not merged: %v", err)
+	}
+	if err := ufs.Rollback(id); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Rollback after discard = %v, want ErrSnapshotNotFound", err)
+	}
+}
+
+func TestSnapshotStaleHandles(t *testing.T) {
+	ufs, _ := snapshotUnion(t)
+	before, err := ufs.OpenFile("/before", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+
+	id, err := ufs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := before.Write([]byte("x")); !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("write to frozen layer = %v, want ErrStaleHandle", err)
+	}
+
+	after, err := ufs.Create("/after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if _, err := after.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Rollback(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := after.Write([]byte("x")); !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("write to discarded layer = %v, want ErrStaleHandle", err)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	ufs := New(WithReadOnlyLayer(mustNewMemFS()))
+	if _, err := ufs.Snapshot(); !errors.Is(err, ErrNoWritableLayer) {
+		t.Errorf("Snapshot without writable layer = %v", err)
+	}
+	if err := ufs.Rollback(7); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Rollback(7) = %v", err)
+	}
+	if err := ufs.DiscardSnapshot(7); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("DiscardSnapshot(7) = %v", err)
+	}
+}
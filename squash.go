@@ -0,0 +1,309 @@
+package unionfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrLayersChanged is returned when the layer stack changes while an
+// operation that replaces layers is running
+var ErrLayersChanged = errors.New("layer stack changed during operation")
+
+// Squash flattens layers from through to (inclusive, counted from the top)
+// into dst, which should be empty, and replaces them with it. dst receives
+// the merged view of the span with whiteouts applied; whiteout and opaque
+// markers are kept only where they still hide something in the layers below
+// the span. If the span includes the writable layer, dst becomes the
+// writable layer. Writes made while the span is copied go to a scratch layer
+// and are applied to dst before the swap.
+//
+// Reads are not held off while the span is copied. A lookup resolves the
+// layer holding a file under the same lock as the swap, so it is served
+// either from the span or from dst, and handles opened on the span before
+// the swap keep reading the replaced layers. The replaced layers are
+// sealed, as by Snapshot, so handles opened for writing on them fail with
+// ErrStaleHandle. Unions with several writable branches hold off all access
+// while a span with a branch is copied.
+//
+// Example:
+//
+//	// Collapse the read-only layers 1-8 into one
+//	flat, _ := memfs.NewFS()
+//	err := ufs.Squash(1, 8, flat, unionfs.LayerName("base-flat"))
+func (ufs *UnionFS) Squash(from, to int, dst absfs.FileSystem, opts ...LayerOption) error {
+	ufs.mu.Lock()
+	span, below, err := ufs.layerSpan(from, to)
+	if err != nil {
+		ufs.mu.Unlock()
+		return err
+	}
+
+	writable := !span[0].readOnly
+	var scratch *Layer
+	if writable && ufs.pooled() {
+		// Writes may land in any branch of the span, so block them until
+		// it is replaced
+		defer ufs.mu.Unlock()
+	} else {
+		if writable {
+			if scratch, err = ufs.freezeWritable("squash"); err != nil {
+				ufs.mu.Unlock()
+				return fmt.Errorf("squash: %w", err)
+			}
+		}
+		ufs.mu.Unlock()
+	}
+
+	err = ufs.materialize(span, below, dst)
+
+	if !writable || scratch != nil {
+		ufs.mu.Lock()
+		defer ufs.mu.Unlock()
+	}
+	if err != nil {
+		ufs.thaw(scratch, span[0])
+		return fmt.Errorf("squash: %w", err)
+	}
+
+	// The scratch layer sits above the span and is replaced with it
+	top := from
+	if scratch != nil {
+		if len(ufs.layers) == 0 || ufs.layers[0] != scratch {
+			return ErrLayersChanged
+		}
+		top = 0
+		from, to = from+1, to+1
+	}
+	current, _, err := ufs.layerSpan(from, to)
+	if err != nil || !sameLayers(current, span) {
+		ufs.thaw(scratch, span[0])
+		return ErrLayersChanged
+	}
+	if scratch != nil {
+		if err := ufs.mergeLayer(scratch.fs, dst, "/"); err != nil {
+			ufs.thaw(scratch, span[0])
+			return fmt.Errorf("squash: %w", err)
+		}
+		scratch.sealed.Store(true)
+	}
+	for _, replaced := range span {
+		replaced.sealed.Store(true)
+	}
+
+	layer := newLayer(dst, !writable, opts)
+	layers := append([]*Layer(nil), ufs.layers[:top]...)
+	layers = append(layers, layer)
+	ufs.setLayers(append(layers, ufs.layers[to+1:]...))
+	if writable && top == 0 {
+		ufs.writableLayer = layer
+	}
+	for i, route := range ufs.routes {
+		if containsLayer(span, route.layer) {
+			ufs.routes[i].layer = layer
+		}
+	}
+	ufs.cache.clear()
+	return nil
+}
+
+// thaw undoes freezeWritable after a failed squash, applying the writes
+// scratch took back to frozen. Once other layers have been stacked on top,
+// scratch is left in place as the writable layer. The caller must hold
+// ufs.mu.
+func (ufs *UnionFS) thaw(scratch, frozen *Layer) {
+	if scratch == nil || len(ufs.layers) < 2 || ufs.layers[0] != scratch || ufs.layers[1] != frozen {
+		return
+	}
+	if ufs.mergeLayer(scratch.fs, frozen.fs, "/") != nil {
+		return
+	}
+	scratch.sealed.Store(true)
+	ufs.setLayers(ufs.layers[1:])
+	frozen.digestMu.Lock()
+	frozen.digest = ""
+	frozen.digestMu.Unlock()
+	frozen.readOnly = false
+	frozen.sealed.Store(false)
+	ufs.writableLayer = frozen
+	ufs.cache.clear()
+}
+
+// layerSpan returns layers from..to and the layers below them. The caller
+// must hold ufs.mu.
+func (ufs *UnionFS) layerSpan(from, to int) ([]*Layer, []*Layer, error) {
+	if from < 0 || to >= len(ufs.layers) || from > to {
+		return nil, nil, fmt.Errorf("invalid layer range [%d, %d] of %d layers", from, to, len(ufs.layers))
+	}
+	span := append([]*Layer(nil), ufs.layers[from:to+1]...)
+	below := append([]*Layer(nil), ufs.layers[to+1:]...)
+	return span, below, nil
+}
+
+// sameLayers reports whether two layer lists hold the same layers
+func sameLayers(a, b []*Layer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// materialize writes the merged view of span into dst, followed by the
+// markers of span that still apply to the layers below
+func (ufs *UnionFS) materialize(span, below []*Layer, dst absfs.FileSystem) error {
+	view := ufs.layerView(span)
+	if err := copyTree(view, dst, "/"); err != nil {
+		return err
+	}
+
+	lower := ufs.layerView(below)
+	kept := make(map[string]bool)
+	for _, layer := range span {
+		err := walkMarkers(layer.fs, "/", func(marker string) error {
+			if kept[marker] || !markerNeeded(view, lower, marker) {
+				return nil
+			}
+			kept[marker] = true
+			return writeMarker(dst, marker)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markerNeeded reports whether a whiteout or opaque marker from a span
+// still hides something below the span once the span is flattened
+func markerNeeded(view, lower *UnionFS, marker string) bool {
+	dir := path.Dir(marker)
+	if info, err := view.Stat(dir); err != nil || !info.IsDir() {
+		// The directory itself is hidden or gone, so its markers are moot
+		return false
+	}
+	if isOpaqueWhiteout(marker) {
+		info, err := lower.Stat(dir)
+		return err == nil && info.IsDir()
+	}
+
+	target := path.Join(dir, path.Base(marker)[len(WhiteoutPrefix):])
+	if _, err := view.Lstat(target); err == nil {
+		// The flattened layer has the entry, which shadows the lower one
+		return false
+	}
+	_, err := lower.Lstat(target)
+	return err == nil
+}
+
+// walkMarkers calls fn for every whiteout and opaque marker in fs under dir
+func walkMarkers(fs absfs.FileSystem, dir string, fn func(marker string) error) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		switch {
+		case isWhiteout(entry.Name()):
+			if err := fn(p); err != nil {
+				return err
+			}
+		case entry.IsDir():
+			if err := walkMarkers(fs, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeMarker creates an empty whiteout or opaque marker
+func writeMarker(fs absfs.FileSystem, marker string) error {
+	if err := fs.MkdirAll(path.Dir(marker), 0755); err != nil {
+		return err
+	}
+	f, err := fs.Create(marker)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyTree copies the visible tree of src under dir into dst, preserving
+// modes, times and symlinks
+func copyTree(src *UnionFS, dst absfs.FileSystem, dir string) error {
+	entries, err := src.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		info, err := src.Lstat(p)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := src.Readlink(p)
+			if err != nil {
+				return err
+			}
+			linker, ok := dst.(absfs.SymLinker)
+			if !ok {
+				return &os.LinkError{Op: "symlink", Old: target, New: p, Err: errors.ErrUnsupported}
+			}
+			if err := linker.Symlink(target, p); err != nil {
+				return err
+			}
+			continue
+		case info.IsDir():
+			if err := dst.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			if err := copyTree(src, dst, p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copyFile(src, dst, p, info); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if err := dst.Chmod(p, info.Mode()); err != nil {
+			return err
+		}
+		dst.Chtimes(p, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// copyFile copies one regular file from src to dst
+func copyFile(src *UnionFS, dst absfs.FileSystem, p string, info os.FileInfo) error {
+	in, err := src.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, src.copyBufferSize)
+	_, err = io.CopyBuffer(out, in, buf)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// snapshotView returns every visible path of a union with its contents
+func snapshotView(t *testing.T, ufs *UnionFS) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := ufs.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir(%s): %v", dir, err)
+		}
+		for _, entry := range entries {
+			p := path.Join(dir, entry.Name())
+			if entry.IsDir() {
+				out[p] = "<dir>"
+				walk(p)
+				continue
+			}
+			data, err := readFile(ufs, p)
+			if err != nil {
+				t.Fatalf("read %s: %v", p, err)
+			}
+			out[p] = string(data)
+		}
+	}
+	walk("/")
+	return out
+}
+
+// squashStack builds a four-layer union with whiteouts at several depths
+func squashStack(t *testing.T) *UnionFS {
+	t.Helper()
+	l1, l2, l3 := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+
+	writeFile(l3, "/etc/base.conf", []byte("l3"), 0644)
+	writeFile(l3, "/etc/removed.conf", []byte("l3"), 0644)
+	writeFile(l3, "/opt/old/file", []byte("l3"), 0644)
+
+	writeFile(l2, "/etc/base.conf", []byte("l2"), 0644)
+	writeFile(l2, "/etc/l2only.conf", []byte("l2"), 0644)
+	writeFile(l2, "/var/cache", []byte("l2"), 0644)
+
+	writeFile(l1, "/etc/.wh.removed.conf", nil, 0644) // hides l3: must be kept
+	writeFile(l1, "/etc/.wh.l2only.conf", nil, 0644)  // hides l2 only: dropped
+	writeFile(l1, "/var/.wh.missing", nil, 0644)      // hides nothing: dropped
+	writeFile(l1, "/etc/app.conf", []byte("l1"), 0644)
+
+	return New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(l1, LayerName("l1")),
+		WithReadOnlyLayer(l2, LayerName("l2")),
+		WithReadOnlyLayer(l3, LayerName("l3")),
+	)
+}
+
+// TestSquashReadOnlySpan tests flattening read-only layers above a base
+func TestSquashReadOnlySpan(t *testing.T) {
+	ufs := squashStack(t)
+	before := snapshotView(t, ufs)
+
+	flat := mustNewMemFS()
+	if err := ufs.Squash(1, 2, flat, LayerName("flat")); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := snapshotView(t, ufs); !reflect.DeepEqual(after, before) {
+		t.Errorf("view changed:\nbefore %v\nafter  %v", before, after)
+	}
+	var names []string
+	for _, l := range ufs.Layers() {
+		names = append(names, l.Name)
+	}
+	if want := []string{"", "flat", "l3"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("layers: got %v, want %v", names, want)
+	}
+
+	// Only the whiteout that still hides something below survives
+	if _, err := flat.Stat("/etc/.wh.removed.conf"); err != nil {
+		t.Error("expected whiteout against the base to be kept")
+	}
+	for _, marker := range []string{"/etc/.wh.l2only.conf", "/var/.wh.missing"} {
+		if _, err := flat.Stat(marker); err == nil {
+			t.Errorf("expected %s to be dropped", marker)
+		}
+	}
+	if data, _ := readFile(flat, "/etc/base.conf"); string(data) != "l2" {
+		t.Errorf("expected upper version in flattened layer, got %q", data)
+	}
+}
+
+// TestSquashWritableSpan tests flattening the writable layer into its base
+func TestSquashWritableSpan(t *testing.T) {
+	ufs := squashStack(t)
+	writeFile(ufs, "/etc/app.conf", []byte("edited"), 0644)
+	ufs.Remove("/opt/old/file")
+	before := snapshotView(t, ufs)
+
+	top := mustNewMemFS()
+	if err := ufs.Squash(0, 1, top); err != nil {
+		t.Fatal(err)
+	}
+	if after := snapshotView(t, ufs); !reflect.DeepEqual(after, before) {
+		t.Errorf("view changed:\nbefore %v\nafter  %v", before, after)
+	}
+	if layers := ufs.Layers(); len(layers) != 3 || layers[0].ReadOnly {
+		t.Fatalf("expected a writable top layer, got %+v", layers)
+	}
+
+	// New writes land in the squashed layer
+	writeFile(ufs, "/new.txt", []byte("new"), 0644)
+	if _, err := top.Stat("/new.txt"); err != nil {
+		t.Errorf("expected write in squashed layer: %v", err)
+	}
+}
+
+// hookFS calls hook before the first file is created in it
+type hookFS struct {
+	absfs.FileSystem
+	hook func()
+}
+
+func (h *hookFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if h.hook != nil && flag&os.O_CREATE != 0 {
+		hook := h.hook
+		h.hook = nil
+		hook()
+	}
+	return h.FileSystem.OpenFile(name, flag, perm)
+}
+
+// TestSquashSealsWritable tests that handles on the replaced writable layer
+// go stale instead of losing writes
+func TestSquashSealsWritable(t *testing.T) {
+	ufs := squashStack(t)
+	f, err := ufs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ufs.Squash(0, 1, mustNewMemFS()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("two")); !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("write after squash: %v", err)
+	}
+	if data, _ := readFile(ufs, "/f"); string(data) != "one" {
+		t.Errorf("f = %q", data)
+	}
+}
+
+// TestSquashWritesDuringCopy tests that the union stays usable while a
+// writable span is copied and keeps the writes made meanwhile
+func TestSquashWritesDuringCopy(t *testing.T) {
+	ufs := squashStack(t)
+	writeFile(ufs, "/etc/app.conf", []byte("edited"), 0644)
+
+	dst := &hookFS{FileSystem: mustNewMemFS()}
+	dst.hook = func() {
+		if err := writeFile(ufs, "/during.txt", []byte("during"), 0644); err != nil {
+			t.Errorf("write during squash: %v", err)
+		}
+		if err := ufs.Remove("/etc/app.conf"); err != nil {
+			t.Errorf("remove during squash: %v", err)
+		}
+	}
+	if err := ufs.Squash(0, 1, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if layers := ufs.Layers(); len(layers) != 3 || layers[0].ReadOnly {
+		t.Fatalf("expected a writable top layer, got %+v", layers)
+	}
+	if data, _ := readFile(dst, "/during.txt"); string(data) != "during" {
+		t.Errorf("during.txt in squashed layer = %q", data)
+	}
+	if _, err := ufs.Stat("/etc/app.conf"); !os.IsNotExist(err) {
+		t.Errorf("removed file visible: %v", err)
+	}
+}
+
+// TestSquashInvalidRange tests range validation
+func TestSquashInvalidRange(t *testing.T) {
+	ufs := squashStack(t)
+	for _, r := range [][2]int{{-1, 1}, {2, 1}, {1, 4}} {
+		if err := ufs.Squash(r[0], r[1], mustNewMemFS()); err == nil {
+			t.Errorf("Squash(%d, %d): expected error", r[0], r[1])
+		}
+	}
+}
+
+// TestSquashConcurrentReads tests that lookups racing a squash are served
+// from the replaced layers or from dst, never from a stale index
+func TestSquashConcurrentReads(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		ufs := squashStack(t)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if data, err := ufs.ReadFile("/opt/old/file"); err != nil || string(data) != "l3" {
+						t.Errorf("ReadFile = %q, %v", data, err)
+						return
+					}
+					if data, err := readFile(ufs, "/etc/base.conf"); err != nil || string(data) != "l2" {
+						t.Errorf("read = %q, %v", data, err)
+						return
+					}
+					if _, err := ufs.Which("/opt/old/file"); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		err := ufs.Squash(1, 3, mustNewMemFS())
+		close(stop)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
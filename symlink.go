@@ -24,7 +24,7 @@ func (ufs *UnionFS) Readlink(name string) (string, error) {
 		if linker, ok := layer.fs.(interface {
 			Readlink(string) (string, error)
 		}); ok {
-			target, err := linker.Readlink(name)
+			target, err := linker.Readlink(ufs.layerName(layer, name))
 			if err == nil {
 				return target, nil
 			}
@@ -40,15 +40,16 @@ func (ufs *UnionFS) Readlink(name string) (string, error) {
 
 // Symlink creates a symbolic link
 func (ufs *UnionFS) Symlink(oldname, newname string) error {
-	layer, err := ufs.getWritableLayer()
+	newname = ufs.resolveCase(cleanPath(newname))
+
+	_, found, _ := ufs.findLayer(newname)
+	layer, _, err := ufs.writeTarget(newname, found)
 	if err != nil {
 		return err
 	}
 
-	newname = cleanPath(newname)
-
 	// Ensure parent directory exists
-	if err := ufs.ensureDir(newname); err != nil {
+	if err := ufs.ensureDir(layer, newname); err != nil {
 		return err
 	}
 
@@ -60,7 +61,12 @@ func (ufs *UnionFS) Symlink(oldname, newname string) error {
 	if linker, ok := layer.fs.(interface {
 		Symlink(string, string) error
 	}); ok {
-		return linker.Symlink(oldname, newname)
+		if err := linker.Symlink(oldname, newname); err != nil {
+			return err
+		}
+		ufs.InvalidateCache(newname)
+		ufs.notify(Create, newname)
+		return nil
 	}
 
 	// If the underlying filesystem doesn't support symlinks, return error
@@ -69,13 +75,11 @@ func (ufs *UnionFS) Symlink(oldname, newname string) error {
 
 // Lchown changes the ownership of a symlink (without following it)
 func (ufs *UnionFS) Lchown(name string, uid, gid int) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
+	name = ufs.resolveCase(cleanPath(name))
+	if _, err := ufs.getWritableLayer(name); err != nil {
 		return err
 	}
 
-	name = cleanPath(name)
-
 	// Get file info without following symlinks
 	info, err := ufs.Lstat(name)
 	if err != nil {
@@ -84,22 +88,26 @@ func (ufs *UnionFS) Lchown(name string, uid, gid int) error {
 
 	// Find which layer has the file
 	ufs.mu.RLock()
-	layerIdx := -1
+	var found *Layer
 	for i, l := range ufs.layers {
 		if ufs.checkWhiteout(name, i) {
 			continue
 		}
 		_, err := l.fs.Stat(name)
 		if err == nil {
-			layerIdx = i
+			found = l
 			break
 		}
 	}
 	ufs.mu.RUnlock()
 
-	// Copy up if file is in a lower layer
-	if layerIdx > 0 {
-		if err := ufs.copyUp(name, info); err != nil {
+	// Copy up if file is in a read-only layer
+	layer, needCopy, err := ufs.writeTarget(name, found)
+	if err != nil {
+		return err
+	}
+	if needCopy {
+		if err := ufs.copyUp(layer, name, info); err != nil {
 			return err
 		}
 	}
@@ -116,6 +124,7 @@ func (ufs *UnionFS) Lchown(name string, uid, gid int) error {
 
 	if err == nil {
 		ufs.InvalidateCache(name)
+		ufs.notify(Chmod, name)
 	}
 	return err
 }
@@ -137,7 +146,7 @@ func (ufs *UnionFS) LstatIfPossible(name string) (os.FileInfo, bool, error) {
 		if lstater, ok := layer.fs.(interface {
 			LstatIfPossible(string) (os.FileInfo, bool, error)
 		}); ok {
-			info, supported, err := lstater.LstatIfPossible(name)
+			info, supported, err := lstater.LstatIfPossible(ufs.layerName(layer, name))
 			if err == nil {
 				return info, supported, nil
 			}
@@ -146,7 +155,7 @@ func (ufs *UnionFS) LstatIfPossible(name string) (os.FileInfo, bool, error) {
 			}
 		} else {
 			// Fall back to regular Stat if Lstat not supported
-			info, err := layer.fs.Stat(name)
+			info, err := ufs.statLayer(layer, name)
 			if err == nil {
 				return info, false, nil
 			}
@@ -0,0 +1,242 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// ociOpaqueWhiteout is the opaque marker name used by OCI image layers
+const ociOpaqueWhiteout = ".wh..wh..opq"
+
+// ExportTar writes the merged view of the union to w as a tar archive,
+// as if all layers were flattened into one
+func (ufs *UnionFS) ExportTar(w io.Writer) error {
+	return exportTar(w, ufs.FileSystem(), "/", false)
+}
+
+// ExportOCILayer writes the primary writable layer to w as an uncompressed OCI image
+// layer: a tar archive of the changes, with whiteouts for deletions and
+// ".wh..wh..opq" opaque markers.
+func (ufs *UnionFS) ExportOCILayer(w io.Writer) error {
+	layer, err := ufs.primaryLayer()
+	if err != nil {
+		return err
+	}
+	return exportTar(w, layer.fs, "/", true)
+}
+
+// ImportOCILayer extracts an uncompressed OCI image layer into dst, so that
+// dst can be used as a layer. Whiteouts are kept as whiteouts and OCI opaque
+// markers are converted to OpaqueWhiteout.
+func ImportOCILayer(dst absfs.FileSystem, r io.Reader) error {
+	return importTar(dst, r, "/", true)
+}
+
+// exportTar writes the tree of src under root to w as a tar archive. Entry
+// names are relative to root, and whiteout markers are written like any
+// other file, using OCI opaque markers if oci is set.
+func exportTar(w io.Writer, src absfs.FileSystem, root string, oci bool) error {
+	tw := tar.NewWriter(w)
+	if err := exportTarDir(tw, src, cleanPath(root), "", oci); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportTarDir writes the contents of dir, recursively
+func exportTarDir(tw *tar.Writer, src absfs.FileSystem, dir, prefix string, oci bool) error {
+	entries, err := src.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		name := path.Join(prefix, entry.Name())
+
+		info, err := lstatLayer(src, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if oci && isOpaqueWhiteout(name) {
+			hdr.Name = path.Join(prefix, ociOpaqueWhiteout)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if hdr.Linkname, err = readlinkLayer(src, p); err != nil {
+				return err
+			}
+		}
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			if err := exportTarDir(tw, src, p, name, oci); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := src.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importTar extracts a tar archive into dst under root, creating parent
+// directories as needed and restoring modes and modification times. OCI
+// opaque markers are renamed to OpaqueWhiteout if oci is set.
+func importTar(dst absfs.FileSystem, r io.Reader, root string, oci bool) error {
+	root = cleanPath(root)
+	type dirTimes struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := archiveName(hdr.Name)
+		if name == "" {
+			continue
+		}
+		if oci && path.Base(name) == ociOpaqueWhiteout {
+			name = path.Join(path.Dir(name), OpaqueWhiteout)
+		}
+		p := path.Join(root, name)
+		mode := hdr.FileInfo().Mode()
+
+		if hdr.Typeflag != tar.TypeDir {
+			if err := dst.MkdirAll(path.Dir(p), 0755); err != nil {
+				return err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := dst.MkdirAll(p, mode.Perm()); err != nil {
+				return err
+			}
+			if err := dst.Chmod(p, mode); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{p, hdr.ModTime})
+			continue
+		case tar.TypeSymlink:
+			linker, ok := dst.(interface {
+				Symlink(string, string) error
+			})
+			if !ok {
+				return &os.LinkError{Op: "symlink", Old: hdr.Linkname, New: p, Err: errors.ErrUnsupported}
+			}
+			dst.Remove(p)
+			if err := linker.Symlink(hdr.Linkname, p); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			if err := copyLayerFile(dst, path.Join(root, archiveName(hdr.Linkname)), p); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeGNUSparse:
+			f, err := dst.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0200)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			// Devices, fifos and extended headers have no filesystem form here
+			continue
+		}
+
+		if err := dst.Chmod(p, mode); err != nil {
+			return err
+		}
+		dst.Chtimes(p, hdr.ModTime, hdr.ModTime)
+	}
+
+	// Directory times are restored last, since creating entries changes them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dst.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+	return nil
+}
+
+// copyLayerFile copies a regular file within one filesystem
+func copyLayerFile(fs absfs.FileSystem, from, to string) error {
+	src, err := fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := fs.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lstatLayer stats p in fs without following a final symlink, if the
+// filesystem supports it
+func lstatLayer(fs absfs.FileSystem, p string) (os.FileInfo, error) {
+	if lstater, ok := fs.(interface {
+		Lstat(string) (os.FileInfo, error)
+	}); ok {
+		return lstater.Lstat(p)
+	}
+	return fs.Stat(p)
+}
+
+// readlinkLayer reads a symlink in fs
+func readlinkLayer(fs absfs.FileSystem, p string) (string, error) {
+	if linker, ok := fs.(interface {
+		Readlink(string) (string, error)
+	}); ok {
+		return linker.Readlink(p)
+	}
+	return "", &os.PathError{Op: "readlink", Path: p, Err: errors.ErrUnsupported}
+}
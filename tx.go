@@ -0,0 +1,320 @@
+package unionfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// ErrTxDone is returned when committing or aborting a finished transaction
+var ErrTxDone = errors.New("transaction already committed or aborted")
+
+// Tx is a set of changes staged in a private scratch layer above the
+// writable layer. Tx embeds a UnionFS, so it is used like the union it came
+// from: its reads see the union plus its own changes, and its writes,
+// removes and renames stay private until Commit.
+type Tx struct {
+	*UnionFS
+	parent  *UnionFS
+	base    *Layer // the parent's writable layer when the transaction began
+	scratch *Layer
+	err     error
+
+	mu   sync.Mutex
+	done bool
+}
+
+// Begin starts a transaction. Errors starting it, such as a missing
+// writable layer, several writable branches or write routes, are returned
+// by Commit and by the transaction's writes.
+//
+// Example:
+//
+//	tx := ufs.Begin()
+//	if err := tx.Rename("/etc/app/new.conf", "/etc/app/app.conf"); err != nil {
+//	    tx.Abort()
+//	    return err
+//	}
+//	return tx.Commit()
+func (ufs *UnionFS) Begin() *Tx {
+	ufs.mu.RLock()
+	layers := append([]*Layer(nil), ufs.layers...)
+	base := ufs.writableLayer
+	pooled := ufs.pooled()
+	ufs.mu.RUnlock()
+
+	tx := &Tx{UnionFS: ufs.layerView(layers), parent: ufs, base: base}
+	if base == nil {
+		tx.err = ErrNoWritableLayer
+		return tx
+	}
+	if pooled {
+		tx.err = ErrMultipleBranches
+		return tx
+	}
+	scratch, err := ufs.scratchLayer("tx")
+	if err != nil {
+		tx.err = fmt.Errorf("begin: %w", err)
+		return tx
+	}
+	tx.scratch = scratch
+	tx.UnionFS.layers = append([]*Layer{scratch}, tx.UnionFS.layers...)
+	tx.UnionFS.writableLayer = scratch
+	return tx
+}
+
+// Commit merges the transaction's changes into the writable layer. Readers
+// of the union see either none or all of them: the merge holds off lookups
+// and listings until it is complete, and a merge that fails partway is
+// undone, leaving the transaction open so Commit can be retried or the
+// transaction aborted. Undoing needs a copy of what the merge replaces, so
+// Commit keeps the writable layer's versions of the paths the transaction
+// changed in memory while it runs. Changes made to the union by others
+// since Begin are overwritten where the transaction touched the same paths.
+// If the layer stack was changed since Begin, Commit fails with
+// ErrLayersChanged.
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+	ufs := tx.parent
+
+	ufs.mu.Lock()
+	defer ufs.mu.Unlock()
+
+	if ufs.writableLayer != tx.base {
+		tx.finish()
+		return ErrLayersChanged
+	}
+	var events []Event
+	if ufs.watching() {
+		events = txEvents(tx.scratch.fs, ufs.layerView(ufs.layers), "/")
+	}
+
+	// Handles opened in the transaction must not change what is merged
+	tx.scratch.sealed.Store(true)
+	journal, err := ufs.journalMerge(tx.scratch.fs, tx.base.fs)
+	if err == nil {
+		if err = ufs.mergeLayer(tx.scratch.fs, tx.base.fs, "/"); err != nil {
+			if undoErr := journal.undo(tx.base.fs); undoErr != nil {
+				ufs.cache.clear()
+				tx.finish()
+				return fmt.Errorf("commit: %w", errors.Join(err, undoErr))
+			}
+		}
+	}
+	if err != nil {
+		tx.scratch.sealed.Store(false)
+		ufs.cache.clear()
+		return fmt.Errorf("commit: %w", err)
+	}
+	tx.finish()
+	ufs.cache.clear()
+	for _, ev := range events {
+		ufs.notifyEvent(ev)
+	}
+	return nil
+}
+
+// Abort discards the transaction's changes
+func (tx *Tx) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+	tx.finish()
+	return nil
+}
+
+// check returns the error ending the transaction, if any. A transaction
+// that failed to begin is over once the error is reported. The caller holds
+// tx.mu.
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.err != nil {
+		tx.done = true
+		return tx.err
+	}
+	return nil
+}
+
+// finish ends the transaction, leaving it a read-only view of the union.
+// Handles opened for writing in the transaction become stale. The caller
+// holds tx.mu.
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.scratch.sealed.Store(true)
+	view := tx.UnionFS
+	view.mu.Lock()
+	view.layers = view.layers[1:]
+	view.writableLayer = nil
+	view.mu.Unlock()
+}
+
+// txEvents returns the events that merging the scratch layer fs under dir
+// into a union whose current view is before will cause
+func txEvents(fs absfs.FileSystem, before *UnionFS, dir string) []Event {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var events []Event
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if target, ok := originalPath(p); ok {
+			if _, err := before.Lstat(target); err == nil {
+				events = append(events, Event{Op: Remove, Path: target})
+			}
+			continue
+		}
+		if isWhiteout(entry.Name()) {
+			continue
+		}
+
+		info, err := before.Lstat(p)
+		switch {
+		case err != nil:
+			events = append(events, Event{Op: Create, Path: p})
+		case entry.Type()&os.ModeType == 0 && info.Mode().IsRegular():
+			events = append(events, Event{Op: Write, Path: p})
+		}
+		if entry.IsDir() {
+			events = append(events, txEvents(fs, before, p)...)
+		}
+	}
+	return events
+}
+
+// mergeJournal keeps the state of the paths in a layer that merging another
+// layer into it will change, so that a failed merge can be undone. Only the
+// entries the merge replaces or removes are copied, to an in-memory layer.
+type mergeJournal struct {
+	ufs   *UnionFS
+	saved absfs.FileSystem
+	paths []journalPath
+	seen  map[string]bool
+	dirs  []journalPath // directories the merge descends into
+}
+
+// journalPath is a path the merge will change, whether it existed and, for
+// directories the merge descends into, their metadata
+type journalPath struct {
+	path    string
+	existed bool
+	info    os.FileInfo
+}
+
+// newJournal returns an empty journal
+func (ufs *UnionFS) newJournal() (*mergeJournal, error) {
+	saved, err := memfs.NewFS()
+	if err != nil {
+		return nil, err
+	}
+	return &mergeJournal{ufs: ufs, saved: saved, seen: make(map[string]bool)}, nil
+}
+
+// journalMerge records the state of everything in lower that merging upper
+// into it will change
+func (ufs *UnionFS) journalMerge(upper, lower absfs.FileSystem) (*mergeJournal, error) {
+	j, err := ufs.newJournal()
+	if err != nil {
+		return nil, err
+	}
+	if err := j.record(upper, lower, "/"); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// record mirrors mergeLayer, saving each lower path it is about to touch
+func (j *mergeJournal) record(upper, lower absfs.FileSystem, dir string) error {
+	entries, err := upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if isOpaqueWhiteout(p) {
+			stale, err := lower.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range stale {
+				if err := j.save(lower, path.Join(dir, e.Name())); err != nil {
+					return err
+				}
+			}
+		} else if target, ok := originalPath(p); ok {
+			if err := j.save(lower, target); err != nil {
+				return err
+			}
+		} else if info, err := lstatLayer(upper, p); err != nil {
+			return err
+		} else if existing, err := lstatLayer(lower, p); err == nil && existing.IsDir() && info.IsDir() {
+			// Merging into an existing directory only rewrites its metadata
+			j.dirs = append(j.dirs, journalPath{path: p, existed: true, info: existing})
+			if err := j.record(upper, lower, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := j.save(lower, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save copies p and anything under it from lower, or notes that it is absent
+func (j *mergeJournal) save(lower absfs.FileSystem, p string) error {
+	if j.seen[p] {
+		return nil
+	}
+	j.seen[p] = true
+	if _, err := lstatLayer(lower, p); os.IsNotExist(err) {
+		j.paths = append(j.paths, journalPath{path: p})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := j.ufs.copyLayerTree(lower, j.saved, p); err != nil {
+		return err
+	}
+	j.paths = append(j.paths, journalPath{path: p, existed: true})
+	return nil
+}
+
+// undo puts every recorded path in lower back the way it was
+func (j *mergeJournal) undo(lower absfs.FileSystem) error {
+	var errs []error
+	for i := len(j.paths) - 1; i >= 0; i-- {
+		jp := j.paths[i]
+		if err := removeLayerPath(lower, jp.path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if jp.existed {
+			if err := j.ufs.copyLayerTree(j.saved, lower, jp.path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for i := len(j.dirs) - 1; i >= 0; i-- {
+		d := j.dirs[i]
+		if err := lower.Chmod(d.path, d.info.Mode()); err != nil {
+			errs = append(errs, err)
+		}
+		lower.Chtimes(d.path, d.info.ModTime(), d.info.ModTime())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,260 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// txUnion returns a union with config files split across its layers
+func txUnion(t *testing.T) *UnionFS {
+	t.Helper()
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app/a.conf", []byte("old"), 0644)
+	writeFile(base, "/etc/app/b.conf", []byte("old"), 0644)
+	writeFile(base, "/etc/app/legacy.conf", []byte("old"), 0644)
+
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(base),
+	)
+	if err := writeFile(ufs, "/etc/app/c.conf", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ufs
+}
+
+// stageUpdate replaces the config set inside tx
+func stageUpdate(t *testing.T, tx *Tx) {
+	t.Helper()
+	for _, name := range []string{"a.conf", "b.conf", "c.conf"} {
+		if err := writeFile(tx, "/etc/app/"+name, []byte("new!!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Rename("/etc/app/legacy.conf", "/etc/app/d.conf"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	ufs := txUnion(t)
+	before := snapshotView(t, ufs)
+
+	tx := ufs.Begin()
+	stageUpdate(t, tx)
+
+	// Changes are visible in the transaction only
+	if data, err := readFile(tx, "/etc/app/a.conf"); err != nil || string(data) != "new!!" {
+		t.Errorf("tx read = %q, %v", data, err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("union changed before commit:\n got %v\nwant %v", got, before)
+	}
+	want := snapshotView(t, tx.UnionFS)
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after commit:\n got %v\nwant %v", got, want)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("second Commit = %v, want ErrTxDone", err)
+	}
+	if err := writeFile(tx, "/late", nil, 0644); !errors.Is(err, ErrNoWritableLayer) {
+		t.Errorf("write after commit = %v, want ErrNoWritableLayer", err)
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	ufs := txUnion(t)
+	before := snapshotView(t, ufs)
+
+	tx := ufs.Begin()
+	stageUpdate(t, tx)
+	f, err := tx.Create("/etc/app/open.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := tx.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("after abort:\n got %v\nwant %v", got, before)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("write after abort = %v, want ErrStaleHandle", err)
+	}
+}
+
+func TestTxCommitIsAtomic(t *testing.T) {
+	ufs := txUnion(t)
+	oldNames := []string{"a.conf", "b.conf", "c.conf", "legacy.conf"}
+	newNames := []string{"a.conf", "b.conf", "c.conf", "d.conf"}
+
+	tx := ufs.Begin()
+	stageUpdate(t, tx)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var mixed []string
+	var mu sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				entries, err := ufs.ReadDir("/etc/app")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var names []string
+				sizes := make(map[int64]bool)
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+					info, err := entry.Info()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					sizes[info.Size()] = true
+				}
+				sort.Strings(names)
+				old := reflect.DeepEqual(names, oldNames) && sizes[3] && len(sizes) == 1
+				updated := reflect.DeepEqual(names, newNames) && sizes[5] && len(sizes) == 1
+				if !old && !updated {
+					mu.Lock()
+					mixed = append(mixed, names...)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	err := tx.Commit()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mixed) > 0 {
+		t.Errorf("readers saw a partial commit: %v", mixed)
+	}
+}
+
+func TestTxWatchEvents(t *testing.T) {
+	ufs := txUnion(t)
+	events, cancel := ufs.Watch("/", true)
+	defer cancel()
+
+	tx := ufs.Begin()
+	stageUpdate(t, tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[Event]bool)
+	for len(events) > 0 {
+		got[<-events] = true
+	}
+	for _, want := range []Event{
+		{Op: Write, Path: "/etc/app/a.conf"},
+		{Op: Create, Path: "/etc/app/d.conf"},
+		{Op: Remove, Path: "/etc/app/legacy.conf"},
+	} {
+		if !got[want] {
+			t.Errorf("missing event %v in %v", want, got)
+		}
+	}
+}
+
+func TestTxErrors(t *testing.T) {
+	tx := New(WithReadOnlyLayer(mustNewMemFS())).Begin()
+	if err := tx.Commit(); !errors.Is(err, ErrNoWritableLayer) {
+		t.Errorf("Commit without writable layer = %v", err)
+	}
+
+	ufs := txUnion(t)
+	tx = ufs.Begin()
+	writeFile(tx, "/x", nil, 0644)
+	if _, err := ufs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrLayersChanged) {
+		t.Errorf("Commit after layer change = %v, want ErrLayersChanged", err)
+	}
+}
+
+// failFS fails creating the file named fail, once
+type failFS struct {
+	absfs.FileSystem
+	fail string
+}
+
+func (f *failFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if name == f.fail && flag&os.O_CREATE != 0 {
+		f.fail = ""
+		return nil, &os.PathError{Op: "open", Path: name, Err: errFailed}
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+var errFailed = errors.New("injected failure")
+
+func TestTxCommitFailure(t *testing.T) {
+	base := mustNewMemFS()
+	writeFile(base, "/etc/app/a.conf", []byte("old"), 0644)
+	writeFile(base, "/etc/app/b.conf", []byte("old"), 0644)
+	writeFile(base, "/etc/app/legacy.conf", []byte("old"), 0644)
+	top := &failFS{FileSystem: mustNewMemFS()}
+	ufs := New(WithWritableLayer(top), WithReadOnlyLayer(base))
+	if err := writeFile(ufs, "/etc/app/c.conf", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotView(t, ufs)
+
+	tx := ufs.Begin()
+	stageUpdate(t, tx)
+	want := snapshotView(t, tx.UnionFS)
+
+	// The merge fails after a.conf, b.conf and the whiteout are written
+	top.fail = "/etc/app/c.conf"
+	if err := tx.Commit(); !errors.Is(err, errFailed) {
+		t.Fatalf("Commit = %v, want injected failure", err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, before) {
+		t.Errorf("after failed commit:\n got %v\nwant %v", got, before)
+	}
+	if data, _ := readFile(top, "/etc/app/c.conf"); string(data) != "old" {
+		t.Errorf("writable c.conf = %q, want old", data)
+	}
+	if _, err := top.Stat("/etc/app/.wh.legacy.conf"); !os.IsNotExist(err) {
+		t.Errorf("whiteout left in writable layer: %v", err)
+	}
+
+	// The transaction stays open and can be retried
+	if err := writeFile(tx, "/etc/app/e.conf", []byte("new!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want["/etc/app/e.conf"] = "new!!"
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotView(t, ufs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after retried commit:\n got %v\nwant %v", got, want)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -31,24 +32,51 @@ var (
 type Layer struct {
 	fs       absfs.FileSystem
 	readOnly bool
+	id       string
+	name     string
+	labels   map[string]string
+	spec     *LayerSpec // manifest entry the layer was loaded from, if any
+	digestMu sync.Mutex
+	digest   string      // cached content digest of a read-only layer
+	sealed   atomic.Bool // set when frozen by a snapshot or discarded
 }
 
 // UnionFS implements a union filesystem with multiple layers
 type UnionFS struct {
-	layers         []*Layer // ordered from top (highest precedence) to bottom
-	writableLayer  *Layer   // reference to the writable layer (if any)
-	mu             sync.RWMutex
-	cache          *Cache
-	copyBufferSize int
+	layers          []*Layer // ordered from top (highest precedence) to bottom
+	writableLayer   *Layer   // reference to the writable layer (if any)
+	mu              sync.RWMutex
+	cache           *Cache
+	copyBufferSize  int
+	parallelism     int // max concurrent per-layer probes; <= 1 means sequential
+	dirOrdering     DirOrdering
+	caseInsensitive bool
+	watchers        []LayerWatcher
+	stopWatchers    []func()
+	layerWatches    map[*Layer]func() // stop functions of watched layers
+	watchersClosed  bool
+	notifier        notifier
+	newScratch      func() (absfs.FileSystem, error)
+	snapshots       map[SnapshotID]*Layer // scratch layer pushed by each snapshot
+	lastSnapshot    SnapshotID
+	rebasePolicy    RebasePolicy
+	originMu        sync.Mutex
+	origins         map[string]fileVersion // lower version of each copied-up file
+	createPolicy    CreatePolicy
+	searchPolicy    SearchPolicy
+	branchPrefixes  []branchPrefix
+	roundRobin      atomic.Uint64 // entries created by CreateRoundRobin
+	routes          []writeRoute
+	folded          caseIndex // spellings of layer directories, in case-insensitive mode
 }
 
 // Option is a functional option for configuring UnionFS
 type Option func(*UnionFS)
 
 // WithWritableLayer adds a writable layer at the top of the layer stack
-func WithWritableLayer(fs absfs.FileSystem) Option {
+func WithWritableLayer(fs absfs.FileSystem, opts ...LayerOption) Option {
 	return func(ufs *UnionFS) {
-		layer := &Layer{fs: fs, readOnly: false}
+		layer := newLayer(fs, false, opts)
 		ufs.layers = append([]*Layer{layer}, ufs.layers...)
 		ufs.writableLayer = layer
 	}
@@ -56,9 +84,9 @@ func WithWritableLayer(fs absfs.FileSystem) Option {
 
 // WithReadOnlyLayer adds a read-only layer to the layer stack
 // Read-only layers are added in order after the writable layer
-func WithReadOnlyLayer(fs absfs.FileSystem) Option {
+func WithReadOnlyLayer(fs absfs.FileSystem, opts ...LayerOption) Option {
 	return func(ufs *UnionFS) {
-		layer := &Layer{fs: fs, readOnly: true}
+		layer := newLayer(fs, true, opts)
 		// Simply append - layers will be in order: writable, then read-only in order added
 		ufs.layers = append(ufs.layers, layer)
 	}
@@ -87,16 +115,68 @@ func WithCopyBufferSize(size int) Option {
 	}
 }
 
+// WithParallelLookup probes layers concurrently during lookups and directory
+// merges, using at most workers concurrent calls. This helps when lower layers
+// are slow (network or archive backed). Layer precedence and whiteout handling
+// are identical to the sequential path. A value of 1 or less disables it.
+func WithParallelLookup(workers int) Option {
+	return func(ufs *UnionFS) {
+		ufs.parallelism = workers
+	}
+}
+
+// WithDirOrdering sets the order of entries returned by ReadDir and directory
+// handles. The default, OrderByName, matches os.ReadDir. Sorted orderings
+// stream only layers implementing SortedLister, such as archive layers;
+// other layers, including memfs and host directories from NewDirLayer or
+// os.DirFS, are read in full and buffered when a listing starts. OrderLayer
+// streams every layer in batches.
+func WithDirOrdering(ordering DirOrdering) Option {
+	return func(ufs *UnionFS) {
+		ufs.dirOrdering = ordering
+	}
+}
+
+// WithCaseInsensitive matches names across layers case-insensitively, for
+// trees that originate on case-insensitive filesystems. Lookups find entries
+// regardless of case, entries differing only in case are merged with the
+// upper layer's spelling winning, whiteouts hide names in any case, and
+// writes reuse the existing spelling. Lookups of names that are not spelled
+// exactly as stored need directory scans, so this mode is slower.
+func WithCaseInsensitive() Option {
+	return func(ufs *UnionFS) {
+		ufs.caseInsensitive = true
+	}
+}
+
+// WithScratchLayers sets how throwaway writable layers are created for
+// snapshots and transactions. The default creates in-memory layers.
+func WithScratchLayers(newFS func() (absfs.FileSystem, error)) Option {
+	return func(ufs *UnionFS) {
+		ufs.newScratch = newFS
+	}
+}
+
+// WithRebasePolicy sets how Rebase resolves conflicts. The default,
+// RebaseFail, leaves the union unchanged when there are any.
+func WithRebasePolicy(policy RebasePolicy) Option {
+	return func(ufs *UnionFS) {
+		ufs.rebasePolicy = policy
+	}
+}
+
 // New creates a new UnionFS with the specified options
 func New(opts ...Option) *UnionFS {
 	ufs := &UnionFS{
 		layers:         make([]*Layer, 0),
-		copyBufferSize: 32 * 1024, // default 32KB
+		copyBufferSize: 32 * 1024,                // default 32KB
 		cache:          newCache(false, 0, 0, 0), // disabled by default
 	}
 	for _, opt := range opts {
 		opt(ufs)
 	}
+	ufs.orderBranches()
+	ufs.startWatchers()
 	return ufs
 }
 
@@ -150,22 +230,10 @@ func cleanPath(p string) string {
 
 // checkWhiteout checks if a file is marked as deleted via whiteout in any layer above the given index
 func (ufs *UnionFS) checkWhiteout(p string, startLayer int) bool {
-	wPath := whiteoutPath(p)
 	for i := 0; i < startLayer; i++ {
-		layer := ufs.layers[i]
-		if _, err := layer.fs.Stat(wPath); err == nil {
+		if ufs.hasWhiteout(ufs.layers[i], p) {
 			return true
 		}
-		// Check for opaque directory whiteout in parent directories
-		// Use path package for virtual paths (forward slashes)
-		dir := path.Dir(p)
-		for dir != "/" && dir != "." {
-			opaquePath := path.Join(dir, OpaqueWhiteout)
-			if _, err := layer.fs.Stat(opaquePath); err == nil {
-				return true
-			}
-			dir = path.Dir(dir)
-		}
 	}
 	return false
 }
@@ -173,20 +241,44 @@ func (ufs *UnionFS) checkWhiteout(p string, startLayer int) bool {
 // findFile searches for a file across all layers, respecting whiteouts
 // Returns the file info, layer index, and error
 func (ufs *UnionFS) findFile(path string) (os.FileInfo, int, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+	return ufs.findFileLocked(path)
+}
+
+// findLayer is findFile returning the layer the file was found in instead
+// of its index. The layer is resolved under the same lock as the lookup, so
+// restructuring the stack cannot swap it for another.
+func (ufs *UnionFS) findLayer(path string) (os.FileInfo, *Layer, error) {
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+	info, idx, err := ufs.findFileLocked(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, ufs.layers[idx], nil
+}
+
+// findFileLocked is findFile for callers that hold ufs.mu, so that the
+// returned index stays valid until they release it
+func (ufs *UnionFS) findFileLocked(path string) (os.FileInfo, int, error) {
 	path = cleanPath(path)
 
-	// Check cache first
-	if info, layer, ok := ufs.cache.getStat(path); ok {
+	// Check cache first. Entries are keyed by the folded path in
+	// case-insensitive mode, so all spellings of a name share one entry
+	key := ufs.nameKey(path)
+	if info, layer, ok := ufs.cache.getStat(key); ok {
 		return info, layer, nil
 	}
 
 	// Check negative cache
-	if ufs.cache.isNegative(path) {
+	if ufs.cache.isNegative(key) {
 		return nil, -1, os.ErrNotExist
 	}
 
-	ufs.mu.RLock()
-	defer ufs.mu.RUnlock()
+	if ufs.parallel() {
+		return ufs.findFileParallel(path)
+	}
 
 	for i, layer := range ufs.layers {
 		// Check if this file is whited out in an upper layer
@@ -194,10 +286,11 @@ func (ufs *UnionFS) findFile(path string) (os.FileInfo, int, error) {
 			continue
 		}
 
-		info, err := layer.fs.Stat(path)
+		info, err := ufs.statLayer(layer, path)
 		if err == nil {
 			// Found the file - cache it
-			ufs.cache.putStat(path, info, i)
+			info, i = ufs.newestBranch(path, info, i, ufs.statLayer)
+			ufs.cache.putStat(key, info, i)
 			return info, i, nil
 		}
 		if !os.IsNotExist(err) {
@@ -207,28 +300,14 @@ func (ufs *UnionFS) findFile(path string) (os.FileInfo, int, error) {
 	}
 
 	// File not found in any layer - cache negative result
-	ufs.cache.putNegative(path)
+	ufs.cache.putNegative(key)
 	return nil, -1, os.ErrNotExist
 }
 
-// getWritableLayer returns the writable layer or an error
-func (ufs *UnionFS) getWritableLayer() (*Layer, error) {
-	ufs.mu.RLock()
-	defer ufs.mu.RUnlock()
-
-	if ufs.writableLayer == nil {
-		return nil, ErrNoWritableLayer
-	}
-	return ufs.writableLayer, nil
-}
-
-// ensureDir ensures all parent directories exist in the writable layer
-func (ufs *UnionFS) ensureDir(p string) error {
-	layer, err := ufs.getWritableLayer()
-	if err != nil {
-		return err
-	}
-
+// ensureDir ensures all parent directories of p exist in layer. Parents
+// the union shows are copied up with their mode and times, so that creating
+// an entry in a layer does not change how its parents look.
+func (ufs *UnionFS) ensureDir(layer *Layer, p string) error {
 	dir := path.Dir(p)
 	if dir == "/" || dir == "." {
 		return nil
@@ -238,6 +317,12 @@ func (ufs *UnionFS) ensureDir(p string) error {
 	if _, err := layer.fs.Stat(dir); err == nil {
 		return nil
 	}
+	if err := ufs.ensureDir(layer, dir); err != nil {
+		return err
+	}
+	if info, _, err := ufs.findFile(dir); err == nil && info.IsDir() {
+		return ufs.copyUpDir(layer, dir, info)
+	}
 
 	// Create directory with proper permissions
 	return layer.fs.MkdirAll(dir, 0755)
@@ -246,13 +331,13 @@ func (ufs *UnionFS) ensureDir(p string) error {
 // InvalidateCache removes a path from the cache
 func (ufs *UnionFS) InvalidateCache(path string) {
 	path = cleanPath(path)
-	ufs.cache.invalidate(path)
+	ufs.cache.invalidate(ufs.nameKey(path))
 }
 
 // InvalidateCacheTree removes all cache entries under a path prefix
 func (ufs *UnionFS) InvalidateCacheTree(pathPrefix string) {
 	pathPrefix = cleanPath(pathPrefix)
-	ufs.cache.invalidateTree(pathPrefix)
+	ufs.cache.invalidateTree(ufs.nameKey(pathPrefix))
 }
 
 // ClearCache removes all cache entries
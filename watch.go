@@ -0,0 +1,271 @@
+package unionfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrWatchUnsupported is returned when native change notification is not available on this platform
+var ErrWatchUnsupported = errors.New("layer watching not supported on this platform")
+
+// LayerEvent describes a change made directly to a layer's backing store,
+// bypassing UnionFS
+type LayerEvent struct {
+	// Path is the virtual path (forward slashes, rooted at "/") that changed
+	Path string
+	// Tree reports that everything under Path may have changed
+	Tree bool
+	// Op is the kind of change, or 0 if unknown
+	Op Op
+	// Layer is the ID or name of the layer that changed, so that changes
+	// hidden by the layers above it are not reported. Watchers of layers
+	// that implement LayerWatcher are tied to their layer and need not set
+	// it; events without one are assumed to be visible.
+	Layer string
+}
+
+// LayerWatcher is implemented by layers (or companions of layers) that can
+// report changes made underneath UnionFS. Watch delivers events to fn until
+// the returned stop function is called.
+type LayerWatcher interface {
+	Watch(fn func(LayerEvent)) (stop func())
+}
+
+// WithLayerWatcher registers a watcher whose events invalidate the stat cache.
+// Layers whose filesystem implements LayerWatcher are watched automatically,
+// including those added later by Snapshot, Squash or RebaseOnto.
+func WithLayerWatcher(w LayerWatcher) Option {
+	return func(ufs *UnionFS) {
+		ufs.watchers = append(ufs.watchers, w)
+	}
+}
+
+// startWatchers starts all registered watchers and any layer that implements LayerWatcher
+func (ufs *UnionFS) startWatchers() {
+	watchers := append([]LayerWatcher(nil), ufs.watchers...)
+	for _, w := range watchers {
+		ufs.stopWatchers = append(ufs.stopWatchers, w.Watch(ufs.handleLayerEvent))
+	}
+	ufs.watchLayers()
+}
+
+// setLayers replaces the layer stack, watching the layers it adds and
+// stopping the watches of the layers it drops. The caller must hold ufs.mu.
+func (ufs *UnionFS) setLayers(layers []*Layer) {
+	ufs.layers = layers
+	ufs.watchLayers()
+}
+
+// watchLayers starts watching the layers of the stack that implement
+// LayerWatcher and are not watched yet, and stops watching layers that have
+// left the stack. The caller must hold ufs.mu, or be New.
+func (ufs *UnionFS) watchLayers() {
+	if ufs.watchersClosed {
+		return
+	}
+	current := make(map[*Layer]bool, len(ufs.layers))
+	for _, layer := range ufs.layers {
+		current[layer] = true
+		if _, ok := ufs.layerWatches[layer]; ok {
+			continue
+		}
+		if w, ok := layer.fs.(LayerWatcher); ok {
+			layer := layer
+			if ufs.layerWatches == nil {
+				ufs.layerWatches = make(map[*Layer]func())
+			}
+			ufs.layerWatches[layer] = w.Watch(func(ev LayerEvent) { ufs.handleEventIn(layer, ev) })
+		}
+	}
+	for layer, stop := range ufs.layerWatches {
+		if !current[layer] {
+			stop()
+			delete(ufs.layerWatches, layer)
+		}
+	}
+}
+
+// Close stops all layer watchers, including those of layers added later.
+// The layers themselves are not closed.
+func (ufs *UnionFS) Close() error {
+	ufs.mu.Lock()
+	stops := ufs.stopWatchers
+	for _, stop := range ufs.layerWatches {
+		stops = append(stops, stop)
+	}
+	ufs.stopWatchers = nil
+	ufs.layerWatches = nil
+	ufs.watchersClosed = true
+	ufs.mu.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+	return nil
+}
+
+// handleLayerEvent invalidates the cache entries affected by an external
+// change and forwards it to Watch subscribers
+func (ufs *UnionFS) handleLayerEvent(ev LayerEvent) {
+	var layer *Layer
+	if ev.Layer != "" {
+		layer, _, _ = ufs.layerByRef(ev.Layer)
+	}
+	ufs.handleEventIn(layer, ev)
+}
+
+// handleEventIn handles an external change to layer, or to an unknown layer
+// if nil. Changes hidden by the layers above are not forwarded.
+func (ufs *UnionFS) handleEventIn(layer *Layer, ev LayerEvent) {
+	p := cleanPath(ev.Path)
+	tree := ev.Tree
+	op := ev.Op
+
+	// A whiteout or opaque marker changes visibility of the path it masks
+	if isOpaqueWhiteout(p) {
+		p = path.Dir(p)
+		tree = true
+		if op != 0 {
+			op = Write
+		}
+	} else if original, ok := originalPath(p); ok {
+		p = original
+		tree = true
+		op = whiteoutEventOp(op)
+	}
+
+	if tree {
+		ufs.InvalidateCacheTree(p)
+	} else {
+		ufs.InvalidateCache(p)
+	}
+
+	if op != 0 && !ufs.shadowed(layer, p, tree) {
+		ufs.notify(op, p)
+	}
+}
+
+// shadowed reports whether the layers above layer hide p, so that a change
+// to p in layer does not show in the merged view. Directories above do not
+// hide changes under a lower directory, since their contents are merged.
+func (ufs *UnionFS) shadowed(layer *Layer, p string, tree bool) bool {
+	if layer == nil {
+		return false
+	}
+	ufs.mu.RLock()
+	defer ufs.mu.RUnlock()
+
+	idx := indexOfLayer(ufs.layers, layer)
+	if idx < 0 {
+		return true
+	}
+	if ufs.checkWhiteout(p, idx) {
+		return true
+	}
+	for _, upper := range ufs.layers[:idx] {
+		if info, err := ufs.lstatIn(upper, p); err == nil && !(tree && info.IsDir()) {
+			return true
+		}
+	}
+	return false
+}
+
+// pollState is the metadata compared between polling passes
+type pollState struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// pollingWatcher detects changes by periodically walking a filesystem
+type pollingWatcher struct {
+	fs       absfs.Filer
+	interval time.Duration
+}
+
+// NewPollingWatcher returns a LayerWatcher that walks fs every interval and
+// reports paths whose size, modification time or mode changed, appeared or
+// disappeared. It works with any filesystem and is the fallback when native
+// change notification is unavailable.
+func NewPollingWatcher(fs absfs.Filer, interval time.Duration) LayerWatcher {
+	return &pollingWatcher{fs: fs, interval: interval}
+}
+
+// Watch implements LayerWatcher
+func (w *pollingWatcher) Watch(fn func(LayerEvent)) func() {
+	done := make(chan struct{})
+	var once sync.Once
+
+	prev := w.scan()
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				cur := w.scan()
+				diffPollStates(prev, cur, fn)
+				prev = cur
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// scan walks the whole filesystem and records the state of every path
+func (w *pollingWatcher) scan() map[string]pollState {
+	states := make(map[string]pollState)
+	w.scanDir("/", states)
+	return states
+}
+
+// scanDir records the state of every entry under dir
+func (w *pollingWatcher) scanDir(dir string, states map[string]pollState) {
+	entries, err := w.fs.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		states[p] = pollState{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		if entry.IsDir() {
+			w.scanDir(p, states)
+		}
+	}
+}
+
+// diffPollStates reports every path that differs between two scans
+func diffPollStates(prev, cur map[string]pollState, fn func(LayerEvent)) {
+	for p, st := range cur {
+		old, ok := prev[p]
+		switch {
+		case !ok:
+			fn(LayerEvent{Path: p, Op: Create})
+		case old.mode.IsDir() != st.mode.IsDir():
+			fn(LayerEvent{Path: p, Tree: true, Op: Remove | Create})
+		case old.size != st.size || !old.modTime.Equal(st.modTime):
+			fn(LayerEvent{Path: p, Op: Write})
+		case old.mode != st.mode:
+			fn(LayerEvent{Path: p, Op: Chmod})
+		}
+	}
+	for p, st := range prev {
+		if _, ok := cur[p]; !ok {
+			fn(LayerEvent{Path: p, Tree: st.mode.IsDir(), Op: Remove})
+		}
+	}
+}
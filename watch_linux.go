@@ -0,0 +1,181 @@
+//go:build linux
+
+package unionfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that can change what a layer exposes
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_CLOSE_WRITE
+
+// inotifyWatcher reports changes under an OS directory using inotify
+type inotifyWatcher struct {
+	root string
+	fd   int
+	file *os.File // fd wrapped for the runtime poller so Close unblocks reads
+	mu   sync.Mutex
+	dirs map[int]string // watch descriptor -> virtual directory path
+	once sync.Once
+}
+
+// NewInotifyWatcher returns a LayerWatcher for a layer backed by the OS
+// directory root. Every directory under root is watched, and directories
+// created later are added as they appear.
+func NewInotifyWatcher(root string) (LayerWatcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		root: root,
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int]string),
+	}
+	if err := w.addTree("/"); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// addTree adds watches for the virtual directory dir and all its subdirectories
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(w.osPath(dir), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Entries can vanish while walking; they will be reported by their parent
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = w.virtualPath(p)
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// osPath converts a virtual path to a path on the OS filesystem
+func (w *inotifyWatcher) osPath(p string) string {
+	return filepath.Join(w.root, filepath.FromSlash(p))
+}
+
+// virtualPath converts an OS path under root to a virtual path
+func (w *inotifyWatcher) virtualPath(p string) string {
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil {
+		return "/"
+	}
+	return cleanPath(filepath.ToSlash(rel))
+}
+
+// Watch implements LayerWatcher
+func (w *inotifyWatcher) Watch(fn func(LayerEvent)) func() {
+	go w.run(fn)
+	return func() {
+		w.once.Do(func() { w.file.Close() })
+	}
+}
+
+// run reads inotify events until the watcher is stopped
+func (w *inotifyWatcher) run(fn func(LayerEvent)) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			name := string(trimNul(nameBytes))
+			w.dispatch(int(raw.Wd), raw.Mask, name, fn)
+		}
+	}
+}
+
+// dispatch converts a raw inotify event into a LayerEvent
+func (w *inotifyWatcher) dispatch(wd int, mask uint32, name string, fn func(LayerEvent)) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were dropped; everything may be stale
+		fn(LayerEvent{Path: "/", Tree: true, Op: Write})
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok || mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+
+	if name == "" {
+		// Event on the watched directory itself
+		self := mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0
+		fn(LayerEvent{Path: dir, Tree: self, Op: inotifyOp(mask)})
+		return
+	}
+
+	p := cleanPath(dir + "/" + name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	if isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// Errors are ignored: the directory may already be gone again
+		_ = w.addTree(p)
+	}
+	fn(LayerEvent{Path: p, Tree: isDir, Op: inotifyOp(mask)})
+}
+
+// inotifyOp maps an inotify event mask to an Op
+func inotifyOp(mask uint32) Op {
+	var op Op
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		op |= Create
+	}
+	if mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0 {
+		op |= Write
+	}
+	if mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		op |= Remove
+	}
+	if mask&syscall.IN_ATTRIB != 0 {
+		op |= Chmod
+	}
+	return op
+}
+
+// trimNul strips the NUL padding inotify appends to names
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
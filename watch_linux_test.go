@@ -0,0 +1,54 @@
+//go:build linux
+
+package unionfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestInotifyWatcher tests that inotify reports changes, including in new subdirectories
+func TestInotifyWatcher(t *testing.T) {
+	root := t.TempDir()
+
+	w, err := NewInotifyWatcher(root)
+	if err != nil {
+		t.Fatalf("failed to create watcher: %v", err)
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]LayerEvent)
+	stop := w.Watch(func(ev LayerEvent) {
+		mu.Lock()
+		seen[ev.Path] = ev
+		mu.Unlock()
+	})
+	defer stop()
+
+	has := func(p string) (LayerEvent, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		ev, ok := seen[p]
+		return ev, ok
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, 2*time.Second, func() bool { _, ok := has("/sub"); return ok }) {
+		t.Fatal("no event for created directory")
+	}
+	if ev, _ := has("/sub"); !ev.Tree {
+		t.Error("directory event should cover the whole tree")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "sub", "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, 2*time.Second, func() bool { _, ok := has("/sub/file.txt"); return ok }) {
+		t.Error("no event for file in new subdirectory")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package unionfs
+
+// NewInotifyWatcher is only available on Linux. Use NewPollingWatcher on
+// other platforms.
+func NewInotifyWatcher(root string) (LayerWatcher, error) {
+	return nil, ErrWatchUnsupported
+}
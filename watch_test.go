@@ -0,0 +1,180 @@
+package unionfs
+
+import (
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// lockedFiler serializes directory reads with test edits, since memfs is not
+// safe for concurrent mutation
+type lockedFiler struct {
+	absfs.Filer
+	mu *sync.Mutex
+}
+
+func (l lockedFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.ReadDir(name)
+}
+
+// waitFor polls cond until it returns true or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+// TestPollingWatcherInvalidatesCache tests that direct edits to a layer are picked up
+func TestPollingWatcherInvalidatesCache(t *testing.T) {
+	baseLayer := mustNewMemFS()
+	overlay := mustNewMemFS()
+	writeFile(baseLayer, "/config.txt", []byte("v1"), 0644)
+
+	var mu sync.Mutex
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(baseLayer),
+		WithStatCache(true, time.Hour),
+		WithLayerWatcher(NewPollingWatcher(lockedFiler{baseLayer, &mu}, 10*time.Millisecond)),
+	)
+	defer ufs.Close()
+
+	if _, err := ufs.Stat("/config.txt"); err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	if _, err := ufs.Stat("/new.txt"); err == nil {
+		t.Fatal("expected /new.txt to not exist yet")
+	}
+
+	// Edit the base layer behind the union's back
+	mu.Lock()
+	writeFile(baseLayer, "/config.txt", []byte("version 2"), 0644)
+	writeFile(baseLayer, "/new.txt", []byte("new"), 0644)
+	mu.Unlock()
+
+	ok := waitFor(t, 2*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		info, err := ufs.Stat("/config.txt")
+		if err != nil || info.Size() != int64(len("version 2")) {
+			return false
+		}
+		_, err = ufs.Stat("/new.txt")
+		return err == nil
+	})
+	if !ok {
+		t.Error("cache was not invalidated after external change")
+	}
+}
+
+// TestPollingWatcherStop tests that stopping a watcher stops event delivery
+func TestPollingWatcherStop(t *testing.T) {
+	layer := mustNewMemFS()
+	events := make(chan LayerEvent, 16)
+
+	stop := NewPollingWatcher(layer, 5*time.Millisecond).Watch(func(ev LayerEvent) {
+		events <- ev
+	})
+	stop()
+	stop() // stopping twice must be safe
+
+	writeFile(layer, "/file.txt", []byte("data"), 0644)
+	time.Sleep(30 * time.Millisecond)
+
+	if len(events) != 0 {
+		t.Errorf("expected no events after stop, got %d", len(events))
+	}
+}
+
+// TestHandleLayerEventWhiteout tests that whiteout events invalidate the masked path
+func TestHandleLayerEventWhiteout(t *testing.T) {
+	baseLayer := mustNewMemFS()
+	overlay := mustNewMemFS()
+	writeFile(baseLayer, "/dir/file.txt", []byte("content"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(baseLayer),
+		WithStatCache(true, time.Hour),
+	)
+
+	if _, err := ufs.Stat("/dir/file.txt"); err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+
+	// Whiteout the file directly in the overlay
+	writeFile(overlay, "/dir/.wh.file.txt", nil, 0644)
+	ufs.handleLayerEvent(LayerEvent{Path: "/dir/.wh.file.txt"})
+
+	if _, err := ufs.Stat("/dir/file.txt"); err == nil {
+		t.Error("expected whited out file to be hidden after event")
+	}
+
+	// Opaque markers invalidate the whole directory
+	overlay.Remove("/dir/.wh.file.txt")
+	ufs.handleLayerEvent(LayerEvent{Path: "/dir/.wh.file.txt"})
+	if _, err := ufs.Stat("/dir/file.txt"); err != nil {
+		t.Fatalf("expected file to be visible again: %v", err)
+	}
+
+	writeFile(overlay, "/dir/"+OpaqueWhiteout, nil, 0644)
+	ufs.handleLayerEvent(LayerEvent{Path: "/dir/" + OpaqueWhiteout})
+	if _, err := ufs.Stat("/dir/file.txt"); err == nil {
+		t.Error("expected file to be hidden by opaque directory after event")
+	}
+}
+
+// watchedFS is a layer that reports changes made to it behind the union's
+// back
+type watchedFS struct {
+	absfs.FileSystem
+	LayerWatcher
+}
+
+// TestWatchSquashedLayer tests that a layer added by Squash is watched
+func TestWatchSquashedLayer(t *testing.T) {
+	a, b := mustNewMemFS(), mustNewMemFS()
+	writeFile(a, "/config.txt", []byte("v1"), 0644)
+	writeFile(b, "/other.txt", []byte("other"), 0644)
+	ufs := New(
+		WithWritableLayer(mustNewMemFS()),
+		WithReadOnlyLayer(a),
+		WithReadOnlyLayer(b),
+		WithStatCache(true, time.Hour),
+	)
+	defer ufs.Close()
+
+	var mu sync.Mutex
+	flat := mustNewMemFS()
+	dst := watchedFS{flat, NewPollingWatcher(lockedFiler{flat, &mu}, 10*time.Millisecond)}
+	if err := ufs.Squash(1, 2, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat("/new.txt"); err == nil {
+		t.Fatal("expected /new.txt to not exist yet")
+	}
+
+	// Edit the squashed layer behind the union's back
+	mu.Lock()
+	writeFile(flat, "/new.txt", []byte("new"), 0644)
+	mu.Unlock()
+
+	ok := waitFor(t, 2*time.Second, func() bool {
+		_, err := ufs.Stat("/new.txt")
+		return err == nil
+	})
+	if !ok {
+		t.Error("cache was not invalidated after external change to the squashed layer")
+	}
+}
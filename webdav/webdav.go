@@ -0,0 +1,162 @@
+// Package webdav serves a UnionFS over WebDAV, so desktop clients can browse
+// and edit the merged view. Writes go to the union's writable layer with the
+// usual copy-on-write and whiteout handling.
+//
+// Example:
+//
+//	ufs := unionfs.New(
+//	    unionfs.WithWritableLayer(overlay),
+//	    unionfs.WithReadOnlyLayer(base),
+//	)
+//	http.ListenAndServe(":8080", webdav.NewHandler(ufs))
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/absfs/unionfs"
+	"golang.org/x/net/webdav"
+)
+
+// FileSystem adapts a UnionFS to webdav.FileSystem
+type FileSystem struct {
+	ufs *unionfs.UnionFS
+}
+
+// Ensure FileSystem implements webdav.FileSystem at compile time
+var _ webdav.FileSystem = (*FileSystem)(nil)
+
+// NewFileSystem returns a webdav.FileSystem serving ufs
+func NewFileSystem(ufs *unionfs.UnionFS) *FileSystem {
+	return &FileSystem{ufs: ufs}
+}
+
+// NewHandler returns a WebDAV handler serving ufs with in-memory locks
+func NewHandler(ufs *unionfs.UnionFS) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: NewFileSystem(ufs),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// Mkdir creates a directory in the writable layer
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.ufs.Mkdir(name, perm)
+}
+
+// OpenFile opens a file or directory. Directory listings are the merged
+// listings of the union, with whiteouts applied.
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.ufs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RemoveAll removes a file or directory tree, whiting out lower layer copies
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	return fs.ufs.RemoveAll(name)
+}
+
+// Rename moves a file or directory. Files are renamed in the writable layer.
+// Directories may have contents in read-only layers that cannot be renamed,
+// so they are copied to the new name and then removed.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	info, err := fs.ufs.Lstat(oldName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fs.ufs.Rename(oldName, newName)
+	}
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+	if newName == oldName || isWithin(newName, oldName) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	if _, err := fs.ufs.Lstat(newName); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	if err := fs.copyDir(ctx, oldName, newName, info); err != nil {
+		return err
+	}
+	return fs.ufs.RemoveAll(oldName)
+}
+
+// Stat returns the merged view's file info
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.ufs.Stat(name)
+}
+
+// isWithin reports whether p is below dir
+func isWithin(p, dir string) bool {
+	return dir == "/" || len(p) > len(dir) && p[:len(dir)] == dir && p[len(dir)] == '/'
+}
+
+// copyDir copies the merged tree at src to dst
+func (fs *FileSystem) copyDir(ctx context.Context, src, dst string, info os.FileInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := fs.ufs.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+		return err
+	}
+	entries, err := fs.ufs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from, to := path.Join(src, entry.Name()), path.Join(dst, entry.Name())
+		info, err := fs.ufs.Lstat(from)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := fs.ufs.Readlink(from)
+			if err != nil {
+				return err
+			}
+			if err := fs.ufs.Symlink(target, to); err != nil {
+				return err
+			}
+			continue
+		case info.IsDir():
+			err = fs.copyDir(ctx, from, to, info)
+		case info.Mode().IsRegular():
+			err = fs.copyFile(from, to, info)
+		default:
+			err = &os.PathError{Op: "rename", Path: from, Err: errors.ErrUnsupported}
+		}
+		if err != nil {
+			return err
+		}
+		fs.ufs.Chtimes(to, info.ModTime(), info.ModTime())
+	}
+	if err := fs.ufs.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return fs.ufs.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies one regular file
+func (fs *FileSystem) copyFile(src, dst string, info os.FileInfo) error {
+	in, err := fs.ufs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.ufs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+	"github.com/absfs/unionfs"
+)
+
+// writeFile creates a file with the given contents
+func writeFile(t *testing.T, fs interface {
+	OpenFile(string, int, os.FileMode) (absfs.File, error)
+}, name, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(data))
+	f.Close()
+}
+
+// newServer serves a union with a populated base layer
+func newServer(t *testing.T) (*unionfs.UnionFS, absfs.FileSystem, *httptest.Server) {
+	t.Helper()
+	overlay, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.MkdirAll("/docs/sub", 0755)
+	for name, data := range map[string]string{
+		"/docs/readme.txt":  "base readme",
+		"/docs/old.txt":     "old",
+		"/docs/sub/a.txt":   "a",
+		"/docs/.hidden.txt": "hidden",
+	} {
+		writeFile(t, base, name, data)
+	}
+
+	ufs := unionfs.New(unionfs.WithWritableLayer(overlay), unionfs.WithReadOnlyLayer(base))
+	srv := httptest.NewServer(NewHandler(ufs))
+	t.Cleanup(srv.Close)
+	return ufs, overlay, srv
+}
+
+// do sends a WebDAV request and returns the status and body
+func do(t *testing.T, method, url, body string, header map[string]string) (int, string, http.Header) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), resp.Header
+}
+
+// TestReadWrite tests GET, PUT, DELETE and MKCOL against the union
+func TestReadWrite(t *testing.T) {
+	ufs, overlay, srv := newServer(t)
+
+	if status, body, _ := do(t, "GET", srv.URL+"/docs/readme.txt", "", nil); status != http.StatusOK || body != "base readme" {
+		t.Errorf("GET: %d %q", status, body)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/docs/readme.txt", "edited", nil); status != http.StatusCreated {
+		t.Errorf("PUT: %d", status)
+	}
+	if data, _ := ufs.ReadFile("/docs/readme.txt"); string(data) != "edited" {
+		t.Errorf("expected edited contents, got %q", data)
+	}
+	if _, err := overlay.Stat("/docs/readme.txt"); err != nil {
+		t.Errorf("expected copy-up into the writable layer: %v", err)
+	}
+
+	if status, _, _ := do(t, "DELETE", srv.URL+"/docs/old.txt", "", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE: %d", status)
+	}
+	if _, err := ufs.Stat("/docs/old.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected deleted file to be hidden, got %v", err)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/docs/old.txt", "", nil); status != http.StatusNotFound {
+		t.Errorf("GET deleted: %d", status)
+	}
+
+	if status, _, _ := do(t, "MKCOL", srv.URL+"/new", "", nil); status != http.StatusCreated {
+		t.Errorf("MKCOL: %d", status)
+	}
+	if info, err := ufs.Stat("/new"); err != nil || !info.IsDir() {
+		t.Errorf("expected new directory, got %v, %v", info, err)
+	}
+
+	// A collection recreated over a deleted one starts out empty
+	do(t, "DELETE", srv.URL+"/docs/", "", nil)
+	if status, _, _ := do(t, "MKCOL", srv.URL+"/docs", "", nil); status != http.StatusCreated {
+		t.Errorf("MKCOL over deleted: %d", status)
+	}
+	if entries, err := ufs.ReadDir("/docs"); err != nil || len(entries) != 0 {
+		t.Errorf("expected empty collection, got %d entries, %v", len(entries), err)
+	}
+	if _, err := ufs.Stat("/docs/sub/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected lower contents to stay hidden, got %v", err)
+	}
+}
+
+// TestPropfind tests that listings are merged and hide whiteouts
+func TestPropfind(t *testing.T) {
+	ufs, _, srv := newServer(t)
+	ufs.Remove("/docs/old.txt")
+	writeFile(t, ufs, "/docs/new.txt", "new")
+
+	status, body, _ := do(t, "PROPFIND", srv.URL+"/docs/", "", map[string]string{"Depth": "1"})
+	if status != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: %d", status)
+	}
+	for _, want := range []string{"/docs/readme.txt", "/docs/new.txt", "/docs/sub/", "/docs/.hidden.txt"} {
+		if !strings.Contains(body, "<D:href>"+want+"</D:href>") {
+			t.Errorf("expected %s in listing", want)
+		}
+	}
+	for _, hidden := range []string{"old.txt", ".wh."} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("expected %s to be hidden from listing", hidden)
+		}
+	}
+}
+
+// TestMove tests renaming files and directories that live in lower layers
+func TestMove(t *testing.T) {
+	ufs, _, srv := newServer(t)
+	writeFile(t, ufs, "/docs/sub/b.txt", "b")
+
+	status, _, _ := do(t, "MOVE", srv.URL+"/docs/readme.txt", "", map[string]string{"Destination": srv.URL + "/readme.txt"})
+	if status != http.StatusCreated {
+		t.Errorf("MOVE file: %d", status)
+	}
+	if data, _ := ufs.ReadFile("/readme.txt"); string(data) != "base readme" {
+		t.Errorf("expected moved file, got %q", data)
+	}
+	if _, err := ufs.Stat("/docs/readme.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected source to be gone, got %v", err)
+	}
+
+	status, _, _ = do(t, "MOVE", srv.URL+"/docs/sub/", "", map[string]string{"Destination": srv.URL + "/moved/"})
+	if status != http.StatusCreated {
+		t.Errorf("MOVE dir: %d", status)
+	}
+	for name, want := range map[string]string{"/moved/a.txt": "a", "/moved/b.txt": "b"} {
+		if data, err := ufs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"/docs/sub", "/docs/sub/a.txt"} {
+		if _, err := ufs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected to be gone, got %v", name, err)
+		}
+	}
+
+	status, _, _ = do(t, "MOVE", srv.URL+"/moved/", "", map[string]string{"Destination": srv.URL + "/moved/inner/"})
+	if status < 400 {
+		t.Errorf("expected moving a directory into itself to fail, got %d", status)
+	}
+}
+
+// TestLocks tests that locked resources refuse writes without the token
+func TestLocks(t *testing.T) {
+	_, _, srv := newServer(t)
+	lockBody := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+	status, _, header := do(t, "LOCK", srv.URL+"/docs/readme.txt", lockBody, map[string]string{"Timeout": "Second-60"})
+	if status != http.StatusOK {
+		t.Fatalf("LOCK: %d", status)
+	}
+	token := header.Get("Lock-Token")
+	if token == "" {
+		t.Fatal("expected a lock token")
+	}
+
+	if status, _, _ := do(t, "PUT", srv.URL+"/docs/readme.txt", "x", nil); status != http.StatusLocked {
+		t.Errorf("PUT without token: %d", status)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/docs/readme.txt", "x", map[string]string{"If": "(" + token + ")"}); status >= 300 {
+		t.Errorf("PUT with token: %d", status)
+	}
+	if status, _, _ := do(t, "UNLOCK", srv.URL+"/docs/readme.txt", "", map[string]string{"Lock-Token": token}); status != http.StatusNoContent {
+		t.Errorf("UNLOCK: %d", status)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/docs/readme.txt", "y", nil); status >= 300 {
+		t.Errorf("PUT after unlock: %d", status)
+	}
+}
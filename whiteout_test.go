@@ -0,0 +1,133 @@
+package unionfs
+
+import (
+	"os"
+	"testing"
+)
+
+// TestRemoveAllHidesLowerChildren tests that a directory whiteout also hides
+// the lower directory's contents, including after the directory is recreated
+func TestRemoveAllHidesLowerChildren(t *testing.T) {
+	overlay := mustNewMemFS()
+	base := mustNewMemFS()
+	writeFile(base, "/dir/sub/file.txt", []byte("base"), 0644)
+
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(base),
+	)
+
+	if err := ufs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir", "/dir/sub", "/dir/sub/file.txt"} {
+		if _, err := ufs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected to be hidden, got %v", name, err)
+		}
+	}
+
+	writeFile(ufs, "/dir/new.txt", []byte("new"), 0644)
+	entries, err := ufs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); len(got) != 1 || got[0] != "new.txt" {
+		t.Errorf("expected only the new file, got %v", got)
+	}
+	if _, err := ufs.Stat("/dir/sub/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected lower file to stay hidden, got %v", err)
+	}
+}
+
+// TestWhiteoutHidesDescendants tests that a directory's whiteout hides what
+// the layers below hold under it, at any depth and in any upper layer
+func TestWhiteoutHidesDescendants(t *testing.T) {
+	overlay, middle, base := mustNewMemFS(), mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/a/b/c/file", []byte("base"), 0644)
+	writeFile(base, "/a/keep", []byte("base"), 0644)
+	writeFile(middle, "/a/.wh.b", nil, 0644)
+	ufs := New(
+		WithWritableLayer(overlay),
+		WithReadOnlyLayer(middle),
+		WithReadOnlyLayer(base),
+	)
+
+	for _, name := range []string{"/a/b", "/a/b/c", "/a/b/c/file"} {
+		if _, err := ufs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s visible: %v", name, err)
+		}
+	}
+	if _, err := ufs.Stat("/a/keep"); err != nil {
+		t.Errorf("/a/keep hidden: %v", err)
+	}
+}
+
+// TestMkdirOverWhiteout tests that a directory recreated over a removed
+// lower directory starts empty, and one recreated over a file does not need
+// an opaque marker
+func TestMkdirOverWhiteout(t *testing.T) {
+	overlay, base := mustNewMemFS(), mustNewMemFS()
+	writeFile(base, "/dir/old", []byte("base"), 0644)
+	writeFile(base, "/deep/sub/old", []byte("base"), 0644)
+	writeFile(base, "/file", []byte("base"), 0644)
+	ufs := New(WithWritableLayer(overlay), WithReadOnlyLayer(base))
+
+	for _, name := range []string{"/dir", "/deep", "/file"} {
+		if err := ufs.RemoveAll(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ufs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.MkdirAll("/deep/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.Mkdir("/file", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"/dir", "/deep", "/deep/sub", "/file"} {
+		entries, err := ufs.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if dir == "/deep" {
+			want = 1
+		}
+		if len(entries) != want {
+			t.Errorf("%s = %v, want %d entries", dir, entryNames(entries), want)
+		}
+	}
+	for _, dir := range []string{"/dir", "/deep"} {
+		if _, err := overlay.Stat(dir + "/" + OpaqueWhiteout); err != nil {
+			t.Errorf("%s not opaque: %v", dir, err)
+		}
+	}
+	if _, err := overlay.Stat("/file/" + OpaqueWhiteout); !os.IsNotExist(err) {
+		t.Errorf("/file marked opaque: %v", err)
+	}
+}
+
+// TestWhiteoutLookupStats tests that looking for markers stops at the first
+// parent directory a layer lacks
+func TestWhiteoutLookupStats(t *testing.T) {
+	overlay, base := mustNewMemFS(), mustNewMemFS()
+	const deep = "/a/b/c/d/e/f/g/h/file"
+	writeFile(base, deep, []byte("base"), 0644)
+	overlay.MkdirAll("/a/b", 0755)
+
+	stats := 0
+	ufs := New(
+		WithWritableLayer(&statCountFS{FileSystem: overlay, stats: &stats}),
+		WithReadOnlyLayer(base),
+	)
+	if ufs.hasWhiteout(ufs.layers[0], deep) {
+		t.Fatal("deep path whited out")
+	}
+	// Two per parent the layer holds, and two at /a/b/c
+	if stats != 6 {
+		t.Errorf("%d Stats, want 6", stats)
+	}
+}